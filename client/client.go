@@ -0,0 +1,268 @@
+/*
+Package client talks to a tiedot HTTP API server, offering collection and document functions that resemble the
+embedded (package db) usage, so that an application may switch between embedded and networked database easily.
+
+HTTP connections are pooled and re-used. Idempotent requests (everything except document insert) are retried upon
+network failure and upon retryable errors (see dberr.IsRetryable): temporary server unavailability (HTTP 502, 503, 504),
+which includes writes shed by write rate limit and queries shed by admission control, and exceeded quota (HTTP 429).
+*/
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	DEFAULT_MAX_IDLE_CONNS = 16                     // Default number of idle connections kept in the pool.
+	DEFAULT_RETRIES        = 3                      // Default number of retries for idempotent requests.
+	DEFAULT_RETRY_DELAY    = 100 * time.Millisecond // Default delay before the first retry, the delay grows linearly.
+)
+
+// Client sends requests to a tiedot HTTP API server.
+type Client struct {
+	baseURL    string
+	authToken  string
+	HTTP       *http.Client  // HTTP client with a pool of connections
+	Retries    int           // Number of retries for idempotent requests
+	RetryDelay time.Duration // Delay before the first retry
+}
+
+// Error is returned when the server responds with an unsuccessful HTTP status.
+type Error struct {
+	Status  int    // HTTP status code
+	Message string // Response body
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.Status, e.Message)
+}
+
+// Return true if the server may succeed in handling the request later, which makes the error retryable.
+func (e Error) Temporary() bool {
+	switch e.Status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Create a client of the server at base URL (e.g. "http://127.0.0.1:8080").
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		HTTP: &http.Client{Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConns:        DEFAULT_MAX_IDLE_CONNS,
+			MaxIdleConnsPerHost: DEFAULT_MAX_IDLE_CONNS,
+			IdleConnTimeout:     90 * time.Second,
+		}},
+		Retries:    DEFAULT_RETRIES,
+		RetryDelay: DEFAULT_RETRY_DELAY,
+	}
+}
+
+// Authorize all requests using the pre-shared token given to server parameter "-authtoken".
+func (client *Client) SetAuthToken(token string) {
+	client.authToken = token
+}
+
+// Send a request to the API endpoint and return response body. Idempotent requests are retried on temporary failures.
+func (client *Client) call(method, endpoint string, params url.Values, body []byte, idempotent bool) (respBody []byte, err error) {
+	reqURL := client.baseURL + "/" + endpoint + "?" + params.Encode()
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		if respBody, retry, err = client.callOnce(method, reqURL, body); err == nil || !retry || !idempotent || attempt >= client.Retries {
+			return
+		}
+		time.Sleep(client.RetryDelay * time.Duration(attempt+1))
+	}
+}
+
+// Send a request once. Return whether a failed request is worth retrying.
+func (client *Client) callOnce(method, reqURL string, body []byte) (respBody []byte, retry bool, err error) {
+	req, err := http.NewRequest(method, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client.authToken != "" {
+		req.Header.Set("Authorization", "token "+client.authToken)
+	}
+	resp, err := client.HTTP.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	if respBody, err = ioutil.ReadAll(resp.Body); err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode >= 300 {
+		err = Error{Status: resp.StatusCode, Message: strings.TrimSpace(string(respBody))}
+		return nil, dberr.IsRetryable(err), err
+	}
+	return
+}
+
+// Create a new collection.
+func (client *Client) Create(name string) error {
+	_, err := client.call("POST", "create", url.Values{"col": {name}}, nil, false)
+	return err
+}
+
+// Return all collection names.
+func (client *Client) AllCols() (ret []string, err error) {
+	resp, err := client.call("GET", "all", url.Values{}, nil, true)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(resp, &ret)
+	return
+}
+
+// Rename a collection.
+func (client *Client) Rename(oldName, newName string) error {
+	_, err := client.call("POST", "rename", url.Values{"old": {oldName}, "new": {newName}}, nil, false)
+	return err
+}
+
+// Drop a collection and lose all of its documents and indexes.
+func (client *Client) Drop(name string) error {
+	_, err := client.call("POST", "drop", url.Values{"col": {name}}, nil, false)
+	return err
+}
+
+// Use the return value to interact with collection. The collection is not checked for existence.
+func (client *Client) Use(name string) *Col {
+	return &Col{client: client, name: name}
+}
+
+// Col is a collection on the server.
+type Col struct {
+	client *Client
+	name   string
+}
+
+// Insert a document into the collection. Insert is never retried, as the server may have inserted the document already.
+func (col *Col) Insert(doc map[string]interface{}) (id int, err error) {
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return
+	}
+	resp, err := col.client.call("POST", "insert", url.Values{"col": {col.name}}, docJS, false)
+	if err != nil {
+		return
+	}
+	return strconv.Atoi(string(resp))
+}
+
+// Find and retrieve a document by ID.
+func (col *Col) Read(id int) (doc map[string]interface{}, err error) {
+	resp, err := col.client.call("GET", "get", url.Values{"col": {col.name}, "id": {strconv.Itoa(id)}}, nil, true)
+	if httpErr, ok := err.(Error); ok && httpErr.Status == http.StatusNotFound {
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
+	} else if err != nil {
+		return
+	}
+	err = json.Unmarshal(resp, &doc)
+	return
+}
+
+// Update a document.
+func (col *Col) Update(id int, doc map[string]interface{}) error {
+	if doc == nil {
+		return fmt.Errorf("Updating %d: input doc may not be nil", id)
+	}
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = col.client.call("POST", "update", url.Values{"col": {col.name}, "id": {strconv.Itoa(id)}}, docJS, true)
+	return err
+}
+
+// Delete a document.
+func (col *Col) Delete(id int) error {
+	_, err := col.client.call("POST", "delete", url.Values{"col": {col.name}, "id": {strconv.Itoa(id)}}, nil, true)
+	return err
+}
+
+// Create an index on the path.
+func (col *Col) Index(idxPath []string) error {
+	_, err := col.client.call("POST", "index", url.Values{"col": {col.name}, "path": {strings.Join(idxPath, ",")}}, nil, false)
+	return err
+}
+
+// Return all indexed paths.
+func (col *Col) AllIndexes() (ret [][]string, err error) {
+	resp, err := col.client.call("GET", "indexes", url.Values{"col": {col.name}}, nil, true)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(resp, &ret)
+	return
+}
+
+// Remove an index.
+func (col *Col) Unindex(idxPath []string) error {
+	_, err := col.client.call("POST", "unindex", url.Values{"col": {col.name}, "path": {strings.Join(idxPath, ",")}}, nil, false)
+	return err
+}
+
+// Return approximate number of documents in the collection.
+func (col *Col) ApproxDocCount() (int, error) {
+	resp, err := col.client.call("GET", "approxdoccount", url.Values{"col": {col.name}}, nil, true)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(resp))
+}
+
+// Evaluate a query and return the resulting documents, keyed by document ID.
+func (col *Col) Query(q interface{}) (docs map[int]map[string]interface{}, err error) {
+	qJS, err := json.Marshal(q)
+	if err != nil {
+		return
+	}
+	resp, err := col.client.call("GET", "query", url.Values{"col": {col.name}, "q": {string(qJS)}}, nil, true)
+	if err != nil {
+		return
+	}
+	var byStrID map[string]map[string]interface{}
+	if err = json.Unmarshal(resp, &byStrID); err != nil {
+		return
+	}
+	docs = make(map[int]map[string]interface{}, len(byStrID))
+	for strID, doc := range byStrID {
+		id, err := strconv.Atoi(strID)
+		if err != nil {
+			return nil, err
+		}
+		docs[id] = doc
+	}
+	return
+}
+
+// Evaluate a query and put document IDs of the result into result map (as map keys), just like db.EvalQuery.
+func EvalQuery(q interface{}, src *Col, result *map[int]struct{}) error {
+	docs, err := src.Query(q)
+	if err != nil {
+		return err
+	}
+	for id := range docs {
+		(*result)[id] = struct{}{}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/httpapi"
+)
+
+const (
+	TEST_DATA_DIR = "/tmp/tiedot_client_test"
+)
+
+func startServer(t *testing.T) *httptest.Server {
+	os.RemoveAll(TEST_DATA_DIR)
+	var err error
+	if httpapi.HttpDB, err = db.OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	for endpoint, handler := range map[string]http.HandlerFunc{
+		"/create": httpapi.Create, "/all": httpapi.All, "/rename": httpapi.Rename, "/drop": httpapi.Drop,
+		"/insert": httpapi.Insert, "/get": httpapi.Get, "/update": httpapi.Update, "/delete": httpapi.Delete,
+		"/index": httpapi.Index, "/indexes": httpapi.Indexes, "/unindex": httpapi.Unindex,
+		"/query": httpapi.Query, "/approxdoccount": httpapi.ApproxDocCount,
+	} {
+		mux.HandleFunc(endpoint, handler)
+	}
+	return httptest.NewServer(mux)
+}
+
+func stopServer(srv *httptest.Server) {
+	srv.Close()
+	httpapi.HttpDB.Close()
+	os.RemoveAll(TEST_DATA_DIR)
+}
+
+func TestClientCrud(t *testing.T) {
+	srv := startServer(t)
+	defer stopServer(srv)
+	client := New(srv.URL + "/")
+	// Collection management
+	if err := client.Create("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Create("a"); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err := client.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if cols, err := client.AllCols(); err != nil || len(cols) != 1 || cols[0] != "b" {
+		t.Fatal(cols, err)
+	}
+	col := client.Use("b")
+	// Index management
+	if err := col.Index([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if indexes, err := col.AllIndexes(); err != nil || len(indexes) != 1 || indexes[0][0] != "a" || indexes[0][1] != "b" {
+		t.Fatal(indexes, err)
+	}
+	// Document management
+	id, err := col.Insert(map[string]interface{}{"a": map[string]interface{}{"b": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(id); err != nil || doc["a"].(map[string]interface{})["b"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	if err := col.Update(id, map[string]interface{}{"a": map[string]interface{}{"b": 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := col.ApproxDocCount(); err != nil || count < 0 {
+		t.Fatal(count, err)
+	}
+	// Query
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": 2, "in": []interface{}{"a", "b"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	if docs, err := col.Query("all"); err != nil || len(docs) != 1 || docs[id]["a"].(map[string]interface{})["b"].(float64) != 2 {
+		t.Fatal(docs, err)
+	}
+	if _, err := col.Query(map[string]interface{}{"eq": 2, "in": []interface{}{"not indexed"}}); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err := col.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := col.Read(id); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	if err := col.Unindex([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Drop("b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`["a"]`))
+	}))
+	defer srv.Close()
+	client := New(srv.URL)
+	client.RetryDelay = 0
+	// Idempotent request succeeds after retries
+	if cols, err := client.AllCols(); err != nil || len(cols) != 1 || calls != 3 {
+		t.Fatal(cols, err, calls)
+	}
+	// Non-idempotent request is not retried
+	atomic.StoreInt32(&calls, 0)
+	if _, err := client.Use("a").Insert(map[string]interface{}{}); err == nil || err.(Error).Status != http.StatusServiceUnavailable || calls != 1 {
+		t.Fatal(err, calls)
+	}
+	// Give up after running out of retries
+	atomic.StoreInt32(&calls, -10)
+	if _, err := client.AllCols(); err == nil || int(calls) != -10+client.Retries+1 {
+		t.Fatal(err, calls)
+	}
+}
+
+func TestClientRetryableErrors(t *testing.T) {
+	var calls int32
+	status := int32(http.StatusTooManyRequests)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 2 {
+			http.Error(w, "", int(atomic.LoadInt32(&status)))
+			return
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+	client := New(srv.URL)
+	client.RetryDelay = 0
+	// Exceeded quota is retried
+	if _, err := client.AllCols(); err != nil || calls != 2 {
+		t.Fatal(err, calls)
+	}
+	// Bad request is not
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	if _, err := client.AllCols(); err == nil || dberr.IsRetryable(err) || calls != 1 {
+		t.Fatal(err, calls)
+	}
+	// Classification of database errors
+	for _, retryable := range []error{
+		dberr.New(dberr.ErrorWriteQueueFull, 1), dberr.New(dberr.ErrorTooBusy, 1), dberr.New(dberr.ErrorQuotaExceeded, "a", 1),
+		dberr.New(dberr.ErrorIndexBuilding, []string{"a"}, "q"), Error{Status: http.StatusServiceUnavailable},
+	} {
+		if !dberr.IsRetryable(retryable) {
+			t.Fatal(retryable)
+		}
+	}
+	for _, permanent := range []error{
+		nil, dberr.New(dberr.ErrorDocTooLarge, 1, 2), dberr.New(dberr.ErrorNeedIndex, []string{"a"}, "q"),
+		dberr.New(dberr.ErrorNoDoc, 1), Error{Status: http.StatusBadRequest}, os.ErrNotExist,
+	} {
+		if dberr.IsRetryable(permanent) {
+			t.Fatal(permanent)
+		}
+	}
+}
+
+func TestClientAuthToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token secret" {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+	client := New(srv.URL)
+	if _, err := client.AllCols(); err == nil || err.(Error).Status != http.StatusUnauthorized {
+		t.Fatal(err)
+	}
+	client.SetAuthToken("secret")
+	if _, err := client.AllCols(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,145 @@
+// Blob file contains binary attachments of documents.
+//
+// A blob is stored as one or more consecutive chunks, every chunk has a binary
+// header followed by up to BlobChunkSize bytes of data. The first chunk
+// location is the blob ID.
+//
+// Blob data may contain any byte value, hence the amount of space in-use is
+// kept in the file header instead of being figured out from file content.
+//
+// Deleted blobs are marked as deleted and the space is irrecoverable.
+
+package data
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	BlobFileHeader  = 1 + 10    // BlobFileHeader is the size of blob file header fields.
+	BlobChunkHeader = 1 + 10    // BlobChunkHeader is the size of blob chunk header fields.
+	BlobChunkSize   = 64 * 1024 // BlobChunkSize is the maximum size of data in a blob chunk.
+
+	blobChunkLast = 1 // Chunk validity - the last chunk of a blob.
+	blobChunkMore = 2 // Chunk validity - more chunks of the blob follow.
+)
+
+// Blob file contains blob chunks.
+type BlobFile struct {
+	*DataFile
+}
+
+// Open a blob file.
+func (conf *Config) OpenBlobFile(path string) (blob *BlobFile, err error) {
+	blob = new(BlobFile)
+	growth := conf.BlobFileGrowth
+	if growth == 0 {
+		growth = conf.ColFileGrowth
+	}
+	if blob.DataFile, err = conf.openDataFile(path, growth, false); err != nil {
+		return
+	}
+	if blob.Buf[0] == 0 {
+		blob.Used = BlobFileHeader
+		blob.writeHeader()
+	} else {
+		used, _ := binary.Varint(blob.Buf[1:BlobFileHeader])
+		blob.Used = int(used)
+	}
+	return
+}
+
+func (blob *BlobFile) writeHeader() {
+	blob.Buf[0] = 1
+	binary.PutVarint(blob.Buf[1:BlobFileHeader], int64(blob.Used))
+}
+
+// Write all data from the reader into a new blob, return the blob ID and size.
+// The blob is not stored if the reader returns an error.
+func (blob *BlobFile) Write(in io.Reader) (id, size int, err error) {
+	id = blob.Used
+	pos := id
+	for {
+		if err = blob.EnsureSize(pos - blob.Used + BlobChunkHeader + BlobChunkSize); err != nil {
+			return
+		}
+		n, readErr := io.ReadFull(in, blob.Buf[pos+BlobChunkHeader:pos+BlobChunkHeader+BlobChunkSize])
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return 0, 0, readErr
+		}
+		size += n
+		blob.Buf[pos] = blobChunkMore
+		if readErr != nil {
+			blob.Buf[pos] = blobChunkLast
+		}
+		binary.PutVarint(blob.Buf[pos+1:pos+BlobChunkHeader], int64(n))
+		pos += BlobChunkHeader + n
+		if readErr != nil {
+			break
+		}
+	}
+	blob.Used = pos
+	blob.writeHeader()
+	return
+}
+
+// Return the location and data length of a valid chunk.
+func (blob *BlobFile) chunk(pos int) (validity byte, length int, err error) {
+	if pos < BlobFileHeader || pos > blob.Used-BlobChunkHeader {
+		return 0, 0, dberr.New(dberr.ErrorNoBlob, pos)
+	}
+	validity = blob.Buf[pos]
+	dataLen, _ := binary.Varint(blob.Buf[pos+1 : pos+BlobChunkHeader])
+	if validity != blobChunkLast && validity != blobChunkMore || dataLen < 0 || dataLen > BlobChunkSize ||
+		pos+BlobChunkHeader+int(dataLen) > blob.Used {
+		return 0, 0, dberr.New(dberr.ErrorNoBlob, pos)
+	}
+	return validity, int(dataLen), nil
+}
+
+// Write the blob data into the writer, return the number of bytes written.
+func (blob *BlobFile) Read(id int, out io.Writer) (written int, err error) {
+	for pos := id; ; {
+		validity, length, err := blob.chunk(pos)
+		if err != nil {
+			return written, dberr.New(dberr.ErrorNoBlob, id)
+		}
+		n, err := out.Write(blob.Buf[pos+BlobChunkHeader : pos+BlobChunkHeader+length])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if validity == blobChunkLast {
+			return written, nil
+		}
+		pos += BlobChunkHeader + length
+	}
+}
+
+// Mark all chunks of the blob as deleted.
+func (blob *BlobFile) Delete(id int) error {
+	for pos := id; ; {
+		validity, length, err := blob.chunk(pos)
+		if err != nil {
+			return dberr.New(dberr.ErrorNoBlob, id)
+		}
+		blob.Buf[pos] = 0
+		if validity == blobChunkLast {
+			return nil
+		}
+		pos += BlobChunkHeader + length
+	}
+}
+
+// Clear the entire blob file.
+func (blob *BlobFile) Clear() (err error) {
+	if err = blob.DataFile.Clear(); err != nil {
+		return
+	}
+	blob.Used = BlobFileHeader
+	blob.writeHeader()
+	return
+}
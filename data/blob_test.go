@@ -0,0 +1,67 @@
+package data
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestBlobFile(t *testing.T) {
+	tmp := "/tmp/tiedot_blob_test"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	conf := defaultConfig()
+	conf.ColFileGrowth = BlobChunkSize // grow several times
+	blob, err := conf.OpenBlobFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zeros := make([]byte, 3*BlobChunkSize+1)
+	zerosID, size, err := blob.Write(bytes.NewReader(zeros))
+	if err != nil || size != len(zeros) {
+		t.Fatal(size, err)
+	}
+	textID, size, err := blob.Write(strings.NewReader("text"))
+	if err != nil || size != 4 {
+		t.Fatal(size, err)
+	}
+	if err := blob.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Space in-use is not confused by blobs of zeros
+	if blob, err = conf.OpenBlobFile(tmp); err != nil {
+		t.Fatal(err)
+	}
+	for id, content := range map[int][]byte{zerosID: zeros, textID: []byte("text")} {
+		out := new(bytes.Buffer)
+		if n, err := blob.Read(id, out); err != nil || n != len(content) || !bytes.Equal(out.Bytes(), content) {
+			t.Fatal(id, n, err)
+		}
+	}
+	if newID, _, err := blob.Write(strings.NewReader("more")); err != nil || newID <= textID {
+		t.Fatal(newID, err)
+	}
+	if err := blob.Delete(zerosID); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{zerosID, zerosID + 1, -1, 0, blob.Used} {
+		if _, err := blob.Read(id, new(bytes.Buffer)); dberr.Type(err) != dberr.ErrorNoBlob {
+			t.Fatal(id, err)
+		}
+		if err := blob.Delete(id); dberr.Type(err) != dberr.ErrorNoBlob {
+			t.Fatal(id, err)
+		}
+	}
+	if err := blob.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blob.Read(textID, new(bytes.Buffer)); dberr.Type(err) != dberr.ErrorNoBlob {
+		t.Fatal(err)
+	}
+	if err := blob.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,72 @@
+// Checksums of data file regions, for detecting corruption of data at rest.
+//
+// A data file is divided into regions of ChecksumRegionSize bytes. Writes mark
+// the regions they touch as hot. Verification takes the checksum of a hot
+// region, which turns the region cold, and compares the content of a cold
+// region against the checksum taken earlier; a mismatch means that the region
+// has changed without being written, e.g. by disk bit rot. Checksums are kept
+// in memory, hence corruption is detected in regions left unwritten between
+// two verifications while the file stays open.
+
+package data
+
+import (
+	"hash/crc32"
+	"sync"
+)
+
+// ChecksumRegionSize is the number of bytes covered by a checksum of data file content.
+const ChecksumRegionSize = 64 * 1024
+
+type regionSums struct {
+	lock *sync.Mutex // Serialises verifications
+	sums []uint32    // CRC-32 of every region as of its latest verification
+	cold []bool      // Whether the region has not been written since its checksum was taken
+}
+
+func newRegionSums() *regionSums {
+	return &regionSums{lock: new(sync.Mutex)}
+}
+
+// Mark the regions of the written bytes as hot. The caller must place write lock.
+func (file *DataFile) touch(offset, length int) {
+	if file.sums == nil {
+		return
+	}
+	cold := file.sums.cold
+	for region := offset / ChecksumRegionSize; region <= (offset+length-1)/ChecksumRegionSize && region < len(cold); region++ {
+		cold[region] = false
+	}
+}
+
+/*
+VerifyChecksums goes through regions of the in-use part of the file, starting from the region of the offset, until at
+least maxBytes (0 for the rest of the file) have been verified. The checksums of cold regions are verified - mismatches
+are reported as corruption (CorruptChecksum) - and those of hot regions are taken. Return the offset to continue from,
+0 after the end of the in-use part, and the number of bytes verified. The caller must place read lock.
+*/
+func (file *DataFile) VerifyChecksums(offset, maxBytes int) (next, verified int) {
+	sums := file.sums
+	sums.lock.Lock()
+	defer sums.lock.Unlock()
+	for region := offset / ChecksumRegionSize; region*ChecksumRegionSize < file.Used; region++ {
+		if maxBytes > 0 && verified >= maxBytes {
+			return region * ChecksumRegionSize, verified
+		}
+		start, end := region*ChecksumRegionSize, (region+1)*ChecksumRegionSize
+		if end > file.Used {
+			end = file.Used
+		}
+		sum := crc32.ChecksumIEEE(file.Buf[start:end])
+		for len(sums.sums) <= region {
+			sums.sums = append(sums.sums, 0)
+			sums.cold = append(sums.cold, false)
+		}
+		if sums.cold[region] && sums.sums[region] != sum {
+			file.reportCorruption(start, CorruptChecksum)
+		}
+		sums.sums[region], sums.cold[region] = sum, true
+		verified += end - start
+	}
+	return 0, verified
+}
@@ -0,0 +1,95 @@
+package data
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestVerifyChecksums(t *testing.T) {
+	var events []CorruptionEvent
+	SetCorruptionHandler(func(event CorruptionEvent) { events = append(events, event) })
+	defer SetCorruptionHandler(nil)
+	col, err := setupTestCollection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer col.Close()
+	// Fill three regions
+	doc := bytes.Repeat([]byte("a"), 1000)
+	var ids []int
+	for col.Used < 2*ChecksumRegionSize+1 {
+		id, err := col.Insert(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// The first pass takes checksums, the chunks cover whole regions
+	if next, verified := col.VerifyChecksums(0, 1); next != ChecksumRegionSize || verified != ChecksumRegionSize {
+		t.Fatal(next, verified)
+	}
+	if next, verified := col.VerifyChecksums(ChecksumRegionSize, 0); next != 0 || verified != col.Used-ChecksumRegionSize {
+		t.Fatal(next, verified)
+	}
+	// Written regions are not mistaken for corruption
+	if _, err := col.Update(ids[0], []byte("b")); err != nil {
+		t.Fatal(err)
+	} else if err := col.Delete(ids[len(ids)-1]); err != nil {
+		t.Fatal(err)
+	} else if _, err := col.Insert(doc); err != nil {
+		t.Fatal(err)
+	}
+	col.VerifyChecksums(0, 0)
+	if len(events) != 0 {
+		t.Fatal(events)
+	}
+	// Content changed without being written is reported once
+	col.Buf[ChecksumRegionSize+10]++
+	if _, verified := col.VerifyChecksums(0, 0); verified != col.Used || len(events) != 1 {
+		t.Fatal(verified, events)
+	} else if events[0] != (CorruptionEvent{Collection: "tmp", File: tmp, Offset: ChecksumRegionSize, Kind: CorruptChecksum}) {
+		t.Fatal(events)
+	}
+	col.VerifyChecksums(0, 0)
+	if len(events) != 1 {
+		t.Fatal(events)
+	}
+}
+
+func TestHashTableChecksums(t *testing.T) {
+	var events []CorruptionEvent
+	SetCorruptionHandler(func(event CorruptionEvent) { events = append(events, event) })
+	defer SetCorruptionHandler(nil)
+	htPath := "/tmp/tiedot_test_checksum"
+	os.Remove(htPath)
+	defer os.Remove(htPath)
+	ht, err := defaultConfig().OpenHashTable(htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ht.Close()
+	for i := 0; i < 10000; i++ {
+		ht.Put(i, i)
+	}
+	ht.VerifyChecksums(0, 0)
+	// Puts (growing buckets too), removals and increments are writes
+	for i := 0; i < 10000; i++ {
+		ht.Put(i, i+1)
+		ht.Remove(i, i)
+		ht.Incr(i, 1)
+	}
+	ht.VerifyChecksums(0, 0)
+	if len(events) != 0 {
+		t.Fatal(events)
+	}
+	// Clearing the file forgets the checksums
+	ht.Buf[0]++
+	if err := ht.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	ht.VerifyChecksums(0, 0)
+	if len(events) != 0 {
+		t.Fatal(events)
+	}
+}
@@ -16,6 +16,7 @@ package data
 
 import (
 	"encoding/binary"
+	"io"
 
 	"github.com/HouzuoGuo/tiedot/dberr"
 )
@@ -29,7 +30,7 @@ type Collection struct {
 // Open a collection file.
 func (conf *Config) OpenCollection(path string) (col *Collection, err error) {
 	col = new(Collection)
-	col.DataFile, err = OpenDataFile(path, conf.ColFileGrowth)
+	col.DataFile, err = conf.openDataFile(path, conf.ColFileGrowth, false)
 	col.Config = conf
 	col.Config.CalculateConfigConstants()
 	return
@@ -37,17 +38,58 @@ func (conf *Config) OpenCollection(path string) (col *Collection, err error) {
 
 // Find and retrieve a document by ID (physical document location). Return value is a copy of the document.
 func (col *Collection) Read(id int) []byte {
-	if id < 0 || id > col.Used-DocHeader || col.Buf[id] != 1 {
+	doc := col.view(id)
+	if doc == nil {
 		return nil
-	} else if room, _ := binary.Varint(col.Buf[id+1 : id+11]); room > int64(col.DocMaxRoom) {
+	}
+	docCopy := make([]byte, len(doc))
+	copy(docCopy, doc)
+	return docCopy
+}
+
+// Write a document (without padding) by ID (physical document location) to the output, without making a copy.
+// Return number of bytes written, and false if the document does not exist.
+func (col *Collection) ReadTo(id int, out io.Writer) (n int, found bool, err error) {
+	doc := col.view(id)
+	if doc == nil {
+		return 0, false, nil
+	}
+	end := len(doc)
+	for end > 0 && doc[end-1] == ' ' {
+		end--
+	}
+	n, err = out.Write(doc[:end])
+	return n, true, err
+}
+
+// Return the document (including padding) in file buffer by ID, or nil if the document does not exist.
+func (col *Collection) view(id int) []byte {
+	if id < 0 || id > col.Used-DocHeader || col.Buf[id] == 0 {
+		return nil
+	} else if col.Buf[id] != 1 {
+		col.reportCorruption(id, CorruptDocHeader)
+		return nil
+	} else if room, _ := binary.Varint(col.Buf[id+1 : id+11]); room < 0 || room > int64(col.DocMaxRoom) {
+		col.reportCorruption(id, CorruptDocHeader)
 		return nil
 	} else if docEnd := id + DocHeader + int(room); docEnd >= col.Size {
+		col.reportCorruption(id, CorruptDocHeader)
 		return nil
 	} else {
-		docCopy := make([]byte, room)
-		copy(docCopy, col.Buf[id+DocHeader:docEnd])
-		return docCopy
+		return col.Buf[id+DocHeader : docEnd]
+	}
+}
+
+// Fill the file buffer region with padding.
+func (col *Collection) pad(padding, paddingEnd int) {
+	for ; padding < paddingEnd; padding += col.LenPadding {
+		copySize := col.LenPadding
+		if padding+col.LenPadding >= paddingEnd {
+			copySize = paddingEnd - padding
+		}
+		copy(col.Buf[padding:padding+copySize], col.Padding)
 	}
+	col.touch(padding, paddingEnd-padding)
 }
 
 // Insert a new document, return the new document ID.
@@ -66,13 +108,8 @@ func (col *Collection) Insert(data []byte) (id int, err error) {
 	col.Buf[id] = 1
 	binary.PutVarint(col.Buf[id+1:id+11], int64(room))
 	copy(col.Buf[id+DocHeader:col.Used], data)
-	for padding := id + DocHeader + len(data); padding < col.Used; padding += col.LenPadding {
-		copySize := col.LenPadding
-		if padding+col.LenPadding >= col.Used {
-			copySize = col.Used - padding
-		}
-		copy(col.Buf[padding:padding+copySize], col.Padding)
-	}
+	col.touch(id, DocHeader+len(data))
+	col.pad(id+DocHeader+len(data), col.Used)
 	return
 }
 
@@ -87,9 +124,11 @@ func (col *Collection) Update(id int, data []byte) (newID int, err error) {
 	}
 	currentDocRoom, _ := binary.Varint(col.Buf[id+1 : id+11])
 	if currentDocRoom > int64(col.DocMaxRoom) {
+		col.reportCorruption(id, CorruptDocHeader)
 		return 0, dberr.New(dberr.ErrorNoDoc, id)
 	}
 	if docEnd := id + DocHeader + int(currentDocRoom); docEnd >= col.Size {
+		col.reportCorruption(id, CorruptDocHeader)
 		return 0, dberr.New(dberr.ErrorNoDoc, id)
 	}
 	if dataLen <= int(currentDocRoom) {
@@ -97,13 +136,8 @@ func (col *Collection) Update(id int, data []byte) (newID int, err error) {
 		paddingEnd := id + DocHeader + int(currentDocRoom)
 		// Overwrite data and then overwrite padding
 		copy(col.Buf[id+DocHeader:padding], data)
-		for ; padding < paddingEnd; padding += col.LenPadding {
-			copySize := col.LenPadding
-			if padding+col.LenPadding >= paddingEnd {
-				copySize = paddingEnd - padding
-			}
-			copy(col.Buf[padding:padding+copySize], col.Padding)
-		}
+		col.touch(id+DocHeader, len(data))
+		col.pad(padding, paddingEnd)
 		return id, nil
 	}
 
@@ -121,6 +155,7 @@ func (col *Collection) Delete(id int) error {
 
 	if col.Buf[id] == 1 {
 		col.Buf[id] = 0
+		col.touch(id, 1)
 	}
 
 	return nil
@@ -128,17 +163,41 @@ func (col *Collection) Delete(id int) error {
 
 // Run the function on every document; stop when the function returns false.
 func (col *Collection) ForEachDoc(fun func(id int, doc []byte) bool) {
+	col.ScanRaw(func(id int, validity byte, raw []byte) bool {
+		return validity != 1 || fun(id, raw)
+	})
+}
+
+/*
+ScanRaw runs the function on every document header found in the file by physical location, regardless of the lookup
+tables, so that recovery tools may salvage documents from a partially corrupted file; stop when the function returns
+false. Validity is 1 for a document and 0 for a deleted document, raw is the document data including padding - it
+refers to the file buffer, and must not be modified or used after the file changes. Corrupted regions are reported
+and skipped byte by byte until the next valid header.
+*/
+func (col *Collection) ScanRaw(fun func(physID int, validity byte, raw []byte) bool) {
+	corrupted := false
 	for id := 0; id < col.Used-DocHeader && id >= 0; {
 		validity := col.Buf[id]
 		room, _ := binary.Varint(col.Buf[id+1 : id+11])
 		docEnd := id + DocHeader + int(room)
-		if (validity == 0 || validity == 1) && room <= int64(col.DocMaxRoom) && docEnd > 0 && docEnd <= col.Used {
-			if validity == 1 && !fun(id, col.Buf[id+DocHeader:docEnd]) {
+		// While skipping a corrupted region, stray zero bytes would look like empty deleted documents
+		minRoom := int64(0)
+		if corrupted {
+			minRoom = 1
+		}
+		if (validity == 0 || validity == 1) && room >= minRoom && room <= int64(col.DocMaxRoom) && docEnd > 0 && docEnd <= col.Used {
+			if !fun(id, validity, col.Buf[id+DocHeader:docEnd]) {
 				break
 			}
 			id = docEnd
+			corrupted = false
 		} else {
-			// Corrupted document - move on
+			// Corrupted document - report where the corrupted region starts, and move on
+			if !corrupted {
+				col.reportCorruption(id, CorruptDocHeader)
+			}
+			corrupted = true
 			id++
 		}
 	}
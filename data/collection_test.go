@@ -1,6 +1,7 @@
 package data
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -388,3 +389,65 @@ func TestCollectionGrowAndOutOfBoundAccess(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestReadTo(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	col, err := defaultConfig().OpenCollection(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer col.Close()
+	large := RandStringBytes(200000)
+	id, err := col.Insert([]byte(large))
+	if err != nil || id != 0 || col.Used != DocHeader+len(large)*2 {
+		t.Fatal(id, err, col.Used)
+	}
+	out := new(bytes.Buffer)
+	if n, found, err := col.ReadTo(id, out); err != nil || !found || n != len(large) || out.String() != large {
+		t.Fatal(n, found, err)
+	}
+	if _, found, _ := col.ReadTo(col.Size, out); found {
+		t.Fatal("Found nothing")
+	}
+}
+
+func TestScanRaw(t *testing.T) {
+	col, err := setupTestCollection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer col.Close()
+	ids := make([]int, 4)
+	for i := range ids {
+		if ids[i], err = col.Insert([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	col.Delete(ids[1])
+	// Corrupt the header of the third document
+	col.Buf[ids[2]] = 9
+	type rawDoc struct {
+		physID   int
+		validity byte
+		data     string
+	}
+	var found []rawDoc
+	col.ScanRaw(func(physID int, validity byte, raw []byte) bool {
+		found = append(found, rawDoc{physID, validity, strings.TrimSpace(string(raw))})
+		return true
+	})
+	expected := []rawDoc{{ids[0], 1, "0"}, {ids[1], 0, "1"}, {ids[3], 1, "3"}}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatal(found)
+	}
+	// Stop early
+	found = nil
+	col.ScanRaw(func(physID int, validity byte, raw []byte) bool {
+		found = append(found, rawDoc{physID, validity, strings.TrimSpace(string(raw))})
+		return false
+	})
+	if len(found) != 1 {
+		t.Fatal(found)
+	}
+}
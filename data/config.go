@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
 )
 
 const (
@@ -13,6 +15,9 @@ const (
 	DocHeader         = 1 + 10      // DocHeader is the size of document header fields.
 	EntrySize         = 1 + 10 + 10 // EntrySize is the size of a single hash table entry.
 	BucketHeader      = 10          // BucketHeader is the size of hash table bucket's header fields.
+
+	CompactFileGrowth = 512 * 1024 // CompactFileGrowth is the initial size and size growth of files in compact configuration.
+	CompactHashBits   = 10         // CompactHashBits is the number of hash key bits in compact configuration.
 )
 
 /*
@@ -26,6 +31,26 @@ type Config struct {
 	HTFileGrowth  int  /// HTFileGrowth is the size (in bytes) to grow hash table file to fit in more entries.
 	HashBits      uint // HashBits is the number of bits to consider for hashing indexed key, also determines the initial number of buckets in a hash table file.
 
+	BlobFileGrowth      int // BlobFileGrowth is the size (in bytes) to grow attachment files, 0 for ColFileGrowth.
+	InsertLogFileGrowth int // InsertLogFileGrowth is the size (in bytes) to grow insertion log files, 0 for InsertLogGrowth.
+	GrowthThreshold     int // GrowthThreshold is the file size (in bytes) beyond which files grow by GrowthPercent of their size instead of the fixed size, 0 to turn off.
+	GrowthPercent       int // GrowthPercent is the percentage of current size to grow a file larger than GrowthThreshold by.
+
+	DocMaxDepth    int // DocMaxDepth is the maximum nesting depth of objects and arrays in an inserted/updated document, 0 for unlimited.
+	DocMaxKeys     int // DocMaxKeys is the maximum total number of object keys in an inserted/updated document, 0 for unlimited.
+	DocMaxArrayLen int // DocMaxArrayLen is the maximum length of any array in an inserted/updated document, 0 for unlimited.
+
+	VerboseLog    *bool `json:",omitempty"` // VerboseLog turns INFO log messages on or off, absent to leave it to the program.
+	PlanCacheSize int   // PlanCacheSize is the maximum number of compiled query plans cached by a database, 0 for the default.
+	SlowQueryMs   int   // SlowQueryMs is the duration (in milliseconds) beyond which a query is logged as slow, 0 to turn off.
+	QueryMaxIDs   int   // QueryMaxIDs is the maximum number of document IDs in a query result or intermediate set, 0 for unlimited.
+
+	RepairLookup bool // RepairLookup removes document ID lookup entries found pointing at invalid document data, instead of only reporting them.
+
+	OrderedIteration bool // OrderedIteration visits documents in ascending ID order in collection iteration and query cursors over all documents, e.g. for repeatable test output, at the cost of collecting all IDs first.
+
+	ColdPath string // ColdPath is the directory (e.g. on a slower disk) of cold tier partitions that documents not accessed for a while are moved into, empty for no cold tier.
+
 	InitialBuckets int    `json:"-"` // InitialBuckets is the number of buckets initially allocated in a hash table file.
 	Padding        string `json:"-"` // Padding is pre-allocated filler (space characters) for new documents.
 	LenPadding     int    `json:"-"` // LenPadding is the calculated length of Padding string.
@@ -41,11 +66,18 @@ func (conf *Config) CalculateConfigConstants() {
 	conf.InitialBuckets = 1 << conf.HashBits
 }
 
-// CreateOrReadConfig creates default performance configuration underneath the input database directory.
+/*
+CreateOrReadConfig creates default performance configuration underneath the input database directory, or reads the
+existing configuration. A corrupted configuration of a database without any collection yet (e.g. torn by a crash
+while the database was being created) is replaced by the default.
+*/
 func CreateOrReadConfig(path string) (conf *Config, err error) {
-	var file *os.File
-	var j []byte
+	return CreateOrReadConfigFrom(path, nil)
+}
 
+// CreateOrReadConfigFrom is CreateOrReadConfig creating the initial configuration (e.g. CompactConfig()) instead of the
+// default, nil for the default.
+func CreateOrReadConfigFrom(path string, initial *Config) (conf *Config, err error) {
 	if err = os.MkdirAll(path, 0700); err != nil {
 		return
 	}
@@ -53,48 +85,99 @@ func CreateOrReadConfig(path string) (conf *Config, err error) {
 	filePath := fmt.Sprintf("%s/data-config.json", path)
 
 	// set the default dataConfig
-	conf = defaultConfig()
-
-	// try to open the file
-	if file, err = os.OpenFile(filePath, os.O_RDONLY, 0644); err != nil {
-		if _, ok := err.(*os.PathError); ok {
-			// if we could not find the file because it doesn't exist, lets create it
-			// so the database always runs with these settings
-			err = nil
-
-			if file, err = os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644); err != nil {
-				return
-			}
-
-			j, err = json.MarshalIndent(conf, "", "  ")
-			if err != nil {
-				return
-			}
-
-			if _, err = file.Write(j); err != nil {
-				return
-			}
-
-		} else {
-			return
-		}
-	} else {
-		// if we find the file we will leave it as it is and merge
-		// it into the default
-		var b []byte
-		if b, err = ioutil.ReadAll(file); err != nil {
-			return
+	newConfig := func() *Config {
+		if initial == nil {
+			return defaultConfig()
 		}
+		copied := *initial
+		copied.CalculateConfigConstants()
+		return &copied
+	}
+	conf = newConfig()
 
-		if err = json.Unmarshal(b, conf); err != nil {
-			return
+	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		// create the file so the database always runs with these settings
+		return conf, writeConfig(filePath, conf)
+	} else if err != nil {
+		return
+	}
+	// merge the existing file into the default
+	if err = json.Unmarshal(content, conf); err == nil {
+		err = conf.validate()
+	}
+	if err != nil {
+		if !emptyDir(path) {
+			return nil, fmt.Errorf("Configuration file %s is corrupted (%v), please restore it from a backup of the database, or remove it if the database was created with default configuration", filePath, err)
 		}
+		tdlog.Noticef("Configuration file %s is corrupted (%v), the database has nothing in it yet hence default configuration is written", filePath, err)
+		conf = newConfig()
+		return conf, writeConfig(filePath, conf)
 	}
 
 	conf.CalculateConfigConstants()
 	return
 }
 
+// Write the configuration into the file.
+func writeConfig(filePath string, conf *Config) error {
+	content, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filePath, content, 0644)
+}
+
+// Return an error if a configuration value is out of range.
+func (conf *Config) validate() error {
+	switch {
+	case conf.DocMaxRoom < 1:
+		return fmt.Errorf("DocMaxRoom %d must be positive", conf.DocMaxRoom)
+	case conf.ColFileGrowth < 1:
+		return fmt.Errorf("ColFileGrowth %d must be positive", conf.ColFileGrowth)
+	case conf.PerBucket < 1:
+		return fmt.Errorf("PerBucket %d must be positive", conf.PerBucket)
+	case conf.HTFileGrowth < 1:
+		return fmt.Errorf("HTFileGrowth %d must be positive", conf.HTFileGrowth)
+	case conf.HashBits < 1 || conf.HashBits > 30:
+		return fmt.Errorf("HashBits %d must be between 1 and 30", conf.HashBits)
+	case conf.DocMaxDepth < 0 || conf.DocMaxKeys < 0 || conf.DocMaxArrayLen < 0:
+		return fmt.Errorf("DocMaxDepth, DocMaxKeys, and DocMaxArrayLen must not be negative")
+	case conf.BlobFileGrowth < 0 || conf.InsertLogFileGrowth < 0 || conf.GrowthThreshold < 0 || conf.GrowthPercent < 0:
+		return fmt.Errorf("BlobFileGrowth, InsertLogFileGrowth, GrowthThreshold, and GrowthPercent must not be negative")
+	case conf.PlanCacheSize < 0 || conf.SlowQueryMs < 0 || conf.QueryMaxIDs < 0:
+		return fmt.Errorf("PlanCacheSize, SlowQueryMs, and QueryMaxIDs must not be negative")
+	}
+	return nil
+}
+
+// Return true if the database directory has no sub-directory, i.e. no collection has been created in it.
+func emptyDir(dbPath string) bool {
+	content, err := ioutil.ReadDir(dbPath)
+	if err != nil {
+		return false
+	}
+	for _, info := range content {
+		if info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// Open a data file that grows by the specified size, with adaptive growth set up according to the configuration.
+func (conf *Config) openDataFile(path string, growth int, sparse bool) (file *DataFile, err error) {
+	open := OpenDataFile
+	if sparse {
+		open = OpenSparseDataFile
+	}
+	if file, err = open(path, growth); err != nil {
+		return
+	}
+	file.GrowthThreshold, file.GrowthPercent = conf.GrowthThreshold, conf.GrowthPercent
+	return
+}
+
 func defaultConfig() *Config {
 	/*
 		The default configuration matches the constants defined in tiedot version 3.2 and older. They correspond to ~16MB
@@ -112,3 +195,25 @@ func defaultConfig() *Config {
 
 	return ret
 }
+
+/*
+CompactConfig returns the configuration of a compact database, suited to applications having hundreds of small
+collections: hash tables have 1024 buckets instead of tens of thousands, and files start small and grow by small
+increments up to GrowthThreshold, beyond which they grow by GrowthPercent of their size.
+*/
+func CompactConfig() *Config {
+	ret := &Config{
+		DocMaxRoom:          DefaultDocMaxRoom,
+		ColFileGrowth:       CompactFileGrowth,
+		PerBucket:           16,
+		HTFileGrowth:        CompactFileGrowth,
+		HashBits:            CompactHashBits,
+		InsertLogFileGrowth: CompactFileGrowth / 8,
+		GrowthThreshold:     16 * CompactFileGrowth,
+		GrowthPercent:       50,
+	}
+
+	ret.CalculateConfigConstants()
+
+	return ret
+}
@@ -2,6 +2,7 @@ package data
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -112,3 +113,91 @@ func matchConfig(d1, d2 *Config) error {
 
 	return nil
 }
+
+func TestCorruptedConfig(t *testing.T) {
+	tmp := "/tmp/tiedot_config_test_corrupted"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Torn configuration of a database with nothing in it is replaced by the default
+	if err := ioutil.WriteFile(tmp+"/data-config.json", []byte(`{"DocMaxRoom": 104`), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := verifyConfigFromPath(tmp, defaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateOrReadConfig(tmp); err != nil {
+		t.Fatal(err)
+	}
+	// Not so once a collection exists
+	if err := os.MkdirAll(tmp+"/col", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{`{"DocMaxRoom": 104`, `{"HashBits": 0}`, `{"PerBucket": -1}`} {
+		if err := ioutil.WriteFile(tmp+"/data-config.json", []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		} else if _, err := CreateOrReadConfig(tmp); err == nil {
+			t.Fatal("Did not error", content)
+		}
+	}
+}
+
+func TestFileGrowthPerType(t *testing.T) {
+	tmp := "/tmp/tiedot_config_test_growth"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := defaultConfig()
+	conf.ColFileGrowth, conf.BlobFileGrowth, conf.InsertLogFileGrowth = 8192, 4096, 2048
+	conf.GrowthThreshold, conf.GrowthPercent = 1048576, 10
+	blob, err := conf.OpenBlobFile(tmp + "/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	log, err := conf.OpenInsertLog(tmp + "/ins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	col, err := conf.OpenCollection(tmp + "/col")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer col.Close()
+	if blob.Size != 4096 || log.Size != 2048 || col.Size != 8192 {
+		t.Fatal(blob.Size, log.Size, col.Size)
+	} else if col.DataFile.GrowthThreshold != 1048576 || col.DataFile.GrowthPercent != 10 {
+		t.Fatal(col.DataFile.GrowthThreshold, col.DataFile.GrowthPercent)
+	}
+}
+
+func TestCompactConfig(t *testing.T) {
+	tmp := "/tmp/tiedot_config_test_compact"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	compact := CompactConfig()
+	if err := compact.validate(); err != nil {
+		t.Fatal(err)
+	} else if compact.InitialBuckets*compact.BucketSize > compact.HTFileGrowth {
+		t.Fatal("Initial buckets do not fit in hash table file", compact.InitialBuckets*compact.BucketSize)
+	}
+	// A new database is created with the initial configuration
+	conf, err := CreateOrReadConfigFrom(tmp, compact)
+	if err != nil || conf.HashBits != CompactHashBits || conf.HTFileGrowth != CompactFileGrowth || conf.BucketSize != compact.BucketSize {
+		t.Fatal(conf, err)
+	}
+	// An existing database keeps its configuration
+	if conf, err = CreateOrReadConfig(tmp); err != nil || conf.HashBits != CompactHashBits || conf.GrowthPercent != compact.GrowthPercent {
+		t.Fatal(conf, err)
+	}
+	os.RemoveAll(tmp)
+	if _, err = CreateOrReadConfig(tmp); err != nil {
+		t.Fatal(err)
+	} else if conf, err = CreateOrReadConfigFrom(tmp, compact); err != nil || conf.HashBits != HASH_BITS {
+		t.Fatal(conf, err)
+	}
+}
@@ -0,0 +1,66 @@
+// Reporting of corruption found in data files.
+
+package data
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	CorruptBucketChain    = "bad bucket chain"        // CorruptBucketChain is a hash table bucket chained to an invalid bucket.
+	CorruptDocHeader      = "invalid document header" // CorruptDocHeader is a document header of invalid validity flag or room.
+	CorruptChecksum       = "checksum mismatch"       // CorruptChecksum is file content not matching its recorded checksum.
+	CorruptDanglingLookup = "dangling lookup entry"   // CorruptDanglingLookup is a document ID lookup entry pointing at invalid document data.
+)
+
+// CorruptionEvent describes corruption found in a data file.
+type CorruptionEvent struct {
+	Collection string // Collection is the name of the collection the file belongs to.
+	File       string // File is the path of the corrupted file.
+	Offset     int    // Offset is the position in file where corruption is found, -1 if not known.
+	Kind       string // Kind is one of the Corrupt* constants.
+}
+
+var corruptionHandler func(CorruptionEvent)
+var corruptionLock = new(sync.RWMutex)
+
+/*
+SetCorruptionHandler registers a function to be called with every corruption found in data files, e.g. to quarantine
+a collection, alert an operator, or schedule a repair. Pass nil to remove the handler. The handler is called on the
+goroutine that finds the corruption, possibly while it holds database locks, hence the handler must return quickly and
+must not call back into the database - it should hand the event over to another goroutine instead.
+*/
+func SetCorruptionHandler(handler func(CorruptionEvent)) {
+	corruptionLock.Lock()
+	defer corruptionLock.Unlock()
+	corruptionHandler = handler
+}
+
+// ReportCorruption hands the corruption event over to the registered handler, if any.
+func ReportCorruption(event CorruptionEvent) {
+	corruptionLock.RLock()
+	handler := corruptionHandler
+	corruptionLock.RUnlock()
+	if handler != nil {
+		handler(event)
+	}
+}
+
+/*
+Return the name of the collection a data file belongs to. Collection files sit in the collection directory, whereas
+index hash table files sit in the index directory underneath and are named after partition number alone.
+*/
+func collectionOf(filePath string) string {
+	dir := filepath.Dir(filePath)
+	if _, err := strconv.Atoi(filepath.Base(filePath)); err == nil {
+		dir = filepath.Dir(dir)
+	}
+	return filepath.Base(dir)
+}
+
+// Report corruption found at the offset of the data file.
+func (file *DataFile) reportCorruption(offset int, kind string) {
+	ReportCorruption(CorruptionEvent{Collection: collectionOf(file.Path), File: file.Path, Offset: offset, Kind: kind})
+}
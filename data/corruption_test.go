@@ -0,0 +1,54 @@
+package data
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestCollectionOf(t *testing.T) {
+	for filePath, name := range map[string]string{"/db/Feeds/dat_0": "Feeds", "/db/Feeds/id_3": "Feeds", "/db/Feeds/Title/2": "Feeds"} {
+		if got := collectionOf(filePath); got != name {
+			t.Fatal(filePath, got)
+		}
+	}
+}
+
+func TestReportCorruption(t *testing.T) {
+	var events []CorruptionEvent
+	SetCorruptionHandler(func(event CorruptionEvent) { events = append(events, event) })
+	defer SetCorruptionHandler(nil)
+	// Invalid document header
+	col, err := setupTestCollection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer col.Close()
+	id1, _ := col.Insert([]byte("abc"))
+	id2, _ := col.Insert([]byte("def"))
+	if col.Read(id1) == nil || len(events) != 0 {
+		t.Fatal(events)
+	}
+	col.Buf[id2] = 7
+	if col.Read(id2) != nil || len(events) != 1 || events[0] != (CorruptionEvent{Collection: "tmp", File: tmp, Offset: id2, Kind: CorruptDocHeader}) {
+		t.Fatal(events)
+	}
+	col.ForEachDoc(func(int, []byte) bool { return true })
+	if len(events) != 2 || events[1].Offset != id2 {
+		t.Fatal(events)
+	}
+	// Bad bucket chain
+	events = nil
+	htPath := "/tmp/tiedot_test_hash"
+	os.Remove(htPath)
+	defer os.Remove(htPath)
+	ht, err := defaultConfig().OpenHashTable(htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ht.Close()
+	binary.PutVarint(ht.Buf[0:10], int64(ht.numBuckets+1))
+	if ht.nextBucket(0) != 0 || len(events) != 1 || events[0].Kind != CorruptBucketChain || events[0].File != htPath || events[0].Offset != 0 {
+		t.Fatal(events)
+	}
+}
@@ -3,7 +3,9 @@
 package data
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/HouzuoGuo/tiedot/gommap"
 	"github.com/HouzuoGuo/tiedot/tdlog"
@@ -13,8 +15,12 @@ import (
 type DataFile struct {
 	Path               string
 	Size, Used, Growth int
+	GrowthThreshold    int // Beyond this size the file grows by GrowthPercent of its size (if larger than Growth), 0 to turn off.
+	GrowthPercent      int
+	Sparse             bool // Grow the file without writing zeros, leaving disk space unallocated until it is written.
 	Fh                 *os.File
 	Buf                gommap.MMap
+	sums               *regionSums // Checksums of regions, see VerifyChecksums
 }
 
 // Return true if the buffer begins with 64 consecutive zero bytes.
@@ -31,9 +37,55 @@ func LooksEmpty(buf gommap.MMap) bool {
 	return true
 }
 
+/*
+WriteFileAtomic writes the content into a temporary file next to the file, and renames the temporary file over the file
+once the content is on disk. A crash leaves either the previous or the new content behind, never a torn file.
+*/
+func WriteFileAtomic(filePath string, content []byte, perm os.FileMode) error {
+	tmpPath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, perm); err != nil {
+		return err
+	}
+	tmpFile, err := os.OpenFile(tmpPath, os.O_RDWR, perm)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = tmpFile.Sync()
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// Persist the rename, where the platform allows syncing a directory
+	if dir, err := os.Open(filepath.Dir(filePath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
 // Open a data file that grows by the specified size.
 func OpenDataFile(path string, growth int) (file *DataFile, err error) {
-	file = &DataFile{Path: path, Growth: growth}
+	return openDataFile(path, growth, false)
+}
+
+/*
+Open a data file that grows by the specified size, without writing zeros into the new room. The file system allocates
+disk space only as the file is written, so the room of an empty file takes little space. Where the file system does not
+support sparse files, the file is filled with zeros as usual.
+*/
+func OpenSparseDataFile(path string, growth int) (file *DataFile, err error) {
+	return openDataFile(path, growth, true)
+}
+
+func openDataFile(path string, growth int, sparse bool) (file *DataFile, err error) {
+	file = &DataFile{Path: path, Growth: growth, Sparse: sparse, sums: newRegionSums()}
 	if file.Fh, err = os.OpenFile(file.Path, os.O_CREATE|os.O_RDWR, 0600); err != nil {
 		return
 	}
@@ -97,25 +149,53 @@ func (file *DataFile) overwriteWithZero(from int, size int) (err error) {
 	return file.Fh.Sync()
 }
 
+// Extend the file by size bytes of zeros from the offset, leaving them unallocated if the file is sparse.
+func (file *DataFile) extend(from int, size int) error {
+	if file.Sparse {
+		return file.Fh.Truncate(int64(from + size))
+	}
+	return file.overwriteWithZero(from, size)
+}
+
+// Return the size to grow the file by next time - a percentage of the current size for a large file, or the fixed
+// growth otherwise.
+func (file *DataFile) nextGrowth() int {
+	if file.GrowthThreshold > 0 && file.GrowthPercent > 0 && file.Size >= file.GrowthThreshold {
+		if growth := file.Size / 100 * file.GrowthPercent; growth > file.Growth {
+			return growth
+		}
+	}
+	return file.Growth
+}
+
 // Ensure there is enough room for that many bytes of data.
 func (file *DataFile) EnsureSize(more int) (err error) {
 	if file.Used+more <= file.Size {
 		return
-	} else if file.Buf != nil {
-		if err = file.Buf.Unmap(); err != nil {
-			return
-		}
 	}
-	if err = file.overwriteWithZero(file.Size, file.Growth); err != nil {
+	growth := file.nextGrowth()
+	if err = file.extend(file.Size, growth); err != nil {
 		return
-	} else if file.Buf, err = gommap.Map(file.Fh); err != nil {
+	}
+	if file.Buf == nil {
+		file.Buf, err = gommap.Map(file.Fh)
+	} else {
+		// Data already mapped stays put on platforms that support it, avoiding a re-map of the entire file
+		err = file.Buf.Grow(file.Fh)
+	}
+	if err != nil {
 		return
 	}
-	file.Size += file.Growth
-	tdlog.Infof("%s grown: %d -> %d bytes (%d bytes in-use)", file.Path, file.Size-file.Growth, file.Size, file.Used)
+	file.Size += growth
+	tdlog.Infof("%s grown: %d -> %d bytes (%d bytes in-use)", file.Path, file.Size-growth, file.Size, file.Used)
 	return file.EnsureSize(more)
 }
 
+// Flush the file, including changes made through its memory map, to disk.
+func (file *DataFile) Sync() error {
+	return file.Fh.Sync()
+}
+
 // Un-map the file buffer and close the file handle.
 func (file *DataFile) Close() (err error) {
 	if err = file.Buf.Unmap(); err != nil {
@@ -132,12 +212,13 @@ func (file *DataFile) Clear() (err error) {
 		return
 	} else if file.Fh, err = os.OpenFile(file.Path, os.O_CREATE|os.O_RDWR, 0600); err != nil {
 		return
-	} else if err = file.overwriteWithZero(0, file.Growth); err != nil {
+	} else if err = file.extend(0, file.Growth); err != nil {
 		return
 	} else if file.Buf, err = gommap.Map(file.Fh); err != nil {
 		return
 	}
 	file.Used, file.Size = 0, file.Growth
+	file.sums = newRegionSums()
 	tdlog.Infof("%s cleared: %d of %d bytes in-use", file.Path, file.Used, file.Size)
 	return
 }
@@ -0,0 +1,65 @@
+// +build linux
+
+package data
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+// Return the number of bytes allocated on disk to the file.
+func allocatedBytes(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestSparseHashTable(t *testing.T) {
+	tmp := "/tmp/tiedot_test_sparse_hash"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	ht, err := d.OpenHashTable(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ht.Close()
+	if !ht.Sparse || ht.Size != d.HTFileGrowth {
+		t.Fatal(ht.Sparse, ht.Size)
+	}
+	// An empty hash table takes little disk space
+	if allocated := allocatedBytes(t, tmp); allocated > int64(d.HTFileGrowth/8) {
+		t.Fatal("Hash table file was allocated", allocated)
+	}
+	// Entries take the pages they are written to
+	for i := 0; i < 100; i++ {
+		ht.Put(i, i)
+	}
+	if allocated := allocatedBytes(t, tmp); allocated > int64(d.HTFileGrowth/8) {
+		t.Fatal("Hash table file was allocated", allocated)
+	}
+	// Growth and clearing keep the file sparse
+	if err := ht.EnsureSize(ht.Size); err != nil {
+		t.Fatal(err)
+	} else if ht.Size != 2*d.HTFileGrowth {
+		t.Fatal(ht.Size)
+	} else if allocated := allocatedBytes(t, tmp); allocated > int64(d.HTFileGrowth/8) {
+		t.Fatal("Grown room was allocated", allocated)
+	}
+	if err := ht.Clear(); err != nil {
+		t.Fatal(err)
+	} else if allocated := allocatedBytes(t, tmp); allocated > int64(d.HTFileGrowth/8) {
+		t.Fatal("Cleared file was allocated", allocated)
+	}
+	for i := 0; i < 1000; i++ {
+		ht.Put(i, i)
+	}
+	for i := 0; i < 1000; i++ {
+		if vals := ht.Get(i, 0); len(vals) != 1 || vals[0] != i {
+			t.Fatal(i, vals)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/HouzuoGuo/tiedot/gommap"
 	"github.com/bouk/monkey"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"testing"
@@ -293,3 +294,41 @@ func TestEnsureSizeMapErr(t *testing.T) {
 		t.Error("Expected error `gommap.Map` in inner function `EnsureSize`")
 	}
 }
+func TestWriteFileAtomic(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	for _, content := range []string{"first", "2"} {
+		if err := WriteFileAtomic(tmp, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		} else if written, err := ioutil.ReadFile(tmp); err != nil || string(written) != content {
+			t.Fatal(string(written), err)
+		} else if _, err := os.Stat(tmp + ".tmp"); !os.IsNotExist(err) {
+			t.Fatal("Temporary file is left behind")
+		}
+	}
+}
+func TestAdaptiveGrowth(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	tmpFile, err := OpenDataFile(tmp, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	tmpFile.GrowthThreshold, tmpFile.GrowthPercent = 2048, 100
+	// Below threshold the file grows by the fixed size, beyond it by the percentage of its size
+	for _, size := range []int{2048, 4048} {
+		tmpFile.Used = tmpFile.Size
+		if err := tmpFile.EnsureSize(1); err != nil {
+			t.Fatal(err)
+		} else if tmpFile.Size != size {
+			t.Fatal(tmpFile.Size, size)
+		}
+	}
+	// Percentage smaller than the fixed size does not slow the growth down
+	tmpFile.GrowthPercent = 1
+	tmpFile.Used = tmpFile.Size
+	if err := tmpFile.EnsureSize(1); err != nil || tmpFile.Size != 5072 {
+		t.Fatal(tmpFile.Size, err)
+	}
+}
@@ -0,0 +1,88 @@
+// On-disk format version of data files, and migration of older formats.
+
+package data
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatFile    = "data-format" // FormatFile is the name of the file underneath database directory holding the format version.
+	FormatVersion = 1             // FormatVersion is the version of data, lookup, and hash table file layout written by this program.
+)
+
+/*
+formatUpgrades are the upgrades of database files, keyed by the format version they upgrade from. Each upgrade leaves
+the files in the layout of the next version. A database made before format versions were stamped is of version 0,
+which has the same layout as version 1.
+*/
+var formatUpgrades = map[int]func(dbPath string) error{
+	0: func(string) error { return nil },
+}
+
+// ReadFormat returns the format version of database files underneath the database directory, 0 if it is not stamped.
+func ReadFormat(dbPath string) (version int, err error) {
+	content, err := ioutil.ReadFile(path.Join(dbPath, FormatFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return
+	}
+	if version, err = strconv.Atoi(strings.TrimSpace(string(content))); err != nil || version < 1 {
+		return 0, fmt.Errorf("Format file %s is corrupted", path.Join(dbPath, FormatFile))
+	}
+	return
+}
+
+// Stamp the format version onto database files underneath the database directory.
+func writeFormat(dbPath string, version int) error {
+	return WriteFileAtomic(path.Join(dbPath, FormatFile), []byte(strconv.Itoa(version)), 0600)
+}
+
+/*
+CheckFormat returns an error if database files underneath the directory are not in the current format version. Files
+of a new database, as well as files made before format versions were stamped, are stamped with the current version.
+*/
+func CheckFormat(dbPath string) error {
+	version, err := ReadFormat(dbPath)
+	if err != nil {
+		return err
+	} else if version == 0 {
+		return writeFormat(dbPath, FormatVersion)
+	} else if version > FormatVersion {
+		return fmt.Errorf("Database %s has format version %d, which is newer than the supported version %d", dbPath, version, FormatVersion)
+	} else if version < FormatVersion {
+		return fmt.Errorf("Database %s has format version %d, please upgrade it to version %d using MigrateFormat", dbPath, version, FormatVersion)
+	}
+	return nil
+}
+
+/*
+MigrateFormat upgrades database files underneath the directory in place, one format version at a time, to the current
+version. The database must not be open. The version is stamped after each upgrade, hence an interrupted migration
+carries on from where it stopped; nevertheless, make a backup (e.g. copy of the directory) beforehand.
+*/
+func MigrateFormat(dbPath string) error {
+	version, err := ReadFormat(dbPath)
+	if err != nil {
+		return err
+	} else if version > FormatVersion {
+		return fmt.Errorf("Database %s has format version %d, which is newer than the supported version %d", dbPath, version, FormatVersion)
+	}
+	for ; version < FormatVersion; version++ {
+		upgrade, exists := formatUpgrades[version]
+		if !exists {
+			return fmt.Errorf("There is no upgrade from format version %d", version)
+		} else if err := upgrade(dbPath); err != nil {
+			return fmt.Errorf("Failed to upgrade %s from format version %d: %v", dbPath, version, err)
+		} else if err := writeFormat(dbPath, version+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
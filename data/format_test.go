@@ -0,0 +1,77 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestFormatVersion(t *testing.T) {
+	tmp := "/tmp/tiedot_format_test"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := ReadFormat(tmp); err != nil || version != 0 {
+		t.Fatal(version, err)
+	}
+	// Unstamped files are stamped with the current version
+	if err := CheckFormat(tmp); err != nil {
+		t.Fatal(err)
+	} else if version, err := ReadFormat(tmp); err != nil || version != FormatVersion {
+		t.Fatal(version, err)
+	}
+	// Newer version is refused
+	if err := ioutil.WriteFile(path.Join(tmp, FormatFile), []byte(strconv.Itoa(FormatVersion+1)), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := CheckFormat(tmp); err == nil {
+		t.Fatal("Did not error")
+	} else if err := MigrateFormat(tmp); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Corrupted stamp
+	if err := ioutil.WriteFile(path.Join(tmp, FormatFile), []byte("abc"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := CheckFormat(tmp); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestMigrateFormat(t *testing.T) {
+	tmp := "/tmp/tiedot_format_test"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateFormat(tmp); err != nil {
+		t.Fatal(err)
+	} else if version, err := ReadFormat(tmp); err != nil || version != FormatVersion {
+		t.Fatal(version, err)
+	}
+	// Already current
+	if err := MigrateFormat(tmp); err != nil {
+		t.Fatal(err)
+	}
+	// Upgrades run in order, and a failed upgrade leaves the version of the last successful one
+	upgrades := formatUpgrades
+	defer func() { formatUpgrades = upgrades }()
+	var ran []int
+	formatUpgrades = map[int]func(string) error{
+		0: func(string) error { ran = append(ran, 0); return nil },
+	}
+	os.Remove(path.Join(tmp, FormatFile))
+	if err := MigrateFormat(tmp); err != nil || len(ran) != 1 {
+		t.Fatal(ran, err)
+	}
+	formatUpgrades = map[int]func(string) error{}
+	os.Remove(path.Join(tmp, FormatFile))
+	if err := MigrateFormat(tmp); err == nil {
+		t.Fatal("Did not error")
+	} else if version, err := ReadFormat(tmp); err != nil || version != 0 {
+		t.Fatal(version, err)
+	}
+}
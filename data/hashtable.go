@@ -13,6 +13,7 @@ package data
 
 import (
 	"encoding/binary"
+	"strconv"
 	"sync"
 
 	"github.com/HouzuoGuo/tiedot/tdlog"
@@ -24,12 +25,18 @@ type HashTable struct {
 	*DataFile
 	numBuckets int
 	Lock       *sync.RWMutex
+	sketch     *keySketch   // Estimates entries per key, nil until the first estimate
+	sketchLock *sync.Mutex  // Protects building the sketch under read lock
+	sorted     *SortedIndex // Entries ordered by key, nil until the first range lookup
+	sortedLock *sync.Mutex  // Protects building the sorted index under read lock
+	MixKeys    bool         // Choose buckets by MixKey, for keys that keep their information in high bits
 }
 
 // Open a hash table file.
 func (conf *Config) OpenHashTable(path string) (ht *HashTable, err error) {
-	ht = &HashTable{Config: conf, Lock: new(sync.RWMutex)}
-	if ht.DataFile, err = OpenDataFile(path, ht.HTFileGrowth); err != nil {
+	ht = &HashTable{Config: conf, Lock: new(sync.RWMutex), sketchLock: new(sync.Mutex), sortedLock: new(sync.Mutex)}
+	// Most buckets of a new hash table stay empty for long, hence the file is allocated as entries are written
+	if ht.DataFile, err = conf.openDataFile(path, ht.HTFileGrowth, true); err != nil {
 		return
 	}
 	conf.CalculateConfigConstants()
@@ -37,6 +44,28 @@ func (conf *Config) OpenHashTable(path string) (ht *HashTable, err error) {
 	return
 }
 
+/*
+Return the integer key with all of its bits mixed into the low bits, keeping it non-negative. HashKey only smears a few
+bits downwards, hence keys that differ in high bits alone (e.g. ordered number keys) share a bucket unless mixed.
+*/
+func MixKey(key int) int {
+	x := uint64(key)
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return int(x >> (64 - strconv.IntSize + 1))
+}
+
+// Return the bucket of the key.
+func (ht *HashTable) bucketOf(key int) int {
+	if ht.MixKeys {
+		key = MixKey(key)
+	}
+	return ht.HashKey(key)
+}
+
 // Follow the longest bucket chain to calculate total number of buckets, hence the "used size" of hash table file.
 func (ht *HashTable) calculateNumBuckets() {
 	ht.numBuckets = ht.Size / ht.BucketSize
@@ -69,6 +98,7 @@ func (ht *HashTable) nextBucket(bucket int) int {
 		return 0
 	} else if err < 0 || next <= bucket || next >= ht.numBuckets || next < ht.InitialBuckets {
 		tdlog.CritNoRepeat("Bad hash table - repair ASAP %s", ht.Path)
+		ht.reportCorruption(bucketAddr, CorruptBucketChain)
 		return 0
 	} else {
 		return next
@@ -91,6 +121,8 @@ func (ht *HashTable) growBucket(bucket int) {
 	ht.EnsureSize(ht.BucketSize)
 	lastBucketAddr := ht.lastBucket(bucket) * ht.BucketSize
 	binary.PutVarint(ht.Buf[lastBucketAddr:lastBucketAddr+10], int64(ht.numBuckets))
+	ht.touch(lastBucketAddr, 10)
+	ht.touch(ht.Used, ht.BucketSize)
 	ht.Used += ht.BucketSize
 	ht.numBuckets++
 }
@@ -101,23 +133,32 @@ func (ht *HashTable) Clear() (err error) {
 		return
 	}
 	ht.calculateNumBuckets()
+	ht.sketch = nil
+	ht.sorted = nil
 	return
 }
 
 // Store the entry into a vacant (invalidated or empty) place in the appropriate bucket.
 func (ht *HashTable) Put(key, val int) {
-	for bucket, entry := ht.HashKey(key), 0; ; {
+	for bucket, entry := ht.bucketOf(key), 0; ; {
 		entryAddr := bucket*ht.BucketSize + BucketHeader + entry*EntrySize
 		if ht.Buf[entryAddr] != 1 {
 			ht.Buf[entryAddr] = 1
 			binary.PutVarint(ht.Buf[entryAddr+1:entryAddr+11], int64(key))
 			binary.PutVarint(ht.Buf[entryAddr+11:entryAddr+21], int64(val))
+			ht.touch(entryAddr, EntrySize)
+			if ht.sketch != nil {
+				ht.sketch.add(key, 1)
+			}
+			if ht.sorted != nil {
+				ht.sorted.Put(key, val)
+			}
 			return
 		}
 		if entry++; entry == ht.PerBucket {
 			entry = 0
 			if bucket = ht.nextBucket(bucket); bucket == 0 {
-				ht.growBucket(ht.HashKey(key))
+				ht.growBucket(ht.bucketOf(key))
 				ht.Put(key, val)
 				return
 			}
@@ -132,7 +173,7 @@ func (ht *HashTable) Get(key, limit int) (vals []int) {
 	} else {
 		vals = make([]int, 0, limit)
 	}
-	for count, entry, bucket := 0, 0, ht.HashKey(key); ; {
+	for count, entry, bucket := 0, 0, ht.bucketOf(key); ; {
 		entryAddr := bucket*ht.BucketSize + BucketHeader + entry*EntrySize
 		entryKey, _ := binary.Varint(ht.Buf[entryAddr+1 : entryAddr+11])
 		entryVal, _ := binary.Varint(ht.Buf[entryAddr+11 : entryAddr+21])
@@ -155,15 +196,54 @@ func (ht *HashTable) Get(key, limit int) (vals []int) {
 	}
 }
 
+// Add delta to the value of the first entry of the key and return the new value. If the key does not have an entry yet,
+// store a new entry with delta as value.
+func (ht *HashTable) Incr(key, delta int) int {
+	for entry, bucket := 0, ht.bucketOf(key); ; {
+		entryAddr := bucket*ht.BucketSize + BucketHeader + entry*EntrySize
+		entryKey, _ := binary.Varint(ht.Buf[entryAddr+1 : entryAddr+11])
+		entryVal, _ := binary.Varint(ht.Buf[entryAddr+11 : entryAddr+21])
+		if ht.Buf[entryAddr] == 1 {
+			if int(entryKey) == key {
+				newVal := int(entryVal) + delta
+				binary.PutVarint(ht.Buf[entryAddr+11:entryAddr+21], int64(newVal))
+				ht.touch(entryAddr+11, 10)
+				if ht.sorted != nil {
+					ht.sorted.Remove(key, int(entryVal))
+					ht.sorted.Put(key, newVal)
+				}
+				return newVal
+			}
+		} else if entryKey == 0 && entryVal == 0 {
+			break
+		}
+		if entry++; entry == ht.PerBucket {
+			entry = 0
+			if bucket = ht.nextBucket(bucket); bucket == 0 {
+				break
+			}
+		}
+	}
+	ht.Put(key, delta)
+	return delta
+}
+
 // Flag an entry as invalid, so that Get will not return it later on.
 func (ht *HashTable) Remove(key, val int) {
-	for entry, bucket := 0, ht.HashKey(key); ; {
+	for entry, bucket := 0, ht.bucketOf(key); ; {
 		entryAddr := bucket*ht.BucketSize + BucketHeader + entry*EntrySize
 		entryKey, _ := binary.Varint(ht.Buf[entryAddr+1 : entryAddr+11])
 		entryVal, _ := binary.Varint(ht.Buf[entryAddr+11 : entryAddr+21])
 		if ht.Buf[entryAddr] == 1 {
 			if int(entryKey) == key && int(entryVal) == val {
 				ht.Buf[entryAddr] = 0
+				ht.touch(entryAddr, 1)
+				if ht.sketch != nil {
+					ht.sketch.add(key, -1)
+				}
+				if ht.sorted != nil {
+					ht.sorted.Remove(key, val)
+				}
 				return
 			}
 		} else if entryKey == 0 && entryVal == 0 {
@@ -178,7 +178,7 @@ func TestPartitionEntries(t *testing.T) {
 }
 func TestOpenHashTableErr(t *testing.T) {
 	errMessage := "Error open data file"
-	patch := monkey.Patch(OpenDataFile, func(path string, growth int) (file *DataFile, err error) {
+	patch := monkey.Patch(OpenSparseDataFile, func(path string, growth int) (file *DataFile, err error) {
 		return nil, errors.New(errMessage)
 	})
 	defer patch.Unpatch()
@@ -230,7 +230,7 @@ func TestRemoveEqualZeroPerBucket(t *testing.T) {
 func TestCalculateNumBucketsSizeOver(t *testing.T) {
 	os.Remove(tmp)
 	defer os.Remove(tmp)
-	patch := monkey.Patch(OpenDataFile, func(path string, growth int) (file *DataFile, err error) {
+	patch := monkey.Patch(OpenSparseDataFile, func(path string, growth int) (file *DataFile, err error) {
 		return &DataFile{
 			Path:   path,
 			Growth: growth,
@@ -251,3 +251,64 @@ func TestNextBucketZero(t *testing.T) {
 	}
 
 }
+
+func TestIncr(t *testing.T) {
+	tmp := "/tmp/tiedot_test_hash"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	ht, err := d.OpenHashTable(tmp)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer ht.Close()
+	if val := ht.Incr(1, 5); val != 5 {
+		t.Fatal(val)
+	}
+	if val := ht.Incr(1, -7); val != -2 {
+		t.Fatal(val)
+	}
+	// Many keys do not interfere with each other, even when buckets overflow
+	for i := 2; i < d.PerBucket*d.InitialBuckets; i += 7 {
+		ht.Incr(i, i)
+		ht.Incr(i, 1)
+	}
+	for i := 2; i < d.PerBucket*d.InitialBuckets; i += 7 {
+		if vals := ht.Get(i, 0); len(vals) != 1 || vals[0] != i+1 {
+			t.Fatal(i, vals)
+		}
+	}
+	if vals := ht.Get(1, 0); len(vals) != 1 || vals[0] != -2 {
+		t.Fatal(vals)
+	}
+}
+
+func TestMixKeys(t *testing.T) {
+	tmp := "/tmp/tiedot_test_hash"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	ht, err := d.OpenHashTable(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ht.Close()
+	// Keys differing in high bits alone would share a bucket
+	ht.MixKeys = true
+	for i := 0; i < 10000; i++ {
+		ht.Put(i<<40, i)
+	}
+	if ht.numBuckets != d.InitialBuckets {
+		t.Fatal("Buckets are chained", ht.numBuckets, d.InitialBuckets)
+	}
+	for i := 0; i < 10000; i++ {
+		if vals := ht.Get(i<<40, 0); !reflect.DeepEqual(vals, []int{i}) {
+			t.Fatal(i, vals)
+		}
+	}
+	for _, key := range []int{0, 1, -1, math.MaxInt32, math.MinInt32} {
+		if MixKey(key) < 0 {
+			t.Fatal(key, MixKey(key))
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Insertion log file records the order in which documents are inserted.
+//
+// Every entry has a validity byte, followed by document ID and insertion
+// sequence number. Entries are appended one after another - a document
+// inserted more than once (e.g. re-inserted under the same ID after deletion)
+// has more than one entry, until Compact leaves the latest entry of each
+// document that still exists.
+
+package data
+
+import "encoding/binary"
+
+const (
+	InsertLogEntrySize = 1 + 10 + 10 // InsertLogEntrySize is the size of a single insertion log entry.
+	InsertLogGrowth    = 1048576     // InsertLogGrowth is the default initial size and size growth of insertion log file.
+)
+
+// Insertion log file contains document IDs and their insertion sequence numbers.
+type InsertLog struct {
+	*DataFile
+	LastSeq int64 // Largest sequence number found in or appended to the log
+	Deleted int   // Number of documents deleted since the log was opened or compacted, whose entries are left behind
+}
+
+// Open an insertion log file.
+func (conf *Config) OpenInsertLog(path string) (log *InsertLog, err error) {
+	log = new(InsertLog)
+	growth := conf.InsertLogFileGrowth
+	if growth == 0 {
+		growth = InsertLogGrowth
+	}
+	if log.DataFile, err = conf.openDataFile(path, growth, false); err != nil {
+		return
+	}
+	// Used size calculated from file content may fall short of the last entry, which ends with zero bytes
+	log.Used = (log.Used + InsertLogEntrySize - 1) / InsertLogEntrySize * InsertLogEntrySize
+	log.ForEach(func(id int, seq int64) bool {
+		if seq > log.LastSeq {
+			log.LastSeq = seq
+		}
+		return true
+	})
+	return
+}
+
+// Return the number of entries in the log, including those left behind by deleted documents.
+func (log *InsertLog) Len() int {
+	return log.Used / InsertLogEntrySize
+}
+
+// Append an entry to the log.
+func (log *InsertLog) Append(id int, seq int64) (err error) {
+	if err = log.EnsureSize(InsertLogEntrySize); err != nil {
+		return
+	}
+	entry := log.Used
+	log.Buf[entry] = 1
+	binary.PutVarint(log.Buf[entry+1:entry+11], int64(id))
+	binary.PutVarint(log.Buf[entry+11:entry+21], seq)
+	log.Used += InsertLogEntrySize
+	if seq > log.LastSeq {
+		log.LastSeq = seq
+	}
+	return
+}
+
+/*
+Compact the log in place, leaving the latest entry of each document that keep returns true for (i.e. the document
+still exists), in the order of appending. Should the compaction be interrupted, the log may keep extra entries of a
+document, of which the latest still counts.
+*/
+func (log *InsertLog) Compact(keep func(id int) bool) {
+	latest := make(map[int]int)
+	log.forEachEntry(func(entry, id int, _ int64) bool {
+		latest[id] = entry
+		return true
+	})
+	used := 0
+	log.forEachEntry(func(entry, id int, _ int64) bool {
+		if latest[id] == entry && keep(id) {
+			copy(log.Buf[used:used+InsertLogEntrySize], log.Buf[entry:entry+InsertLogEntrySize])
+			used += InsertLogEntrySize
+		}
+		return true
+	})
+	for i := used; i < log.Used; i++ {
+		log.Buf[i] = 0
+	}
+	log.Used = used
+	log.Deleted = 0
+}
+
+// Clear the log and resize it to initial size.
+func (log *InsertLog) Clear() error {
+	log.LastSeq, log.Deleted = 0, 0
+	return log.DataFile.Clear()
+}
+
+// Run the function on every entry in the order of appending; stop when the function returns false.
+func (log *InsertLog) ForEach(fun func(id int, seq int64) bool) {
+	log.forEachEntry(func(_, id int, seq int64) bool {
+		return fun(id, seq)
+	})
+}
+
+// Run the function on every entry and its position in the order of appending; stop when the function returns false.
+func (log *InsertLog) forEachEntry(fun func(entry, id int, seq int64) bool) {
+	for entry := 0; entry+InsertLogEntrySize <= log.Used; entry += InsertLogEntrySize {
+		if log.Buf[entry] != 1 {
+			continue
+		}
+		id, _ := binary.Varint(log.Buf[entry+1 : entry+11])
+		seq, _ := binary.Varint(log.Buf[entry+11 : entry+21])
+		if !fun(entry, int(id), seq) {
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package data
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestInsertLog(t *testing.T) {
+	tmp := "/tmp/tiedot_test_insertlog"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	log, err := defaultConfig().OpenInsertLog(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough entries to grow the file
+	total := InsertLogGrowth/InsertLogEntrySize + 10
+	for i := 0; i < total; i++ {
+		if err := log.Append(i, int64(i*2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Entries survive reopening in the order of appending
+	if log, err = defaultConfig().OpenInsertLog(tmp); err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if log.Used != total*InsertLogEntrySize {
+		t.Fatal(log.Used, total*InsertLogEntrySize)
+	}
+	if err := log.Append(-1, 1<<40); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	log.ForEach(func(id int, seq int64) bool {
+		if count < total && (id != count || seq != int64(count*2)) || count == total && (id != -1 || seq != 1<<40) {
+			t.Fatal(count, id, seq)
+		}
+		count++
+		return true
+	})
+	if count != total+1 {
+		t.Fatal(count)
+	}
+	// Stop early
+	count = 0
+	log.ForEach(func(id int, seq int64) bool {
+		count++
+		return count < 5
+	})
+	if count != 5 {
+		t.Fatal(count)
+	}
+	// The largest sequence number is found upon opening
+	if log.LastSeq != 1<<40 {
+		t.Fatal(log.LastSeq)
+	}
+	// Compaction leaves the latest entry of each kept document
+	if err := log.Append(3, 1<<41); err != nil {
+		t.Fatal(err)
+	}
+	log.Deleted = 10
+	log.Compact(func(id int) bool {
+		return id < 5
+	})
+	var ids []int
+	var seqs []int64
+	log.ForEach(func(id int, seq int64) bool {
+		ids, seqs = append(ids, id), append(seqs, seq)
+		return true
+	})
+	if !reflect.DeepEqual(ids, []int{0, 1, 2, 4, -1, 3}) || !reflect.DeepEqual(seqs, []int64{0, 2, 4, 8, 1 << 40, 1 << 41}) {
+		t.Fatal(ids, seqs)
+	} else if log.Len() != 6 || log.Deleted != 0 {
+		t.Fatal(log.Len(), log.Deleted)
+	}
+	// Compacted log is seen by another opening
+	reopened, err := defaultConfig().OpenInsertLog(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Len() != 6 || reopened.LastSeq != 1<<41 {
+		t.Fatal(reopened.Len(), reopened.LastSeq)
+	}
+}
@@ -2,11 +2,16 @@
 // in order to allow addressing of a document using an unchanging ID:
 // The hash table stores the unchanging ID as entry key and the physical
 // document location as entry value.
+// A partition may have a cold tier - another partition (e.g. on a slower disk) holding documents that have not been
+// accessed for a while, documents are read from either tier transparently.
 
 package data
 
 import (
+	"bytes"
+	"io"
 	"sync"
+	"time"
 
 	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/HouzuoGuo/tiedot/tdlog"
@@ -21,6 +26,14 @@ type Partition struct {
 
 	exclUpdate     map[int]chan struct{}
 	exclUpdateLock *sync.Mutex // guard against concurrent exclusive locking of documents
+
+	dangling     map[int]int // lookup entries (ID to physical ID) found pointing at invalid document data
+	danglingLock *sync.Mutex
+
+	cold       *Partition    // cold tier holding documents migrated by MigrateCold, nil if there is none
+	access     map[int]int64 // last access time (Unix seconds) of lookup entries, tracked only if there is a cold tier
+	accessLock *sync.Mutex
+	opened     int64 // time (Unix seconds) the partition was opened, the access time of entries not accessed since
 }
 
 func (conf *Config) newPartition() *Partition {
@@ -30,6 +43,11 @@ func (conf *Config) newPartition() *Partition {
 		exclUpdateLock: new(sync.Mutex),
 		exclUpdate:     make(map[int]chan struct{}),
 		DataLock:       new(sync.RWMutex),
+		dangling:       make(map[int]int),
+		danglingLock:   new(sync.Mutex),
+		access:         make(map[int]int64),
+		accessLock:     new(sync.Mutex),
+		opened:         time.Now().Unix(),
 	}
 }
 
@@ -45,47 +63,123 @@ func (conf *Config) OpenPartition(colPath, lookupPath string) (part *Partition,
 	return
 }
 
+// Open the cold tier of the partition. Documents are moved into the cold tier by MigrateCold, and moved back upon update.
+func (part *Partition) OpenCold(colPath, lookupPath string) (err error) {
+	cold, err := part.Config.OpenPartition(colPath, lookupPath)
+	if err != nil {
+		return
+	}
+	part.cold = cold
+	return
+}
+
+// Return true if the partition has a cold tier.
+func (part *Partition) HasCold() bool {
+	return part.cold != nil
+}
+
+// Record an access of the document in the hot tier.
+func (part *Partition) touch(id int) {
+	if part.cold == nil {
+		return
+	}
+	part.accessLock.Lock()
+	part.access[id] = time.Now().Unix()
+	part.accessLock.Unlock()
+}
+
+// Forget the access time of a document no longer in the hot tier.
+func (part *Partition) forget(id int) {
+	part.accessLock.Lock()
+	delete(part.access, id)
+	part.accessLock.Unlock()
+}
+
 // Insert a document. The ID may be used to retrieve/update/delete the document later on.
 func (part *Partition) Insert(id int, data []byte) (physID int, err error) {
+	part.repairLookup()
 	physID, err = part.col.Insert(data)
 	if err != nil {
 		return
 	}
 	part.lookup.Put(id, physID)
+	part.touch(id)
 	return
 }
 
+// Write a document by ID to the output without making a copy, return number of bytes written.
+func (part *Partition) ReadTo(id int, out io.Writer) (int, error) {
+	physID := part.lookup.Get(id, 1)
+	if len(physID) == 0 {
+		if part.cold != nil {
+			return part.cold.ReadTo(id, out)
+		}
+		return 0, dberr.New(dberr.ErrorNoDoc, id)
+	}
+	n, found, err := part.col.ReadTo(physID[0], out)
+	if !found {
+		part.flagDangling(id, physID[0])
+		return 0, dberr.New(dberr.ErrorNoDoc, id)
+	}
+	part.touch(id)
+	return n, err
+}
+
 // Find and retrieve a document by ID.
 func (part *Partition) Read(id int) ([]byte, error) {
 	physID := part.lookup.Get(id, 1)
 
 	if len(physID) == 0 {
+		if part.cold != nil {
+			return part.cold.Read(id)
+		}
 		return nil, dberr.New(dberr.ErrorNoDoc, id)
 	}
 
 	data := part.col.Read(physID[0])
 
 	if data == nil {
+		part.flagDangling(id, physID[0])
 		return nil, dberr.New(dberr.ErrorNoDoc, id)
 	}
 
+	part.touch(id)
 	return data, nil
 }
 
-// Update a document.
+// Return whether the document exists, without reading it.
+func (part *Partition) Has(id int) bool {
+	if len(part.lookup.Get(id, 1)) > 0 {
+		return true
+	}
+	return part.cold != nil && part.cold.Has(id)
+}
+
+// Update a document. A document in the cold tier is moved back into the hot tier.
 func (part *Partition) Update(id int, data []byte) (err error) {
+	part.repairLookup()
 	physID := part.lookup.Get(id, 1)
 	if len(physID) == 0 {
+		if part.cold != nil && len(part.cold.lookup.Get(id, 1)) > 0 {
+			if _, err = part.Insert(id, data); err != nil {
+				return
+			}
+			return part.cold.Delete(id)
+		}
 		return dberr.New(dberr.ErrorNoDoc, id)
 	}
 	newID, err := part.col.Update(physID[0], data)
-	if err != nil {
+	if dberr.Type(err) == dberr.ErrorNoDoc {
+		part.flagDangling(id, physID[0])
+		return
+	} else if err != nil {
 		return
 	}
 	if newID != physID[0] {
 		part.lookup.Remove(id, physID[0])
 		part.lookup.Put(id, newID)
 	}
+	part.touch(id)
 	return
 }
 
@@ -117,12 +211,57 @@ func (part *Partition) UnlockUpdate(id int) {
 
 // Delete a document.
 func (part *Partition) Delete(id int) (err error) {
+	part.repairLookup()
 	physID := part.lookup.Get(id, 1)
 	if len(physID) == 0 {
+		if part.cold != nil {
+			return part.cold.Delete(id)
+		}
 		return dberr.New(dberr.ErrorNoDoc, id)
 	}
 	part.col.Delete(physID[0])
 	part.lookup.Remove(id, physID[0])
+	part.forget(id)
+	return
+}
+
+/*
+Move documents not accessed (inserted, read, or updated) within the idle duration from the hot tier into the cold tier,
+return the number of documents moved. Access times are kept in memory, documents not accessed since the partition was
+opened count as accessed at that time. Do nothing if there is no cold tier. The caller must place the write lock of
+DataLock.
+*/
+func (part *Partition) MigrateCold(idle time.Duration) (moved int, err error) {
+	if part.cold == nil {
+		return
+	}
+	part.repairLookup()
+	deadline := time.Now().Add(-idle).Unix()
+	ids, physIDs := part.lookup.GetPartition(0, 1)
+	for i, id := range ids {
+		part.accessLock.Lock()
+		accessed, tracked := part.access[id]
+		part.accessLock.Unlock()
+		if !tracked {
+			accessed = part.opened
+		}
+		if accessed > deadline {
+			continue
+		}
+		doc := part.col.Read(physIDs[i])
+		if doc == nil {
+			part.flagDangling(id, physIDs[i])
+			continue
+		}
+		// Leave out the padding, otherwise the document room doubles upon every move
+		if _, err = part.cold.Insert(id, bytes.TrimRight(doc, " ")); err != nil {
+			return
+		}
+		part.col.Delete(physIDs[i])
+		part.lookup.Remove(id, physIDs[i])
+		part.forget(id)
+		moved++
+	}
 	return
 }
 
@@ -131,17 +270,110 @@ func (part *Partition) ForEachDoc(partNum, totalPart int, fun func(id int, doc [
 	ids, physIDs := part.lookup.GetPartition(partNum, totalPart)
 	for i, id := range ids {
 		data := part.col.Read(physIDs[i])
-		if data != nil {
-			if !fun(id, data) {
-				return false
-			}
+		if data == nil {
+			part.flagDangling(id, physIDs[i])
+		} else if !fun(id, data) {
+			return false
 		}
 	}
+	if part.cold != nil {
+		return part.cold.ForEachDoc(partNum, totalPart, fun)
+	}
 	return true
 }
 
-// Return approximate number of documents in the partition.
+// Record a lookup entry found pointing at invalid document data, and report it as corruption.
+func (part *Partition) flagDangling(id, physID int) {
+	part.danglingLock.Lock()
+	_, flagged := part.dangling[id]
+	part.dangling[id] = physID
+	part.danglingLock.Unlock()
+	if !flagged && part.lookup != nil {
+		ReportCorruption(CorruptionEvent{Collection: collectionOf(part.lookup.Path), File: part.lookup.Path, Offset: -1, Kind: CorruptDanglingLookup})
+	}
+}
+
+// Return IDs of documents whose lookup entries are found pointing at invalid document data and not removed yet.
+func (part *Partition) Dangling() []int {
+	part.danglingLock.Lock()
+	defer part.danglingLock.Unlock()
+	ids := make([]int, 0, len(part.dangling))
+	for id := range part.dangling {
+		ids = append(ids, id)
+	}
+	if part.cold != nil {
+		ids = append(ids, part.cold.Dangling()...)
+	}
+	return ids
+}
+
+/*
+Remove lookup entries found pointing at invalid document data, return IDs of the documents removed. An entry is
+checked again before removal, in case it has been repaired (e.g. by updating the document) meanwhile. The caller must
+place the write lock of DataLock.
+*/
+func (part *Partition) RemoveDangling() (ids []int) {
+	part.danglingLock.Lock()
+	dangling := part.dangling
+	part.dangling = make(map[int]int)
+	part.danglingLock.Unlock()
+	for id, physID := range dangling {
+		if part.col.Read(physID) != nil {
+			continue
+		}
+		for _, entry := range part.lookup.Get(id, 0) {
+			if entry == physID {
+				part.lookup.Remove(id, physID)
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	if len(ids) > 0 {
+		tdlog.Noticef("Removed %d dangling lookup entries from %s", len(ids), part.lookup.Path)
+	}
+	if part.cold != nil {
+		ids = append(ids, part.cold.RemoveDangling()...)
+	}
+	return
+}
+
+// Remove dangling lookup entries if the configuration asks for it. The caller must place the write lock of DataLock.
+func (part *Partition) repairLookup() {
+	if part.RepairLookup {
+		part.RemoveDangling()
+	}
+}
+
+// Return IDs of all documents in the partition.
+func (part *Partition) IDs() []int {
+	ids, _ := part.lookup.GetPartition(0, 1)
+	if part.cold != nil {
+		ids = append(ids, part.cold.IDs()...)
+	}
+	return ids
+}
+
+// Return IDs of documents in a part (partNum of totalPart) of the lookup table; documents are spread over the parts
+// evenly, as their IDs are random.
+func (part *Partition) IDsInRange(partNum, totalPart int) []int {
+	ids, _ := part.lookup.GetPartition(partNum, totalPart)
+	if part.cold != nil {
+		ids = append(ids, part.cold.IDsInRange(partNum, totalPart)...)
+	}
+	return ids
+}
+
+// Return approximate number of documents in the partition, including those in the cold tier.
 func (part *Partition) ApproxDocCount() int {
+	if part.cold != nil {
+		return part.hotDocCount() + part.cold.ApproxDocCount()
+	}
+	return part.hotDocCount()
+}
+
+// Return approximate number of documents in the lookup table.
+func (part *Partition) hotDocCount() int {
 	totalPart := 24 // not magic; a larger number makes estimation less accurate, but improves performance
 	for {
 		keys, _ := part.lookup.GetPartition(0, totalPart)
@@ -157,7 +389,34 @@ func (part *Partition) ApproxDocCount() int {
 	}
 }
 
-// Clear data file and lookup hash table.
+// Return the document data file and the ID lookup table file of the partition, e.g. for verifying their checksums.
+// The files are guarded by DataLock.
+func (part *Partition) Files() []*DataFile {
+	files := []*DataFile{part.col.DataFile, part.lookup.DataFile}
+	if part.cold != nil {
+		files = append(files, part.cold.Files()...)
+	}
+	return files
+}
+
+// Return the size of data file in use, and the space taken by deleted documents within it (reclaimed by scrubbing the
+// collection). The space is counted by going through all document headers. The caller must place read lock.
+func (part *Partition) DataUsage() (used, deleted int) {
+	part.col.ScanRaw(func(_ int, validity byte, raw []byte) bool {
+		if validity == 0 {
+			deleted += DocHeader + len(raw)
+		}
+		return true
+	})
+	used = part.col.Used
+	if part.cold != nil {
+		coldUsed, coldDeleted := part.cold.DataUsage()
+		used, deleted = used+coldUsed, deleted+coldDeleted
+	}
+	return
+}
+
+// Clear data file and lookup hash table, as well as those of the cold tier.
 func (part *Partition) Clear() error {
 
 	var err error
@@ -174,6 +433,15 @@ func (part *Partition) Clear() error {
 		err = dberr.New(dberr.ErrorIO)
 	}
 
+	part.accessLock.Lock()
+	part.access = make(map[int]int64)
+	part.accessLock.Unlock()
+	if part.cold != nil {
+		if e := part.cold.Clear(); e != nil {
+			err = e
+		}
+	}
+
 	return err
 }
 
@@ -190,5 +458,10 @@ func (part *Partition) Close() error {
 		tdlog.CritNoRepeat("Failed to close %s: %v", part.lookup.Path, e)
 		err = dberr.New(dberr.ErrorIO)
 	}
+	if part.cold != nil {
+		if e := part.cold.Close(); e != nil {
+			err = e
+		}
+	}
 	return err
 }
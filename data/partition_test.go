@@ -304,3 +304,156 @@ func TestClose(t *testing.T) {
 		t.Error("Expected error after call close")
 	}
 }
+
+func TestDanglingLookup(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	var events []CorruptionEvent
+	SetCorruptionHandler(func(event CorruptionEvent) { events = append(events, event) })
+	defer SetCorruptionHandler(nil)
+	d := defaultConfig()
+	part, err := d.OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	for id := 1; id <= 3; id++ {
+		if _, err = part.Insert(id, []byte("doc")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Make the lookup entries of documents 1 and 2 dangle
+	for _, id := range []int{1, 2} {
+		part.col.Delete(part.lookup.Get(id, 1)[0])
+	}
+	if _, err := part.Read(1); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	part.ForEachDoc(0, 1, func(int, []byte) bool { return true })
+	if dangling := part.Dangling(); len(dangling) != 2 {
+		t.Fatal(dangling)
+	} else if len(events) != 2 || events[0].Kind != CorruptDanglingLookup || events[0].File != htPath {
+		t.Fatal(events)
+	}
+	// Only flagged without the repair option
+	if _, err = part.Insert(4, []byte("doc")); err != nil || len(part.Dangling()) != 2 || len(part.lookup.Get(1, 0)) != 1 {
+		t.Fatal(err, part.Dangling())
+	}
+	// Removed upon the next write with the repair option
+	d.RepairLookup = true
+	if err = part.Update(3, []byte("doc")); err != nil {
+		t.Fatal(err)
+	} else if len(part.Dangling()) != 0 || len(part.lookup.Get(1, 0)) != 0 || len(part.lookup.Get(2, 0)) != 0 {
+		t.Fatal(part.Dangling())
+	} else if ids := part.IDs(); len(ids) != 2 {
+		t.Fatal(ids)
+	}
+	// An entry repaired meanwhile is left alone
+	part.flagDangling(3, part.lookup.Get(3, 1)[0])
+	if ids := part.RemoveDangling(); len(ids) != 0 || len(part.lookup.Get(3, 0)) != 1 {
+		t.Fatal(ids)
+	}
+}
+
+func TestDataUsage(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	part, err := defaultConfig().OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	for id := 0; id < 10; id++ {
+		if _, err = part.Insert(id, []byte("document")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	used, deleted := part.DataUsage()
+	if used == 0 || deleted != 0 {
+		t.Fatal(used, deleted)
+	}
+	if err = part.Delete(3); err != nil {
+		t.Fatal(err)
+	}
+	// A deleted document takes its header and room
+	if usedAfter, deleted := part.DataUsage(); usedAfter != used || deleted != used/10 {
+		t.Fatal(usedAfter, deleted)
+	}
+}
+
+func TestColdTier(t *testing.T) {
+	paths := []string{"/tmp/tiedot_test_col", "/tmp/tiedot_test_ht", "/tmp/tiedot_test_cold_col", "/tmp/tiedot_test_cold_ht"}
+	for _, p := range paths {
+		os.Remove(p)
+		defer os.Remove(p)
+	}
+	d := defaultConfig()
+	part, err := d.OpenPartition(paths[0], paths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	if moved, err := part.MigrateCold(0); err != nil || moved != 0 || part.HasCold() {
+		t.Fatal(moved, err)
+	} else if err := part.OpenCold(paths[2], paths[3]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := part.Insert(i, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Documents accessed within the idle duration stay
+	if moved, err := part.MigrateCold(time.Hour); err != nil || moved != 0 {
+		t.Fatal(moved, err)
+	} else if moved, err := part.MigrateCold(0); err != nil || moved != 3 {
+		t.Fatal(moved, err)
+	} else if len(part.lookup.Get(0, 0)) != 0 || len(part.cold.lookup.Get(0, 0)) != 1 {
+		t.Fatal("not moved")
+	}
+	// Read from either tier
+	if doc, err := part.Read(1); err != nil || string(doc) != "1 " {
+		t.Fatal(doc, err)
+	} else if len(part.IDs()) != 3 || len(part.Files()) != 4 {
+		t.Fatal(part.IDs())
+	}
+	seen := 0
+	part.ForEachDoc(0, 1, func(id int, doc []byte) bool {
+		seen++
+		return true
+	})
+	if seen != 3 {
+		t.Fatal(seen)
+	}
+	// Update moves the document back into hot tier
+	if err := part.Update(1, []byte("one")); err != nil {
+		t.Fatal(err)
+	} else if len(part.lookup.Get(1, 0)) != 1 || len(part.cold.lookup.Get(1, 0)) != 0 {
+		t.Fatal("not moved back")
+	} else if doc, err := part.Read(1); err != nil || string(doc) != "one   " {
+		t.Fatal(doc, err)
+	}
+	// Delete from either tier
+	if err := part.Delete(1); err != nil {
+		t.Fatal(err)
+	} else if err := part.Delete(2); err != nil {
+		t.Fatal(err)
+	} else if err := part.Delete(2); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if ids := part.IDs(); len(ids) != 1 || ids[0] != 0 {
+		t.Fatal(ids)
+	}
+	if err := part.Clear(); err != nil {
+		t.Fatal(err)
+	} else if len(part.IDs()) != 0 {
+		t.Fatal(part.IDs())
+	}
+}
@@ -0,0 +1,106 @@
+// Count-min sketch of hash table keys.
+//
+// The sketch estimates how many entries a key has without following bucket
+// chains, and how many distinct keys there are. Counters are decremented when
+// entries are removed, so estimates stay accurate as the table changes; an
+// estimate is never below the actual number of entries.
+
+package data
+
+import "math"
+
+const (
+	SketchWidth = 2048 // SketchWidth is the number of counters in each row of a hash table key sketch.
+	SketchDepth = 4    // SketchDepth is the number of rows (independent hash functions) of a hash table key sketch.
+)
+
+// Seeds of the hash function of each sketch row.
+var sketchSeeds = [SketchDepth]uint64{0x9e3779b97f4a7c15, 0xbf58476d1ce4e5b9, 0x94d049bb133111eb, 0xd6e8feb86659fd93}
+
+type keySketch struct {
+	cells   [SketchDepth][SketchWidth]int32
+	entries int // Total number of entries
+}
+
+// Build a sketch of all entries of the hash table.
+func newKeySketch(ht *HashTable) *keySketch {
+	sketch := new(keySketch)
+	keys, _ := ht.GetPartition(0, 1)
+	for _, key := range keys {
+		sketch.add(key, 1)
+	}
+	return sketch
+}
+
+// Return the counter of the key in the row.
+func (sketch *keySketch) cell(row, key int) *int32 {
+	// Keys of numbers differ in high bits only, mix all bits into the low ones (MurmurHash3 finalizer)
+	h := uint64(key) ^ sketchSeeds[row]
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return &sketch.cells[row][h%SketchWidth]
+}
+
+func (sketch *keySketch) add(key, delta int) {
+	for row := 0; row < SketchDepth; row++ {
+		*sketch.cell(row, key) += int32(delta)
+	}
+	sketch.entries += delta
+}
+
+func (sketch *keySketch) estimate(key int) int {
+	min := sketch.entries
+	for row := 0; row < SketchDepth; row++ {
+		if count := int(*sketch.cell(row, key)); count < min {
+			min = count
+		}
+	}
+	return min
+}
+
+// Estimate the number of distinct keys by the fraction of zero counters in the first row (linear counting).
+func (sketch *keySketch) distinct() int {
+	zeros := 0
+	for _, count := range sketch.cells[0] {
+		if count == 0 {
+			zeros++
+		}
+	}
+	if zeros == SketchWidth {
+		return 0
+	} else if zeros == 0 {
+		// Saturated, the estimate is merely a lower bound
+		zeros = 1
+	}
+	estimate := int(SketchWidth*math.Log(float64(SketchWidth)/float64(zeros)) + 0.5)
+	if estimate > sketch.entries {
+		estimate = sketch.entries
+	} else if estimate < 1 {
+		estimate = 1
+	}
+	return estimate
+}
+
+// Return the sketch of the hash table, build it upon first use.
+func (ht *HashTable) keySketch() *keySketch {
+	ht.sketchLock.Lock()
+	defer ht.sketchLock.Unlock()
+	if ht.sketch == nil {
+		ht.sketch = newKeySketch(ht)
+	}
+	return ht.sketch
+}
+
+// Return the estimated number of entries of the key, which is never below the actual number. Estimates come from a
+// sketch of the keys, built upon first use and maintained afterwards. The caller must place (read) lock.
+func (ht *HashTable) EstimateCount(key int) int {
+	return ht.keySketch().estimate(key)
+}
+
+// Return the estimated number of distinct keys. The caller must place (read) lock.
+func (ht *HashTable) EstimateDistinct() int {
+	return ht.keySketch().distinct()
+}
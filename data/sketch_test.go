@@ -0,0 +1,61 @@
+package data
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEstimateCount(t *testing.T) {
+	tmp := "/tmp/tiedot_test_sketch"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	ht, err := defaultConfig().OpenHashTable(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ht.Close()
+	if ht.EstimateCount(1) != 0 || ht.EstimateDistinct() != 0 {
+		t.Fatal("Not empty")
+	}
+	ht.sketch = nil
+	// Key i has i entries
+	for key := 1; key <= 100; key++ {
+		for val := 0; val < key; val++ {
+			ht.Put(key, val)
+		}
+	}
+	// The sketch is built from existing entries, then maintained
+	for key := 1; key <= 100; key++ {
+		if estimate := ht.EstimateCount(key); estimate < key {
+			t.Fatal(key, estimate)
+		}
+	}
+	for key := 1; key <= 100; key++ {
+		ht.Remove(key, 0)
+		ht.Remove(key, 1000)
+		ht.Put(key+1000, 0)
+	}
+	exact := 0
+	for key := 1; key <= 100; key++ {
+		estimate := ht.EstimateCount(key)
+		if estimate < key-1 {
+			t.Fatal(key, estimate)
+		} else if estimate == key-1 {
+			exact++
+		}
+		if estimate = ht.EstimateCount(key + 1000); estimate < 1 {
+			t.Fatal(key, estimate)
+		}
+	}
+	if exact < 95 {
+		t.Fatal("Estimates are too far off", exact)
+	}
+	if distinct := ht.EstimateDistinct(); distinct < 190 || distinct > 210 {
+		t.Fatal(distinct)
+	}
+	if err := ht.Clear(); err != nil {
+		t.Fatal(err)
+	} else if ht.EstimateCount(1001) != 0 || ht.EstimateDistinct() != 0 {
+		t.Fatal("Not cleared")
+	}
+}
@@ -0,0 +1,193 @@
+// Sorted index of hash table entries.
+//
+// Hash table buckets scatter the keys, hence looking for the entries of a key
+// range would have to visit every entry. The sorted index keeps the entries
+// ordered by key (then value) in a two-level B+tree: a sequence of leaf
+// blocks, each holding at most SortedBlockSize ordered entries that precede
+// those of the next block.
+
+package data
+
+import "sort"
+
+// SortedBlockSize is the maximum number of entries in a leaf block of a sorted index.
+const SortedBlockSize = 256
+
+type sortedEntry struct {
+	key, val int
+}
+
+// Return true if entry a comes before entry b.
+func (a sortedEntry) less(b sortedEntry) bool {
+	return a.key < b.key || a.key == b.key && a.val < b.val
+}
+
+// SortedIndex holds key-value entries ordered by key, enabling lookup of key ranges.
+type SortedIndex struct {
+	blocks [][]sortedEntry
+	size   int
+}
+
+// Return a new empty sorted index.
+func NewSortedIndex() *SortedIndex {
+	return new(SortedIndex)
+}
+
+// Return the position of the first entry that does not come before the entry; the block number is len(blocks) if
+// there is no such entry.
+func (idx *SortedIndex) search(entry sortedEntry) (block, pos int) {
+	block = sort.Search(len(idx.blocks), func(i int) bool {
+		leaf := idx.blocks[i]
+		return !leaf[len(leaf)-1].less(entry)
+	})
+	if block < len(idx.blocks) {
+		leaf := idx.blocks[block]
+		pos = sort.Search(len(leaf), func(i int) bool {
+			return !leaf[i].less(entry)
+		})
+	}
+	return
+}
+
+// Store the entry, unless it is already stored.
+func (idx *SortedIndex) Put(key, val int) {
+	entry := sortedEntry{key, val}
+	if len(idx.blocks) == 0 {
+		idx.blocks = [][]sortedEntry{{entry}}
+		idx.size = 1
+		return
+	}
+	block, pos := idx.search(entry)
+	if block == len(idx.blocks) {
+		block--
+		pos = len(idx.blocks[block])
+	} else if idx.blocks[block][pos] == entry {
+		return
+	}
+	leaf := append(idx.blocks[block], sortedEntry{})
+	copy(leaf[pos+1:], leaf[pos:])
+	leaf[pos] = entry
+	idx.blocks[block] = leaf
+	idx.size++
+	// Split a full block in halves
+	if len(leaf) > SortedBlockSize {
+		half := len(leaf) / 2
+		right := append(make([]sortedEntry, 0, SortedBlockSize+1), leaf[half:]...)
+		idx.blocks[block] = leaf[:half:half]
+		idx.blocks = append(idx.blocks, nil)
+		copy(idx.blocks[block+2:], idx.blocks[block+1:])
+		idx.blocks[block+1] = right
+	}
+}
+
+// Remove the entry if it is stored.
+func (idx *SortedIndex) Remove(key, val int) {
+	entry := sortedEntry{key, val}
+	block, pos := idx.search(entry)
+	if block == len(idx.blocks) || idx.blocks[block][pos] != entry {
+		return
+	}
+	leaf := idx.blocks[block]
+	idx.blocks[block] = append(leaf[:pos], leaf[pos+1:]...)
+	idx.size--
+	if len(idx.blocks[block]) == 0 {
+		idx.blocks = append(idx.blocks[:block], idx.blocks[block+1:]...)
+	}
+}
+
+// Return the number of entries.
+func (idx *SortedIndex) Len() int {
+	return idx.size
+}
+
+// Call fun on the entries of keys within [from, to] in ascending order of key then value, until fun returns false.
+func (idx *SortedIndex) Range(from, to int, fun func(key, val int) (moveOn bool)) {
+	minVal := -int(^uint(0)>>1) - 1
+	for block, pos := idx.search(sortedEntry{from, minVal}); block < len(idx.blocks); block, pos = block+1, 0 {
+		for _, entry := range idx.blocks[block][pos:] {
+			if entry.key > to || !fun(entry.key, entry.val) {
+				return
+			}
+		}
+	}
+}
+
+// Call fun on the entries of keys within [from, to] in descending order of key then value, until fun returns false.
+func (idx *SortedIndex) RangeDesc(from, to int, fun func(key, val int) (moveOn bool)) {
+	if len(idx.blocks) == 0 {
+		return
+	}
+	last := sortedEntry{to, int(^uint(0) >> 1)}
+	block, pos := idx.search(last)
+	if block == len(idx.blocks) {
+		block--
+		pos = len(idx.blocks[block])
+	} else if idx.blocks[block][pos] == last {
+		pos++
+	}
+	for ; block >= 0; block-- {
+		leaf := idx.blocks[block]
+		for i := pos - 1; i >= 0; i-- {
+			if leaf[i].key < from || !fun(leaf[i].key, leaf[i].val) {
+				return
+			}
+		}
+		if block > 0 {
+			pos = len(idx.blocks[block-1])
+		}
+	}
+}
+
+// Build a sorted index of all entries of the hash table.
+func newSortedIndex(ht *HashTable) *SortedIndex {
+	keys, vals := ht.GetPartition(0, 1)
+	entries := make([]sortedEntry, len(keys))
+	for i := range keys {
+		entries[i] = sortedEntry{keys[i], vals[i]}
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].less(entries[b])
+	})
+	// Leave room in every block for insertions
+	idx := &SortedIndex{size: len(entries)}
+	for len(entries) > 0 {
+		n := SortedBlockSize / 2
+		if n > len(entries) {
+			n = len(entries)
+		}
+		idx.blocks = append(idx.blocks, append(make([]sortedEntry, 0, SortedBlockSize+1), entries[:n]...))
+		entries = entries[n:]
+	}
+	return idx
+}
+
+// Return the sorted index of the hash table, build it upon first use.
+func (ht *HashTable) sortedIndex() *SortedIndex {
+	ht.sortedLock.Lock()
+	defer ht.sortedLock.Unlock()
+	if ht.sorted == nil {
+		ht.sorted = newSortedIndex(ht)
+	}
+	return ht.sorted
+}
+
+// Return the entries of keys within [from, to], ordered by key then value. Entries come from a sorted index of the
+// hash table, built upon first use and maintained afterwards. The caller must place (read) lock.
+func (ht *HashTable) Range(from, to int) (keys, vals []int) {
+	ht.sortedIndex().Range(from, to, func(key, val int) bool {
+		keys = append(keys, key)
+		vals = append(vals, val)
+		return true
+	})
+	return
+}
+
+// Call fun on the entries of keys within [from, to] ordered by key then value, descending if desc is set, until fun
+// returns false. The caller must place (read) lock.
+func (ht *HashTable) RangeFunc(from, to int, desc bool, fun func(key, val int) (moveOn bool)) {
+	if desc {
+		ht.sortedIndex().RangeDesc(from, to, fun)
+	} else {
+		ht.sortedIndex().Range(from, to, fun)
+	}
+}
@@ -0,0 +1,107 @@
+package data
+
+import (
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestSortedIndex(t *testing.T) {
+	idx := NewSortedIndex()
+	// Mirror the index in a set of entries
+	entries := make(map[sortedEntry]struct{})
+	for i := 0; i < 20000; i++ {
+		key, val := rand.Intn(1000)-500, rand.Intn(50)
+		if rand.Intn(3) == 0 {
+			idx.Remove(key, val)
+			delete(entries, sortedEntry{key, val})
+		} else {
+			idx.Put(key, val)
+			entries[sortedEntry{key, val}] = struct{}{}
+		}
+	}
+	if idx.Len() != len(entries) {
+		t.Fatal(idx.Len(), len(entries))
+	}
+	for _, bounds := range [][2]int{{-1000, 1000}, {-10, 10}, {0, 0}, {499, 600}, {10, -10}} {
+		var expected []sortedEntry
+		for entry := range entries {
+			if entry.key >= bounds[0] && entry.key <= bounds[1] {
+				expected = append(expected, entry)
+			}
+		}
+		sort.Slice(expected, func(a, b int) bool {
+			return expected[a].less(expected[b])
+		})
+		var got []sortedEntry
+		idx.Range(bounds[0], bounds[1], func(key, val int) bool {
+			got = append(got, sortedEntry{key, val})
+			return true
+		})
+		if len(got) != len(expected) {
+			t.Fatal(bounds, len(got), len(expected))
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Fatal(bounds, i, got[i], expected[i])
+			}
+		}
+		got = got[:0]
+		idx.RangeDesc(bounds[0], bounds[1], func(key, val int) bool {
+			got = append(got, sortedEntry{key, val})
+			return true
+		})
+		if len(got) != len(expected) {
+			t.Fatal(bounds, len(got), len(expected))
+		}
+		for i := range got {
+			if got[i] != expected[len(expected)-1-i] {
+				t.Fatal(bounds, i, got[i], expected[len(expected)-1-i])
+			}
+		}
+	}
+	// Stop early
+	visited := 0
+	idx.Range(-1000, 1000, func(key, val int) bool {
+		visited++
+		return visited < 3
+	})
+	if visited != 3 {
+		t.Fatal(visited)
+	}
+}
+
+func TestHashTableRange(t *testing.T) {
+	tmp := "/tmp/tiedot_test_sorted"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	ht, err := defaultConfig().OpenHashTable(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ht.Close()
+	for key := 0; key < 1000; key++ {
+		ht.Put(key, key*10)
+	}
+	// The sorted index is built from existing entries, then maintained
+	if keys, vals := ht.Range(10, 12); len(keys) != 3 || keys[0] != 10 || vals[2] != 120 {
+		t.Fatal(keys, vals)
+	}
+	ht.Remove(11, 110)
+	ht.Put(11, 1)
+	ht.Put(12, 2)
+	if keys, vals := ht.Range(10, 12); len(keys) != 4 || keys[1] != 11 || vals[1] != 1 || vals[2] != 2 || vals[3] != 120 {
+		t.Fatal(keys, vals)
+	}
+	ht.Incr(10, 5)
+	if keys, vals := ht.Range(10, 10); len(keys) != 1 || vals[0] != 105 {
+		t.Fatal(keys, vals)
+	}
+	if err := ht.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := ht.Range(0, 1000); len(keys) != 0 {
+		t.Fatal(keys)
+	}
+}
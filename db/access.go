@@ -0,0 +1,152 @@
+// Sampled document access statistics.
+
+package db
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DocAccess is the estimated number of reads and updates of a document, see Col.TrackAccess.
+type DocAccess struct {
+	ID      int
+	Reads   int64
+	Updates int64
+}
+
+// AccessStats sums up document access statistics of a collection, see Col.TrackAccess.
+type AccessStats struct {
+	Docs    int       // Number of documents with accesses counted
+	Reads   int64     // Estimated number of document reads
+	Updates int64     // Estimated number of document updates
+	Since   time.Time // When tracking started
+}
+
+// accessTracker counts a sample of document reads and updates of a collection.
+type accessTracker struct {
+	seen   int64 // Number of accesses seen, sampled or not (atomic)
+	every  int64 // One access in every this many is counted, as this many accesses
+	since  time.Time
+	lock   *sync.Mutex
+	counts map[int]*DocAccess
+}
+
+/*
+Start counting reads (Read and ReadTo) and updates of documents of the collection, replacing the counters tracked so
+far. To limit the overhead, one access in every sampleEvery accesses is counted, as sampleEvery accesses; 1 counts every
+access. 0 stops tracking and forgets the counters. Counters are kept in memory, and query evaluation does not count as
+document reads.
+*/
+func (col *Col) TrackAccess(sampleEvery int) error {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err := col.checkFlags(0); err != nil {
+		return err
+	} else if sampleEvery < 0 {
+		return fmt.Errorf("Sample rate %d must not be negative", sampleEvery)
+	} else if sampleEvery == 0 {
+		col.access.Store((*accessTracker)(nil))
+		return nil
+	}
+	col.access.Store(&accessTracker{every: int64(sampleEvery), since: time.Now(), lock: new(sync.Mutex), counts: make(map[int]*DocAccess)})
+	return nil
+}
+
+// Return the access tracker of the collection, or nil if accesses are not tracked.
+func (col *Col) accessTracker() *accessTracker {
+	tracker, _ := col.access.Load().(*accessTracker)
+	return tracker
+}
+
+// Count a read or update of the document, if accesses are tracked and the access is sampled.
+func (col *Col) countAccess(id int, update bool) {
+	tracker := col.accessTracker()
+	if tracker == nil || atomic.AddInt64(&tracker.seen, 1)%tracker.every != 0 {
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	count, exists := tracker.counts[id]
+	if !exists {
+		count = &DocAccess{ID: id}
+		tracker.counts[id] = count
+	}
+	if update {
+		count.Updates += tracker.every
+	} else {
+		count.Reads += tracker.every
+	}
+}
+
+// Forget the access counters of a deleted document.
+func (col *Col) forgetAccess(id int) {
+	if tracker := col.accessTracker(); tracker != nil {
+		tracker.lock.Lock()
+		delete(tracker.counts, id)
+		tracker.lock.Unlock()
+	}
+}
+
+// Forget the access counters of all documents, e.g. upon truncating the collection.
+func (col *Col) forgetAllAccess() {
+	if tracker := col.accessTracker(); tracker != nil {
+		tracker.lock.Lock()
+		tracker.counts = make(map[int]*DocAccess)
+		tracker.lock.Unlock()
+	}
+}
+
+// Return the sum of document access counters of the collection, zero if accesses are not tracked.
+func (col *Col) AccessStats() (stats AccessStats) {
+	tracker := col.accessTracker()
+	if tracker == nil {
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	stats.Docs, stats.Since = len(tracker.counts), tracker.since
+	for _, count := range tracker.counts {
+		stats.Reads += count.Reads
+		stats.Updates += count.Updates
+	}
+	return
+}
+
+// Return the access counters of a document, zero if the access of the document has not been counted.
+func (col *Col) AccessOf(id int) DocAccess {
+	if tracker := col.accessTracker(); tracker != nil {
+		tracker.lock.Lock()
+		defer tracker.lock.Unlock()
+		if count, exists := tracker.counts[id]; exists {
+			return *count
+		}
+	}
+	return DocAccess{ID: id}
+}
+
+// Return access counters of up to n most accessed (read and updated) documents, the most accessed first.
+func (col *Col) MostAccessed(n int) []DocAccess {
+	tracker := col.accessTracker()
+	if tracker == nil {
+		return []DocAccess{}
+	}
+	tracker.lock.Lock()
+	ret := make([]DocAccess, 0, len(tracker.counts))
+	for _, count := range tracker.counts {
+		ret = append(ret, *count)
+	}
+	tracker.lock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if a, b := ret[i].Reads+ret[i].Updates, ret[j].Reads+ret[j].Updates; a != b {
+			return a > b
+		}
+		return ret[i].ID < ret[j].ID
+	})
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTrackAccess(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 0, 3)
+	for i := 0; i < 3; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// Not tracked by default
+	if _, err := col.Read(ids[0]); err != nil {
+		t.Fatal(err)
+	} else if stats := col.AccessStats(); stats.Docs != 0 || len(col.MostAccessed(10)) != 0 {
+		t.Fatal(stats)
+	} else if err := col.TrackAccess(-1); err == nil {
+		t.Fatal("did not error")
+	} else if err := col.TrackAccess(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := col.Read(ids[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := col.ReadTo(ids[0], ioutil.Discard); err != nil {
+		t.Fatal(err)
+	} else if err := col.Update(ids[0], map[string]interface{}{"a": 10}); err != nil {
+		t.Fatal(err)
+	} else if err := col.Update(ids[2], map[string]interface{}{"a": 20}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := col.AccessStats(); stats.Docs != 3 || stats.Reads != 4 || stats.Updates != 2 || stats.Since.IsZero() {
+		t.Fatal(stats)
+	} else if access := col.AccessOf(ids[0]); access.Reads != 1 || access.Updates != 1 {
+		t.Fatal(access)
+	} else if top := col.MostAccessed(2); len(top) != 2 || top[0].ID != ids[1] || top[0].Reads != 3 || top[1].ID != ids[0] {
+		t.Fatal(top)
+	}
+	// Deleted documents are forgotten
+	if err := col.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	} else if access := col.AccessOf(ids[1]); access.Reads != 0 || access.ID != ids[1] {
+		t.Fatal(access)
+	}
+	// Sampled accesses are counted as many
+	if err := col.TrackAccess(4); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		if _, err := col.Read(ids[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := col.AccessStats(); stats.Docs != 1 || stats.Reads != 8 {
+		t.Fatal(stats)
+	}
+	if err := db.Truncate("col"); err != nil {
+		t.Fatal(err)
+	} else if stats := col.AccessStats(); stats.Docs != 0 {
+		t.Fatal(stats)
+	} else if err := col.TrackAccess(0); err != nil {
+		t.Fatal(err)
+	} else if stats := col.AccessStats(); !stats.Since.IsZero() {
+		t.Fatal(stats)
+	}
+}
@@ -0,0 +1,223 @@
+// Admission control of heavy operations.
+
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	PRIORITY_HIGH = iota // Latency-sensitive operations, the default
+	PRIORITY_LOW         // Background operations (e.g. analytics) that give way to high priority operations
+)
+
+type callerKey struct{}
+type priorityKey struct{}
+
+// Return a copy of the context that identifies the caller of heavy operations, for the purpose of caller quotas.
+func WithCaller(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, callerKey{}, name)
+}
+
+// Return a copy of the context that runs heavy operations at the priority, PRIORITY_HIGH or PRIORITY_LOW.
+func WithPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// Return the caller name ("" if anonymous) and priority of heavy operations run by the context.
+func callerOf(ctx context.Context) (name string, priority int) {
+	name, _ = ctx.Value(callerKey{}).(string)
+	if ctxPriority, _ := ctx.Value(priorityKey{}).(int); ctxPriority == PRIORITY_LOW {
+		priority = PRIORITY_LOW
+	}
+	return
+}
+
+// callerQuota is a token bucket refilled at the rate of quota, holding at most one second worth of operations.
+type callerQuota struct {
+	perSec int
+	tokens float64
+	last   time.Time
+}
+
+// Take a token from the bucket and return true. If the bucket is empty, return false - unless mustWait is set, in which
+// case the operation goes into debt to be paid back by subsequent refills.
+func (quota *callerQuota) take(now time.Time, mustWait bool) bool {
+	quota.tokens += now.Sub(quota.last).Seconds() * float64(quota.perSec)
+	if quota.tokens > float64(quota.perSec) {
+		quota.tokens = float64(quota.perSec)
+	}
+	quota.last = now
+	if quota.tokens < 1 && !mustWait {
+		return false
+	}
+	quota.tokens--
+	return true
+}
+
+// heavyWaiter is a heavy operation waiting for its turn.
+type heavyWaiter struct {
+	priority int
+	turn     chan struct{} // Closed when the operation is admitted
+}
+
+/*
+heavyLimiter admits a limited number of heavy operations (queries, scans, scrubs) at a time, the others wait in queue.
+Waiting high priority operations are always admitted before the low priority ones, and low priority operations may be
+limited further to leave turns for high priority ones.
+*/
+type heavyLimiter struct {
+	lock       *sync.Mutex
+	maxRunning int                     // Maximum number of running operations, 0 for unlimited
+	maxLow     int                     // Maximum number of running low priority operations, 0 for no separate limit
+	maxQueue   int                     // Maximum number of waiting operations, 0 for unlimited
+	timeout    time.Duration           // Maximum time an operation waits for its turn, 0 for unlimited
+	running    [2]int                  // Number of running operations per priority
+	waiting    [2][]*heavyWaiter       // Waiting operations per priority, in order of arrival
+	quotas     map[string]*callerQuota // Caller name -> operation quota
+}
+
+func newHeavyLimiter() *heavyLimiter {
+	return &heavyLimiter{lock: new(sync.Mutex), quotas: make(map[string]*callerQuota)}
+}
+
+/*
+Limit heavy operations - queries, collection scans (ForEachDoc and alike), and scrubs - to maxRunning at a time, 0 for
+unlimited. Further operations wait for their turn; when maxQueue operations are already waiting, or the wait exceeds
+timeout, a query or scrub fails with ErrorTooBusy instead. Scans cannot fail, hence they always wait for their turn.
+0 is unlimited for maxQueue and timeout. Operations already running are not affected, and those waiting are admitted
+as the new limit allows.
+Heavy operations must not be nested, e.g. a query inside ForEachDoc, as the inner operation may wait for a turn that
+never comes.
+*/
+func (db *DB) SetHeavyLimit(maxRunning, maxQueue int, timeout time.Duration) {
+	lim := db.heavy
+	lim.lock.Lock()
+	defer lim.lock.Unlock()
+	lim.maxRunning, lim.maxQueue, lim.timeout = maxRunning, maxQueue, timeout
+	lim.dispatch()
+}
+
+// Limit low priority heavy operations (see WithPriority) to maxRunning at a time, 0 for no limit other than that of
+// SetHeavyLimit. Low priority operations beyond the limit wait for their turn just like those beyond SetHeavyLimit.
+func (db *DB) SetLowPriorityLimit(maxRunning int) {
+	lim := db.heavy
+	lim.lock.Lock()
+	defer lim.lock.Unlock()
+	lim.maxLow = maxRunning
+	lim.dispatch()
+}
+
+// Limit heavy operations of the caller (see WithCaller) to the rate per second, 0 to remove the limit. A query or
+// scrub beyond the limit fails with ErrorQuotaExceeded; a scan proceeds anyway, and its excess is charged to the
+// subsequent operations of the caller.
+func (db *DB) SetCallerQuota(caller string, perSec int) {
+	lim := db.heavy
+	lim.lock.Lock()
+	defer lim.lock.Unlock()
+	if perSec <= 0 {
+		delete(lim.quotas, caller)
+		return
+	}
+	lim.quotas[caller] = &callerQuota{perSec: perSec, tokens: float64(perSec), last: time.Now()}
+}
+
+// Return number of heavy operations waiting for their turn.
+func (db *DB) HeavyQueueDepth() int {
+	lim := db.heavy
+	lim.lock.Lock()
+	defer lim.lock.Unlock()
+	return len(lim.waiting[PRIORITY_HIGH]) + len(lim.waiting[PRIORITY_LOW])
+}
+
+// Return true if an operation of the priority may run now. The caller must place limiter lock.
+func (lim *heavyLimiter) vacant(priority int) bool {
+	if lim.maxRunning > 0 && lim.running[PRIORITY_HIGH]+lim.running[PRIORITY_LOW] >= lim.maxRunning {
+		return false
+	}
+	return priority == PRIORITY_HIGH || lim.maxLow <= 0 || lim.running[PRIORITY_LOW] < lim.maxLow
+}
+
+// Admit waiting operations while there are vacant turns, high priority ones first. The caller must place limiter lock.
+func (lim *heavyLimiter) dispatch() {
+	for _, priority := range []int{PRIORITY_HIGH, PRIORITY_LOW} {
+		for len(lim.waiting[priority]) > 0 && lim.vacant(priority) {
+			waiter := lim.waiting[priority][0]
+			lim.waiting[priority] = lim.waiting[priority][1:]
+			lim.running[priority]++
+			close(waiter.turn)
+		}
+	}
+}
+
+// Remove the operation from the waiting queue and return true, or return false if it has been admitted meanwhile.
+// The caller must place limiter lock.
+func (lim *heavyLimiter) withdraw(waiter *heavyWaiter) bool {
+	queue := lim.waiting[waiter.priority]
+	for i, w := range queue {
+		if w == waiter {
+			lim.waiting[waiter.priority] = append(queue[:i:i], queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Wait for the turn of a heavy operation and return the function that ends it. The context identifies the caller and
+priority of the operation. Unless mustWait is set, return ErrorQuotaExceeded if the caller has exceeded its quota,
+ErrorTooBusy if too many operations are waiting already or the wait times out; the context error if it is cancelled.
+*/
+func (lim *heavyLimiter) admit(ctx context.Context, mustWait bool) (done func(), err error) {
+	caller, priority := callerOf(ctx)
+	lim.lock.Lock()
+	if quota, exists := lim.quotas[caller]; exists && !quota.take(time.Now(), mustWait) {
+		lim.lock.Unlock()
+		return nil, dberr.New(dberr.ErrorQuotaExceeded, caller, quota.perSec)
+	}
+	done = func() {
+		lim.lock.Lock()
+		lim.running[priority]--
+		lim.dispatch()
+		lim.lock.Unlock()
+	}
+	// Do not overtake the operations already waiting at the same or higher priority
+	if lim.vacant(priority) && len(lim.waiting[PRIORITY_HIGH]) == 0 && (priority == PRIORITY_HIGH || len(lim.waiting[PRIORITY_LOW]) == 0) {
+		lim.running[priority]++
+		lim.lock.Unlock()
+		return
+	}
+	maxRunning, timeout := lim.maxRunning, lim.timeout
+	if !mustWait && lim.maxQueue > 0 && len(lim.waiting[PRIORITY_HIGH])+len(lim.waiting[PRIORITY_LOW]) >= lim.maxQueue {
+		lim.lock.Unlock()
+		return nil, dberr.New(dberr.ErrorTooBusy, maxRunning)
+	}
+	waiter := &heavyWaiter{priority: priority, turn: make(chan struct{})}
+	lim.waiting[priority] = append(lim.waiting[priority], waiter)
+	lim.lock.Unlock()
+	var expired <-chan time.Time
+	if !mustWait && timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-waiter.turn:
+		return
+	case <-expired:
+		err = dberr.New(dberr.ErrorTooBusy, maxRunning)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	lim.lock.Lock()
+	defer lim.lock.Unlock()
+	if !lim.withdraw(waiter) {
+		// Admitted just as the wait ended, hence go ahead
+		return done, nil
+	}
+	return nil, err
+}
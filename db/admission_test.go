@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestHeavyLimit(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if _, err := col.Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	kv, err := db.KV("kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetHeavyLimit(1, 1, 100*time.Millisecond)
+	// A scan occupies the only turn
+	scanning, release := make(chan struct{}), make(chan struct{})
+	go col.ForEachDoc(func(int, []byte) bool {
+		close(scanning)
+		<-release
+		return false
+	})
+	<-scanning
+	// The first query waits and times out, while the second is shed right away
+	waiting := make(chan error)
+	go func() {
+		waiting <- EvalQuery("all", col, &map[int]struct{}{})
+	}()
+	for db.HeavyQueueDepth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := EvalQueryDocs("all", col); dberr.Type(err) != dberr.ErrorTooBusy {
+		t.Fatal(err)
+	}
+	if err := <-waiting; dberr.Type(err) != dberr.ErrorTooBusy {
+		t.Fatal(err)
+	}
+	// A cancelled scrub stops waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.ScrubContext(ctx, "col", nil); err != context.Canceled {
+		t.Fatal(err)
+	}
+	// Key-value lookups are not heavy operations
+	if _, found, err := kv.Get("a"); err != nil || found {
+		t.Fatal(found, err)
+	}
+	// A waiting query proceeds once the scan ends
+	go func() {
+		waiting <- EvalQueryParams(map[string]interface{}{"eq": "$1", "in": []interface{}{"a"}}, []interface{}{1}, col, &map[int]struct{}{})
+	}()
+	for db.HeavyQueueDepth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if err := <-waiting; dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	db.SetHeavyLimit(0, 0, 0)
+	if err := EvalQuery("all", col, &map[int]struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPriorityAndQuota(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	low := WithPriority(context.Background(), PRIORITY_LOW)
+	db.SetHeavyLimit(1, 0, 0)
+	// While a scan occupies the only turn, a low priority query arrives before a high priority one
+	scanning, release := make(chan struct{}), make(chan struct{})
+	done, err := db.heavy.admit(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		close(scanning)
+		<-release
+		done()
+	}()
+	<-scanning
+	finished := make(chan int, 2)
+	go func() {
+		EvalQueryContext(low, "all", col, &map[int]struct{}{})
+		finished <- PRIORITY_LOW
+	}()
+	for db.HeavyQueueDepth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		EvalQuery("all", col, &map[int]struct{}{})
+		finished <- PRIORITY_HIGH
+	}()
+	for db.HeavyQueueDepth() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// The high priority query takes its turn first
+	close(release)
+	if first, second := <-finished, <-finished; first != PRIORITY_HIGH || second != PRIORITY_LOW {
+		t.Fatal(first, second)
+	}
+	// Low priority operations are limited further, high priority ones are not
+	db.SetHeavyLimit(0, 0, 0)
+	db.SetLowPriorityLimit(1)
+	done, err = db.heavy.admit(low, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(low, 10*time.Millisecond)
+	if err := EvalQueryContext(ctx, "all", col, &map[int]struct{}{}); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := EvalQuery("all", col, &map[int]struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	done()
+	if err := EvalQueryContext(low, "all", col, &map[int]struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if db.HeavyQueueDepth() != 0 {
+		t.Fatal(db.HeavyQueueDepth())
+	}
+	// A caller exceeding its quota is refused, the other callers are not affected
+	db.SetCallerQuota("analytics", 2)
+	analytics := WithCaller(low, "analytics")
+	for i := 0; i < 2; i++ {
+		if err := EvalQueryParamsContext(analytics, "all", []interface{}{}, col, &map[int]struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := EvalQueryContext(analytics, "all", col, &map[int]struct{}{}); dberr.Type(err) != dberr.ErrorQuotaExceeded {
+		t.Fatal(err)
+	}
+	if err := EvalQueryContext(WithCaller(context.Background(), "web"), "all", col, &map[int]struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	db.SetCallerQuota("analytics", 0)
+	if err := EvalQueryContext(analytics, "all", col, &map[int]struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+}
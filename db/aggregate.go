@@ -0,0 +1,358 @@
+// Aggregation of documents into groups.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	AGG_COUNT = "count" // Number of documents in the group, or of those having a value at the path if one is given
+	AGG_SUM   = "sum"   // Sum of the numbers at the path
+	AGG_MIN   = "min"   // Smallest number at the path
+	AGG_MAX   = "max"   // Largest number at the path
+	AGG_AVG   = "avg"   // Average of the numbers at the path
+)
+
+// AggregateGroup is a group of documents in aggregation result.
+type AggregateGroup struct {
+	Key    interface{}            // Value of the group-by path as seen by its index, nil for documents without a value
+	Values map[string]interface{} // Accumulated values by name, nil for min/max/avg of a group without numbers
+}
+
+// accumulator computes a named value over the documents of a group.
+type accumulator struct {
+	name string
+	op   string
+	path []string // Empty for counting all documents
+}
+
+// groupState is the accumulated values of a group on its way, one per accumulator.
+type groupState struct {
+	count []int
+	sum   []float64
+	min   []float64
+	max   []float64
+}
+
+// aggregation is a parsed aggregation pipeline.
+type aggregation struct {
+	matches []interface{} // Queries documents must match, all documents if there is none
+	groupBy []string      // Indexed path to group by, nil to put all documents into one group
+	accs    []accumulator
+}
+
+// Parse a document path given as a comma-separated string or a vector of path segments.
+func parseAggPath(spec interface{}) ([]string, error) {
+	switch path := spec.(type) {
+	case string:
+		if path == "" {
+			return nil, nil
+		}
+		return strings.Split(path, ","), nil
+	case []interface{}:
+		ret := make([]string, 0, len(path))
+		for _, seg := range path {
+			ret = append(ret, fmt.Sprint(seg))
+		}
+		if len(ret) == 0 {
+			return nil, nil
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("Expecting path as string or vector, but %v given", spec)
+}
+
+// Parse an aggregation pipeline, see Aggregate.
+func parseAggregation(pipeline interface{}) (agg aggregation, err error) {
+	stages, ok := pipeline.([]interface{})
+	if !ok || len(stages) == 0 {
+		return agg, fmt.Errorf("Expecting a vector of aggregation stages, but %v given", pipeline)
+	}
+	for i, stage := range stages {
+		expr, ok := stage.(map[string]interface{})
+		if !ok || len(expr) != 1 {
+			return agg, fmt.Errorf("Expecting aggregation stage of one operation, but %v given", stage)
+		}
+		if q, isMatch := expr["match"]; isMatch {
+			if agg.accs != nil {
+				return agg, errors.New("Aggregation stage `match` must come before `group`")
+			}
+			agg.matches = append(agg.matches, q)
+			continue
+		}
+		groupSpec, isGroup := expr["group"]
+		if !isGroup {
+			return agg, fmt.Errorf("Unknown aggregation stage %v", stage)
+		} else if i != len(stages)-1 {
+			return agg, errors.New("Aggregation stage `group` must be the last stage")
+		}
+		group, ok := groupSpec.(map[string]interface{})
+		if !ok {
+			return agg, fmt.Errorf("Expecting group specification as object, but %v given", groupSpec)
+		}
+		names := make([]string, 0, len(group))
+		for name := range group {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		agg.accs = make([]accumulator, 0, len(group))
+		for _, name := range names {
+			if name == "by" {
+				if agg.groupBy, err = parseAggPath(group[name]); err != nil {
+					return
+				}
+				continue
+			}
+			accSpec, ok := group[name].(map[string]interface{})
+			if !ok || len(accSpec) != 1 {
+				return agg, fmt.Errorf("Expecting accumulator %s of one operation, but %v given", name, group[name])
+			}
+			for op, pathSpec := range accSpec {
+				acc := accumulator{name: name, op: op}
+				if acc.path, err = parseAggPath(pathSpec); err != nil {
+					return
+				}
+				switch op {
+				case AGG_COUNT:
+				case AGG_SUM, AGG_MIN, AGG_MAX, AGG_AVG:
+					if len(acc.path) == 0 {
+						return agg, fmt.Errorf("Missing path of accumulator %s", name)
+					}
+				default:
+					return agg, fmt.Errorf("Unknown accumulator operation %s of %s", op, name)
+				}
+				agg.accs = append(agg.accs, acc)
+			}
+		}
+	}
+	if agg.accs == nil {
+		return agg, errors.New("Missing aggregation stage `group`")
+	}
+	return
+}
+
+/*
+Aggregate documents of the collection without exporting them. The pipeline is a vector of stages:
+- Zero or more {"match": QUERY} stages, documents must match all of the queries
+- One {"group": {"by": PATH, NAME: {OPERATION: PATH}, ...}} stage at last
+Documents are grouped by the values of an indexed path - as seen by the index, e.g. numbers on a string index are
+grouped by their string form. A document having several values at the path (e.g. an array) is put into the group of
+each value, documents without a value form a group of nil key. Leave out "by" to put all documents into one group.
+Each named accumulator computes a value of the group: "count" of documents (of those having a value at the path, if it
+is not empty), and "sum", "min", "max", "avg" of the numbers found at the path. Paths are comma-separated strings or
+vectors of path segments, e.g.
+
+	[{"match": {"eq": "paid", "in": ["Status"]}},
+	 {"group": {"by": "Country", "Orders": {"count": ""}, "Total": {"sum": "Amount"}, "Largest": {"max": "Amount"}}}]
+
+Partitions are aggregated in parallel. Groups are returned in order of their keys (see CompareValues).
+*/
+func Aggregate(src *Col, pipeline interface{}) (groups []AggregateGroup, err error) {
+	agg, err := parseAggregation(pipeline)
+	if err != nil {
+		return
+	}
+	done, err := src.db.heavy.admit(context.Background(), false)
+	if err != nil {
+		return
+	}
+	defer done()
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	defer src.db.logSlowQuery(pipeline, time.Now())
+	if err = src.checkFlags(COL_READ); err != nil {
+		return
+	}
+	return src.aggregate(agg)
+}
+
+// Aggregate documents by a parsed pipeline. The caller must place schema lock.
+func (col *Col) aggregate(agg aggregation) (groups []AggregateGroup, err error) {
+	idxName := strings.Join(agg.groupBy, INDEX_PATH_SEP)
+	if agg.groupBy != nil {
+		if _, indexed := col.indexPaths[idxName]; !indexed {
+			return nil, dberr.New(dberr.ErrorNeedIndex, idxName, agg.groupBy)
+		} else if _, building := col.building[idxName]; building {
+			return nil, dberr.New(dberr.ErrorIndexBuilding, agg.groupBy, agg.groupBy)
+		}
+	}
+	var matched map[int]struct{}
+	for _, q := range agg.matches {
+		result := make(map[int]struct{})
+		if matched == nil {
+			err = evalQuery(q, col, &result, false)
+		} else {
+			err = evalIntersected(q, col, matched, &result)
+		}
+		if err != nil {
+			return
+		}
+		matched = result
+	}
+	// Each partition accumulates its own groups, which are merged afterwards
+	partGroups := make([]map[interface{}]*groupState, col.db.numParts)
+	wg := new(sync.WaitGroup)
+	wg.Add(col.db.numParts)
+	for i := 0; i < col.db.numParts; i++ {
+		go func(partNum int) {
+			defer wg.Done()
+			states := make(map[interface{}]*groupState)
+			fun := func(id int, doc []byte) bool {
+				col.accumulate(agg, idxName, doc, states)
+				return true
+			}
+			part := col.parts[partNum]
+			part.DataLock.RLock()
+			defer part.DataLock.RUnlock()
+			if matched == nil {
+				part.ForEachDoc(0, 1, fun)
+			} else {
+				for id := range matched {
+					if id%col.db.numParts != partNum {
+						continue
+					} else if doc, err := part.Read(id); err == nil {
+						fun(id, doc)
+					}
+				}
+			}
+			partGroups[partNum] = states
+		}(i)
+	}
+	wg.Wait()
+	merged := make(map[interface{}]*groupState)
+	for _, states := range partGroups {
+		for key, state := range states {
+			if total, exists := merged[key]; exists {
+				total.merge(state)
+			} else {
+				merged[key] = state
+			}
+		}
+	}
+	groups = make([]AggregateGroup, 0, len(merged))
+	for key, state := range merged {
+		groups = append(groups, AggregateGroup{Key: key, Values: state.values(agg.accs)})
+	}
+	sort.Slice(groups, func(a, b int) bool {
+		return CompareValues(groups[a].Key, groups[b].Key) < 0
+	})
+	return
+}
+
+// Accumulate a document into the states of its groups.
+func (col *Col) accumulate(agg aggregation, idxName string, doc []byte, states map[interface{}]*groupState) {
+	keys := []interface{}{nil}
+	if agg.groupBy != nil {
+		if canons := col.canonicalValues(idxName, doc); len(canons) > 0 {
+			keys = canons
+		}
+	}
+	// Numbers at the path of each accumulator
+	nums := make([][]float64, len(agg.accs))
+	hasValue := make([]bool, len(agg.accs))
+	for i, acc := range agg.accs {
+		if len(acc.path) == 0 {
+			hasValue[i] = true
+			continue
+		}
+		vals, err := GetInRaw(doc, acc.path)
+		if err != nil {
+			// Skip corrupted document
+			return
+		}
+		for _, val := range vals {
+			if val == nil {
+				continue
+			}
+			hasValue[i] = true
+			if num, isNum := toFloat(val); isNum && !math.IsNaN(num) {
+				nums[i] = append(nums[i], num)
+			}
+		}
+	}
+	seen := make(map[interface{}]struct{}, len(keys))
+	for _, key := range keys {
+		if _, dup := seen[key]; dup {
+			continue
+		}
+		seen[key] = struct{}{}
+		state, exists := states[key]
+		if !exists {
+			state = newGroupState(len(agg.accs))
+			states[key] = state
+		}
+		for i, acc := range agg.accs {
+			if acc.op == AGG_COUNT {
+				if hasValue[i] {
+					state.count[i]++
+				}
+				continue
+			}
+			for _, num := range nums[i] {
+				state.count[i]++
+				state.sum[i] += num
+				state.min[i] = math.Min(state.min[i], num)
+				state.max[i] = math.Max(state.max[i], num)
+			}
+		}
+	}
+}
+
+// Return the initial state of a group with the number of accumulators.
+func newGroupState(numAccs int) *groupState {
+	state := &groupState{
+		count: make([]int, numAccs),
+		sum:   make([]float64, numAccs),
+		min:   make([]float64, numAccs),
+		max:   make([]float64, numAccs),
+	}
+	for i := 0; i < numAccs; i++ {
+		state.min[i], state.max[i] = math.Inf(1), math.Inf(-1)
+	}
+	return state
+}
+
+// Merge the state of the same group accumulated by another partition.
+func (state *groupState) merge(other *groupState) {
+	for i := range state.count {
+		state.count[i] += other.count[i]
+		state.sum[i] += other.sum[i]
+		state.min[i] = math.Min(state.min[i], other.min[i])
+		state.max[i] = math.Max(state.max[i], other.max[i])
+	}
+}
+
+// Return the accumulated values by name.
+func (state *groupState) values(accs []accumulator) map[string]interface{} {
+	ret := make(map[string]interface{}, len(accs))
+	for i, acc := range accs {
+		if acc.op == AGG_COUNT {
+			ret[acc.name] = float64(state.count[i])
+			continue
+		} else if acc.op != AGG_SUM && state.count[i] == 0 {
+			ret[acc.name] = nil
+			continue
+		}
+		switch acc.op {
+		case AGG_SUM:
+			ret[acc.name] = state.sum[i]
+		case AGG_MIN:
+			ret[acc.name] = state.min[i]
+		case AGG_MAX:
+			ret[acc.name] = state.max[i]
+		case AGG_AVG:
+			ret[acc.name] = state.sum[i] / float64(state.count[i])
+		}
+	}
+	return ret
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestAggregate(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	// Groups of several partitions are merged
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(path.Join(TEST_DATA_DIR, PART_NUM_FILE), []byte("4"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"Country"}); err != nil {
+		t.Fatal(err)
+	} else if err := col.Index([]string{"Status"}); err != nil {
+		t.Fatal(err)
+	}
+	docs := []string{
+		`{"Country": "NZ", "Status": "paid", "Amount": 10}`,
+		`{"Country": "NZ", "Status": "paid", "Amount": 30}`,
+		`{"Country": "NZ", "Status": "open", "Amount": 100}`,
+		`{"Country": "AU", "Status": "paid", "Amount": [1, 2]}`,
+		`{"Country": "AU", "Status": "paid", "Amount": "unknown"}`,
+		`{"Country": ["AU", "NZ", "NZ"], "Status": "paid", "Amount": 5}`,
+		`{"Status": "paid", "Amount": 7}`,
+	}
+	for _, doc := range docs {
+		var parsed map[string]interface{}
+		if err := json.Unmarshal([]byte(doc), &parsed); err != nil {
+			t.Fatal(err)
+		} else if _, err := col.Insert(parsed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aggregate := func(pipeline string) ([]AggregateGroup, error) {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(pipeline), &parsed); err != nil {
+			t.Fatal(err)
+		}
+		return Aggregate(col, parsed)
+	}
+	groups, err := aggregate(`[{"match": {"eq": "paid", "in": ["Status"]}},
+		{"group": {"by": "Country", "n": {"count": ""}, "amounts": {"count": "Amount"}, "total": {"sum": "Amount"},
+		"low": {"min": "Amount"}, "high": {"max": "Amount"}, "avg": {"avg": ["Amount"]}}}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []AggregateGroup{
+		{Key: nil, Values: map[string]interface{}{"n": 1.0, "amounts": 1.0, "total": 7.0, "low": 7.0, "high": 7.0, "avg": 7.0}},
+		{Key: "AU", Values: map[string]interface{}{"n": 3.0, "amounts": 3.0, "total": 8.0, "low": 1.0, "high": 5.0, "avg": 8.0 / 3}},
+		{Key: "NZ", Values: map[string]interface{}{"n": 3.0, "amounts": 3.0, "total": 45.0, "low": 5.0, "high": 30.0, "avg": 15.0}},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatal(groups)
+	}
+	// All documents in one group, and groups without numbers
+	if groups, err := aggregate(`[{"group": {"n": {"count": []}, "total": {"sum": "Nothing"}, "avg": {"avg": "Nothing"}}}]`); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(groups, []AggregateGroup{{Values: map[string]interface{}{"n": 7.0, "total": 0.0, "avg": nil}}}) {
+		t.Fatal(groups)
+	}
+	// Match stages intersect
+	if groups, err := aggregate(`[{"match": {"eq": "paid", "in": ["Status"]}}, {"match": {"eq": "NZ", "in": ["Country"]}},
+		{"group": {"by": ["Status"], "n": {"count": ""}}}]`); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(groups, []AggregateGroup{{Key: "paid", Values: map[string]interface{}{"n": 3.0}}}) {
+		t.Fatal(groups)
+	} else if groups, err := aggregate(`[{"match": {"eq": "none", "in": ["Status"]}}, {"group": {"n": {"count": ""}}}]`); err != nil || len(groups) != 0 {
+		t.Fatal(groups, err)
+	}
+	// Group-by paths must be indexed
+	if _, err := aggregate(`[{"group": {"by": "Amount", "n": {"count": ""}}}]`); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	for _, pipeline := range []string{
+		`{"group": {"n": {"count": ""}}}`,
+		`[]`,
+		`[{"match": "all"}]`,
+		`[{"group": {"n": {"count": ""}}}, {"match": "all"}]`,
+		`[{"sort": "Amount"}]`,
+		`[{"group": {"n": {"median": "Amount"}}}]`,
+		`[{"group": {"total": {"sum": ""}}}]`,
+		`[{"group": {"n": "count"}}]`,
+		`[{"group": {"by": 1, "n": {"count": ""}}}]`,
+		`[{"match": {"eq": 1}}, {"group": {"n": {"count": ""}}}]`,
+	} {
+		if _, err := aggregate(pipeline); err == nil {
+			t.Fatal("Did not error", pipeline)
+		}
+	}
+}
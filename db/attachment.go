@@ -0,0 +1,190 @@
+// Binary attachments of documents.
+
+package db
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	BLOB_FILE        = "blob_"        // Prefix of partition blob (attachment data) file name.
+	ATTACHMENTS_ATTR = "_attachments" // Document attribute referring to attachments by name.
+)
+
+// Open blob files of the partitions that have them. The caller must place schema lock.
+func (col *Col) loadBlobs() error {
+	col.blobs = make([]*data.BlobFile, col.db.numParts)
+	for i := 0; i < col.db.numParts; i++ {
+		blobPath := path.Join(col.db.path, col.name, BLOB_FILE+strconv.Itoa(i))
+		if _, err := os.Stat(blobPath); os.IsNotExist(err) {
+			continue
+		}
+		var err error
+		if col.blobs[i], err = col.db.Config.OpenBlobFile(blobPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the blob file of the partition, create the file if necessary. The caller must place partition lock.
+func (col *Col) blobFile(partNum int) (blob *data.BlobFile, err error) {
+	if col.blobs[partNum] == nil {
+		col.blobs[partNum], err = col.db.Config.OpenBlobFile(path.Join(col.db.path, col.name, BLOB_FILE+strconv.Itoa(partNum)))
+	}
+	return col.blobs[partNum], err
+}
+
+// Return the blob ID of the named attachment in the document.
+func attachmentBlob(doc map[string]interface{}, name string) (blobID int, exists bool) {
+	attachments, _ := doc[ATTACHMENTS_ATTR].(map[string]interface{})
+	ref, _ := attachments[name].(map[string]interface{})
+	if floatID, isNum := ref["blob"].(float64); isNum {
+		return int(floatID), true
+	}
+	return 0, false
+}
+
+// Delete blobs of all attachments referred to by the document. The caller must place partition lock.
+func (col *Col) deleteAttachments(partNum int, docB []byte) {
+	if col.blobs[partNum] == nil {
+		return
+	}
+	var doc map[string]interface{}
+	if json.Unmarshal(docB, &doc) != nil {
+		return
+	}
+	attachments, _ := doc[ATTACHMENTS_ATTR].(map[string]interface{})
+	for name := range attachments {
+		if blobID, exists := attachmentBlob(doc, name); exists {
+			col.blobs[partNum].Delete(blobID)
+		}
+	}
+}
+
+// Replace the attachment reference in the document, or remove it if blobID is negative; then delete the blob of the
+// previous attachment.
+func (col *Col) setAttachment(id int, name string, blobID, size int) error {
+	partNum := id % col.db.numParts
+	part := col.parts[partNum]
+	originalB, err := part.Read(id)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err = json.Unmarshal(originalB, &doc); err != nil {
+		return err
+	}
+	prevBlobID, hadPrev := attachmentBlob(doc, name)
+	attachments, _ := doc[ATTACHMENTS_ATTR].(map[string]interface{})
+	if blobID >= 0 {
+		if attachments == nil {
+			attachments = make(map[string]interface{})
+			doc[ATTACHMENTS_ATTR] = attachments
+		}
+		attachments[name] = map[string]interface{}{"blob": blobID, "size": size}
+	} else if !hadPrev {
+		return dberr.New(dberr.ErrorNoAttachment, id, name)
+	} else if delete(attachments, name); len(attachments) == 0 {
+		delete(doc, ATTACHMENTS_ATTR)
+	}
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err = part.Update(id, docJS); err != nil {
+		return err
+	}
+	if hadPrev {
+		col.blobs[partNum].Delete(prevBlobID)
+	}
+	part.LockUpdate(id)
+	col.unindexDoc(id, originalB)
+	col.indexDoc(id, docJS)
+	part.UnlockUpdate(id)
+	col.written(id, CHANGE_UPDATE, originalB, docJS)
+	return nil
+}
+
+// Store all data from the reader as the named attachment of the document, replacing the existing attachment of the
+// same name. The document refers to its attachments in attribute "_attachments" ({"name": {"blob": ID, "size": bytes}}),
+// which should be kept intact by document updates.
+func (col *Col) PutAttachment(id int, name string, in io.Reader) error {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err := col.checkFlags(COL_WRITE); err != nil {
+		return err
+	}
+	partNum := id % col.db.numParts
+	part := col.parts[partNum]
+	part.DataLock.Lock()
+	defer part.DataLock.Unlock()
+	if _, err := part.Read(id); err != nil {
+		return err
+	}
+	blob, err := col.blobFile(partNum)
+	if err != nil {
+		return err
+	}
+	blobID, size, err := blob.Write(in)
+	if err != nil {
+		return err
+	}
+	if err = col.setAttachment(id, name, blobID, size); err != nil {
+		blob.Delete(blobID)
+	}
+	return err
+}
+
+// Write the named attachment of the document into the writer, return the number of bytes written.
+func (col *Col) GetAttachment(id int, name string, out io.Writer) (int, error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err := col.checkFlags(COL_READ); err != nil {
+		return 0, err
+	}
+	partNum := id % col.db.numParts
+	part := col.parts[partNum]
+	part.DataLock.RLock()
+	defer part.DataLock.RUnlock()
+	docB, err := part.Read(id)
+	if err != nil {
+		return 0, err
+	}
+	var doc map[string]interface{}
+	if err = json.Unmarshal(docB, &doc); err != nil {
+		return 0, err
+	}
+	blobID, exists := attachmentBlob(doc, name)
+	if !exists || col.blobs[partNum] == nil {
+		return 0, dberr.New(dberr.ErrorNoAttachment, id, name)
+	}
+	return col.blobs[partNum].Read(blobID, out)
+}
+
+// Remove the named attachment from the document.
+func (col *Col) DeleteAttachment(id int, name string) error {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err := col.checkFlags(COL_WRITE); err != nil {
+		return err
+	}
+	partNum := id % col.db.numParts
+	part := col.parts[partNum]
+	part.DataLock.Lock()
+	defer part.DataLock.Unlock()
+	if col.blobs[partNum] == nil {
+		if _, err := part.Read(id); err != nil {
+			return err
+		}
+		return dberr.New(dberr.ErrorNoAttachment, id, name)
+	}
+	return col.setAttachment(id, name, -1, 0)
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("read error")
+}
+
+func TestAttachment(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"name"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"name": "photo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := col.PutAttachment(12345, "a", strings.NewReader("")); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	if _, err := col.GetAttachment(id, "a", new(bytes.Buffer)); dberr.Type(err) != dberr.ErrorNoAttachment {
+		t.Fatal(err)
+	}
+	// Large binary attachment spans several chunks, and contains long runs of zeros
+	large := bytes.Repeat([]byte{0, 0, 0, 1, 2, 3}, data.BlobChunkSize)
+	if err := col.PutAttachment(id, "large", bytes.NewReader(large)); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.PutAttachment(id, "small", strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.PutAttachment(id, "small", strings.NewReader("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.PutAttachment(id, "empty", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.PutAttachment(id, "broken", failingReader{}); err == nil {
+		t.Fatal("Did not error")
+	}
+	checkAttachments := func(col *Col) {
+		for name, content := range map[string][]byte{"large": large, "small": []byte("second"), "empty": {}} {
+			out := new(bytes.Buffer)
+			if n, err := col.GetAttachment(id, name, out); err != nil || n != len(content) || !bytes.Equal(out.Bytes(), content) {
+				t.Fatal(name, n, err)
+			}
+		}
+		doc, err := col.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attachments := doc[ATTACHMENTS_ATTR].(map[string]interface{})
+		if len(attachments) != 3 || attachments["small"].(map[string]interface{})["size"].(float64) != 6 {
+			t.Fatal(doc)
+		}
+		// Document remains indexed
+		result := make(map[int]struct{})
+		if err := EvalQuery(map[string]interface{}{"eq": "photo", "in": []interface{}{"name"}}, col, &result); err != nil || len(result) != 1 {
+			t.Fatal(result, err)
+		}
+	}
+	checkAttachments(col)
+	// Attachments survive scrub and re-opening the database
+	if err := db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	checkAttachments(col)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("col")
+	checkAttachments(col)
+	// Delete attachment
+	if err := col.DeleteAttachment(id, "large"); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.DeleteAttachment(id, "large"); dberr.Type(err) != dberr.ErrorNoAttachment {
+		t.Fatal(err)
+	}
+	if _, err := col.GetAttachment(id, "large", new(bytes.Buffer)); dberr.Type(err) != dberr.ErrorNoAttachment {
+		t.Fatal(err)
+	}
+	// Deleting the document deletes its attachments
+	part := id % db.numParts
+	doc, _ := col.Read(id)
+	smallBlob, _ := attachmentBlob(doc, "small")
+	if err := col.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := col.blobs[part].Read(smallBlob, new(bytes.Buffer)); dberr.Type(err) != dberr.ErrorNoBlob {
+		t.Fatal(err)
+	}
+	// Read-only collection may not have attachments changed
+	other, err := col.Insert(map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Reopen("col", COL_READ); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.PutAttachment(other, "a", strings.NewReader("")); dberr.Type(err) != dberr.ErrorColReadOnly {
+		t.Fatal(err)
+	}
+	if err := col.DeleteAttachment(other, "a"); dberr.Type(err) != dberr.ErrorColReadOnly {
+		t.Fatal(err)
+	}
+}
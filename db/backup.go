@@ -0,0 +1,271 @@
+// Backup manifest, verification of dumped databases, and archive dumps.
+
+package db
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+const (
+	DUMP_MANIFEST_FILE  = "dump_manifest.json" // Name of the manifest file written into dump destination directory.
+	DUMP_FORMAT_VERSION = 1                    // Version of database file format and manifest written by Dump.
+)
+
+// DumpManifest describes a dumped database, so that a corrupted or truncated backup is detected before restoring it.
+type DumpManifest struct {
+	FormatVersion int         // Version of database file format and manifest
+	Created       time.Time   // When the dump was made
+	NumParts      int         // Number of partitions of the database
+	Config        data.Config // Performance configuration of the database
+	Files         []DumpFile  // All files of the dump, except the manifest
+}
+
+// DumpFile is a file of a dumped database.
+type DumpFile struct {
+	Path   string // Path relative to the dump directory
+	Size   int64  // Size in bytes
+	SHA256 string // SHA-256 checksum in hexadecimal
+}
+
+// Return the SHA-256 checksum of the file in hexadecimal.
+func hashFile(filePath string) (string, error) {
+	return hashFileProgress(filePath, newTracker(context.Background(), 0, nil))
+}
+
+// Return the SHA-256 checksum of the file in hexadecimal, counting bytes read as work done.
+func hashFileProgress(filePath string, tr *tracker) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(hash, progressWriter{tr, filePath}), file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Read the manifest of a dumped database, and check that all files listed are intact. Return the manifest.
+func VerifyDump(dir string) (manifest *DumpManifest, err error) {
+	return verifyDump(dir, func(total int64) *tracker { return newTracker(context.Background(), total, nil) })
+}
+
+// Read and verify the manifest of a dumped database, tracking the verification with the tracker made for the total
+// size of dump files.
+func verifyDump(dir string, track func(total int64) *tracker) (manifest *DumpManifest, err error) {
+	manifestJS, err := ioutil.ReadFile(path.Join(dir, DUMP_MANIFEST_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read dump manifest: %v", err)
+	}
+	manifest = new(DumpManifest)
+	if err = json.Unmarshal(manifestJS, manifest); err != nil {
+		return nil, fmt.Errorf("Dump manifest is corrupted: %v", err)
+	} else if manifest.FormatVersion < 1 || manifest.FormatVersion > DUMP_FORMAT_VERSION {
+		return nil, fmt.Errorf("Dump format version %d is not supported", manifest.FormatVersion)
+	}
+	total := int64(0)
+	for _, file := range manifest.Files {
+		total += file.Size
+	}
+	tr := track(total)
+	for _, file := range manifest.Files {
+		filePath := path.Join(dir, file.Path)
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("Dump file %s is missing: %v", file.Path, err)
+		} else if info.Size() != file.Size {
+			return nil, fmt.Errorf("Dump file %s has size %d, expected %d", file.Path, info.Size(), file.Size)
+		}
+		if checksum, err := hashFileProgress(filePath, tr); err != nil {
+			return nil, err
+		} else if checksum != file.SHA256 {
+			event := data.CorruptionEvent{File: filePath, Offset: -1, Kind: data.CorruptChecksum}
+			if slash := strings.Index(file.Path, "/"); slash > 0 {
+				event.Collection = file.Path[:slash]
+			}
+			data.ReportCorruption(event)
+			return nil, fmt.Errorf("Dump file %s has checksum %s, expected %s", file.Path, checksum, file.SHA256)
+		}
+	}
+	return
+}
+
+// Verify a dumped database and copy its files into the destination directory, which must not exist yet. Open the
+// restored database with OpenDB afterwards.
+func RestoreDump(dir, dest string) error {
+	return RestoreDumpContext(context.Background(), dir, dest, nil)
+}
+
+/*
+Restore a dumped database like RestoreDump does, and report the number of bytes verified and copied so far to the
+progress function (which may be nil). If the context is cancelled, restore stops and removes the destination directory.
+*/
+func RestoreDumpContext(ctx context.Context, dir, dest string, progress func(Progress)) (err error) {
+	var tr *tracker
+	manifest, err := verifyDump(dir, func(total int64) *tracker {
+		// Every file is read once for verification and once more for copying
+		tr = newTracker(ctx, 2*total, progress)
+		return tr
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("Restore destination %s already exists", dest)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dest)
+		}
+	}()
+	for _, file := range manifest.Files {
+		destPath := path.Join(dest, file.Path)
+		if err = os.MkdirAll(filepath.Dir(destPath), 0700); err != nil {
+			return
+		} else if _, _, err = cloneFile(path.Join(dir, file.Path), destPath, tr); err != nil {
+			return
+		}
+	}
+	tr.reportNow()
+	return nil
+}
+
+/*
+Write the database as a gzip-compressed tar archive into the output, e.g. to pipe a backup into object storage without
+an intermediate directory. The archive ends with a manifest of the files (see Dump). Use RestoreArchive to restore it.
+*/
+func (db *DB) DumpArchive(out io.Writer) error {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	if err := db.checkDumpable(); err != nil {
+		return err
+	}
+	gzOut := gzip.NewWriter(out)
+	tarOut := tar.NewWriter(gzOut)
+	manifest := DumpManifest{FormatVersion: DUMP_FORMAT_VERSION, Created: time.Now(), NumParts: db.numParts, Config: *db.Config}
+	err := filepath.Walk(db.path, func(currPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(db.path, currPath)
+		if err != nil {
+			return err
+		} else if relPath == "." || relPath == DUMP_MANIFEST_FILE {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if info.IsDir() {
+			header.Name += "/"
+			return tarOut.WriteHeader(header)
+		}
+		file, err := os.Open(currPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := tarOut.WriteHeader(header); err != nil {
+			return err
+		}
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(tarOut, hash), io.LimitReader(file, header.Size))
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, DumpFile{Path: header.Name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	manifestJS, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tarOut.WriteHeader(&tar.Header{Name: DUMP_MANIFEST_FILE, Mode: 0600, Size: int64(len(manifestJS)), ModTime: manifest.Created}); err != nil {
+		return err
+	} else if _, err := tarOut.Write(manifestJS); err != nil {
+		return err
+	} else if err := tarOut.Close(); err != nil {
+		return err
+	}
+	return gzOut.Close()
+}
+
+// Extract a database archive made by DumpArchive into the destination directory, which must not exist yet, and verify
+// the extracted files against the manifest. Nothing is left behind in the destination if the archive is found corrupted.
+func RestoreArchive(in io.Reader, dest string) (err error) {
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("Restore destination %s already exists", dest)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dest)
+		}
+	}()
+	gzIn, err := gzip.NewReader(in)
+	if err != nil {
+		return
+	}
+	tarIn := tar.NewReader(gzIn)
+	if err = os.MkdirAll(dest, 0700); err != nil {
+		return
+	}
+	for {
+		header, err := tarIn.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("Archive entry %s is outside of the database directory", header.Name)
+		}
+		destPath := filepath.Join(dest, filepath.FromSlash(name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(destPath, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(destPath), 0700); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(destPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tarIn)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Archive entry %s is not a regular file or directory", header.Name)
+		}
+	}
+	_, err = VerifyDump(dest)
+	return
+}
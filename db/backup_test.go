@@ -0,0 +1,237 @@
+package db
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+func TestDumpManifest(t *testing.T) {
+	bakDir, restoreDir := TEST_DATA_DIR+"bak", TEST_DATA_DIR+"restore"
+	for _, dir := range []string{TEST_DATA_DIR, bakDir, restoreDir} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.Use("col").Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := db.Dump(bakDir); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := VerifyDump(bakDir)
+	if err != nil {
+		t.Fatal(err)
+	} else if manifest.FormatVersion != DUMP_FORMAT_VERSION || manifest.NumParts != db.numParts || manifest.Config.ColFileGrowth != db.Config.ColFileGrowth {
+		t.Fatal(manifest)
+	}
+	foundPartNumFile := false
+	for _, file := range manifest.Files {
+		if file.Path == PART_NUM_FILE {
+			foundPartNumFile = true
+		}
+	}
+	if !foundPartNumFile {
+		t.Fatal(manifest.Files)
+	}
+	// Restore the dump and open the restored database
+	if err := RestoreDump(bakDir, restoreDir); err != nil {
+		t.Fatal(err)
+	} else if err := RestoreDump(bakDir, restoreDir); err == nil {
+		t.Fatal("Did not error")
+	}
+	restored, err := OpenDB(restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := restored.Use("col").Read(id); err != nil || doc["a"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	// A database restored from dump may be dumped again
+	os.RemoveAll(bakDir + "2")
+	defer os.RemoveAll(bakDir + "2")
+	if err := restored.Dump(bakDir + "2"); err != nil {
+		t.Fatal(err)
+	} else if _, err := VerifyDump(bakDir + "2"); err != nil {
+		t.Fatal(err)
+	}
+	restored.Close()
+	// Detect truncated and corrupted files
+	dataFile := path.Join(bakDir, "col", DOC_DATA_FILE+"0")
+	content, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dataFile, content[:len(content)-1], 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err := VerifyDump(bakDir); err == nil {
+		t.Fatal("Did not error")
+	}
+	var events []data.CorruptionEvent
+	data.SetCorruptionHandler(func(event data.CorruptionEvent) { events = append(events, event) })
+	defer data.SetCorruptionHandler(nil)
+	content[0]++
+	if err := ioutil.WriteFile(dataFile, content, 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err := VerifyDump(bakDir); err == nil {
+		t.Fatal("Did not error")
+	} else if len(events) != 1 || events[0] != (data.CorruptionEvent{Collection: "col", File: dataFile, Offset: -1, Kind: data.CorruptChecksum}) {
+		t.Fatal(events)
+	}
+	os.RemoveAll(restoreDir)
+	if err := RestoreDump(bakDir, restoreDir); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err := ioutil.WriteFile(path.Join(bakDir, DUMP_MANIFEST_FILE), []byte(`{"FormatVersion": 1, "Fil`), 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err := VerifyDump(bakDir); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestDumpArchive(t *testing.T) {
+	restoreDir := TEST_DATA_DIR + "restore"
+	for _, dir := range []string{TEST_DATA_DIR, restoreDir} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err := db.Use("col").Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.Use("col").Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := new(bytes.Buffer)
+	if err := db.DumpArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+	archiveBytes := archive.Bytes()
+	if err := RestoreArchive(bytes.NewReader(archiveBytes), restoreDir); err != nil {
+		t.Fatal(err)
+	} else if err := RestoreArchive(bytes.NewReader(archiveBytes), restoreDir); err == nil {
+		t.Fatal("Did not error")
+	}
+	restored, err := OpenDB(restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, restored.Use("col"), &result); err != nil || !ensureMapHasKeys(result, id) {
+		t.Fatal(result, err)
+	}
+	restored.Close()
+	os.RemoveAll(restoreDir)
+	// Truncated archive is rejected and leaves nothing behind
+	if err := RestoreArchive(bytes.NewReader(archiveBytes[:len(archiveBytes)/2]), restoreDir); err == nil {
+		t.Fatal("Did not error")
+	} else if _, err := os.Stat(restoreDir); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Entries outside of the destination are rejected
+	evil := new(bytes.Buffer)
+	gzOut := gzip.NewWriter(evil)
+	tarOut := tar.NewWriter(gzOut)
+	tarOut.WriteHeader(&tar.Header{Name: "../evil", Mode: 0600, Size: 1, Typeflag: tar.TypeReg})
+	tarOut.Write([]byte("a"))
+	tarOut.Close()
+	gzOut.Close()
+	if err := RestoreArchive(evil, restoreDir); err == nil {
+		t.Fatal("Did not error")
+	} else if _, err := os.Stat(TEST_DATA_DIR + "restore/../evil"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestMaintenanceProgress(t *testing.T) {
+	bakDir, restoreDir := TEST_DATA_DIR+"bak", TEST_DATA_DIR+"restore"
+	for _, dir := range []string{TEST_DATA_DIR, bakDir, restoreDir} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.Use("col").Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last Progress
+	report := func(progress Progress) { last = progress }
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Dump
+	if err := db.DumpContext(cancelled, bakDir, report); err != context.Canceled {
+		t.Fatal(err)
+	} else if _, err := VerifyDump(bakDir); err == nil {
+		t.Fatal("Cancelled dump was verified")
+	}
+	os.RemoveAll(bakDir)
+	if err := db.DumpContext(context.Background(), bakDir, report); err != nil {
+		t.Fatal(err)
+	} else if last.Total == 0 || last.Done != last.Total || last.ETA != 0 {
+		t.Fatal(last)
+	}
+	// Restore
+	if err := RestoreDumpContext(cancelled, bakDir, restoreDir, report); err != context.Canceled {
+		t.Fatal(err)
+	} else if _, err := os.Stat(restoreDir); !os.IsNotExist(err) {
+		t.Fatal("Cancelled restore left files behind")
+	}
+	last = Progress{}
+	if err := RestoreDumpContext(context.Background(), bakDir, restoreDir, report); err != nil {
+		t.Fatal(err)
+	} else if last.Total == 0 || last.Done != last.Total {
+		t.Fatal(last)
+	}
+	// Scrub
+	if err := db.ScrubContext(cancelled, "col", report); err != context.Canceled {
+		t.Fatal(err)
+	} else if doc, err := db.Use("col").Read(id); err != nil || doc["a"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	files, err := ioutil.ReadDir(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "scrub-") {
+			t.Fatal("Cancelled scrub left temporary collection behind")
+		}
+	}
+	last = Progress{}
+	if err := db.ScrubContext(context.Background(), "col", report); err != nil {
+		t.Fatal(err)
+	} else if last.File != "col" || last.Done != 1 {
+		t.Fatal(last)
+	} else if doc, err := db.Use("col").Read(id); err != nil || doc["a"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+}
@@ -0,0 +1,227 @@
+// Staged batches of document writes.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// A document write staged in a batch.
+type batchOp struct {
+	op  string // CHANGE_INSERT, CHANGE_UPDATE, or CHANGE_DELETE
+	id  int
+	doc []byte // JSON text of the new document, nil for deletion
+}
+
+// Batch stages document writes of a collection in memory until they are committed, see Col.NewBatch.
+type Batch struct {
+	col *Col
+	ops []batchOp
+}
+
+/*
+Return an empty batch of document writes of the collection. Writes staged in the batch are applied by Commit: grouped
+by partition, each partition is locked once, and the write rate limit (see DB.SetWriteLimit) is waited for once per
+commit. A batch is not safe for concurrent use.
+*/
+func (col *Col) NewBatch() *Batch {
+	return &Batch{col: col}
+}
+
+// Stage the insertion of a document, return the ID it will be inserted under.
+func (batch *Batch) Insert(doc map[string]interface{}) (id int, err error) {
+	if err = batch.col.validateDoc(doc); err != nil {
+		return
+	}
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return
+	}
+	batch.col.db.schemaLock.RLock()
+	id = batch.col.newID()
+	batch.col.db.schemaLock.RUnlock()
+	if id < 0 {
+		return 0, fmt.Errorf("Generated document ID %d is negative", id)
+	}
+	batch.ops = append(batch.ops, batchOp{op: CHANGE_INSERT, id: id, doc: docJS})
+	return
+}
+
+// Stage the update of a document.
+func (batch *Batch) Update(id int, doc map[string]interface{}) error {
+	if doc == nil {
+		return fmt.Errorf("Updating %d: input doc may not be nil", id)
+	} else if err := batch.col.validateDoc(doc); err != nil {
+		return err
+	}
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	batch.ops = append(batch.ops, batchOp{op: CHANGE_UPDATE, id: id, doc: docJS})
+	return nil
+}
+
+// Stage the deletion of a document.
+func (batch *Batch) Delete(id int) {
+	batch.ops = append(batch.ops, batchOp{op: CHANGE_DELETE, id: id})
+}
+
+// Return the number of staged writes.
+func (batch *Batch) Len() int {
+	return len(batch.ops)
+}
+
+/*
+Apply the staged writes and empty the batch. Writes of a document are applied in the order they were staged. Writes
+that fail (e.g. updating a missing document, or a duplicate value of a unique index) are skipped and their errors are
+returned keyed by document ID; the other writes are applied regardless. Deletions follow relations like DeleteMany: a
+deletion denied by a relation fails the commit before anything is written. If sync is set, the files of the collection
+are flushed to disk once all writes are applied.
+*/
+func (batch *Batch) Commit(sync bool) (failed map[int]error, err error) {
+	col, ops := batch.col, batch.ops
+	batch.ops = nil
+	failed = make(map[int]error)
+	deleting := make([]int, 0)
+	for _, op := range ops {
+		if op.op == CHANGE_DELETE {
+			deleting = append(deleting, op.id)
+		}
+	}
+	rels, froms := col.referringRelations()
+	if err = col.denyReferenced(rels, froms, deleting); err != nil {
+		return
+	}
+	deleted, err := col.commit(ops, failed, sync)
+	if err != nil {
+		return
+	}
+	err = col.cascadeDelete(rels, froms, deleted)
+	return
+}
+
+// Apply staged writes grouped by partition, put errors of failed writes into the failed map. Return IDs of the deleted
+// documents.
+func (col *Col) commit(ops []batchOp, failed map[int]error, sync bool) (deleted []int, err error) {
+	if err = col.db.writes.wait(); err != nil {
+		return
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err = col.checkFlags(COL_WRITE); err != nil {
+		return
+	}
+	byPart := make([][]batchOp, col.db.numParts)
+	for _, op := range ops {
+		if op.id < 0 {
+			failed[op.id] = dberr.New(dberr.ErrorNoDoc, op.id)
+		} else {
+			byPart[op.id%col.db.numParts] = append(byPart[op.id%col.db.numParts], op)
+		}
+	}
+	type change struct {
+		batchOp
+		original []byte
+	}
+	unlock := col.lockUnique()
+	defer unlock()
+	uniques := make(map[uniqueValue]int)
+	for partNum, partOps := range byPart {
+		if len(partOps) == 0 {
+			continue
+		}
+		// Place lock once and apply the writes
+		changes := make([]change, 0, len(partOps))
+		err = col.writePart(partNum, func(part *data.Partition) error {
+			for _, op := range partOps {
+				var original []byte
+				originalB, readErr := part.Read(op.id)
+				if readErr == nil {
+					original = append([]byte(nil), originalB...)
+				}
+				var err error
+				switch op.op {
+				case CHANGE_INSERT:
+					if readErr == nil {
+						err = dberr.New(dberr.ErrorDocExists, op.id)
+					} else if err = col.checkUnique(op.id, op.doc, part, uniques); err == nil {
+						if _, err = part.Insert(op.id, op.doc); err == nil {
+							col.logInsert(op.id)
+						}
+					}
+				case CHANGE_UPDATE:
+					if err = readErr; err == nil {
+						if err = col.checkUnique(op.id, op.doc, part, uniques); err == nil {
+							err = part.Update(op.id, op.doc)
+						}
+					}
+				case CHANGE_DELETE:
+					if err = readErr; err == nil {
+						if err = part.Delete(op.id); err == nil {
+							col.deleteAttachments(partNum, original)
+							col.logDelete(partNum)
+						}
+					}
+				}
+				if err != nil {
+					failed[op.id] = err
+					continue
+				}
+				changes = append(changes, change{batchOp: op, original: original})
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		// Done with the collection data, next is to maintain indexed values
+		part := col.parts[partNum]
+		for _, c := range changes {
+			part.LockUpdate(c.id)
+			if c.original != nil {
+				col.unindexDoc(c.id, c.original)
+			}
+			if c.doc != nil {
+				col.indexDoc(c.id, c.doc)
+			}
+			part.UnlockUpdate(c.id)
+			col.written(c.id, c.op, c.original, c.doc)
+			if c.op == CHANGE_DELETE {
+				deleted = append(deleted, c.id)
+			}
+		}
+	}
+	if sync {
+		err = col.flushFiles()
+	}
+	return
+}
+
+// Flush data files and index files of the collection to disk. The caller must place schema lock.
+func (col *Col) flushFiles() error {
+	for partNum, part := range col.parts {
+		part.DataLock.RLock()
+		for _, file := range part.Files() {
+			if err := file.Sync(); err != nil {
+				part.DataLock.RUnlock()
+				return err
+			}
+		}
+		part.DataLock.RUnlock()
+		for _, ht := range col.hts[partNum] {
+			ht.Lock.RLock()
+			err := ht.Sync()
+			ht.Lock.RUnlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestBatch(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err := col.IndexUnique([]string{"u"}); err != nil {
+		t.Fatal(err)
+	}
+	existing, err := col.Insert(map[string]interface{}{"a": 1, "u": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, err := col.Insert(map[string]interface{}{"a": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := col.NewBatch()
+	ids := make([]int, 0)
+	for i := 0; i < 100; i++ {
+		id, err := batch.Insert(map[string]interface{}{"a": 10 + i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// Writes of a document apply in order
+	if err := batch.Update(ids[0], map[string]interface{}{"a": 3}); err != nil {
+		t.Fatal(err)
+	}
+	batch.Delete(ids[1])
+	batch.Delete(gone)
+	// Failed writes are skipped
+	batch.Delete(12345)
+	if dup, err := batch.Insert(map[string]interface{}{"u": 1}); err != nil {
+		t.Fatal(err)
+	} else if err := batch.Update(existing, map[string]interface{}{"a": 4, "u": 2}); err != nil {
+		t.Fatal(err)
+	} else if batch.Len() != 106 {
+		t.Fatal(batch.Len())
+	} else if failed, err := batch.Commit(true); err != nil {
+		t.Fatal(err)
+	} else if len(failed) != 2 || dberr.Type(failed[12345]) != dberr.ErrorNoDoc || dberr.Type(failed[dup]) != dberr.ErrorDuplicateKey {
+		t.Fatal(failed)
+	}
+	if batch.Len() != 0 {
+		t.Fatal("Batch was not emptied")
+	}
+	if doc, err := col.Read(ids[0]); err != nil || doc["a"].(float64) != 3 {
+		t.Fatal(doc, err)
+	} else if doc, err := col.Read(ids[99]); err != nil || doc["a"].(float64) != 109 {
+		t.Fatal(doc, err)
+	} else if _, err := col.Read(ids[1]); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if _, err := col.Read(gone); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	// Indexes are maintained
+	for val, expected := range map[int][]int{3: {ids[0]}, 4: {existing}, 10: {}, 11: {}, 2: {}, 1: {}, 50: {ids[40]}} {
+		result := make(map[int]struct{})
+		if err := EvalQuery(map[string]interface{}{"eq": val, "in": []interface{}{"a"}}, col, &result); err != nil {
+			t.Fatal(err)
+		} else if !ensureMapHasKeys(result, expected...) {
+			t.Fatal(val, result)
+		}
+	}
+	// Deletions follow relations
+	if err := db.Create("ref"); err != nil {
+		t.Fatal(err)
+	}
+	ref := db.Use("ref")
+	if err := ref.Index([]string{"to"}); err != nil {
+		t.Fatal(err)
+	} else if _, err := ref.Insert(map[string]interface{}{"to": ids[2]}); err != nil {
+		t.Fatal(err)
+	} else if err := db.AddRelation(Relation{From: "ref", Path: []string{"to"}, To: "col", OnDelete: REF_DENY}); err != nil {
+		t.Fatal(err)
+	}
+	batch.Delete(ids[3])
+	batch.Delete(ids[2])
+	if _, err := batch.Commit(false); dberr.Type(err) != dberr.ErrorReferenced {
+		t.Fatal(err)
+	} else if _, err := col.Read(ids[3]); err != nil {
+		t.Fatal("Denied commit was partially applied", err)
+	}
+}
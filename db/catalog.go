@@ -0,0 +1,126 @@
+// System catalog - a read-only collection describing the database.
+
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+)
+
+const (
+	CATALOG_COL = "_catalog" // Name of the system catalog collection.
+
+	CATALOG_KIND_DATABASE   = "database"   // Catalog document kind describing database configuration.
+	CATALOG_KIND_COLLECTION = "collection" // Catalog document kind describing a collection.
+	CATALOG_KIND_INDEX      = "index"      // Catalog document kind describing an index.
+	CATALOG_KIND_QUERY      = "query"      // Catalog document kind describing a named query.
+)
+
+/*
+Catalog rebuilds the system catalog and returns a read-only handle to it. The catalog is an ordinary collection
+that may be queried like any other, its documents look like:
+{"kind": "database", "path": "/db/dir", "partitions": 8, "collections": 2, "config": {"DocMaxRoom": 2097152, ...}}
+{"kind": "collection", "name": "Feeds", "flags": 3, "approx_doc_count": 100, "indexes": 1, "meta": {...}}
+{"kind": "index", "name": "a!b", "collection": "Feeds", "path": ["a", "b"]}
+{"kind": "query", "name": "byTitle", "collection": "Feeds", "query": {"eq": "$1", "in": ["title"]}}
+Paths "kind", "name", and "collection" are indexed. The catalog is a snapshot and does not describe itself.
+*/
+func (db *DB) Catalog() (*Col, error) {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	catalog, exists := db.cols[CATALOG_COL]
+	if !exists {
+		if err := os.MkdirAll(path.Join(db.path, CATALOG_COL), 0700); err != nil {
+			return nil, err
+		}
+		var err error
+		if catalog, err = OpenColFlags(db, CATALOG_COL, COL_READ); err != nil {
+			return nil, err
+		}
+		db.cols[CATALOG_COL] = catalog
+		for _, idxPath := range [][]string{{"kind"}, {"name"}, {"collection"}} {
+			if err := catalog.index(idxPath, IndexOptions{}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := catalog.clear(); err != nil {
+		return nil, err
+	}
+	// Describe the database itself
+	var config map[string]interface{}
+	configJS, err := json.Marshal(db.Config)
+	if err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(configJS, &config); err != nil {
+		return nil, err
+	}
+	docs := []map[string]interface{}{{
+		"kind":        CATALOG_KIND_DATABASE,
+		"path":        db.path,
+		"partitions":  db.numParts,
+		"collections": len(db.cols) - 1,
+		"config":      config,
+	}}
+	// Describe collections and their indexes in a stable order
+	colNames := make([]string, 0, len(db.cols))
+	for name := range db.cols {
+		if name != CATALOG_COL {
+			colNames = append(colNames, name)
+		}
+	}
+	sort.Strings(colNames)
+	for _, name := range colNames {
+		col := db.cols[name]
+		meta := make(map[string]interface{}, len(col.meta))
+		for key, value := range col.meta {
+			meta[key] = value
+		}
+		docs = append(docs, map[string]interface{}{
+			"kind":             CATALOG_KIND_COLLECTION,
+			"name":             name,
+			"flags":            col.flags,
+			"approx_doc_count": col.approxDocCount(false),
+			"indexes":          len(col.indexPaths),
+			"meta":             meta,
+		})
+		for idxName, idxPath := range col.indexPaths {
+			pathCopy := make([]interface{}, len(idxPath))
+			for i, seg := range idxPath {
+				pathCopy[i] = seg
+			}
+			docs = append(docs, map[string]interface{}{
+				"kind":       CATALOG_KIND_INDEX,
+				"name":       idxName,
+				"collection": name,
+				"path":       pathCopy,
+			})
+		}
+	}
+	// Describe named queries
+	queries, err := db.NamedQueries()
+	if err != nil {
+		return nil, err
+	}
+	queryNames := make([]string, 0, len(queries))
+	for name := range queries {
+		queryNames = append(queryNames, name)
+	}
+	sort.Strings(queryNames)
+	for _, name := range queryNames {
+		docs = append(docs, map[string]interface{}{
+			"kind":       CATALOG_KIND_QUERY,
+			"name":       name,
+			"collection": queries[name].Col,
+			"query":      queries[name].Query,
+		})
+	}
+	for _, doc := range docs {
+		if err := catalog.insertRecovery(db.newID(), doc); err != nil {
+			return nil, err
+		}
+	}
+	return catalog, nil
+}
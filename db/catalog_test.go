@@ -0,0 +1,97 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestCatalog(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create("a"); err != nil {
+		t.Fatal(err)
+	} else if err := db.Create("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use("a").Index([]string{"x", "y"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use("a").SetMeta("owner", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := db.Catalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Query collections
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": CATALOG_KIND_COLLECTION, "in": []interface{}{"kind"}}, catalog, &result); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	}
+	// Query indexes of collection "a"
+	result = make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": "a", "in": []interface{}{"collection"}}, catalog, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	for id := range result {
+		doc, err := catalog.Read(id)
+		if err != nil || doc["name"] != "x!y" || doc["kind"] != CATALOG_KIND_INDEX {
+			t.Fatal(doc, err)
+		}
+	}
+	// Collection metadata is included
+	result = make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": "a", "in": []interface{}{"name"}}, catalog, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	for id := range result {
+		doc, err := catalog.Read(id)
+		if err != nil || doc["meta"].(map[string]interface{})["owner"] != "alice" || doc["indexes"].(float64) != 1 {
+			t.Fatal(doc, err)
+		}
+	}
+	// Database configuration
+	result = make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": CATALOG_KIND_DATABASE, "in": []interface{}{"kind"}}, catalog, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	for id := range result {
+		doc, err := catalog.Read(id)
+		if err != nil || int(doc["partitions"].(float64)) != db.numParts || int(doc["collections"].(float64)) != 2 {
+			t.Fatal(doc, err)
+		}
+	}
+	// Catalog is read-only and reflects changes after rebuild
+	if _, err := catalog.Insert(map[string]interface{}{}); dberr.Type(err) != dberr.ErrorColReadOnly {
+		t.Fatal(err)
+	}
+	if err := db.Drop("b"); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := db.Catalog(); err != nil || again != catalog {
+		t.Fatal(again, err)
+	}
+	result = make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": CATALOG_KIND_COLLECTION, "in": []interface{}{"kind"}}, catalog, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	// Catalog remains read-only after re-opening the database
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	if db.Use(CATALOG_COL).Flags() != COL_READ {
+		t.Fatal(db.Use(CATALOG_COL).Flags())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
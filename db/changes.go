@@ -0,0 +1,225 @@
+// Streams of document change events.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	CHANGE_INSERT = "insert" // Change event operation - a document was inserted.
+	CHANGE_UPDATE = "update" // Change event operation - a document was updated.
+	CHANGE_DELETE = "delete" // Change event operation - a document was deleted.
+
+	CHANGE_STREAM_BACKLOG = 10000 // Maximum number of change events waiting to be delivered to a change stream.
+)
+
+// ChangeOptions decide which document bodies change events carry, see Col.Changes. Leave out the bodies a consumer
+// does not need, as they are kept in memory until the event is delivered.
+type ChangeOptions struct {
+	Before bool // Carry the document as it was before an update or deletion
+	After  bool // Carry the document as it is after an insertion or update
+}
+
+// ChangeEvent describes a change made to a document.
+type ChangeEvent struct {
+	ID     int                    `json:"id"`
+	Op     string                 `json:"op"`               // CHANGE_INSERT, CHANGE_UPDATE, or CHANGE_DELETE
+	Before map[string]interface{} `json:"before,omitempty"` // Document before the change, if asked for and there is one
+	After  map[string]interface{} `json:"after,omitempty"`  // Document after the change, if asked for and there is one
+}
+
+// A change event waiting to be delivered, with the JSON text of the document bodies it carries.
+type pendingChange struct {
+	id            int
+	op            string
+	before, after []byte
+}
+
+// A subscriber to change events of a collection.
+type changeStream struct {
+	opts     ChangeOptions
+	events   []pendingChange // Events not yet picked up, in order of changes
+	overflow bool            // Events were dropped as the backlog was full
+	signal   chan struct{}   // Receives a value when there are new events
+	closed   chan struct{}   // Closed when the collection is dropped or the database is closed
+}
+
+// Decode the document bodies of the event, and redact them with the function (unless nil).
+func (pending pendingChange) event(redact func(doc map[string]interface{})) (ev ChangeEvent, err error) {
+	ev = ChangeEvent{ID: pending.id, Op: pending.op}
+	if pending.before != nil {
+		if err = json.Unmarshal(pending.before, &ev.Before); err != nil {
+			return
+		} else if redact != nil {
+			redact(ev.Before)
+		}
+	}
+	if pending.after != nil {
+		if err = json.Unmarshal(pending.after, &ev.After); err == nil && redact != nil {
+			redact(ev.After)
+		}
+	}
+	return
+}
+
+/*
+Tell subscribers that the document has been inserted, updated, or deleted, along with the JSON text of the document
+before and after the change (nil if there is none, or for an insertion read from input without indexes). The caller
+must place schema lock.
+*/
+func (col *Col) written(id int, op string, before, after []byte) {
+	if op != CHANGE_DELETE {
+		col.notifyChange(id)
+	}
+	col.publishChange(id, op, before, after)
+	col.recordVersion(id, op == CHANGE_DELETE)
+	switch op {
+	case CHANGE_UPDATE:
+		col.countAccess(id, true)
+	case CHANGE_DELETE:
+		col.forgetAccess(id)
+	}
+}
+
+// Queue the change event for all change streams. The caller must place schema lock.
+func (col *Col) publishChange(id int, op string, before, after []byte) {
+	col.watchLock.Lock()
+	defer col.watchLock.Unlock()
+	if len(col.streams) == 0 {
+		return
+	}
+	if after == nil && op != CHANGE_DELETE {
+		for s := range col.streams {
+			if s.opts.After {
+				// Read the new document back, it is not at hand
+				part := col.parts[id%col.db.numParts]
+				part.DataLock.RLock()
+				after, _ = part.Read(id)
+				part.DataLock.RUnlock()
+				break
+			}
+		}
+	}
+	for s := range col.streams {
+		if s.overflow {
+			continue
+		} else if len(s.events) >= CHANGE_STREAM_BACKLOG {
+			s.overflow = true
+		} else {
+			pending := pendingChange{id: id, op: op}
+			// The caller may reuse the buffers, keep copies
+			if s.opts.Before && before != nil {
+				pending.before = append([]byte(nil), before...)
+			}
+			if s.opts.After && after != nil {
+				pending.after = append([]byte(nil), after...)
+			}
+			s.events = append(s.events, pending)
+		}
+		select {
+		case s.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+/*
+Call the function on every change made to documents of the collection from now on, in the order of changes, until the
+context is cancelled or the function returns false. Events carry the document before and/or after the change as the
+options ask, with redacted paths (see Redact) masked. Up to CHANGE_STREAM_BACKLOG events wait for a slow function; beyond that the stream falls behind, and ends
+with an error once the waiting events are delivered. Return nil if the function stopped the stream, the context error
+if it was cancelled, or an error if the stream fell behind, the collection is dropped, or the database is closed.
+*/
+func (col *Col) Changes(ctx context.Context, opts ChangeOptions, fun func(ev ChangeEvent) bool) error {
+	s, unsubscribe := col.subscribeChanges(opts)
+	defer unsubscribe()
+	return col.streamChanges(ctx, s, fun)
+}
+
+/*
+Return a channel receiving every change made to documents of the collection from now on, in the order of changes, as
+Changes calls its function. The stream ends like Changes does: the error channel then receives the context error, or
+the error that ended the stream, and both channels are closed. The consumer should keep receiving until the event
+channel is closed, or cancel the context to stop.
+*/
+func (col *Col) Watch(ctx context.Context, opts ChangeOptions) (<-chan ChangeEvent, <-chan error) {
+	s, unsubscribe := col.subscribeChanges(opts)
+	events, errs := make(chan ChangeEvent), make(chan error, 1)
+	go func() {
+		defer unsubscribe()
+		err := col.streamChanges(ctx, s, func(ev ChangeEvent) bool {
+			select {
+			case events <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		if err == nil {
+			// Stopped while waiting for the consumer
+			err = ctx.Err()
+		}
+		errs <- err
+		close(errs)
+		close(events)
+	}()
+	return events, errs
+}
+
+// Subscribe a new change stream to the collection, return the function unsubscribing it.
+func (col *Col) subscribeChanges(opts ChangeOptions) (*changeStream, func()) {
+	s := &changeStream{opts: opts, signal: make(chan struct{}, 1), closed: make(chan struct{})}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.dropped {
+		// The stream of a dropped collection ends right away
+		close(s.closed)
+		return s, func() {}
+	}
+	col.watchLock.Lock()
+	if col.streams == nil {
+		col.streams = make(map[*changeStream]struct{})
+	}
+	col.streams[s] = struct{}{}
+	col.watchLock.Unlock()
+	return s, func() {
+		col.watchLock.Lock()
+		delete(col.streams, s)
+		col.watchLock.Unlock()
+	}
+}
+
+// Call the function on events of the change stream, see Changes.
+func (col *Col) streamChanges(ctx context.Context, s *changeStream, fun func(ev ChangeEvent) bool) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.closed:
+			return fmt.Errorf("Collection %s is no longer available", col.name)
+		case <-s.signal:
+		}
+		col.watchLock.Lock()
+		events, overflow := s.events, s.overflow
+		s.events = nil
+		col.watchLock.Unlock()
+		redact, err := col.redactor()
+		if err != nil {
+			return err
+		}
+		for _, pending := range events {
+			ev, err := pending.event(redact)
+			if err != nil {
+				return err
+			} else if !fun(ev) {
+				return nil
+			}
+		}
+		if overflow {
+			return fmt.Errorf("Change stream of %s fell behind by more than %d events", col.name, CHANGE_STREAM_BACKLOG)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package db
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start a change stream in background, return the channels of its events and its error.
+func startChanges(t *testing.T, col *Col, ctx context.Context, opts ChangeOptions, backlog int) (chan ChangeEvent, chan error) {
+	events := make(chan ChangeEvent, backlog)
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- col.Changes(ctx, opts, func(ev ChangeEvent) bool {
+			events <- ev
+			return true
+		})
+	}()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		col.watchLock.Lock()
+		subscribed := len(col.streams)
+		col.watchLock.Unlock()
+		if subscribed > 0 {
+			break
+		} else if time.Since(start) > 2*time.Second {
+			t.Fatal("Stream did not start")
+		}
+	}
+	return events, streamErr
+}
+
+func TestChanges(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ctx, cancel := context.WithCancel(context.Background())
+	events, streamErr := startChanges(t, col, ctx, ChangeOptions{Before: true, After: true}, 100)
+	next := func() ChangeEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("No event")
+		}
+		return ChangeEvent{}
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := col.Update(id, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	} else if err := col.UpdateBytesFunc(id, func(orig []byte) ([]byte, error) {
+		return []byte(`{"a": 3}`), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fromInput, err := col.InsertFrom(strings.NewReader(`{"b": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	} else if err := col.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []ChangeEvent{
+		{ID: id, Op: CHANGE_INSERT, After: map[string]interface{}{"a": 1.0}},
+		{ID: id, Op: CHANGE_UPDATE, Before: map[string]interface{}{"a": 1.0}, After: map[string]interface{}{"a": 2.0}},
+		{ID: id, Op: CHANGE_UPDATE, Before: map[string]interface{}{"a": 2.0}, After: map[string]interface{}{"a": 3.0}},
+		{ID: fromInput, Op: CHANGE_INSERT, After: map[string]interface{}{"b": 1.0}},
+		{ID: id, Op: CHANGE_DELETE, Before: map[string]interface{}{"a": 3.0}},
+	} {
+		if ev := next(); !reflect.DeepEqual(ev, expected) {
+			t.Fatal(ev, expected)
+		}
+	}
+	cancel()
+	if err := <-streamErr; err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	// Bodies are left out unless asked for
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	events, streamErr = startChanges(t, col, ctx, ChangeOptions{}, 100)
+	if err := col.Update(fromInput, map[string]interface{}{"b": 2}); err != nil {
+		t.Fatal(err)
+	} else if ev := next(); !reflect.DeepEqual(ev, ChangeEvent{ID: fromInput, Op: CHANGE_UPDATE}) {
+		t.Fatal(ev)
+	}
+	// Dropping the collection ends the stream
+	if err := db.Drop("col"); err != nil {
+		t.Fatal(err)
+	} else if err := <-streamErr; err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestChangesFallBehind(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// The function blocks on the first event until the backlog overflows
+	entered, release := make(chan struct{}), make(chan struct{})
+	delivered := 0
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- col.Changes(context.Background(), ChangeOptions{After: true}, func(ev ChangeEvent) bool {
+			if delivered == 0 {
+				close(entered)
+				<-release
+			}
+			delivered++
+			return true
+		})
+	}()
+	for subscribed := 0; subscribed == 0; time.Sleep(time.Millisecond) {
+		col.watchLock.Lock()
+		subscribed = len(col.streams)
+		col.watchLock.Unlock()
+	}
+	publish := func(num int) {
+		db.schemaLock.RLock()
+		defer db.schemaLock.RUnlock()
+		for i := 0; i < num; i++ {
+			col.publishChange(i, CHANGE_UPDATE, []byte(`{}`), []byte(`{"i": 1}`))
+		}
+	}
+	publish(1)
+	<-entered
+	publish(2*CHANGE_STREAM_BACKLOG + 2)
+	close(release)
+	select {
+	case err := <-streamErr:
+		if err == nil || !strings.Contains(err.Error(), "fell behind") || delivered < CHANGE_STREAM_BACKLOG {
+			t.Fatal(err, delivered)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stream did not end")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Changes made right after watching are not missed
+	events, errs := col.Watch(ctx, ChangeOptions{Before: true, After: true})
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := col.Update(id, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	} else if err := col.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []ChangeEvent{
+		{ID: id, Op: CHANGE_INSERT, After: map[string]interface{}{"a": 1.0}},
+		{ID: id, Op: CHANGE_UPDATE, Before: map[string]interface{}{"a": 1.0}, After: map[string]interface{}{"a": 2.0}},
+		{ID: id, Op: CHANGE_DELETE, Before: map[string]interface{}{"a": 2.0}},
+	} {
+		select {
+		case ev := <-events:
+			if !reflect.DeepEqual(ev, expected) {
+				t.Fatal(ev, expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("No event")
+		}
+	}
+	// Cancelling the context ends the stream, also while an event waits for the consumer
+	if _, err := col.Insert(map[string]interface{}{"a": 3}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stream did not end")
+	}
+	for range events {
+	}
+	// Dropping the collection ends the stream with an error
+	events, errs = col.Watch(context.Background(), ChangeOptions{})
+	if err := db.Drop("col"); err != nil {
+		t.Fatal(err)
+	}
+	for range events {
+	}
+	if err := <-errs; err == nil || err == context.Canceled {
+		t.Fatal(err)
+	}
+}
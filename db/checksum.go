@@ -0,0 +1,129 @@
+// Background verification of data file checksums.
+
+package db
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+const CHECKSUM_CHUNK = 1048576 // Approximate number of bytes verified per lock acquisition by the checksum scrubber.
+
+// rotScrubber verifies checksums of all data files continuously, at a throttled rate.
+type rotScrubber struct {
+	lock   *sync.Mutex
+	cancel context.CancelFunc // Stops the scrubber, nil if the scrubber is not running
+	done   chan struct{}      // Closed when the scrubber has stopped
+	passes int64              // Number of completed passes over all collections (atomic)
+}
+
+// A data file and the lock guarding it.
+type checksumTarget struct {
+	file *data.DataFile
+	lock *sync.RWMutex
+}
+
+/*
+Start verifying checksums of the data and index files of all collections in background, at most bytesPerSec bytes per
+second (0 for unlimited), replacing the scrubber already running. Files are divided into regions (see data.DataFile.VerifyChecksums): the
+checksum of a region is taken when the region has been written, and verified on subsequent passes if the region has
+not been written since - a mismatch, e.g. caused by disk bit rot, is reported to the corruption handler (see
+data.SetCorruptionHandler) as data.CorruptChecksum. Checksums are kept in memory, hence the first pass after opening
+the database only takes them. Files are verified as low priority heavy operations (see WithPriority).
+*/
+func (db *DB) StartChecksumScrubber(bytesPerSec int) {
+	db.StopChecksumScrubber()
+	ctx, cancel := context.WithCancel(WithPriority(context.Background(), PRIORITY_LOW))
+	scrubber := db.checksums
+	scrubber.lock.Lock()
+	scrubber.cancel, scrubber.done = cancel, make(chan struct{})
+	done := scrubber.done
+	scrubber.lock.Unlock()
+	go func() {
+		defer close(done)
+		for {
+			for _, name := range db.AllCols() {
+				if err := db.verifyChecksums(ctx, name, bytesPerSec); err != nil {
+					return
+				}
+			}
+			atomic.AddInt64(&scrubber.passes, 1)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop the checksum scrubber, do nothing if it is not running. Checksums taken so far are kept for the next start.
+func (db *DB) StopChecksumScrubber() {
+	scrubber := db.checksums
+	scrubber.lock.Lock()
+	cancel, done := scrubber.cancel, scrubber.done
+	scrubber.cancel, scrubber.done = nil, nil
+	scrubber.lock.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// Return the number of passes the checksum scrubber has completed over all collections.
+func (db *DB) ChecksumPasses() int {
+	return int(atomic.LoadInt64(&db.checksums.passes))
+}
+
+// Verify checksums of all files of the collection at the rate, return an error only if the scrubber is stopping.
+func (db *DB) verifyChecksums(ctx context.Context, name string, bytesPerSec int) error {
+	db.schemaLock.RLock()
+	col := db.cols[name]
+	var targets []checksumTarget
+	if col != nil {
+		for partNum, part := range col.parts {
+			for _, file := range part.Files() {
+				targets = append(targets, checksumTarget{file, part.DataLock})
+			}
+			for _, ht := range col.hts[partNum] {
+				targets = append(targets, checksumTarget{ht.DataFile, ht.Lock})
+			}
+		}
+	}
+	db.schemaLock.RUnlock()
+	for _, target := range targets {
+		for offset := 0; ; {
+			done, err := db.heavy.admit(ctx, true)
+			if err != nil {
+				return err
+			}
+			db.schemaLock.RLock()
+			if db.cols[name] != col {
+				// Closed, dropped or renamed meanwhile
+				db.schemaLock.RUnlock()
+				done()
+				return nil
+			}
+			target.lock.RLock()
+			next, verified := target.file.VerifyChecksums(offset, CHECKSUM_CHUNK)
+			target.lock.RUnlock()
+			db.schemaLock.RUnlock()
+			done()
+			if bytesPerSec > 0 && verified > 0 {
+				select {
+				case <-time.After(time.Duration(verified) * time.Second / time.Duration(bytesPerSec)):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			if offset = next; offset == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
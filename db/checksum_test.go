@@ -0,0 +1,73 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+func TestChecksumScrubber(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := make(chan data.CorruptionEvent, 100)
+	data.SetCorruptionHandler(func(event data.CorruptionEvent) { events <- event })
+	defer data.SetCorruptionHandler(nil)
+	db.StartChecksumScrubber(0)
+	for db.ChecksumPasses() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Writes do not trip the scrubber
+	for i := 0; i < 100; i++ {
+		if _, err := col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for passes := db.ChecksumPasses(); db.ChecksumPasses() < passes+2; {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case event := <-events:
+		t.Fatal(event)
+	default:
+	}
+	// Content changed behind the database's back is reported
+	part := col.parts[0]
+	for _, part = range col.parts {
+		if part.Files()[0].Used > 0 {
+			break
+		}
+	}
+	file := part.Files()[0]
+	part.DataLock.Lock()
+	file.Buf[data.DocHeader]++
+	part.DataLock.Unlock()
+	select {
+	case event := <-events:
+		if event.Kind != data.CorruptChecksum || event.Collection != "col" || event.File != file.Path || event.Offset != 0 {
+			t.Fatal(event)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Corruption is not reported")
+	}
+	db.StopChecksumScrubber()
+	db.StopChecksumScrubber()
+}
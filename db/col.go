@@ -3,38 +3,164 @@
 package db
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
 )
 
 const (
-	DOC_DATA_FILE   = "dat_" // Prefix of partition collection data file name.
-	DOC_LOOKUP_FILE = "id_"  // Prefix of partition hash table (ID lookup) file name.
-	INDEX_PATH_SEP  = "!"    // Separator between index keys in index directory name.
+	DOC_DATA_FILE   = "dat_"    // Prefix of partition collection data file name.
+	DOC_LOOKUP_FILE = "id_"     // Prefix of partition hash table (ID lookup) file name.
+	INDEX_PATH_SEP  = "!"       // Separator between index keys in index directory name.
+	COL_META_FILE   = "meta"    // Name of collection metadata file.
+	INSERT_LOG_FILE = "ins_"    // Prefix of partition insertion log file name.
+	INDEX_OPTS_FILE = "options" // Name of index options file in index directory.
+
+	BACKGROUND_INDEX_BATCH = 100 // Approximate number of documents indexed per lock acquisition in background index build.
+)
+
+const (
+	COL_READ  = 1 << iota            // Collection open flag - allow reading documents and running queries.
+	COL_WRITE                        // Collection open flag - allow inserting, updating, and deleting documents.
+	COL_RDWR  = COL_READ | COL_WRITE // Collection open flag - allow both reading and writing (default).
 )
 
 // Collection has data partitions and some index meta information.
 type Col struct {
-	db         *DB
-	name       string
-	parts      []*data.Partition            // Collection partitions
-	hts        []map[string]*data.HashTable // Index partitions
-	indexPaths map[string][]string          // Index names and paths
+	db          *DB
+	name        string
+	parts       []*data.Partition            // Collection partitions
+	hts         []map[string]*data.HashTable // Index partitions
+	indexPaths  map[string][]string          // Index names and paths
+	indexOpts   map[string]IndexOptions      // Index names and their options, absent for default options
+	flags       int                          // Open flags (COL_READ, COL_WRITE)
+	dropped     bool                         // The collection has been dropped, hence its files are closed
+	meta        map[string]string            // Application-level metadata
+	bulkLoad    bool                         // Index maintenance is suspended until bulk load ends
+	building    map[string]*indexBuild       // Indexes being built in background
+	idGen       func() int                   // Document ID generator, nil for random IDs
+	blobs       []*data.BlobFile             // Attachment data partitions, nil until the first attachment is stored
+	inserts     []*data.InsertLog            // Insertion order of documents in each partition
+	lastInsert  int64                        // Sequence number of the latest insertion, continued from the insertion logs
+	insertLock  sync.Mutex                   // Protects lastInsert
+	workers     []chan *partitionOp          // Write queues of partition workers, nil unless the workers are running
+	workersDone *sync.WaitGroup              // Partition workers that have not exited yet
+	watchers    map[*colWatcher]struct{}     // Subscribers to document changes (see Tail)
+	streams     map[*changeStream]struct{}   // Subscribers to change events (see Changes)
+	watchLock   sync.Mutex                   // Protects watchers and streams
+	stats       atomic.Value                 // Statistics (*ColStats) cached by the statistics collector
+	access      atomic.Value                 // Document access counters (*accessTracker), see TrackAccess
+	uniqueLock  sync.Mutex                   // Serialise writes to unique indexes so that a value never belongs to more than one document
+}
+
+// IndexOptions alter what an index stores.
+type IndexOptions struct {
+	IndexNull bool          // Put documents with null or missing values on the index too, enabling index assisted "null" queries
+	Type      string        // Type of indexed values, one of INDEX_TYPE_* constants
+	Length    bool          // Index the length of arrays at the path instead of array elements, the index type must be number
+	Unique    bool          // Reject documents whose value already belongs to another document, see IndexUnique
+	Parts     int           // Number of index partitions, 0 for as many as document partitions
+	TTL       time.Duration // Delete documents once this long has passed since the indexed time, see IndexTTL
+}
+
+// An index being built in background.
+type indexBuild struct {
+	path       []string
+	docsPerSec int
 }
 
-// Open a collection and load all indexes.
+// Open a collection for reading and writing, and load all indexes.
 func OpenCol(db *DB, name string) (*Col, error) {
-	col := &Col{db: db, name: name}
+	return OpenColFlags(db, name, COL_RDWR)
+}
+
+// Open a collection with the specified open flags (COL_READ, COL_WRITE, or both), and load all indexes.
+func OpenColFlags(db *DB, name string, flags int) (*Col, error) {
+	col := &Col{db: db, name: name, flags: flags}
 	return col, col.load()
 }
 
+// Return the open flags of the collection.
+func (col *Col) Flags() int {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.flags
+}
+
+// Use the function to generate IDs of inserted documents (e.g. for deterministic tests, or time-ordered IDs). The
+// generated IDs must be non-negative and unique. Pass nil to go back to random IDs.
+func (col *Col) SetIDGenerator(gen func() int) {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	col.idGen = gen
+}
+
+// Return the ID of a new document. The caller must place schema lock.
+func (col *Col) newID() int {
+	if col.idGen != nil {
+		return col.idGen()
+	}
+	return col.db.newID()
+}
+
+// Return the name of the collection.
+func (col *Col) Name() string {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.name
+}
+
+// Re-open collection files (already closed by the caller) under the (possibly new) name and flags.
+// The collection handle remains valid for callers holding it. The caller must place schema lock.
+func (col *Col) reopen(name string, flags int) error {
+	reopened, err := OpenColFlags(col.db, name, flags)
+	if err != nil {
+		return err
+	}
+	col.name = reopened.name
+	col.flags = reopened.flags
+	col.parts = reopened.parts
+	col.hts = reopened.hts
+	col.indexPaths = reopened.indexPaths
+	col.indexOpts = reopened.indexOpts
+	col.meta = reopened.meta
+	col.building = reopened.building
+	col.blobs = reopened.blobs
+	col.inserts = reopened.inserts
+	col.insertLock.Lock()
+	col.lastInsert = reopened.lastInsert
+	col.insertLock.Unlock()
+	col.workers = reopened.workers
+	col.workersDone = reopened.workersDone
+	return nil
+}
+
+// Return an error if the collection was not opened with all of the required flags, or has been dropped. The caller must
+// place schema lock.
+func (col *Col) checkFlags(required int) error {
+	if col.dropped {
+		return dberr.New(dberr.ErrorColDropped, col.name)
+	} else if required&COL_READ != 0 && col.flags&COL_READ == 0 {
+		return dberr.New(dberr.ErrorColWriteOnly, col.name)
+	} else if required&COL_WRITE != 0 && col.flags&COL_WRITE == 0 {
+		return dberr.New(dberr.ErrorColReadOnly, col.name)
+	}
+	return nil
+}
+
 // Load collection schema including index schema.
 func (col *Col) load() error {
 	if err := os.MkdirAll(path.Join(col.db.path, col.name), 0700); err != nil {
@@ -46,15 +172,38 @@ func (col *Col) load() error {
 		col.hts[i] = make(map[string]*data.HashTable)
 	}
 	col.indexPaths = make(map[string][]string)
+	col.indexOpts = make(map[string]IndexOptions)
+	col.building = make(map[string]*indexBuild)
+	// Read collection metadata
+	col.meta = make(map[string]string)
+	if metaContent, err := ioutil.ReadFile(path.Join(col.db.path, col.name, COL_META_FILE)); err == nil {
+		if err := json.Unmarshal(metaContent, &col.meta); err != nil {
+			return fmt.Errorf("Collection %s has corrupted metadata file: %v", col.name, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
 	// Open collection document partitions
+	col.inserts = make([]*data.InsertLog, col.db.numParts)
 	for i := 0; i < col.db.numParts; i++ {
 		var err error
 		if col.parts[i], err = col.db.Config.OpenPartition(
 			path.Join(col.db.path, col.name, DOC_DATA_FILE+strconv.Itoa(i)),
 			path.Join(col.db.path, col.name, DOC_LOOKUP_FILE+strconv.Itoa(i))); err != nil {
 			return err
+		} else if col.inserts[i], err = col.db.Config.OpenInsertLog(
+			path.Join(col.db.path, col.name, INSERT_LOG_FILE+strconv.Itoa(i))); err != nil {
+			return err
+		}
+		if col.inserts[i].LastSeq > col.lastInsert {
+			col.lastInsert = col.inserts[i].LastSeq
 		}
 	}
+	if err := col.loadBlobs(); err != nil {
+		return err
+	} else if err := col.loadCold(); err != nil {
+		return err
+	}
 	// Look for index directories
 	colDirContent, err := ioutil.ReadDir(path.Join(col.db.path, col.name))
 	if err != nil {
@@ -68,19 +217,43 @@ func (col *Col) load() error {
 		idxName := htDir.Name()
 		idxPath := strings.Split(idxName, INDEX_PATH_SEP)
 		col.indexPaths[idxName] = idxPath
-		for i := 0; i < col.db.numParts; i++ {
-			if col.hts[i][idxName], err = col.db.Config.OpenHashTable(
-				path.Join(col.db.path, col.name, idxName, strconv.Itoa(i))); err != nil {
+		if optsContent, err := ioutil.ReadFile(path.Join(col.db.path, col.name, idxName, INDEX_OPTS_FILE)); err == nil {
+			var opts IndexOptions
+			if err := json.Unmarshal(optsContent, &opts); err != nil {
+				return fmt.Errorf("Index %v has corrupted options file: %v", idxPath, err)
+			}
+			col.indexOpts[idxName] = opts
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		for i := 0; i < col.indexParts(idxName); i++ {
+			if err = col.openIndexHT(idxName, i); err != nil {
 				return err
 			}
 		}
 	}
+	if col.db.workerQueue > 0 {
+		col.startWorkers()
+	}
 	return nil
 }
 
 // Close all collection files. Do not use the collection afterwards!
 func (col *Col) close() error {
+	col.stopWorkers()
 	errs := make([]error, 0, 0)
+	if col.bulkLoad {
+		// Do not leave incomplete indexes behind
+		if err := col.endBulkLoad(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for idxName := range col.building {
+		// Abort unfinished background index build
+		if err := col.unindex(idxName); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	for i := 0; i < col.db.numParts; i++ {
 		col.parts[i].DataLock.Lock()
 		if err := col.parts[i].Close(); err != nil {
@@ -91,8 +264,19 @@ func (col *Col) close() error {
 				errs = append(errs, err)
 			}
 		}
+		if col.blobs[i] != nil {
+			if err := col.blobs[i].Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := col.inserts[i].Close(); err != nil {
+			errs = append(errs, err)
+		}
 		col.parts[i].DataLock.Unlock()
 	}
+	// Cached statistics and access counters describe documents that are no longer available
+	col.stats.Store((*ColStats)(nil))
+	col.access.Store((*accessTracker)(nil))
 	if len(errs) == 0 {
 		return nil
 	}
@@ -122,52 +306,397 @@ func (col *Col) forEachDoc(fun func(id int, doc []byte) (moveOn bool), placeSche
 	}
 }
 
-// Do fun for all documents in the collection.
+/*
+Do fun for all documents in the collection. Nothing is iterated if the collection is write-only.
+Partitions are locked while fun runs, hence fun must not modify the collection. A document inserted or deleted by
+another goroutine during the iteration may or may not be visited, and rarely may be skipped or visited twice if the
+lookup table grows meanwhile; use ForEachDocSnapshot for stable iteration during writes. Documents are visited in the
+order of their locations, or in ascending ID order if data.Config.OrderedIteration is set.
+*/
 func (col *Col) ForEachDoc(fun func(id int, doc []byte) (moveOn bool)) {
-	col.forEachDoc(fun, true)
+	done, _ := col.db.heavy.admit(context.Background(), true)
+	defer done()
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.checkFlags(COL_READ) != nil {
+		return
+	} else if col.db.Config.OrderedIteration {
+		for _, id := range col.sortedAllIDs() {
+			part := col.parts[id%col.db.numParts]
+			part.DataLock.RLock()
+			doc, err := part.Read(id)
+			part.DataLock.RUnlock()
+			if err == nil && !fun(id, doc) {
+				return
+			}
+		}
+		return
+	}
+	col.forEachDoc(fun, false)
+}
+
+// Return IDs of all documents in ascending order, see data.Config.OrderedIteration. The caller must place schema lock.
+func (col *Col) sortedAllIDs() []int {
+	ids := make([]int, 0, col.approxDocCount(false))
+	for _, part := range col.parts {
+		part.DataLock.RLock()
+		ids = append(ids, part.IDs()...)
+		part.DataLock.RUnlock()
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+/*
+Do fun for all documents that existed when the iteration of their partition began, visiting each document exactly once.
+Document IDs of each partition are collected beforehand, then documents are read one by one without holding locks
+while fun runs, hence fun may modify the collection. Documents inserted during the iteration may not be visited,
+documents deleted during the iteration are skipped. Nothing is iterated if the collection is write-only. If
+data.Config.OrderedIteration is set, IDs of all documents are collected at once and visited in ascending order.
+*/
+func (col *Col) ForEachDocSnapshot(fun func(id int, doc []byte) (moveOn bool)) {
+	done, _ := col.db.heavy.admit(context.Background(), true)
+	defer done()
+	col.db.schemaLock.RLock()
+	if col.checkFlags(COL_READ) != nil {
+		col.db.schemaLock.RUnlock()
+		return
+	}
+	numParts, ordered := col.db.numParts, col.db.Config.OrderedIteration
+	col.db.schemaLock.RUnlock()
+	for partNum := 0; partNum < numParts; partNum++ {
+		col.db.schemaLock.RLock()
+		var ids []int
+		if ordered {
+			// IDs of all partitions are collected at once
+			ids, partNum = col.sortedAllIDs(), numParts
+		} else {
+			part := col.parts[partNum]
+			part.DataLock.RLock()
+			ids = part.IDs()
+			part.DataLock.RUnlock()
+		}
+		col.db.schemaLock.RUnlock()
+		for _, id := range ids {
+			col.db.schemaLock.RLock()
+			if col.db.cols[col.name] != col || col.checkFlags(COL_READ) != nil {
+				// The collection has been dropped or reopened write-only meanwhile
+				col.db.schemaLock.RUnlock()
+				return
+			}
+			part := col.parts[id%numParts]
+			part.DataLock.RLock()
+			doc, err := part.Read(id)
+			part.DataLock.RUnlock()
+			col.db.schemaLock.RUnlock()
+			if err == nil && !fun(id, doc) {
+				return
+			}
+		}
+	}
+}
+
+// Do fun for all documents in the order of insertion (oldest first if asc is true), regardless of physical document
+// location which changes upon update and scrub. Documents inserted before tiedot started recording insertion order,
+// or inserted by InsertRecovery, are considered the oldest. Nothing is iterated if the collection is write-only.
+func (col *Col) ForEachDocOrdered(asc bool, fun func(id int, doc []byte) (moveOn bool)) {
+	done, _ := col.db.heavy.admit(context.Background(), true)
+	defer done()
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.checkFlags(COL_READ) != nil {
+		return
+	}
+	type insertion struct {
+		id  int
+		seq int64
+	}
+	ordered := make([]insertion, 0, col.approxDocCount(false))
+	for _, part := range col.parts {
+		part.DataLock.RLock()
+		for _, id := range part.IDs() {
+			ordered = append(ordered, insertion{id: id})
+		}
+		part.DataLock.RUnlock()
+	}
+	// The latest insertion of a document counts
+	seqs := make(map[int]int64)
+	for i, part := range col.parts {
+		part.DataLock.RLock()
+		col.inserts[i].ForEach(func(id int, seq int64) bool {
+			seqs[id] = seq
+			return true
+		})
+		part.DataLock.RUnlock()
+	}
+	for i := range ordered {
+		ordered[i].seq = seqs[ordered[i].id]
+	}
+	sort.SliceStable(ordered, func(a, b int) bool {
+		if asc {
+			return ordered[a].seq < ordered[b].seq
+		}
+		return ordered[a].seq > ordered[b].seq
+	})
+	for _, doc := range ordered {
+		part := col.parts[doc.id%col.db.numParts]
+		part.DataLock.RLock()
+		docB, err := part.Read(doc.id)
+		part.DataLock.RUnlock()
+		// The document may have been deleted in the meantime
+		if err == nil && !fun(doc.id, docB) {
+			return
+		}
+	}
 }
 
 // Create an index on the path.
 func (col *Col) Index(idxPath []string) (err error) {
 	col.db.schemaLock.Lock()
 	defer col.db.schemaLock.Unlock()
+	if err = col.checkFlags(COL_WRITE); err != nil {
+		return
+	}
+	return col.index(idxPath, IndexOptions{})
+}
+
+// Create an index on the path with the options.
+func (col *Col) IndexWithOptions(idxPath []string, opts IndexOptions) (err error) {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if err = col.checkFlags(COL_WRITE); err != nil {
+		return
+	} else if err = col.checkIndexOptions(idxPath, opts); err != nil {
+		return
+	}
+	return col.index(idxPath, opts)
+}
+
+// Return an error if the index options are invalid. The caller must place schema lock.
+func (col *Col) checkIndexOptions(idxPath []string, opts IndexOptions) error {
+	if err := checkIndexType(opts.Type); err != nil {
+		return err
+	} else if opts.Length && opts.Type != INDEX_TYPE_NUMBER {
+		return fmt.Errorf("Array length index on %v must have number type", idxPath)
+	} else if opts.Parts < 0 || opts.Parts > col.db.numParts {
+		return fmt.Errorf("Index on %v may have 1 to %d partitions", idxPath, col.db.numParts)
+	} else if opts.TTL < 0 || opts.TTL > 0 && (opts.Type != INDEX_TYPE_NUMBER || opts.Length) {
+		return fmt.Errorf("TTL index on %v must have number type and a positive TTL", idxPath)
+	}
+	return nil
+}
+
+// Return the number of partitions of the index. The caller must place schema lock.
+func (col *Col) indexParts(idxName string) int {
+	if parts := col.indexOpts[idxName].Parts; parts > 0 {
+		return parts
+	}
+	return col.db.numParts
+}
+
+/*
+Return the index partition holding the hash key. The caller must place schema lock. Number keys keep their order in
+high bits, hence they are mixed to spread over partitions (and buckets, see data.HashTable.MixKeys).
+*/
+func (col *Col) indexHT(idxName string, hashKey int) *data.HashTable {
+	if col.indexOpts[idxName].Type == INDEX_TYPE_NUMBER {
+		hashKey = data.MixKey(hashKey)
+	}
+	return col.hts[hashKey%col.indexParts(idxName)][idxName]
+}
+
+// Open the hash table file of an index partition. The caller must place schema lock.
+func (col *Col) openIndexHT(idxName string, partNum int) (err error) {
+	ht, err := col.db.Config.OpenHashTable(path.Join(col.db.path, col.name, idxName, strconv.Itoa(partNum)))
+	if err != nil {
+		return
+	}
+	ht.MixKeys = col.indexOpts[idxName].Type == INDEX_TYPE_NUMBER
+	col.hts[partNum][idxName] = ht
+	return
+}
+
+// Return the options of the index on the path.
+func (col *Col) IndexOptionsOf(idxPath []string) (IndexOptions, error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err := col.checkFlags(0); err != nil {
+		return IndexOptions{}, err
+	}
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.indexPaths[idxName]; !exists {
+		return IndexOptions{}, fmt.Errorf("Path %v is not indexed", idxPath)
+	}
+	return col.indexOpts[idxName], nil
+}
+
+// Write index options into the index directory, nothing is written for default options.
+func saveIndexOptions(idxDir string, opts IndexOptions) error {
+	if opts == (IndexOptions{}) {
+		return nil
+	}
+	optsContent, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	return data.WriteFileAtomic(path.Join(idxDir, INDEX_OPTS_FILE), optsContent, 0600)
+}
+
+// Create index files for the path and start maintaining the index on document changes. The caller must place schema lock.
+func (col *Col) createIndex(idxPath []string, opts IndexOptions) (err error) {
 	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
 	if _, exists := col.indexPaths[idxName]; exists {
 		return fmt.Errorf("Path %v is already indexed", idxPath)
 	}
 	col.indexPaths[idxName] = idxPath
+	if opts != (IndexOptions{}) {
+		col.indexOpts[idxName] = opts
+	}
 	idxDir := path.Join(col.db.path, col.name, idxName)
 	if err = os.MkdirAll(idxDir, 0700); err != nil {
 		return err
+	} else if err = saveIndexOptions(idxDir, opts); err != nil {
+		return err
 	}
-	for i := 0; i < col.db.numParts; i++ {
-		if col.hts[i][idxName], err = col.db.Config.OpenHashTable(path.Join(idxDir, strconv.Itoa(i))); err != nil {
+	for i := 0; i < col.indexParts(idxName); i++ {
+		if err = col.openIndexHT(idxName, i); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// Create an index on the path. The caller must place schema lock.
+func (col *Col) index(idxPath []string, opts IndexOptions) (err error) {
+	if err = col.createIndex(idxPath, opts); err != nil {
+		return
+	}
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if opts.Unique {
+		if err = col.indexUnique(idxName); err != nil {
+			col.unindex(idxName)
+		}
+		return
+	}
 	// Put all documents on the new index
 	col.forEachDoc(func(id int, doc []byte) (moveOn bool) {
-		var docObj map[string]interface{}
-		if err := json.Unmarshal(doc, &docObj); err != nil {
+		hashKeys, err := col.indexKeys(idxName, doc)
+		if err != nil {
 			// Skip corrupted document
 			return true
 		}
-		for _, idxVal := range GetIn(docObj, idxPath) {
-			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
-				col.hts[hashKey%col.db.numParts][idxName].Put(hashKey, id)
-			}
+		for _, hashKey := range hashKeys {
+			col.indexHT(idxName, hashKey).Put(hashKey, id)
 		}
 		return true
 	}, false)
 	return
 }
 
-// Return all indexed paths.
+// Create an index on the path without blocking the collection. The index is maintained on document changes right away,
+// while existing documents are put on the index by a background task at the rate of docsPerSec (unlimited if 0).
+// Queries may not use the index until the task finishes; the unfinished index is removed if the collection is closed.
+func (col *Col) IndexBackground(idxPath []string, docsPerSec int) error {
+	return col.IndexBackgroundWithOptions(idxPath, IndexOptions{}, docsPerSec)
+}
+
+// Create an index on the path with the options without blocking the collection, see IndexBackground. Unique indexes
+// are not built in background, as their constraint relies on a complete index.
+func (col *Col) IndexBackgroundWithOptions(idxPath []string, opts IndexOptions, docsPerSec int) error {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if err := col.checkFlags(COL_WRITE); err != nil {
+		return err
+	} else if docsPerSec < 0 {
+		return fmt.Errorf("Invalid index build rate %d", docsPerSec)
+	} else if opts.Unique {
+		return fmt.Errorf("Unique index %v cannot be built in background", idxPath)
+	} else if err := col.checkIndexOptions(idxPath, opts); err != nil {
+		return err
+	}
+	if err := col.createIndex(idxPath, opts); err != nil {
+		return err
+	}
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	build := &indexBuild{path: idxPath, docsPerSec: docsPerSec}
+	col.building[idxName] = build
+	go col.db.runTask(fmt.Sprintf("build index %v of %s", idxPath, col.name), func() error {
+		return col.buildIndex(idxName, build)
+	})
+	return nil
+}
+
+// Put existing documents on an index being built in background, at the rate limited by the build parameters.
+func (col *Col) buildIndex(idxName string, build *indexBuild) error {
+	aborted := fmt.Errorf("Background build of index %v was aborted", build.path)
+	start := time.Now()
+	indexed := 0
+	for partNum := 0; partNum < col.db.numParts; partNum++ {
+		col.db.schemaLock.RLock()
+		if col.building[idxName] != build {
+			col.db.schemaLock.RUnlock()
+			return aborted
+		}
+		numPages := col.parts[partNum].ApproxDocCount()/BACKGROUND_INDEX_BATCH + 1
+		col.db.schemaLock.RUnlock()
+		for page := 0; page < numPages; page++ {
+			col.db.schemaLock.RLock()
+			if col.building[idxName] != build {
+				col.db.schemaLock.RUnlock()
+				return aborted
+			}
+			part := col.parts[partNum]
+			part.DataLock.RLock()
+			part.ForEachDoc(page, numPages, func(id int, doc []byte) bool {
+				indexed++
+				hashKeys, err := col.indexKeys(idxName, doc)
+				if err != nil {
+					// Skip corrupted document
+					return true
+				}
+				for _, hashKey := range hashKeys {
+					ht := col.indexHT(idxName, hashKey)
+					ht.Lock.Lock()
+					// The document may have been indexed already by a concurrent update
+					putOnce(ht, hashKey, id)
+					ht.Lock.Unlock()
+				}
+				return true
+			})
+			part.DataLock.RUnlock()
+			col.db.schemaLock.RUnlock()
+			if build.docsPerSec > 0 {
+				if wait := time.Duration(indexed)*time.Second/time.Duration(build.docsPerSec) - time.Since(start); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+		}
+	}
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if col.building[idxName] != build {
+		return aborted
+	}
+	delete(col.building, idxName)
+	return nil
+}
+
+// Return true if the index on the path is being built in background.
+func (col *Col) IndexBuilding(idxPath []string) bool {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	_, building := col.building[strings.Join(idxPath, INDEX_PATH_SEP)]
+	return building && !col.dropped
+}
+
+// Return all indexed paths, none if the collection has been dropped.
 func (col *Col) AllIndexes() (ret [][]string) {
 	col.db.schemaLock.RLock()
 	defer col.db.schemaLock.RUnlock()
 	ret = make([][]string, 0, len(col.indexPaths))
+	if col.checkFlags(0) != nil {
+		return
+	}
 	for _, path := range col.indexPaths {
 		pathCopy := make([]string, len(path))
 		for i, p := range path {
@@ -178,30 +707,244 @@ func (col *Col) AllIndexes() (ret [][]string) {
 	return ret
 }
 
+// IndexStats describes an index, see Col.IndexStats.
+type IndexStats struct {
+	Path     []string     // Indexed path
+	Options  IndexOptions // Options the index was created with
+	Building bool         // Whether the index is being built in background
+	Entries  int          // Number of entries in hash tables of all partitions
+	Distinct int          // Estimated number of distinct indexed values
+	Bytes    int          // Size of hash table files in use
+}
+
+// Return statistics of all indexes. Entries are counted by going through hash tables, which takes a while on large
+// collections; distinct values are estimated by sketches of the hash tables, see EstimateLookup. Return no statistics
+// if the collection has been dropped.
+func (col *Col) IndexStats() (ret []IndexStats) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	ret = make([]IndexStats, 0, len(col.indexPaths))
+	if col.checkFlags(0) != nil {
+		return
+	}
+	for idxName, idxPath := range col.indexPaths {
+		stats := IndexStats{Path: append([]string{}, idxPath...), Options: col.indexOpts[idxName]}
+		_, stats.Building = col.building[idxName]
+		for i := 0; i < col.indexParts(idxName); i++ {
+			ht := col.hts[i][idxName]
+			ht.Lock.RLock()
+			keys, _ := ht.GetPartition(0, 1)
+			stats.Entries += len(keys)
+			// Equal values are in the same partition, hence the partitions do not share distinct values
+			stats.Distinct += ht.EstimateDistinct()
+			stats.Bytes += ht.Used
+			ht.Lock.RUnlock()
+		}
+		ret = append(ret, stats)
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		return strings.Join(ret[a].Path, INDEX_PATH_SEP) < strings.Join(ret[b].Path, INDEX_PATH_SEP)
+	})
+	return
+}
+
+/*
+Return the estimated number of documents having the value on the index of the path, without looking them up. Estimates
+come from count-min sketches of index hash tables, built upon first use and maintained on writes: they are never below
+the actual number, and are exact unless many distinct values share the sketch counters (or hash keys) of the value.
+Null estimates the documents without a value, if the index has IndexNull option.
+*/
+func (col *Col) EstimateLookup(idxPath []string, val interface{}) (int, error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err := col.checkFlags(0); err != nil {
+		return 0, err
+	}
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.indexPaths[idxName]; !exists {
+		return 0, fmt.Errorf("Path %v is not indexed", idxPath)
+	}
+	return col.estimateLookup(idxName, val), nil
+}
+
+// Return the estimated number of documents having the value on the index. The caller must place schema lock.
+func (col *Col) estimateLookup(idxName string, val interface{}) int {
+	opts := col.indexOpts[idxName]
+	key := indexNullKey
+	if val != nil {
+		canon, ok := opts.canonical(val)
+		if !ok {
+			return 0
+		}
+		key = opts.key(canon)
+	} else if !opts.IndexNull {
+		return 0
+	}
+	ht := col.indexHT(idxName, key)
+	ht.Lock.RLock()
+	defer ht.Lock.RUnlock()
+	return ht.EstimateCount(key)
+}
+
+// An entry of index dump.
+type indexDumpEntry struct {
+	Key int `json:"key"` // Hash key of the indexed value
+	ID  int `json:"id"`  // Document ID
+}
+
+/*
+Write all entries of the index as JSON objects {"key": hash key, "id": document ID}, one entry per line, partition by
+partition. Indexes keep hash keys of values rather than the values themselves; compute the keys of known values with
+StrHash (or NumberKey and BoolKey for typed indexes) to compare the dump against external sources.
+*/
+func (col *Col) DumpIndex(idxPath []string, out io.Writer) error {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err := col.checkFlags(0); err != nil {
+		return err
+	}
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.indexPaths[idxName]; !exists {
+		return fmt.Errorf("Path %v is not indexed", idxPath)
+	}
+	encoder := json.NewEncoder(out)
+	for i := 0; i < col.indexParts(idxName); i++ {
+		ht := col.hts[i][idxName]
+		ht.Lock.RLock()
+		keys, vals := ht.GetPartition(0, 1)
+		ht.Lock.RUnlock()
+		for i, key := range keys {
+			if err := encoder.Encode(indexDumpEntry{Key: key, ID: vals[i]}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Remove an index.
 func (col *Col) Unindex(idxPath []string) error {
 	col.db.schemaLock.Lock()
 	defer col.db.schemaLock.Unlock()
+	if err := col.checkFlags(COL_WRITE); err != nil {
+		return err
+	}
 	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
 	if _, exists := col.indexPaths[idxName]; !exists {
 		return fmt.Errorf("Path %v is not indexed", idxPath)
 	}
-	delete(col.indexPaths, idxName)
-	for i := 0; i < col.db.numParts; i++ {
+	return col.unindex(idxName)
+}
+
+// Remove an index by name. The caller must place schema lock.
+func (col *Col) unindex(idxName string) error {
+	for i := 0; i < col.indexParts(idxName); i++ {
 		col.hts[i][idxName].Close()
 		delete(col.hts[i], idxName)
 	}
+	delete(col.indexPaths, idxName)
+	delete(col.indexOpts, idxName)
+	delete(col.building, idxName)
 	if err := os.RemoveAll(path.Join(col.db.path, col.name, idxName)); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Suspend index maintenance for mass ingestion. Documents inserted, updated, or deleted afterwards are not
+// reflected in indexes (and index lookups give incomplete results) until EndBulkLoad rebuilds all indexes.
+func (col *Col) BeginBulkLoad() error {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if err := col.checkFlags(COL_WRITE); err != nil {
+		return err
+	} else if col.bulkLoad {
+		return fmt.Errorf("Collection %s is already in bulk load mode", col.name)
+	}
+	col.bulkLoad = true
+	return nil
+}
+
+// Resume index maintenance and rebuild all indexes in parallel.
+func (col *Col) EndBulkLoad() error {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if err := col.checkFlags(0); err != nil {
+		return err
+	} else if !col.bulkLoad {
+		return fmt.Errorf("Collection %s is not in bulk load mode", col.name)
+	}
+	return col.endBulkLoad()
+}
+
+// Resume index maintenance and rebuild all indexes, one goroutine per partition. The caller must place schema lock.
+func (col *Col) endBulkLoad() error {
+	col.bulkLoad = false
+	for i := 0; i < col.db.numParts; i++ {
+		for _, ht := range col.hts[i] {
+			if err := ht.Clear(); err != nil {
+				return err
+			}
+		}
+	}
+	wg := new(sync.WaitGroup)
+	wg.Add(col.db.numParts)
+	for i := 0; i < col.db.numParts; i++ {
+		go func(part *data.Partition) {
+			defer wg.Done()
+			part.DataLock.RLock()
+			defer part.DataLock.RUnlock()
+			part.ForEachDoc(0, 1, func(id int, doc []byte) bool {
+				col.indexDoc(id, doc)
+				return true
+			})
+		}(col.parts[i])
+	}
+	wg.Wait()
+	return nil
+}
+
+// Return true if the collection is in bulk load mode.
+func (col *Col) InBulkLoad() bool {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.bulkLoad
+}
+
+// Remove all documents and index entries. The caller must place schema lock.
+func (col *Col) clear() error {
+	for i := 0; i < col.db.numParts; i++ {
+		if err := col.parts[i].Clear(); err != nil {
+			return err
+		}
+		for _, ht := range col.hts[i] {
+			if err := ht.Clear(); err != nil {
+				return err
+			}
+		}
+		if col.blobs[i] != nil {
+			if err := col.blobs[i].Clear(); err != nil {
+				return err
+			}
+		}
+		if err := col.inserts[i].Clear(); err != nil {
+			return err
+		}
+	}
+	col.forgetAllAccess()
+	return nil
+}
+
 func (col *Col) approxDocCount(placeSchemaLock bool) int {
 	if placeSchemaLock {
 		col.db.schemaLock.RLock()
 		defer col.db.schemaLock.RUnlock()
 	}
+	if col.checkFlags(0) != nil {
+		return 0
+	} else if stats := col.cachedStats(); stats != nil {
+		return stats.Docs
+	}
 	total := 0
 	for _, part := range col.parts {
 		part.DataLock.RLock()
@@ -211,15 +954,22 @@ func (col *Col) approxDocCount(placeSchemaLock bool) int {
 	return total
 }
 
-// Return approximate number of documents in the collection.
+// Return approximate number of documents in the collection, as of the latest collection of statistics if the
+// statistics collector is running (see StartStatsCollector), 0 if the collection has been dropped.
 func (col *Col) ApproxDocCount() int {
 	return col.approxDocCount(true)
 }
 
 // Divide the collection into roughly equally sized pages, and do fun on all documents in the specified page.
+// Nothing is iterated if the collection is write-only.
 func (col *Col) ForEachDocInPage(page, total int, fun func(id int, doc []byte) bool) {
+	done, _ := col.db.heavy.admit(context.Background(), true)
+	defer done()
 	col.db.schemaLock.RLock()
 	defer col.db.schemaLock.RUnlock()
+	if col.checkFlags(COL_READ) != nil {
+		return
+	}
 	for iteratePart := 0; iteratePart < col.db.numParts; iteratePart++ {
 		part := col.parts[iteratePart]
 		part.DataLock.RLock()
@@ -230,3 +980,71 @@ func (col *Col) ForEachDocInPage(page, total int, fun func(id int, doc []byte) b
 		part.DataLock.RUnlock()
 	}
 }
+
+// Write collection metadata into the metadata file. The caller must place schema lock.
+func (col *Col) saveMeta() error {
+	metaContent, err := json.Marshal(col.meta)
+	if err != nil {
+		return err
+	}
+	return data.WriteFileAtomic(path.Join(col.db.path, col.name, COL_META_FILE), metaContent, 0600)
+}
+
+// Set an application-level metadata value (e.g. schema version, description, owner) and persist it.
+func (col *Col) SetMeta(key, value string) error {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if err := col.checkFlags(COL_WRITE); err != nil {
+		return err
+	}
+	col.meta[key] = value
+	return col.saveMeta()
+}
+
+// Remove an application-level metadata value and persist the change.
+func (col *Col) UnsetMeta(key string) error {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if err := col.checkFlags(COL_WRITE); err != nil {
+		return err
+	}
+	delete(col.meta, key)
+	return col.saveMeta()
+}
+
+// Return a copy of all application-level metadata.
+func (col *Col) Meta() map[string]string {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	ret := make(map[string]string, len(col.meta))
+	for key, value := range col.meta {
+		ret[key] = value
+	}
+	return ret
+}
+
+// Copy files of all partitions (file name prefix followed by partition number) from one collection directory to another.
+func copyPartitionFiles(prefix, fromDir, toDir string, numParts int) error {
+	for i := 0; i < numParts; i++ {
+		from, err := os.Open(path.Join(fromDir, prefix+strconv.Itoa(i)))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		to, err := os.OpenFile(path.Join(toDir, prefix+strconv.Itoa(i)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			from.Close()
+			return err
+		}
+		_, err = io.Copy(to, from)
+		from.Close()
+		if closeErr := to.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
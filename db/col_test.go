@@ -1,14 +1,20 @@
 package db
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/bouk/monkey"
 	"github.com/pkg/errors"
 )
@@ -182,3 +188,761 @@ func TestForEachDocInPageForEachDocIsFalse(t *testing.T) {
 		return true
 	})
 }
+
+func TestColFlags(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	if db.Use("col").Flags() != COL_RDWR {
+		t.Fatal(db.Use("col").Flags())
+	}
+	id, err := db.Use("col").Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Reopen("col", 0) == nil || db.Reopen("does not exist", COL_READ) == nil {
+		t.Fatal("Did not error")
+	}
+	// Read-only collection rejects mutations
+	if err := db.Reopen("col", COL_READ); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if _, err := col.Insert(map[string]interface{}{"a": 2}); dberr.Type(err) != dberr.ErrorColReadOnly {
+		t.Fatal(err)
+	}
+	if err := col.Update(id, map[string]interface{}{"a": 2}); dberr.Type(err) != dberr.ErrorColReadOnly {
+		t.Fatal(err)
+	}
+	if err := col.Delete(id); dberr.Type(err) != dberr.ErrorColReadOnly {
+		t.Fatal(err)
+	}
+	if err := col.Index([]string{"a"}); dberr.Type(err) != dberr.ErrorColReadOnly {
+		t.Fatal(err)
+	}
+	if err := db.Truncate("col"); dberr.Type(err) != dberr.ErrorColReadOnly {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(id); err != nil || doc["a"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	// Write-only collection rejects reads
+	if err := db.Reopen("col", COL_WRITE); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if _, err := col.Read(id); dberr.Type(err) != dberr.ErrorColWriteOnly {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery("all", col, &result); dberr.Type(err) != dberr.ErrorColWriteOnly {
+		t.Fatal(err)
+	}
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		t.Fatal("Should not iterate")
+		return false
+	})
+	if err := col.Update(id, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+	// Flags survive rename
+	if err := db.Rename("col", "col2"); err != nil {
+		t.Fatal(err)
+	}
+	if db.Use("col2").Flags() != COL_WRITE {
+		t.Fatal(db.Use("col2").Flags())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+func TestColMeta(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if len(col.Meta()) != 0 {
+		t.Fatal(col.Meta())
+	}
+	if err := col.SetMeta("owner", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.SetMeta("version", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.UnsetMeta("owner"); err != nil {
+		t.Fatal(err)
+	}
+	// Returned metadata is a copy
+	col.Meta()["version"] = "3"
+	if meta := col.Meta(); len(meta) != 1 || meta["version"] != "2" {
+		t.Fatal(meta)
+	}
+	// Metadata survives scrub and re-opening the database
+	if err := db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	if meta := db.Use("col").Meta(); len(meta) != 1 || meta["version"] != "2" {
+		t.Fatal(meta)
+	}
+	if err := db.Reopen("col", COL_READ); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use("col").SetMeta("a", "b"); dberr.Type(err) != dberr.ErrorColReadOnly {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupted metadata file
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/col/"+COL_META_FILE, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDB(TEST_DATA_DIR); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := col.EndBulkLoad(); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err := col.BeginBulkLoad(); err != nil || !col.InBulkLoad() {
+		t.Fatal(err)
+	}
+	if err := col.BeginBulkLoad(); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Index is not maintained during bulk load
+	for i := 0; i < 100; i++ {
+		if _, err := col.Insert(map[string]interface{}{"a": 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := col.Update(stale, map[string]interface{}{"a": 3}); err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": 2, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	// All indexes are rebuilt at the end
+	if err := col.EndBulkLoad(); err != nil || col.InBulkLoad() {
+		t.Fatal(err)
+	}
+	for val, count := range map[int]int{1: 0, 2: 100, 3: 1} {
+		result := make(map[int]struct{})
+		if err := EvalQuery(map[string]interface{}{"eq": val, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != count {
+			t.Fatal(val, result, err)
+		}
+	}
+	// Closing the database ends bulk load
+	if err := col.BeginBulkLoad(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := col.Insert(map[string]interface{}{"a": 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	result = make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": 4, "in": []interface{}{"a"}}, db.Use("col"), &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	// Read-only collection may not bulk load
+	if err := db.Reopen("col", COL_READ); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use("col").BeginBulkLoad(); dberr.Type(err) != dberr.ErrorColReadOnly {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexBackground(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	for i := 0; i < 300; i++ {
+		if _, err := col.Insert(map[string]interface{}{"a": i % 3}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := col.IndexBackground([]string{"a"}, -1); err == nil {
+		t.Fatal("Did not error")
+	}
+	failures := make(chan error, 10)
+	db.OnError(func(err error) {
+		failures <- err
+	})
+	// 300 documents at 1000 documents per second take a while
+	if err := col.IndexBackground([]string{"a"}, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.IndexBackground([]string{"a"}, 0); err == nil {
+		t.Fatal("Did not error")
+	}
+	if !col.IndexBuilding([]string{"a"}) {
+		t.Fatal("Index is not building")
+	}
+	// Queries do not use the unfinished index
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, col, &result); dberr.Type(err) != dberr.ErrorIndexBuilding {
+		t.Fatal(err)
+	}
+	// New writes are tracked during the build
+	newDoc, err := col.Insert(map[string]interface{}{"a": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for col.IndexBuilding([]string{"a"}) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatal("Index build was not throttled", elapsed)
+	}
+	for val, count := range map[int]int{0: 100, 1: 100, 2: 100, 3: 1} {
+		result := make(map[int]struct{})
+		if err := EvalQuery(map[string]interface{}{"eq": val, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != count {
+			t.Fatal(val, len(result), err)
+		}
+	}
+	if doc, err := col.Read(newDoc); err != nil || doc["a"].(float64) != 3 {
+		t.Fatal(doc, err)
+	}
+	// Unindex aborts the build
+	if err := col.IndexBackground([]string{"b"}, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.Unindex([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-failures:
+		if !strings.Contains(err.Error(), "aborted") {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Build was not aborted")
+	}
+	if len(col.AllIndexes()) != 1 || col.IndexBuilding([]string{"b"}) {
+		t.Fatal(col.AllIndexes())
+	}
+	// Closing the collection removes the unfinished index
+	if err := col.IndexBackground([]string{"b"}, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Rename("col", "col2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(col.AllIndexes()) != 1 {
+		t.Fatal(col.AllIndexes())
+	}
+}
+
+func TestIndexBackgroundWrites(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 300)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := col.IndexBackgroundWithOptions([]string{"a"}, IndexOptions{Unique: true}, 0); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err := col.IndexBackgroundWithOptions([]string{"a"}, IndexOptions{Type: INDEX_TYPE_NUMBER}, 1000); err != nil {
+		t.Fatal(err)
+	}
+	// A document put on the index by both the build and a write is indexed once
+	dup, err := col.Insert(map[string]interface{}{"a": 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !col.IndexBuilding([]string{"a"}) {
+		t.Fatal("Index is not building")
+	}
+	db.schemaLock.RLock()
+	col.indexDoc(dup, []byte(`{"a": 5000}`))
+	keys, _ := col.indexKeys("a", []byte(`{"a": 5000}`))
+	entries := col.hts[keys[0]%db.numParts]["a"].Get(keys[0], 0)
+	db.schemaLock.RUnlock()
+	if len(entries) != 1 {
+		t.Fatal(entries)
+	}
+	// Update documents while the build goes through them
+	for i, id := range ids {
+		if err := col.Update(id, map[string]interface{}{"a": 1000 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for col.IndexBuilding([]string{"a"}) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Documents indexed by both the build and the updates must not leave entries behind
+	for i, id := range ids {
+		if err := col.Update(id, map[string]interface{}{"a": 2000 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, id := range ids {
+		for val, expected := range map[int][]int{i: {}, 1000 + i: {}, 2000 + i: {id}} {
+			result := make(map[int]struct{})
+			if err := EvalQuery(map[string]interface{}{"eq": val, "in": []interface{}{"a"}}, col, &result); err != nil {
+				t.Fatal(err)
+			} else if !ensureMapHasKeys(result, expected...) {
+				t.Fatal(val, result)
+			}
+		}
+	}
+}
+
+func TestIndexStats(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.IndexWithOptions([]string{"b"}, IndexOptions{Type: INDEX_TYPE_NUMBER}); err != nil {
+		t.Fatal(err)
+	} else if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := col.Insert(map[string]interface{}{"a": i, "b": []interface{}{i, i + 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := col.IndexStats()
+	if len(stats) != 2 || stats[0].Path[0] != "a" || stats[0].Entries != 10 || stats[1].Entries != 20 ||
+		stats[1].Options.Type != INDEX_TYPE_NUMBER || stats[1].Building || stats[0].Bytes <= 0 ||
+		stats[0].Distinct != 10 || stats[1].Distinct != 11 {
+		t.Fatal(stats)
+	}
+}
+
+func TestEstimateLookup(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.IndexWithOptions([]string{"kind"}, IndexOptions{IndexNull: true}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0)
+	for i := 0; i < 100; i++ {
+		doc := map[string]interface{}{"kind": "rare"}
+		if i >= 10 {
+			doc["kind"] = "common"
+		}
+		if i >= 90 {
+			delete(doc, "kind")
+		}
+		id, err := col.Insert(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for val, expected := range map[interface{}]int{"rare": 10, "common": 80, nil: 10, "none": 0} {
+		if estimate, err := col.EstimateLookup([]string{"kind"}, val); err != nil || estimate != expected {
+			t.Fatal(val, estimate, err)
+		}
+	}
+	// Estimates follow document changes once they are in use
+	for _, id := range ids[:5] {
+		if err := col.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := col.Update(ids[10], map[string]interface{}{"kind": "rare"}); err != nil {
+		t.Fatal(err)
+	}
+	if estimate, _ := col.EstimateLookup([]string{"kind"}, "rare"); estimate != 6 {
+		t.Fatal(estimate)
+	} else if estimate, _ = col.EstimateLookup([]string{"kind"}, "common"); estimate != 79 {
+		t.Fatal(estimate)
+	}
+	if stats := col.IndexStats(); len(stats) != 1 || stats[0].Distinct != 3 {
+		t.Fatal(stats)
+	}
+	if _, err := col.EstimateLookup([]string{"nope"}, 1); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestDumpIndex(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[[2]int]bool)
+	for i := 0; i < 10; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": []interface{}{i, "x"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[[2]int{StrHash(strconv.Itoa(i)), id}] = true
+		want[[2]int{StrHash("x"), id}] = true
+	}
+	var out bytes.Buffer
+	if err := col.DumpIndex([]string{"a"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var entry map[string]int
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		} else if !want[[2]int{entry["key"], entry["id"]}] {
+			t.Fatal(entry)
+		}
+		delete(want, [2]int{entry["key"], entry["id"]})
+	}
+	if len(want) != 0 {
+		t.Fatal(want)
+	}
+	if err := col.DumpIndex([]string{"b"}, &out); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestForEachDocOrdered(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 20)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ordered := func(asc bool) (ret []int) {
+		db.Use("col").ForEachDocOrdered(asc, func(id int, doc []byte) bool {
+			ret = append(ret, id)
+			return true
+		})
+		return
+	}
+	check := func(expected []int) {
+		asc, desc := ordered(true), ordered(false)
+		if len(asc) != len(expected) || len(desc) != len(expected) {
+			t.Fatal(asc, desc, expected)
+		}
+		for i, id := range expected {
+			if asc[i] != id || desc[len(expected)-1-i] != id {
+				t.Fatal(asc, desc, expected)
+			}
+		}
+	}
+	check(ids)
+	logLen := func() (n int) {
+		for _, log := range db.Use("col").inserts {
+			n += log.Len()
+		}
+		return
+	}
+	// Relocating documents by growing them, deleting documents, and scrubbing do not change the order
+	if err := col.Update(ids[0], map[string]interface{}{"n": strings.Repeat("a", 1000)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.Delete(ids[5]); err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids[:5], ids[6:]...)
+	if err := db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	check(ids)
+	// Scrub leaves out entries of deleted documents
+	if n := logLen(); n != len(ids) {
+		t.Fatal(n)
+	}
+	// Order survives reopening
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	id, err := db.Use("col").Insert(map[string]interface{}{"n": 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(append(ids, id))
+	// Sequence numbers continue from the insertion logs
+	if seq := db.Use("col").lastInsert; seq != 21 {
+		t.Fatal(seq)
+	}
+	// Stop early
+	count := 0
+	db.Use("col").ForEachDocOrdered(true, func(id int, doc []byte) bool {
+		count++
+		return count < 3
+	})
+	if count != 3 {
+		t.Fatal(count)
+	}
+	// Deleting documents compacts the log
+	if deleted, err := db.Use("col").DeleteMany(ids); err != nil || deleted != len(ids) {
+		t.Fatal(deleted, err)
+	}
+	check([]int{id})
+	if n := logLen(); n != 1 {
+		t.Fatal(n)
+	}
+}
+
+func TestTruncateShrinksFiles(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(TEST_DATA_DIR, "data-config.json"), []byte(`{"ColFileGrowth": 4096, "HTFileGrowth": 4096, "PerBucket": 4, "HashBits": 2}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dataFile := path.Join(TEST_DATA_DIR, "col", DOC_DATA_FILE+"0")
+	htFile := path.Join(TEST_DATA_DIR, "col", "a", "0")
+	for _, file := range []string{dataFile, htFile} {
+		if info, err := os.Stat(file); err != nil || info.Size() <= 4096 {
+			t.Fatal(file, info, err)
+		}
+	}
+	if err := db.Truncate("col"); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{dataFile, htFile} {
+		if info, err := os.Stat(file); err != nil || info.Size() != 4096 {
+			t.Fatal(file, info, err)
+		}
+	}
+	if _, err := col.Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForEachDocSnapshot(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	initial := make(map[int]struct{})
+	for i := 0; i < 100; i++ {
+		id, err := col.Insert(map[string]interface{}{"i": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		initial[id] = struct{}{}
+	}
+	// Modify the collection while iterating: grow documents, delete ten documents, insert new documents
+	visited := make(map[int]struct{})
+	deleted := make(map[int]struct{})
+	inserted := make(map[int]struct{})
+	col.ForEachDocSnapshot(func(id int, doc []byte) bool {
+		if _, dup := visited[id]; dup {
+			t.Fatal("Visited twice", id)
+		}
+		visited[id] = struct{}{}
+		if len(deleted) == 0 {
+			for other := range initial {
+				if other != id && len(deleted) < 10 {
+					if err := col.Delete(other); err != nil {
+						t.Fatal(err)
+					}
+					deleted[other] = struct{}{}
+				}
+			}
+		}
+		if err := col.Update(id, map[string]interface{}{"padding": strings.Repeat("a", 1000)}); err != nil && dberr.Type(err) != dberr.ErrorNoDoc {
+			t.Fatal(err)
+		}
+		if _, isInitial := initial[id]; isInitial {
+			newID, err := col.Insert(map[string]interface{}{"new": true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			inserted[newID] = struct{}{}
+		}
+		return true
+	})
+	for id := range initial {
+		_, isDeleted := deleted[id]
+		if _, isVisited := visited[id]; isVisited == isDeleted {
+			t.Fatal(id, isVisited, isDeleted)
+		}
+	}
+	for id := range visited {
+		_, isInitial := initial[id]
+		if _, isInserted := inserted[id]; !isInitial && !isInserted {
+			t.Fatal("Visited unknown document", id)
+		}
+	}
+	// Stop early
+	count := 0
+	col.ForEachDocSnapshot(func(id int, doc []byte) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Fatal(count)
+	}
+}
+
+func TestOrderedIteration(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Config.OrderedIteration = true
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 0)
+	for i := 0; i < 200; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	visit := func(iterate func(fun func(id int, doc []byte) bool)) []int {
+		visited := make([]int, 0)
+		iterate(func(id int, doc []byte) bool {
+			visited = append(visited, id)
+			return true
+		})
+		return visited
+	}
+	for _, visited := range [][]int{visit(col.ForEachDoc), visit(col.ForEachDocSnapshot), readCursor(t, col.Query("all"))} {
+		if !reflect.DeepEqual(visited, ids) {
+			t.Fatal(visited)
+		}
+	}
+	scanned := make([]int, 0)
+	col.ScanPaths([][]string{{"a"}}, func(id int, values []interface{}) bool {
+		scanned = append(scanned, id)
+		return len(scanned) < 10
+	})
+	if !reflect.DeepEqual(scanned, ids[:10]) {
+		t.Fatal(scanned)
+	}
+}
@@ -0,0 +1,124 @@
+// Cost estimates of queries, for evaluating the cheapest sub-queries of an intersection first.
+
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Return the parameter the value is a placeholder of, or the value itself. Without parameters (nil), placeholders are
+// taken as values.
+func bindParam(val interface{}, params []interface{}) (interface{}, bool) {
+	if params == nil {
+		return val, true
+	} else if paramNum, isPlaceholder := placeholder(val); isPlaceholder {
+		if paramNum < 1 || paramNum > len(params) {
+			return nil, false
+		}
+		return params[paramNum-1], true
+	}
+	return val, true
+}
+
+/*
+Return the estimated number of documents in the query result, or -1 if unknown. Lookups are estimated by index
+sketches (see EstimateLookup), "all" by the statistics cached by the statistics collector if it is running, and
+intersections and unions of them are estimated from their sub-queries; other operations are not estimated. The caller
+must place schema lock.
+*/
+func (col *Col) estimateQuery(q interface{}, params []interface{}) int {
+	switch expr := q.(type) {
+	case []interface{}: // union
+		sum := 0
+		for _, subExpr := range expr {
+			estimate := col.estimateQuery(subExpr, params)
+			if estimate < 0 {
+				return -1
+			}
+			sum += estimate
+		}
+		return sum
+	case string:
+		if expr != "all" {
+			return 1
+		} else if stats := col.cachedStats(); stats != nil {
+			return stats.Docs
+		}
+	case map[string]interface{}:
+		if lookupValue, lookup := expr["eq"]; lookup {
+			return col.estimateLookupExpr(lookupValue, expr, params)
+		} else if lookupValues, multiLookup := expr["all"]; multiLookup {
+			return col.estimateMultiLookup(lookupValues, true, expr, params)
+		} else if lookupValues, multiLookup := expr["any"]; multiLookup {
+			return col.estimateMultiLookup(lookupValues, false, expr, params)
+		} else if subExprs, intersect := expr["n"]; intersect && !hasOperation(expr, "has", "null") {
+			// As small as the smallest known sub-query result
+			subExprVecs, _ := subExprs.([]interface{})
+			min := -1
+			for _, subExpr := range subExprVecs {
+				if estimate := col.estimateQuery(subExpr, params); estimate >= 0 && (min < 0 || estimate < min) {
+					min = estimate
+				}
+			}
+			return min
+		}
+	}
+	return -1
+}
+
+// Return the estimated number of documents found by the lookup expression, or -1 if unknown.
+func (col *Col) estimateLookupExpr(lookupValue interface{}, expr map[string]interface{}, params []interface{}) int {
+	lookupValue, bound := bindParam(lookupValue, params)
+	vecPath, isVec := expr["in"].([]interface{})
+	if !bound || !isVec || lookupValue == nil {
+		return -1
+	}
+	strPath := make([]string, len(vecPath))
+	for i, segment := range vecPath {
+		strPath[i] = fmt.Sprint(segment)
+	}
+	idxName := strings.Join(strPath, INDEX_PATH_SEP)
+	if _, indexed := col.indexPaths[idxName]; !indexed {
+		return -1
+	} else if _, building := col.building[idxName]; building {
+		return -1
+	}
+	estimate := col.estimateLookup(idxName, lookupValue)
+	if limit, hasLimit := expr["limit"]; hasLimit {
+		limit, _ = bindParam(limit, params)
+		if floatLimit, ok := limit.(float64); ok && floatLimit > 0 && int(floatLimit) < estimate {
+			estimate = int(floatLimit)
+		} else if intLimit, ok := limit.(int); ok && intLimit > 0 && intLimit < estimate {
+			estimate = intLimit
+		}
+	}
+	return estimate
+}
+
+// Return the estimated number of documents found by the multi-value lookup, or -1 if unknown.
+func (col *Col) estimateMultiLookup(lookupValues interface{}, matchAll bool, expr map[string]interface{}, params []interface{}) int {
+	lookupValues, bound := bindParam(lookupValues, params)
+	vecValues, ok := lookupValues.([]interface{})
+	if !bound || !ok || len(vecValues) == 0 {
+		return -1
+	}
+	ret := 0
+	for i, val := range vecValues {
+		estimate := col.estimateLookupExpr(val, map[string]interface{}{"in": expr["in"]}, nil)
+		if estimate < 0 {
+			return -1
+		} else if !matchAll {
+			ret += estimate
+		} else if i == 0 || estimate < ret {
+			ret = estimate
+		}
+	}
+	if limit, hasLimit := expr["limit"]; hasLimit {
+		limit, _ = bindParam(limit, params)
+		if floatLimit, ok := limit.(float64); ok && floatLimit > 0 && int(floatLimit) < ret {
+			ret = int(floatLimit)
+		}
+	}
+	return ret
+}
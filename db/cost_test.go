@@ -0,0 +1,135 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func parseQuery(t *testing.T, q string) (ret interface{}) {
+	if err := json.Unmarshal([]byte(q), &ret); err != nil {
+		t.Fatal(q, err)
+	}
+	return
+}
+
+func TestIntersectOrder(t *testing.T) {
+	sets := []map[int]struct{}{
+		{1: {}, 2: {}, 3: {}, 4: {}},
+		{2: {}, 3: {}},
+		{1: {}, 2: {}, 3: {}},
+	}
+	costs := []int{4, -1, 3}
+	order := make([]int, 0)
+	withins := make([]int, 0)
+	result := make(map[int]struct{})
+	if err := intersect(len(sets), func(i int, within map[int]struct{}, subResult *map[int]struct{}) error {
+		order = append(order, i)
+		if within == nil {
+			withins = append(withins, -1)
+		} else {
+			withins = append(withins, len(within))
+		}
+		for id := range sets[i] {
+			(*subResult)[id] = struct{}{}
+		}
+		return nil
+	}, func(i int) int {
+		return costs[i]
+	}, &result); err != nil {
+		t.Fatal(err)
+	}
+	// Cheapest first, unknown cost last
+	if !reflect.DeepEqual(order, []int{2, 0, 1}) || !reflect.DeepEqual(withins, []int{-1, 3, 3}) || !ensureMapHasKeys(result, 2, 3) {
+		t.Fatal(order, withins, result)
+	}
+}
+
+func TestCostBasedIntersection(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"kind"}); err != nil {
+		t.Fatal(err)
+	} else if err := col.Index([]string{"tag"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]int, 0)
+	for i := 0; i < 200; i++ {
+		doc := map[string]interface{}{"kind": "common", "tag": []interface{}{"x"}}
+		if i%50 == 0 {
+			doc["tag"] = []interface{}{"x", "rare"}
+		}
+		id, err := col.Insert(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%50 == 0 {
+			expected = append(expected, id)
+		}
+	}
+	rareOnly, err := col.Insert(map[string]interface{}{"kind": "other", "tag": "rare"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Estimates
+	db.schemaLock.RLock()
+	for q, estimate := range map[string]int{
+		`{"eq": "common", "in": ["kind"]}`:                                 200,
+		`{"eq": "common", "in": ["kind"], "limit": 5}`:                     5,
+		`{"eq": "common", "in": ["nope"]}`:                                 -1,
+		`{"all": ["x", "rare"], "in": ["tag"]}`:                            5,
+		`{"any": ["x", "rare"], "in": ["tag"]}`:                            205,
+		`{"n": [{"eq": "common", "in": ["kind"]}, {"has": ["kind"]}]}`:     200,
+		`[{"eq": "other", "in": ["kind"]}, {"eq": "rare", "in": ["tag"]}]`: 6,
+		`[{"eq": "other", "in": ["kind"]}, {"has": ["kind"]}]`:             -1,
+		`"12345"`: 1,
+	} {
+		if actual := col.estimateQuery(parseQuery(t, q), nil); actual != estimate {
+			t.Fatal(q, actual, estimate)
+		}
+	}
+	if estimate := col.estimateQuery(parseQuery(t, `{"eq": "$1", "in": ["kind"]}`), []interface{}{"other"}); estimate != 1 {
+		t.Fatal(estimate)
+	} else if estimate = col.estimateQuery(parseQuery(t, `{"eq": "$2", "in": ["kind"]}`), []interface{}{"other"}); estimate != -1 {
+		t.Fatal(estimate)
+	}
+	db.schemaLock.RUnlock()
+	// Results do not depend on the order of evaluation
+	for _, q := range []string{
+		`{"n": [{"eq": "common", "in": ["kind"]}, {"eq": "rare", "in": ["tag"]}]}`,
+		`{"n": [{"eq": "rare", "in": ["tag"]}, {"has": ["kind"]}, {"eq": "common", "in": ["kind"]}]}`,
+		`{"n": [{"all": ["x", "rare"], "in": ["tag"]}, {"eq": "common", "in": ["kind"]}]}`,
+	} {
+		result := make(map[int]struct{})
+		if err := EvalQuery(parseQuery(t, q), col, &result); err != nil || !ensureMapHasKeys(result, expected...) {
+			t.Fatal(q, result, err)
+		}
+	}
+	result := make(map[int]struct{})
+	q := parseQuery(t, `{"n": [{"eq": "$1", "in": ["kind"]}, {"eq": "$2", "in": ["tag"]}]}`)
+	if err := EvalQueryParams(q, []interface{}{"common", "rare"}, col, &result); err != nil || !ensureMapHasKeys(result, expected...) {
+		t.Fatal(result, err)
+	}
+	result = make(map[int]struct{})
+	if err := EvalQueryParams(q, []interface{}{"other", "rare"}, col, &result); err != nil || !ensureMapHasKeys(result, rareOnly) {
+		t.Fatal(result, err)
+	}
+	if err := EvalQueryParams(q, []interface{}{"other"}, col, &result); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Sub-query errors are still reported
+	result = make(map[int]struct{})
+	if err := EvalQuery(parseQuery(t, `{"n": [{"eq": "none", "in": ["kind"]}, {"eq": 1, "in": ["nope"]}]}`), col, &result); err == nil {
+		t.Fatal("Did not error")
+	}
+}
@@ -0,0 +1,152 @@
+// Durable counters.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+const (
+	COUNTER_FILE       = "counter_"      // Counter hash table file name prefix, followed by partition number.
+	COUNTER_NAMES_FILE = "counter_names" // Counter names and their hash table keys.
+)
+
+// counters holds all counters of a database, partitioned into one hash table per partition.
+type counters struct {
+	lock   *sync.Mutex
+	names  map[string]int    // Counter name VS hash table key, nil until counters are loaded
+	tables []*data.HashTable // Counter values, indexed by partition number
+}
+
+// Counter is a durable integer counter (e.g. page views, invoice numbers) stored in the database.
+type Counter struct {
+	db   *DB
+	name string
+}
+
+// Use the return value to interact with a counter. A counter does not have to be created beforehand, it starts from 0.
+func (db *DB) Counter(name string) *Counter {
+	return &Counter{db: db, name: name}
+}
+
+// Return all counter names.
+func (db *DB) AllCounters() (ret []string, err error) {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	ctrs := db.counters
+	ctrs.lock.Lock()
+	defer ctrs.lock.Unlock()
+	if err = db.loadCounters(); err != nil {
+		return
+	}
+	ret = make([]string, 0, len(ctrs.names))
+	for name := range ctrs.names {
+		ret = append(ret, name)
+	}
+	return
+}
+
+// Load counter names and open counter hash tables if they have not been loaded. Caller must lock counters.
+func (db *DB) loadCounters() (err error) {
+	ctrs := db.counters
+	if db.dropped {
+		return fmt.Errorf("Database %s has been dropped", db.path)
+	} else if ctrs.names != nil {
+		return
+	}
+	names := make(map[string]int)
+	if namesJS, err := ioutil.ReadFile(path.Join(db.path, COUNTER_NAMES_FILE)); err == nil {
+		if err = json.Unmarshal(namesJS, &names); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	tables := make([]*data.HashTable, db.numParts)
+	for i := range tables {
+		if tables[i], err = db.Config.OpenHashTable(path.Join(db.path, COUNTER_FILE+strconv.Itoa(i))); err != nil {
+			return
+		}
+	}
+	ctrs.names, ctrs.tables = names, tables
+	return
+}
+
+// Close counter hash tables. Caller must place schema lock.
+func (db *DB) closeCounters() (err error) {
+	ctrs := db.counters
+	ctrs.lock.Lock()
+	defer ctrs.lock.Unlock()
+	for _, table := range ctrs.tables {
+		if closeErr := table.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	ctrs.names, ctrs.tables = nil, nil
+	return
+}
+
+// Return the hash table and key of the counter. A key is assigned to the counter if create is true, otherwise the key
+// is -1 if the counter has never been used.
+func (ctr *Counter) locate(create bool) (table *data.HashTable, key int, err error) {
+	ctrs := ctr.db.counters
+	ctrs.lock.Lock()
+	defer ctrs.lock.Unlock()
+	if err = ctr.db.loadCounters(); err != nil {
+		return
+	}
+	key, exists := ctrs.names[ctr.name]
+	if !exists {
+		if !create {
+			return nil, -1, nil
+		}
+		key = len(ctrs.names)
+		ctrs.names[ctr.name] = key
+		namesJS, err := json.Marshal(ctrs.names)
+		if err == nil {
+			err = data.WriteFileAtomic(path.Join(ctr.db.path, COUNTER_NAMES_FILE), namesJS, 0600)
+		}
+		if err != nil {
+			delete(ctrs.names, ctr.name)
+			return nil, 0, err
+		}
+	}
+	return ctrs.tables[key%ctr.db.numParts], key, nil
+}
+
+// Add delta (may be negative) to the counter atomically, and return the new value.
+func (ctr *Counter) Incr(delta int) (int, error) {
+	ctr.db.schemaLock.RLock()
+	defer ctr.db.schemaLock.RUnlock()
+	table, key, err := ctr.locate(true)
+	if err != nil {
+		return 0, err
+	}
+	table.Lock.Lock()
+	defer table.Lock.Unlock()
+	return table.Incr(key, delta), nil
+}
+
+// Return the current value of the counter.
+func (ctr *Counter) Get() (int, error) {
+	ctr.db.schemaLock.RLock()
+	defer ctr.db.schemaLock.RUnlock()
+	table, key, err := ctr.locate(false)
+	if err != nil || key < 0 {
+		return 0, err
+	}
+	table.Lock.RLock()
+	defer table.Lock.RUnlock()
+	if vals := table.Get(key, 1); len(vals) > 0 {
+		return vals[0], nil
+	}
+	return 0, nil
+}
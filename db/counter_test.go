@@ -0,0 +1,68 @@
+package db
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := db.Counter("views").Get(); err != nil || val != 0 {
+		t.Fatal(val, err)
+	}
+	if val, err := db.Counter("views").Incr(5); err != nil || val != 5 {
+		t.Fatal(val, err)
+	}
+	if val, err := db.Counter("views").Incr(-2); err != nil || val != 3 {
+		t.Fatal(val, err)
+	}
+	// Concurrent increments of many counters
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := db.Counter("invoice" + strconv.Itoa(i%4)).Incr(1); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 4; i++ {
+		if val, err := db.Counter("invoice" + strconv.Itoa(i)).Get(); err != nil || val != 500 {
+			t.Fatal(i, val, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Counters survive reopening, and are not mistaken for collections
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if cols := db.AllCols(); len(cols) != 0 {
+		t.Fatal(cols)
+	}
+	if val, err := db.Counter("views").Get(); err != nil || val != 3 {
+		t.Fatal(val, err)
+	}
+	if val, err := db.Counter("invoice0").Incr(1); err != nil || val != 501 {
+		t.Fatal(val, err)
+	}
+	names, err := db.AllCounters()
+	sort.Strings(names)
+	if err != nil || len(names) != 5 || names[0] != "invoice0" || names[4] != "views" {
+		t.Fatal(names, err)
+	}
+}
@@ -0,0 +1,126 @@
+// Server-side cursors over query results, for stable pagination.
+
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	CURSOR_DEFAULT_TTL = 10 * time.Minute // How long an idle cursor is kept if the TTL is not given.
+	CURSOR_MAX_OPEN    = 1024             // Maximum number of open cursors of a database.
+)
+
+// A query result kept for pagination, as an ordered snapshot of document IDs.
+type cursor struct {
+	colName string
+	ids     []int         // Document IDs not fetched yet
+	ttl     time.Duration // How long the cursor is kept while idle
+	expires time.Time
+}
+
+// Open cursors of a database keyed by cursor ID.
+type cursors struct {
+	lock *sync.Mutex
+	byID map[string]*cursor
+}
+
+// Remove expired cursors. The caller must place cursor lock.
+func (curs *cursors) sweep(now time.Time) {
+	for id, cur := range curs.byID {
+		if now.After(cur.expires) {
+			delete(curs.byID, id)
+		}
+	}
+}
+
+/*
+Evaluate the query with the parameters (nil if the query has no placeholders), order the result by document ID and then
+by the sort keys, and keep the ordered result as a cursor. Return the cursor ID and the number of documents in the
+result. Pages of the result are fetched by CursorNext, without evaluating the query again; documents inserted
+afterwards do not shift the pages, documents deleted afterwards are skipped by the reader. The cursor is closed after
+being idle for ttl (CURSOR_DEFAULT_TTL if 0).
+*/
+func (db *DB) OpenCursor(col *Col, q interface{}, params []interface{}, sortKeys []SortKey, ttl time.Duration) (cursorID string, total int, err error) {
+	if ttl <= 0 {
+		ttl = CURSOR_DEFAULT_TTL
+	}
+	result := make(map[int]struct{})
+	if err = EvalQueryParams(q, params, col, &result); err != nil {
+		return
+	}
+	ids := make([]int, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	SortIDs(col, ids, sortKeys)
+	random := make([]byte, 16)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	cursorID = hex.EncodeToString(random)
+	now := time.Now()
+	db.cursors.lock.Lock()
+	defer db.cursors.lock.Unlock()
+	if db.cursors.sweep(now); len(db.cursors.byID) >= CURSOR_MAX_OPEN {
+		return "", 0, fmt.Errorf("Too many open cursors, the limit is %d", CURSOR_MAX_OPEN)
+	}
+	db.cursors.byID[cursorID] = &cursor{colName: col.Name(), ids: ids, ttl: ttl, expires: now.Add(ttl)}
+	return cursorID, len(ids), nil
+}
+
+/*
+Fetch the next n (all if 0) document IDs from the cursor, in result order, along with the queried collection. Return
+false if the cursor has no more IDs, the cursor is then closed. Fetching extends the life of the cursor by its TTL.
+*/
+func (db *DB) CursorNext(cursorID string, n int) (col *Col, ids []int, more bool, err error) {
+	now := time.Now()
+	db.cursors.lock.Lock()
+	cur, exists := db.cursors.byID[cursorID]
+	if !exists || now.After(cur.expires) {
+		delete(db.cursors.byID, cursorID)
+		db.cursors.lock.Unlock()
+		return nil, nil, false, fmt.Errorf("Cursor %s does not exist or has expired", cursorID)
+	}
+	if n <= 0 || n > len(cur.ids) {
+		n = len(cur.ids)
+	}
+	ids, cur.ids = cur.ids[:n], cur.ids[n:]
+	if more = len(cur.ids) > 0; more {
+		cur.expires = now.Add(cur.ttl)
+	} else {
+		delete(db.cursors.byID, cursorID)
+	}
+	db.cursors.lock.Unlock()
+	if col = db.Use(cur.colName); col == nil {
+		db.CloseCursor(cursorID)
+		return nil, nil, false, fmt.Errorf("Collection %s does not exist", cur.colName)
+	}
+	return col, ids, more, nil
+}
+
+// Close the cursor, return false if it does not exist.
+func (db *DB) CloseCursor(cursorID string) bool {
+	db.cursors.lock.Lock()
+	defer db.cursors.lock.Unlock()
+	_, exists := db.cursors.byID[cursorID]
+	delete(db.cursors.byID, cursorID)
+	return exists
+}
+
+// Return the collection name of the cursor, or an error if the cursor does not exist or has expired.
+func (db *DB) CursorCol(cursorID string) (string, error) {
+	db.cursors.lock.Lock()
+	defer db.cursors.lock.Unlock()
+	cur, exists := db.cursors.byID[cursorID]
+	if !exists || time.Now().After(cur.expires) {
+		return "", fmt.Errorf("Cursor %s does not exist or has expired", cursorID)
+	}
+	return cur.colName, nil
+}
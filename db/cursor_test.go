@@ -0,0 +1,74 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCursor(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	for n := 5; n > 0; n-- {
+		if _, err := col.Insert(map[string]interface{}{"n": n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursorID, total, err := db.OpenCursor(col, "all", nil, []SortKey{{Path: []string{"n"}}}, 0)
+	if err != nil || total != 5 {
+		t.Fatal(total, err)
+	}
+	// Documents inserted meanwhile do not shift the pages
+	if _, err := col.Insert(map[string]interface{}{"n": 0}); err != nil {
+		t.Fatal(err)
+	}
+	seen := make([]interface{}, 0, 5)
+	for _, expectMore := range []bool{true, true, false} {
+		pageCol, ids, more, err := db.CursorNext(cursorID, 2)
+		if err != nil || pageCol != col || more != expectMore {
+			t.Fatal(pageCol, ids, more, err)
+		}
+		for _, id := range ids {
+			doc, err := col.Read(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen = append(seen, doc["n"])
+		}
+	}
+	if len(seen) != 5 || seen[0] != float64(1) || seen[4] != float64(5) {
+		t.Fatal(seen)
+	} else if _, _, _, err := db.CursorNext(cursorID, 2); err == nil {
+		t.Fatal("Exhausted cursor was not closed")
+	}
+	// Idle cursors expire
+	cursorID, _, err = db.OpenCursor(col, "all", nil, nil, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, _, _, err := db.CursorNext(cursorID, 1); err == nil {
+		t.Fatal("Cursor did not expire")
+	} else if _, err := db.CursorCol(cursorID); err == nil {
+		t.Fatal("Cursor did not expire")
+	}
+	// Cursors may be closed early
+	if cursorID, _, err = db.OpenCursor(col, "all", nil, nil, 0); err != nil {
+		t.Fatal(err)
+	} else if colName, err := db.CursorCol(cursorID); err != nil || colName != "col" {
+		t.Fatal(colName, err)
+	} else if !db.CloseCursor(cursorID) || db.CloseCursor(cursorID) {
+		t.Fatal("Bad close")
+	} else if _, _, err := db.OpenCursor(col, map[string]interface{}{"eq": 1}, nil, nil, 0); err == nil {
+		t.Fatal("Did not check query")
+	}
+}
@@ -3,6 +3,7 @@
 package db
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -15,6 +16,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/HouzuoGuo/tiedot/data"
@@ -27,48 +29,122 @@ const (
 
 // Database structures.
 type DB struct {
-	Config     *data.Config
-	path       string          // Root path of database directory
-	numParts   int             // Total number of partitions
-	cols       map[string]*Col // All collections
-	schemaLock *sync.RWMutex   // Control access to collection instances.
+	Config      *data.Config
+	path        string          // Root path of database directory
+	numParts    int             // Total number of partitions
+	cols        map[string]*Col // All collections
+	schemaLock  *sync.RWMutex   // Control access to collection instances.
+	bg          *taskRegistry   // Background task status and error callbacks
+	plans       *planCache      // Compiled query plans keyed by query shape
+	rng         *rand.Rand      // Random number generator of document IDs
+	rngLock     *sync.Mutex     // Protect rng from concurrent use
+	writes      *writeLimiter   // Document write rate limit
+	heavy       *heavyLimiter   // Admission control of heavy operations
+	relations   []Relation      // Reference integrity enforced upon deleting documents, protected by schemaLock
+	counters    *counters       // Durable counters, loaded upon first use
+	queries     *namedQueries   // Named queries, loaded upon first use
+	cursors     *cursors        // Open cursors over query results
+	redactions  *redactions     // Redacted paths of collections, loaded upon first use
+	collector   *statsCollector // Background statistics collector
+	checksums   *rotScrubber    // Background verification of data file checksums
+	tiering     *tierMigrator   // Background migration of documents into the cold tier
+	reaper      *ttlReaper      // Background deletion of documents expired by TTL indexes
+	kvLock      *sync.Mutex     // Serialise key-value store writes so that a key never refers to more than one document
+	queueLock   *sync.Mutex     // Serialise queue pops so that a message is never given to more than one consumer
+	lastClock   int64           // Latest reading of the sync clock
+	seqLock     *sync.Mutex     // Protect lastClock and syncNode
+	syncNode    string          // ID of the database instance in sync, loaded when first needed
+	dropped     bool            // Whether the database has been dropped, protected by both schemaLock and counters lock
+	workerQueue int             // Queue length of partition workers, 0 if the workers are not used
+	openOpts    OpenOptions     // How the database directory content is treated upon opening
 }
 
+// Number of databases opened so far, used for telling apart RNG seeds of databases opened at the same time.
+var numOpenDB int64
+
 // Open database and load all collections & indexes.
 func OpenDB(dbPath string) (*DB, error) {
-	rand.Seed(time.Now().UnixNano()) // document ID generation relies on this RNG
-	d, err := data.CreateOrReadConfig(dbPath)
+	return OpenDBWithOptions(dbPath, OpenOptions{})
+}
+
+// Read database configuration and return the database ready to load.
+func newDB(dbPath string, opts OpenOptions) (*DB, error) {
+	d, err := data.CreateOrReadConfigFrom(dbPath, initialConfig(opts))
 	if err != nil {
 		return nil, err
 	}
-	db := &DB{Config: d, path: dbPath, schemaLock: new(sync.RWMutex)}
+	db := &DB{Config: d, path: dbPath, openOpts: opts, schemaLock: new(sync.RWMutex), bg: newTaskRegistry(), plans: newPlanCache(planCacheSize(d)),
+		rng: rand.New(rand.NewSource(time.Now().UnixNano() + atomic.AddInt64(&numOpenDB, 1))), rngLock: new(sync.Mutex), writes: newWriteLimiter(), heavy: newHeavyLimiter(),
+		counters: &counters{lock: new(sync.Mutex)}, queries: &namedQueries{lock: new(sync.Mutex)},
+		cursors: &cursors{lock: new(sync.Mutex), byID: make(map[string]*cursor)}, redactions: &redactions{lock: new(sync.Mutex)},
+		collector: &statsCollector{lock: new(sync.Mutex)}, checksums: &rotScrubber{lock: new(sync.Mutex)},
+		tiering: &tierMigrator{lock: new(sync.Mutex)}, reaper: &ttlReaper{lock: new(sync.Mutex)}, kvLock: new(sync.Mutex), queueLock: new(sync.Mutex), seqLock: new(sync.Mutex)}
 	db.Config.CalculateConfigConstants()
-	return db, db.load()
+	if d.VerboseLog != nil {
+		tdlog.VerboseLog = *d.VerboseLog
+	}
+	return db, nil
+}
+
+// Return the configuration of a new database opened with the options, nil for the default.
+func initialConfig(opts OpenOptions) *data.Config {
+	if opts.Compact {
+		return data.CompactConfig()
+	}
+	return nil
+}
+
+// Return a random document ID.
+func (db *DB) newID() int {
+	db.rngLock.Lock()
+	defer db.rngLock.Unlock()
+	return db.rng.Int()
+}
+
+// Return a reading of the sync clock - current time in nanoseconds, made unique and increasing.
+func (db *DB) clock() int64 {
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+	clock := time.Now().UnixNano()
+	if clock <= db.lastClock {
+		clock = db.lastClock + 1
+	}
+	db.lastClock = clock
+	return clock
 }
 
 // Load all collection schema.
 func (db *DB) load() error {
 	// Create DB directory and PART_NUM_FILE if necessary
-	var numPartsAssumed = false
 	numPartsFilePath := path.Join(db.path, PART_NUM_FILE)
 	if err := os.MkdirAll(db.path, 0700); err != nil {
 		return err
+	} else if err := data.CheckFormat(db.path); err != nil {
+		return err
 	}
-	if partNumFile, err := os.Stat(numPartsFilePath); err != nil {
-		// The new database has as many partitions as number of CPUs recognized by OS
-		if err := ioutil.WriteFile(numPartsFilePath, []byte(strconv.Itoa(runtime.NumCPU())), 0600); err != nil {
-			return err
-		}
-		numPartsAssumed = true
-	} else if partNumFile.IsDir() {
+	if partNumFile, err := os.Stat(numPartsFilePath); err == nil && partNumFile.IsDir() {
 		return fmt.Errorf("Database config file %s is actually a directory, is database path correct?", PART_NUM_FILE)
 	}
 	// Get number of partitions from the text file
-	if numParts, err := ioutil.ReadFile(numPartsFilePath); err != nil {
-		return err
-	} else if db.numParts, err = strconv.Atoi(strings.Trim(string(numParts), "\r\n ")); err != nil {
+	numParts, err := ioutil.ReadFile(numPartsFilePath)
+	if err == nil {
+		if db.numParts, err = strconv.Atoi(strings.Trim(string(numParts), "\r\n ")); err == nil && db.numParts < 1 {
+			err = fmt.Errorf("Number of partitions %d must be positive", db.numParts)
+		}
+		if err != nil {
+			tdlog.Noticef("Database config file %s is corrupted (%v), will recover it", numPartsFilePath, err)
+		}
+	} else if !os.IsNotExist(err) {
 		return err
 	}
+	if err != nil {
+		// The file is missing from a new database, or was torn by a crash
+		if db.numParts, err = db.inferNumParts(); err != nil {
+			return err
+		} else if err := data.WriteFileAtomic(numPartsFilePath, []byte(strconv.Itoa(db.numParts)), 0600); err != nil {
+			return err
+		}
+	}
 	// Look for collection directories and open the collections
 	db.cols = make(map[string]*Col)
 	dirContent, err := ioutil.ReadDir(db.path)
@@ -78,25 +154,126 @@ func (db *DB) load() error {
 	for _, maybeColDir := range dirContent {
 		if !maybeColDir.IsDir() {
 			continue
+		} else if err := db.validateCol(maybeColDir.Name()); err != nil {
+			return err
 		}
-		if numPartsAssumed {
-			return fmt.Errorf("Please manually repair database partition number config file %s", numPartsFilePath)
-		}
-		if db.cols[maybeColDir.Name()], err = OpenCol(db, maybeColDir.Name()); err != nil {
+		if maybeColDir.Name() == CATALOG_COL {
+			// System catalog is always read-only
+			if db.cols[CATALOG_COL], err = OpenColFlags(db, CATALOG_COL, COL_READ); err != nil {
+				return err
+			}
+		} else if db.cols[maybeColDir.Name()], err = OpenCol(db, maybeColDir.Name()); err != nil {
 			return err
 		}
 	}
 	return err
 }
 
+/*
+Return the number of partitions of existing collections, judging by their document data files. A new database has as
+many partitions as number of CPUs recognized by OS, or a single partition if it is opened in compact mode.
+*/
+func (db *DB) inferNumParts() (int, error) {
+	dirContent, err := ioutil.ReadDir(db.path)
+	if err != nil {
+		return 0, err
+	}
+	numParts, hasCol := 0, false
+	for _, maybeColDir := range dirContent {
+		if !maybeColDir.IsDir() {
+			continue
+		}
+		hasCol = true
+		colContent, err := ioutil.ReadDir(path.Join(db.path, maybeColDir.Name()))
+		if err != nil {
+			return 0, err
+		}
+		for _, file := range colContent {
+			if !strings.HasPrefix(file.Name(), DOC_DATA_FILE) {
+				continue
+			}
+			if partNum, err := strconv.Atoi(strings.TrimPrefix(file.Name(), DOC_DATA_FILE)); err == nil && partNum >= numParts {
+				numParts = partNum + 1
+			}
+		}
+	}
+	if !hasCol && db.openOpts.Compact {
+		return 1, nil
+	} else if !hasCol {
+		return runtime.NumCPU(), nil
+	} else if numParts == 0 {
+		return 0, fmt.Errorf("Please manually repair database partition number config file %s", path.Join(db.path, PART_NUM_FILE))
+	}
+	tdlog.Noticef("Number of partitions is recovered from collection data files: %d", numParts)
+	return numParts, nil
+}
+
 // Close all database files. Do not use the DB afterwards!
 func (db *DB) Close() error {
+	db.StopStatsCollector()
+	db.StopChecksumScrubber()
+	db.StopTiering()
+	db.stopTTLReaper()
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
 	errs := make([]error, 0, 0)
 	for _, col := range db.cols {
+		col.stopWatchers()
+		if err := col.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := db.closeCounters(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v", errs)
+}
+
+/*
+Drop the database - close all collections, abort background tasks, and remove everything in the database directory.
+To guard against accidents, confirm must be the database directory path given to OpenDB. The DB may not be used
+afterwards, collections cannot be created in a dropped database.
+*/
+func (db *DB) DropDatabase(confirm string) error {
+	if confirm != db.path {
+		return fmt.Errorf("Will not drop database %s: confirmation \"%s\" does not match the database path", db.path, confirm)
+	}
+	db.StopStatsCollector()
+	db.StopChecksumScrubber()
+	db.StopTiering()
+	db.stopTTLReaper()
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	if db.dropped {
+		return fmt.Errorf("Database %s has been dropped", db.path)
+	}
+	errs := make([]error, 0, 0)
+	for name, col := range db.cols {
+		col.stopWatchers()
+		col.dropped = true
 		if err := col.close(); err != nil {
 			errs = append(errs, err)
+		} else if err := db.removeCold(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	db.cols = make(map[string]*Col)
+	if err := db.closeCounters(); err != nil {
+		errs = append(errs, err)
+	}
+	db.counters.lock.Lock()
+	db.dropped = true
+	db.counters.lock.Unlock()
+	dirContent, err := ioutil.ReadDir(db.path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirContent {
+		if err := os.RemoveAll(path.Join(db.path, entry.Name())); err != nil {
+			errs = append(errs, err)
 		}
 	}
 	if len(errs) == 0 {
@@ -107,7 +284,9 @@ func (db *DB) Close() error {
 
 // create creates collection files. The function does not place a schema lock.
 func (db *DB) create(name string) error {
-	if _, exists := db.cols[name]; exists {
+	if db.dropped {
+		return fmt.Errorf("Database %s has been dropped", db.path)
+	} else if _, exists := db.cols[name]; exists {
 		return fmt.Errorf("Collection %s already exists", name)
 	} else if err := os.MkdirAll(path.Join(db.path, name), 0700); err != nil {
 		return err
@@ -153,18 +332,24 @@ func (db *DB) Rename(oldName, newName string) error {
 		return fmt.Errorf("Collection %s does not exist", oldName)
 	} else if _, exists := db.cols[newName]; exists {
 		return fmt.Errorf("Collection %s already exists", newName)
-	} else if err := db.cols[oldName].close(); err != nil {
+	}
+	col := db.cols[oldName]
+	if err := col.close(); err != nil {
 		return err
 	} else if err := os.Rename(path.Join(db.path, oldName), path.Join(db.path, newName)); err != nil {
 		return err
-	} else if db.cols[newName], err = OpenCol(db, newName); err != nil {
+	} else if err := db.renameCold(oldName, newName); err != nil {
+		return err
+	} else if err := col.reopen(newName, col.flags); err != nil {
 		return err
 	}
+	db.cols[newName] = col
 	delete(db.cols, oldName)
-	return nil
+	return db.renameRedactions(oldName, newName)
 }
 
-// Truncate a collection - delete all documents and clear
+// Truncate a collection - delete all documents and clear indexes. Data, lookup and hash table files are shrunk back to
+// their initial size, hence a once-huge collection returns its disk space.
 func (db *DB) Truncate(name string) error {
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
@@ -172,21 +357,28 @@ func (db *DB) Truncate(name string) error {
 		return fmt.Errorf("Collection %s does not exist", name)
 	}
 	col := db.cols[name]
-	for i := 0; i < db.numParts; i++ {
-		if err := col.parts[i].Clear(); err != nil {
-			return err
-		}
-		for _, ht := range col.hts[i] {
-			if err := ht.Clear(); err != nil {
-				return err
-			}
-		}
+	if err := col.checkFlags(COL_WRITE); err != nil {
+		return err
 	}
-	return nil
+	return col.clear()
 }
 
 // Scrub a collection - fix corrupted documents and de-fragment free space.
 func (db *DB) Scrub(name string) error {
+	return db.ScrubContext(context.Background(), name, nil)
+}
+
+/*
+Scrub a collection like Scrub does, and report the number of documents scrubbed so far to the progress function (which
+may be nil). If the context is cancelled before the scrubbed documents replace the original ones, scrub stops and
+leaves the collection untouched.
+*/
+func (db *DB) ScrubContext(ctx context.Context, name string, progress func(Progress)) error {
+	done, err := db.heavy.admit(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer done()
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
 	if _, exists := db.cols[name]; !exists {
@@ -200,7 +392,10 @@ func (db *DB) Scrub(name string) error {
 	}
 	// Mirror indexes from original collection
 	for _, idxPath := range db.cols[name].indexPaths {
-		if err := os.MkdirAll(path.Join(tmpColDir, strings.Join(idxPath, INDEX_PATH_SEP)), 0700); err != nil {
+		idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+		if err := os.MkdirAll(path.Join(tmpColDir, idxName), 0700); err != nil {
+			return err
+		} else if err := saveIndexOptions(path.Join(tmpColDir, idxName), db.cols[name].indexOpts[idxName]); err != nil {
 			return err
 		}
 	}
@@ -209,32 +404,67 @@ func (db *DB) Scrub(name string) error {
 	if err != nil {
 		return err
 	}
+	tr := newTracker(ctx, int64(db.cols[name].approxDocCount(false)), progress)
 	db.cols[name].forEachDoc(func(id int, doc []byte) bool {
 		var docObj map[string]interface{}
-		if err := json.Unmarshal([]byte(doc), &docObj); err != nil {
+		if json.Unmarshal([]byte(doc), &docObj) != nil {
 			// Skip corrupted document
-			return true
-		}
-		if err := tmpCol.InsertRecovery(id, docObj); err != nil {
+		} else if err := tmpCol.InsertRecovery(id, docObj); err != nil {
 			tdlog.Noticef("Scrub %s: failed to insert back document %v", name, docObj)
 		}
-		return true
+		return tr.advance(name, 1) == nil
 	}, false)
+	if err := ctx.Err(); err != nil {
+		tmpCol.close()
+		os.RemoveAll(tmpColDir)
+		db.removeCold(tmpColName)
+		return err
+	}
+	tr.reportNow()
+	tmpCol.meta = db.cols[name].meta
+	if err := tmpCol.saveMeta(); err != nil {
+		return err
+	}
 	if err := tmpCol.close(); err != nil {
 		return err
 	}
 	// Replace the original collection with the "temporary" one
-	db.cols[name].close()
+	col := db.cols[name]
+	// Insertion order is carried over without the entries of deleted documents
+	for i, log := range col.inserts {
+		log.Compact(col.parts[i].Has)
+	}
+	col.close()
+	// Attachment references in documents remain valid, as documents stay in their partitions; so does insertion order.
+	for _, prefix := range []string{BLOB_FILE, INSERT_LOG_FILE} {
+		if err := copyPartitionFiles(prefix, path.Join(db.path, name), tmpColDir, db.numParts); err != nil {
+			return err
+		}
+	}
 	if err := os.RemoveAll(path.Join(db.path, name)); err != nil {
 		return err
 	}
 	if err := os.Rename(path.Join(db.path, tmpColName), path.Join(db.path, name)); err != nil {
 		return err
+	} else if err := db.renameCold(tmpColName, name); err != nil {
+		// All documents are now in the hot tier
+		return err
 	}
-	if db.cols[name], err = OpenCol(db, name); err != nil {
+	return col.reopen(name, col.flags)
+}
+
+// Close and re-open a collection with the specified open flags (COL_READ, COL_WRITE, or both).
+func (db *DB) Reopen(name string, flags int) error {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	if _, exists := db.cols[name]; !exists {
+		return fmt.Errorf("Collection %s does not exist", name)
+	} else if flags&COL_RDWR == 0 {
+		return fmt.Errorf("Collection %s must be opened for reading, writing, or both", name)
+	} else if err := db.cols[name].close(); err != nil {
 		return err
 	}
-	return nil
+	return db.cols[name].reopen(name, flags)
 }
 
 // Drop a collection and lose all of its documents and indexes.
@@ -243,71 +473,143 @@ func (db *DB) Drop(name string) error {
 	defer db.schemaLock.Unlock()
 	if _, exists := db.cols[name]; !exists {
 		return fmt.Errorf("Collection %s does not exist", name)
-	} else if err := db.cols[name].close(); err != nil {
+	}
+	col := db.cols[name]
+	col.stopWatchers()
+	if err := col.close(); err != nil {
+		return err
+	}
+	col.dropped = true
+	if err := os.RemoveAll(path.Join(db.path, name)); err != nil {
 		return err
-	} else if err := os.RemoveAll(path.Join(db.path, name)); err != nil {
+	} else if err := db.removeCold(name); err != nil {
 		return err
 	}
 	delete(db.cols, name)
 	return nil
 }
 
-// Copy this database into destination directory (for backup).
+// Copy a file into a new destination file. Where the file system supports reflink, the destination shares data with the
+// source (copy-on-write) instead of having the data copied. Return number of bytes in the file.
+func cloneFile(srcPath, destPath string, tr *tracker) (size int64, cloned bool, err error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	destFile, err := os.OpenFile(destPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return 0, false, fmt.Errorf("Destination file %s already exists", destPath)
+	} else if err != nil {
+		return
+	}
+	defer destFile.Close()
+	if reflink(destFile, src) == nil {
+		info, err := src.Stat()
+		if err != nil {
+			return 0, true, err
+		}
+		return info.Size(), true, tr.advance(srcPath, info.Size())
+	}
+	size, err = io.Copy(io.MultiWriter(destFile, progressWriter{tr, srcPath}), src)
+	return
+}
+
+/*
+Copy this database into destination directory (for backup). Where the file system supports reflink (e.g. btrfs, XFS),
+files are cloned near-instantly instead of being copied byte by byte. A manifest listing sizes and checksums of the
+copied files is written into the destination, use VerifyDump to check the backup and RestoreDump to restore it.
+*/
 func (db *DB) Dump(dest string) error {
+	return db.DumpContext(context.Background(), dest, nil)
+}
+
+/*
+Dump the database like Dump does, and report the number of bytes copied so far to the progress function (which may be
+nil). If the context is cancelled, dump stops and leaves an incomplete backup without manifest in the destination.
+*/
+func (db *DB) DumpContext(ctx context.Context, dest string, progress func(Progress)) error {
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
+	if err := db.checkDumpable(); err != nil {
+		return err
+	}
+	total := int64(0)
+	if err := filepath.Walk(db.path, func(currPath string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+	tr := newTracker(ctx, total, progress)
+	manifest := DumpManifest{FormatVersion: DUMP_FORMAT_VERSION, Created: time.Now(), NumParts: db.numParts, Config: *db.Config}
 	cpFun := func(currPath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
-			relPath, err := filepath.Rel(db.path, currPath)
-			if err != nil {
-				return err
-			}
+		relPath, err := filepath.Rel(db.path, currPath)
+		if err != nil {
+			return err
+		}
+		if relPath == DUMP_MANIFEST_FILE {
+			// The database was restored from a dump
+			return nil
+		} else if info.IsDir() {
 			destDir := path.Join(dest, relPath)
 			if err := os.MkdirAll(destDir, 0700); err != nil {
 				return err
 			}
 			tdlog.Noticef("Dump: created directory %s", destDir)
 		} else {
-			src, err := os.Open(currPath)
-			if err != nil {
-				return err
-			}
-			relPath, err := filepath.Rel(db.path, currPath)
-			if err != nil {
-				return err
-			}
 			destPath := path.Join(dest, relPath)
-			if _, fileExists := os.Open(destPath); fileExists == nil {
-				return fmt.Errorf("Destination file %s already exists", destPath)
-			}
-			destFile, err := os.Create(destPath)
+			size, cloned, err := cloneFile(currPath, destPath, tr)
 			if err != nil {
 				return err
+			} else if cloned {
+				tdlog.Noticef("Dump: cloned file %s, size is %d", destPath, size)
+			} else {
+				tdlog.Noticef("Dump: copied file %s, size is %d", destPath, size)
 			}
-			written, err := io.Copy(destFile, src)
+			checksum, err := hashFile(destPath)
 			if err != nil {
 				return err
 			}
-			tdlog.Noticef("Dump: copied file %s, size is %d", destPath, written)
+			manifest.Files = append(manifest.Files, DumpFile{Path: filepath.ToSlash(relPath), Size: size, SHA256: checksum})
 		}
 		return nil
 	}
-	return filepath.Walk(db.path, cpFun)
+	if err := filepath.Walk(db.path, cpFun); err != nil {
+		return err
+	}
+	tr.reportNow()
+	manifestJS, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dest, DUMP_MANIFEST_FILE), manifestJS, 0600)
 }
 
-// ForceUse creates a collection if one does not yet exist. Returns collection handle. Panics on error.
-func (db *DB) ForceUse(name string) *Col {
-	db.schemaLock.RLock()
-	defer db.schemaLock.RUnlock()
+// UseOrCreate creates a collection if one does not yet exist. Returns collection handle.
+func (db *DB) UseOrCreate(name string) (*Col, error) {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
 	if db.cols[name] == nil {
 		if err := db.create(name); err != nil {
-			tdlog.Panicf("ForceUse: failed to create collection - %v", err)
+			return nil, err
 		}
 	}
-	return db.cols[name]
+	return db.cols[name], nil
+}
+
+// ForceUse creates a collection if one does not yet exist. Returns collection handle. Panics on error.
+func (db *DB) ForceUse(name string) *Col {
+	col, err := db.UseOrCreate(name)
+	if err != nil {
+		tdlog.Panicf("ForceUse: failed to create collection - %v", err)
+	}
+	return col
 }
 
 // ColExists returns true only if the given collection name exists in the database.
@@ -2,9 +2,11 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/bouk/monkey"
 	"github.com/pkg/errors"
 	"io/ioutil"
@@ -14,7 +16,6 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
-	"strconv"
 	"strings"
 	"testing"
 )
@@ -60,8 +61,15 @@ func TestOpenErrDB(t *testing.T) {
 	}
 	touchFile(TEST_DATA_DIR+"/ColA", "dat_0")
 	touchFile(TEST_DATA_DIR+"/ColA/a!b!c", "0")
-	if db, err := OpenDB(TEST_DATA_DIR); err == nil {
-		t.Fatal("Did not error")
+	if _, err := OpenDB(TEST_DATA_DIR); err == nil || !strings.Contains(err.Error(), "collection ColA partition 0 lookup file id_0 missing") {
+		t.Fatal(err)
+	}
+	// Number of partitions is recovered from the collection
+	db, err := OpenDBWithOptions(TEST_DATA_DIR, OpenOptions{CreateMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	} else if db.numParts != 1 {
+		t.Fatal(db.numParts)
 	} else if err := db.Close(); err != nil {
 		t.Fatal(err)
 	}
@@ -80,7 +88,10 @@ func TestOpenCloseDB(t *testing.T) {
 	if err := os.MkdirAll(TEST_DATA_DIR+"/ColB", 0700); err != nil {
 		panic(err)
 	}
-	db, err := OpenDB(TEST_DATA_DIR)
+	if _, err := OpenDB(TEST_DATA_DIR); err == nil || !strings.Contains(err.Error(), "index a!b!c of collection ColA has 1 of 2 partitions (missing 1)") {
+		t.Fatal(err)
+	}
+	db, err := OpenDBWithOptions(TEST_DATA_DIR, OpenOptions{CreateMissing: true})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -203,8 +214,19 @@ func TestColCrud(t *testing.T) {
 	if db.Use("d") == nil {
 		t.Fatal(db.cols)
 	}
-	if err := db.Drop("d"); err != nil {
+	dropped := db.Use("d")
+	if err := dropped.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err := db.Drop("d"); err != nil {
 		t.Fatal(err)
+	} else if _, err := dropped.Insert(map[string]interface{}{}); dberr.Type(err) != dberr.ErrorColDropped {
+		t.Fatal(err)
+	} else if _, err := dropped.EstimateLookup([]string{"a"}, 1); dberr.Type(err) != dberr.ErrorColDropped {
+		t.Fatal(err)
+	} else if stats := dropped.IndexStats(); len(stats) != 0 {
+		t.Fatal(stats)
+	} else if n := dropped.ApproxDocCount(); n != 0 {
+		t.Fatal(n)
 	}
 	if allNames := db.AllCols(); len(allNames) != 0 {
 		t.Fatal(allNames)
@@ -229,6 +251,51 @@ func TestColCrud(t *testing.T) {
 		t.Fatal(id, err)
 	}
 }
+func TestColHandleSurvivesSchemaChange(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create("a"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("a")
+	if err := col.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The handle acquired before rename and scrub continues to work afterwards
+	if err := db.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if db.Use("b") != col || col.Name() != "b" {
+		t.Fatal(col.Name())
+	}
+	if err := db.Scrub("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Reopen("b", COL_RDWR); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(id); err != nil || doc["n"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	if _, err := col.Insert(map[string]interface{}{"n": 2}); err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": 2, "in": []interface{}{"n"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
 func TestDumpDB(t *testing.T) {
 	var str bytes.Buffer
 	log.SetOutput(&str)
@@ -317,16 +384,49 @@ func TestOpenErrWhenReadFileNumParts(t *testing.T) {
 		t.Errorf("Expected error : '%s'", errMessage)
 	}
 }
-func TestOpenErrorValidFromFileNumParts(t *testing.T) {
+func TestOpenRecoverNumParts(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
-	errMessage := "Error atoi"
-	patch := monkey.Patch(strconv.Atoi, func(s string) (int, error) {
-		return 0, errors.New(errMessage)
-	})
-	defer patch.Unpatch()
-	if _, err := OpenDB(TEST_DATA_DIR); err.Error() != errMessage {
-		t.Errorf("Expected error : '%s'", errMessage)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("3"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Torn and missing file are recovered from collection data files
+	for _, content := range []string{"", "-1"} {
+		if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		} else if content == "" {
+			os.Remove(TEST_DATA_DIR + "/number_of_partitions")
+		}
+		if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+			t.Fatal(err)
+		} else if db.numParts != 3 {
+			t.Fatal(db.numParts)
+		}
+		db.Close()
+		if numParts, err := ioutil.ReadFile(TEST_DATA_DIR + "/number_of_partitions"); err != nil || string(numParts) != "3" {
+			t.Fatal(string(numParts), err)
+		}
+	}
+	// Nothing to recover from
+	if err := os.RemoveAll(TEST_DATA_DIR + "/col"); err != nil {
+		t.Fatal(err)
+	} else if err := os.MkdirAll(TEST_DATA_DIR+"/col", 0700); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("abc"), 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err := OpenDB(TEST_DATA_DIR); err == nil {
+		t.Fatal("Did not error")
 	}
 }
 func TestOpenErrorListDir(t *testing.T) {
@@ -376,6 +476,29 @@ func TestCreateErrorMkDir(t *testing.T) {
 		t.Errorf("Expected error : '%s'", errMessage)
 	}
 }
+func TestUseOrCreate(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	col, err := db.UseOrCreate("a")
+	if err != nil || col == nil || !db.ColExists("a") {
+		t.Fatal(col, err)
+	}
+	if again, err := db.UseOrCreate("a"); err != nil || again != col {
+		t.Fatal(again, err)
+	}
+	errMessage := "Make dir is unpossible"
+	patch := monkey.Patch(os.MkdirAll, func(path string, perm os.FileMode) error {
+		return errors.New(errMessage)
+	})
+	defer patch.Unpatch()
+	if col, err := db.UseOrCreate("b"); col != nil || err == nil || err.Error() != errMessage {
+		t.Fatal(col, err)
+	}
+}
 func TestCreateErrOpenCol(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
@@ -434,7 +557,7 @@ func TestRenameOpenColError(t *testing.T) {
 	db, _ := OpenDB(TEST_DATA_DIR)
 	col, _ := OpenCol(db, "test")
 	db.cols = map[string]*Col{"test": col}
-	patch := monkey.Patch(OpenCol, func(db *DB, name string) (*Col, error) {
+	patch := monkey.Patch(OpenColFlags, func(db *DB, name string, flags int) (*Col, error) {
 		return nil, errors.New(errMessage)
 	})
 	defer patch.Unpatch()
@@ -469,10 +592,10 @@ func TestTruncatePartitionClear(t *testing.T) {
 	}
 	errMessage := "Error clear partition"
 	var c *data.Partition
-	monkey.PatchInstanceMethod(reflect.TypeOf(c), "Clear", func(_ *data.Partition) error {
+	patchClear := monkey.PatchInstanceMethod(reflect.TypeOf(c), "Clear", func(_ *data.Partition) error {
 		return errors.New(errMessage)
 	})
-	defer monkey.UnpatchInstanceMethod(reflect.TypeOf(c), "Clear")
+	defer patchClear.Unpatch()
 
 	if db.Truncate("a").Error() != errMessage {
 		t.Errorf("Expected error : '%s'", errMessage)
@@ -494,14 +617,14 @@ func TestTruncateHashClearErr(t *testing.T) {
 		hash *data.HashTable
 		c    *data.Partition
 	)
-	monkey.PatchInstanceMethod(reflect.TypeOf(c), "Clear", func(_ *data.Partition) error {
+	patchPartClear := monkey.PatchInstanceMethod(reflect.TypeOf(c), "Clear", func(_ *data.Partition) error {
 		return nil
 	})
-	monkey.PatchInstanceMethod(reflect.TypeOf(hash), "Clear", func(_ *data.HashTable) error {
+	patchHashClear := monkey.PatchInstanceMethod(reflect.TypeOf(hash), "Clear", func(_ *data.HashTable) error {
 		return errors.New(errMessage)
 	})
-	defer monkey.UnpatchInstanceMethod(reflect.TypeOf(c), "Clear")
-	defer monkey.UnpatchInstanceMethod(reflect.TypeOf(hash), "Clear")
+	defer patchPartClear.Unpatch()
+	defer patchHashClear.Unpatch()
 
 	if db.Truncate(collectName).Error() != errMessage {
 		t.Errorf("Expected error : '%s'", errMessage)
@@ -780,3 +903,126 @@ func TestDumpMkDirErr(t *testing.T) {
 		t.Error("Expected error make dir error")
 	}
 }
+
+func TestDropDatabase(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err := db.Use("col").IndexBackground([]string{"a"}, 1); err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Counter("ctr").Incr(1); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.TrackAccess(1); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := col.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropDatabase("wrong"); err == nil {
+		t.Fatal("Did not error")
+	} else if db.Use("col") == nil {
+		t.Fatal("Collection was dropped without confirmation")
+	}
+	if err := db.DropDatabase(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadDir(TEST_DATA_DIR); err != nil || len(content) != 0 {
+		t.Fatal(content, err)
+	}
+	// The handle is unusable afterwards
+	if db.Use("col") != nil || len(db.AllCols()) != 0 {
+		t.Fatal(db.AllCols())
+	}
+	// So are collection handles obtained beforehand
+	if _, err := col.Insert(map[string]interface{}{"a": 2}); dberr.Type(err) != dberr.ErrorColDropped {
+		t.Fatal(err)
+	} else if _, err := col.Read(id); dberr.Type(err) != dberr.ErrorColDropped {
+		t.Fatal(err)
+	} else if err := col.Update(id, map[string]interface{}{"a": 3}); dberr.Type(err) != dberr.ErrorColDropped {
+		t.Fatal(err)
+	} else if err := col.Delete(id); dberr.Type(err) != dberr.ErrorColDropped {
+		t.Fatal(err)
+	} else if err := EvalQuery("all", col, &map[int]struct{}{}); dberr.Type(err) != dberr.ErrorColDropped {
+		t.Fatal(err)
+	}
+	col.ForEachDoc(func(int, []byte) bool {
+		t.Fatal("Iterated a dropped collection")
+		return false
+	})
+	// Neither index nor statistics methods reach the closed files
+	if _, err := col.EstimateLookup([]string{"a"}, 1); dberr.Type(err) != dberr.ErrorColDropped {
+		t.Fatal(err)
+	} else if err := col.DumpIndex([]string{"a"}, ioutil.Discard); dberr.Type(err) != dberr.ErrorColDropped {
+		t.Fatal(err)
+	} else if _, err := col.IndexOptionsOf([]string{"a"}); dberr.Type(err) != dberr.ErrorColDropped {
+		t.Fatal(err)
+	} else if err := col.EndBulkLoad(); dberr.Type(err) != dberr.ErrorColDropped {
+		t.Fatal(err)
+	} else if err := col.TrackAccess(1); dberr.Type(err) != dberr.ErrorColDropped {
+		t.Fatal(err)
+	} else if _, err := col.MigrateCold(0); err == nil {
+		t.Fatal("Did not error")
+	} else if err := col.Changes(context.Background(), ChangeOptions{}, func(ChangeEvent) bool { return true }); err == nil {
+		t.Fatal("Did not error")
+	}
+	if stats := col.IndexStats(); len(stats) != 0 {
+		t.Fatal(stats)
+	} else if indexes := col.AllIndexes(); len(indexes) != 0 {
+		t.Fatal(indexes)
+	} else if n := col.ApproxDocCount(); n != 0 {
+		t.Fatal(n)
+	} else if stats := col.Stats(); stats.Docs != 0 || len(stats.Indexes) != 0 {
+		t.Fatal(stats)
+	} else if access := col.AccessStats(); access.Docs != 0 {
+		t.Fatal(access)
+	}
+	if err := db.Create("col"); err == nil {
+		t.Fatal("Did not error")
+	} else if _, err := db.Counter("ctr").Get(); err == nil {
+		t.Fatal("Did not error")
+	} else if err := db.DropDatabase(TEST_DATA_DIR); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadDir(TEST_DATA_DIR); err != nil || len(content) != 0 {
+		t.Fatal(content, err)
+	}
+}
+
+func TestCloneFile(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	srcPath, destPath := path.Join(TEST_DATA_DIR, "src"), path.Join(TEST_DATA_DIR, "dest")
+	content := bytes.Repeat([]byte("tiedot"), 10000)
+	if err := ioutil.WriteFile(srcPath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Whether the file is cloned or copied depends on the file system
+	if size, _, err := cloneFile(srcPath, destPath, newTracker(context.Background(), 0, nil)); err != nil || size != int64(len(content)) {
+		t.Fatal(size, err)
+	}
+	if copied, err := ioutil.ReadFile(destPath); err != nil || !bytes.Equal(copied, content) {
+		t.Fatal(len(copied), err)
+	}
+	if _, _, err := cloneFile(srcPath, destPath, newTracker(context.Background(), 0, nil)); err == nil {
+		t.Fatal("Did not error")
+	}
+	if _, _, err := cloneFile(path.Join(TEST_DATA_DIR, "does not exist"), path.Join(TEST_DATA_DIR, "dest2"), newTracker(context.Background(), 0, nil)); err == nil {
+		t.Fatal("Did not error")
+	}
+}
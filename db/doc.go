@@ -3,10 +3,15 @@
 package db
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
+	"io"
+	"sort"
 
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/HouzuoGuo/tiedot/tdlog"
 )
 
@@ -50,40 +55,167 @@ func StrHash(str string) int {
 	return hash
 }
 
-// Put a document on all user-created indexes.
-func (col *Col) indexDoc(id int, doc map[string]interface{}) {
-	for idxName, idxPath := range col.indexPaths {
-		for _, idxVal := range GetIn(doc, idxPath) {
-			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
-				partNum := hashKey % col.db.numParts
-				ht := col.hts[partNum][idxName]
-				ht.Lock.Lock()
-				ht.Put(hashKey, id)
-				ht.Lock.Unlock()
+// Return an error if the document exceeds the document nesting depth, key count, or array length limit of the database.
+func (col *Col) validateDoc(doc map[string]interface{}) error {
+	conf := col.db.Config
+	if conf.DocMaxDepth <= 0 && conf.DocMaxKeys <= 0 && conf.DocMaxArrayLen <= 0 {
+		return nil
+	}
+	numKeys := 0
+	var validate func(val interface{}, depth int) error
+	validate = func(val interface{}, depth int) error {
+		switch v := val.(type) {
+		case map[string]interface{}:
+			if conf.DocMaxDepth > 0 && depth > conf.DocMaxDepth {
+				return dberr.New(dberr.ErrorDocTooDeep, conf.DocMaxDepth)
+			}
+			if numKeys += len(v); conf.DocMaxKeys > 0 && numKeys > conf.DocMaxKeys {
+				return dberr.New(dberr.ErrorDocTooManyKeys, conf.DocMaxKeys)
+			}
+			for _, elem := range v {
+				if err := validate(elem, depth+1); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			if conf.DocMaxDepth > 0 && depth > conf.DocMaxDepth {
+				return dberr.New(dberr.ErrorDocTooDeep, conf.DocMaxDepth)
+			}
+			if conf.DocMaxArrayLen > 0 && len(v) > conf.DocMaxArrayLen {
+				return dberr.New(dberr.ErrorDocArrayTooLong, conf.DocMaxArrayLen, len(v))
+			}
+			for _, elem := range v {
+				if err := validate(elem, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return validate(doc, 1)
+}
+
+// Hash key of the index entry standing for null and missing values, on indexes with IndexNull option.
+// Query processor verifies documents found on the index, hence a real value that happens to have the same hash key does
+// not cause wrong result.
+var indexNullKey = StrHash("\x00null")
+
+// Return true if the path does not lead to a value in the document, or leads to a null value.
+func isNullIn(doc interface{}, path []string) bool {
+	return isNull(GetIn(doc, path))
+}
+
+// Return true if there are no values found at a path, or one of them is null.
+func isNull(vals []interface{}) bool {
+	for _, val := range vals {
+		if val == nil {
+			return true
+		}
+	}
+	return len(vals) == 0
+}
+
+/*
+Return hash keys of the document entries on the index. Only the indexed path is extracted from the JSON text, the rest
+of the document is not decoded. The caller must place schema lock.
+*/
+func (col *Col) indexKeys(idxName string, docB []byte) (keys []int, err error) {
+	idxPath := col.indexPaths[idxName]
+	opts := col.indexOpts[idxName]
+	idxVals, err := opts.rawValues(docB, idxPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, idxVal := range idxVals {
+		if idxVal == nil {
+			continue
+		} else if canon, ok := opts.canonical(idxVal); ok {
+			keys = append(keys, opts.key(canon))
+		}
+	}
+	if opts.IndexNull {
+		if opts.Length {
+			// Length index values are not the values at the path
+			if idxVals, err = GetInRaw(docB, idxPath); err != nil {
+				return nil, err
 			}
 		}
+		if isNull(idxVals) {
+			keys = append(keys, indexNullKey)
+		}
 	}
+	return
 }
 
-// Remove a document from all user-created indexes.
-func (col *Col) unindexDoc(id int, doc map[string]interface{}) {
-	for idxName, idxPath := range col.indexPaths {
-		for _, idxVal := range GetIn(doc, idxPath) {
-			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
-				partNum := hashKey % col.db.numParts
-				ht := col.hts[partNum][idxName]
-				ht.Lock.Lock()
-				ht.Remove(hashKey, id)
-				ht.Lock.Unlock()
+// Put a document (JSON text) on all user-created indexes. Does nothing in bulk load mode.
+func (col *Col) indexDoc(id int, docB []byte) {
+	if col.bulkLoad {
+		return
+	}
+	for idxName := range col.indexPaths {
+		hashKeys, err := col.indexKeys(idxName, docB)
+		if err != nil {
+			tdlog.Noticef("Will not attempt to index document %d: %v", id, err)
+			return
+		}
+		// The background build of the index may have put the document already
+		_, building := col.building[idxName]
+		for _, hashKey := range hashKeys {
+			ht := col.indexHT(idxName, hashKey)
+			ht.Lock.Lock()
+			if building {
+				putOnce(ht, hashKey, id)
+			} else {
+				ht.Put(hashKey, id)
 			}
+			ht.Lock.Unlock()
+		}
+	}
+}
+
+// Put the entry on the hash table unless the table has it already. The caller must lock the hash table.
+func putOnce(ht *data.HashTable, key, id int) {
+	for _, existingID := range ht.Get(key, 0) {
+		if existingID == id {
+			return
+		}
+	}
+	ht.Put(key, id)
+}
+
+// Remove a document (JSON text) from all user-created indexes. Does nothing in bulk load mode.
+func (col *Col) unindexDoc(id int, docB []byte) {
+	if col.bulkLoad {
+		return
+	} else if trimmed := bytes.TrimSpace(docB); len(trimmed) == 0 || trimmed[0] != '{' {
+		tdlog.Noticef("Will not attempt to unindex document %d: it is not a JSON object", id)
+		return
+	}
+	for idxName := range col.indexPaths {
+		hashKeys, err := col.indexKeys(idxName, docB)
+		if err != nil {
+			tdlog.Noticef("Will not attempt to unindex document %d: %v", id, err)
+			return
+		}
+		for _, hashKey := range hashKeys {
+			ht := col.indexHT(idxName, hashKey)
+			ht.Lock.Lock()
+			ht.Remove(hashKey, id)
+			ht.Lock.Unlock()
 		}
 	}
 }
 
 // Insert a document with the specified ID into the collection (incl. index). Does not place partition/schema lock.
 func (col *Col) InsertRecovery(id int, doc map[string]interface{}) (err error) {
+	if err = col.checkFlags(COL_WRITE); err != nil {
+		return
+	}
+	return col.insertRecovery(id, doc)
+}
+
+// Insert a document with the specified ID regardless of collection open flags. Does not place partition/schema lock.
+func (col *Col) insertRecovery(id int, doc map[string]interface{}) (err error) {
 	docJS, err := json.Marshal(doc)
 	if err != nil {
 		return
@@ -95,42 +227,172 @@ func (col *Col) InsertRecovery(id int, doc map[string]interface{}) (err error) {
 		return
 	}
 	// Index the document
-	col.indexDoc(id, doc)
+	col.indexDoc(id, docJS)
+	col.written(id, CHANGE_INSERT, nil, docJS)
 	return
 }
 
+// Record the insertion order of a new document. The caller must place partition lock.
+func (col *Col) logInsert(id int) {
+	col.insertLock.Lock()
+	col.lastInsert++
+	seq := col.lastInsert
+	col.insertLock.Unlock()
+	if err := col.inserts[id%col.db.numParts].Append(id, seq); err != nil {
+		tdlog.Noticef("Failed to record insertion order of document %d in %s: %v", id, col.name, err)
+	}
+}
+
+// Record the deletion of a document from the partition, and compact the insertion log of the partition once half of
+// its entries may belong to deleted documents. The caller must place partition lock.
+func (col *Col) logDelete(partNum int) {
+	log := col.inserts[partNum]
+	if log.Deleted++; log.Deleted*2 >= log.Len() {
+		log.Compact(col.parts[partNum].Has)
+	}
+}
+
 // Insert a document into the collection.
 func (col *Col) Insert(doc map[string]interface{}) (id int, err error) {
+	if err = col.validateDoc(doc); err != nil {
+		return
+	}
 	docJS, err := json.Marshal(doc)
 	if err != nil {
 		return
+	} else if err = col.db.writes.wait(); err != nil {
+		return
 	}
-	id = rand.Int()
-	partNum := id % col.db.numParts
 	col.db.schemaLock.RLock()
-	part := col.parts[partNum]
+	if err = col.checkFlags(COL_WRITE); err != nil {
+		col.db.schemaLock.RUnlock()
+		return
+	}
+	if id = col.newID(); id < 0 {
+		col.db.schemaLock.RUnlock()
+		return 0, fmt.Errorf("Generated document ID %d is negative", id)
+	}
+	part := col.parts[id%col.db.numParts]
+	unlock := col.lockUnique()
+	if err = col.checkUnique(id, docJS, nil, nil); err != nil {
+		unlock()
+		col.db.schemaLock.RUnlock()
+		return
+	}
 
 	// Put document data into collection
-	part.DataLock.Lock()
-	_, err = part.Insert(id, []byte(docJS))
-	part.DataLock.Unlock()
+	err = col.writePart(id%col.db.numParts, func(part *data.Partition) (err error) {
+		if _, err = part.Read(id); err == nil {
+			err = fmt.Errorf("Generated document ID %d is already in use", id)
+		} else if _, err = part.Insert(id, []byte(docJS)); err == nil {
+			col.logInsert(id)
+		}
+		return
+	})
 	if err != nil {
+		unlock()
 		col.db.schemaLock.RUnlock()
 		return
 	}
 
 	part.LockUpdate(id)
 	// Index the document
-	col.indexDoc(id, doc)
+	col.indexDoc(id, docJS)
 	part.UnlockUpdate(id)
+	unlock()
+	col.written(id, CHANGE_INSERT, nil, docJS)
 
 	col.db.schemaLock.RUnlock()
 	return
 }
 
+/*
+Insert a document under the specified ID, e.g. to import documents from another database. If the ID is already in use,
+the insertion fails with ErrorDocExists, unless remap is true: the document is then inserted under a newly generated ID.
+Return the ID given to the document.
+*/
+func (col *Col) InsertWithID(id int, doc map[string]interface{}, remap bool) (newID int, err error) {
+	if id < 0 {
+		return 0, fmt.Errorf("Document ID %d is negative", id)
+	} else if err = col.validateDoc(doc); err != nil {
+		return
+	}
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return
+	} else if err = col.db.writes.wait(); err != nil {
+		return
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err = col.checkFlags(COL_WRITE); err != nil {
+		return
+	}
+	unlock := col.lockUnique()
+	defer unlock()
+	if err = col.checkUnique(id, docJS, nil, nil); err != nil {
+		return
+	}
+
+	// Put document data into collection, under a new ID if the ID is in use and may be remapped
+	for newID = id; ; {
+		inUse := false
+		err = col.writePart(newID%col.db.numParts, func(part *data.Partition) (err error) {
+			if _, err = part.Read(newID); err == nil {
+				inUse = true
+			} else if _, err = part.Insert(newID, []byte(docJS)); err == nil {
+				col.logInsert(newID)
+			}
+			return
+		})
+		if err != nil {
+			return
+		} else if !inUse {
+			break
+		} else if !remap {
+			return 0, dberr.New(dberr.ErrorDocExists, id)
+		} else if newID = col.newID(); newID < 0 {
+			return 0, fmt.Errorf("Generated document ID %d is negative", newID)
+		}
+	}
+
+	part := col.parts[newID%col.db.numParts]
+	part.LockUpdate(newID)
+	// Index the document
+	col.indexDoc(newID, docJS)
+	part.UnlockUpdate(newID)
+	col.written(newID, CHANGE_INSERT, nil, docJS)
+	return
+}
+
+/*
+Insert documents under their IDs (keys of the map), see InsertWithID. Return the IDs given to the documents, keyed by
+their original IDs. Importing stops at the first error, the documents imported so far remain in the collection.
+*/
+func (col *Col) ImportDocs(docs map[int]map[string]interface{}, remap bool) (idMap map[int]int, err error) {
+	ids := make([]int, 0, len(docs))
+	for id := range docs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	idMap = make(map[int]int, len(docs))
+	for _, id := range ids {
+		newID, err := col.InsertWithID(id, docs[id], remap)
+		if err != nil {
+			return idMap, err
+		}
+		idMap[id] = newID
+	}
+	return
+}
+
 func (col *Col) read(id int, placeSchemaLock bool) (doc map[string]interface{}, err error) {
 	if placeSchemaLock {
 		col.db.schemaLock.RLock()
+		if err = col.checkFlags(COL_READ); err != nil {
+			col.db.schemaLock.RUnlock()
+			return
+		}
 	}
 	part := col.parts[id%col.db.numParts]
 
@@ -138,6 +400,11 @@ func (col *Col) read(id int, placeSchemaLock bool) (doc map[string]interface{},
 	docB, err := part.Read(id)
 	part.DataLock.RUnlock()
 	if err != nil {
+		if dberr.Type(err) == dberr.ErrorNoDoc && col.db.Config.RepairLookup && len(part.Dangling()) > 0 {
+			part.DataLock.Lock()
+			part.RemoveDangling()
+			part.DataLock.Unlock()
+		}
 		if placeSchemaLock {
 			col.db.schemaLock.RUnlock()
 		}
@@ -153,48 +420,141 @@ func (col *Col) read(id int, placeSchemaLock bool) (doc map[string]interface{},
 
 // Find and retrieve a document by ID.
 func (col *Col) Read(id int) (doc map[string]interface{}, err error) {
-	return col.read(id, true)
+	if doc, err = col.read(id, true); err == nil {
+		col.countAccess(id, false)
+	}
+	return
+}
+
+// Insert a document read from the input (JSON object), return its ID. Unlike Insert, the JSON text is stored verbatim,
+// and decoded only if document limits are configured. The input is read into memory in full, up to the maximum
+// document size, before the collection is locked.
+func (col *Col) InsertFrom(in io.Reader) (id int, err error) {
+	conf := col.db.Config
+	maxLen := conf.DocMaxRoom >> 1
+	input := new(bytes.Buffer)
+	if _, err = input.ReadFrom(io.LimitReader(in, int64(maxLen)+1)); err != nil {
+		return
+	} else if input.Len() > maxLen {
+		return 0, dberr.New(dberr.ErrorDocTooLarge, conf.DocMaxRoom, input.Len()<<1)
+	}
+	docB := input.Bytes()
+	if conf.DocMaxDepth > 0 || conf.DocMaxKeys > 0 || conf.DocMaxArrayLen > 0 {
+		var doc map[string]interface{}
+		if err = json.Unmarshal(docB, &doc); err != nil {
+			return
+		} else if doc == nil {
+			return 0, errors.New("Input is not a JSON object")
+		} else if err = col.validateDoc(doc); err != nil {
+			return
+		}
+	} else if trimmed := bytes.TrimLeft(docB, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(docB) {
+		return 0, errors.New("Input is not a JSON object")
+	}
+	if err = col.db.writes.wait(); err != nil {
+		return
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err = col.checkFlags(COL_WRITE); err != nil {
+		return
+	}
+	if id = col.newID(); id < 0 {
+		return 0, fmt.Errorf("Generated document ID %d is negative", id)
+	}
+	part := col.parts[id%col.db.numParts]
+	unlock := col.lockUnique()
+	defer unlock()
+
+	// Put document data into collection
+	part.DataLock.Lock()
+	if _, err = part.Read(id); err == nil {
+		err = fmt.Errorf("Generated document ID %d is already in use", id)
+	} else if err = col.checkUnique(id, docB, part, nil); err == nil {
+		if _, err = part.Insert(id, docB); err == nil {
+			col.logInsert(id)
+		}
+	}
+	part.DataLock.Unlock()
+	if err != nil {
+		return
+	}
+
+	if len(col.indexPaths) > 0 {
+		part.LockUpdate(id)
+		// Index the document
+		col.indexDoc(id, docB)
+		part.UnlockUpdate(id)
+	}
+	col.written(id, CHANGE_INSERT, nil, docB)
+	return
+}
+
+// Write a document's JSON text to the output straight from the data file, return number of bytes written.
+func (col *Col) ReadTo(id int, out io.Writer) (n int, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err = col.checkFlags(COL_READ); err != nil {
+		return
+	}
+	part := col.parts[id%col.db.numParts]
+	part.DataLock.RLock()
+	n, err = part.ReadTo(id, out)
+	part.DataLock.RUnlock()
+	if err == nil {
+		col.countAccess(id, false)
+	}
+	return
 }
 
 // Update a document.
 func (col *Col) Update(id int, doc map[string]interface{}) error {
 	if doc == nil {
 		return fmt.Errorf("Updating %d: input doc may not be nil", id)
+	} else if err := col.validateDoc(doc); err != nil {
+		return err
 	}
 	docJS, err := json.Marshal(doc)
 	if err != nil {
 		return err
+	} else if err = col.db.writes.wait(); err != nil {
+		return err
 	}
 	col.db.schemaLock.RLock()
+	if err := col.checkFlags(COL_WRITE); err != nil {
+		col.db.schemaLock.RUnlock()
+		return err
+	}
 	part := col.parts[id%col.db.numParts]
-
-	// Place lock, read back original document and update
-	part.DataLock.Lock()
-	originalB, err := part.Read(id)
-	if err != nil {
-		part.DataLock.Unlock()
+	unlock := col.lockUnique()
+	if err = col.checkUnique(id, docJS, nil, nil); err != nil {
+		unlock()
 		col.db.schemaLock.RUnlock()
 		return err
 	}
-	err = part.Update(id, []byte(docJS))
-	part.DataLock.Unlock()
+
+	// Place lock, read back original document and update
+	var originalB []byte
+	err = col.writePart(id%col.db.numParts, func(part *data.Partition) (err error) {
+		if originalB, err = part.Read(id); err == nil {
+			err = part.Update(id, []byte(docJS))
+		}
+		return
+	})
 	if err != nil {
+		unlock()
 		col.db.schemaLock.RUnlock()
 		return err
 	}
 
 	// Done with the collection data, next is to maintain indexed values
-	var original map[string]interface{}
-	json.Unmarshal(originalB, &original)
 	part.LockUpdate(id)
-	if original != nil {
-		col.unindexDoc(id, original)
-	} else {
-		tdlog.Noticef("Will not attempt to unindex document %d during update", id)
-	}
-	col.indexDoc(id, doc)
+	col.unindexDoc(id, originalB)
+	col.indexDoc(id, docJS)
 	// Done with the index
 	part.UnlockUpdate(id)
+	unlock()
+	col.written(id, CHANGE_UPDATE, originalB, docJS)
 
 	col.db.schemaLock.RUnlock()
 	return nil
@@ -206,8 +566,17 @@ func (col *Col) Update(id int, doc map[string]interface{}) error {
 // provided buffer could be modified (reused for returned value);
 // non-nil error will be propagated back and returned from UpdateBytesFunc.
 func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []byte, err error)) error {
+	if err := col.db.writes.wait(); err != nil {
+		return err
+	}
 	col.db.schemaLock.RLock()
+	if err := col.checkFlags(COL_WRITE); err != nil {
+		col.db.schemaLock.RUnlock()
+		return err
+	}
 	part := col.parts[id%col.db.numParts]
+	unlock := col.lockUnique()
+	defer unlock()
 
 	// Place lock, read back original document and update
 	part.DataLock.Lock()
@@ -217,8 +586,7 @@ func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []by
 		col.db.schemaLock.RUnlock()
 		return err
 	}
-	var original map[string]interface{}
-	json.Unmarshal(originalB, &original) // Unmarshal originalB before passing it to update
+	original := append([]byte(nil), originalB...) // Copy originalB before passing it to update
 	docB, err := update(originalB)
 	if err != nil {
 		part.DataLock.Unlock()
@@ -230,6 +598,14 @@ func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []by
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
 		return err
+	} else if err = col.validateDoc(doc); err != nil {
+		part.DataLock.Unlock()
+		col.db.schemaLock.RUnlock()
+		return err
+	} else if err = col.checkUnique(id, docB, part, nil); err != nil {
+		part.DataLock.Unlock()
+		col.db.schemaLock.RUnlock()
+		return err
 	}
 	err = part.Update(id, docB)
 	part.DataLock.Unlock()
@@ -240,26 +616,117 @@ func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []by
 
 	// Done with the collection data, next is to maintain indexed values
 	part.LockUpdate(id)
-	if original != nil {
-		col.unindexDoc(id, original)
-	} else {
-		tdlog.Noticef("Will not attempt to unindex document %d during update", id)
-	}
-	col.indexDoc(id, doc)
+	col.unindexDoc(id, original)
+	col.indexDoc(id, docB)
 	// Done with the index
 	part.UnlockUpdate(id)
+	col.written(id, CHANGE_UPDATE, original, docB)
 
 	col.db.schemaLock.RUnlock()
 	return nil
 }
 
+/*
+Update documents by their IDs with the function, which receives the ID and JSON text of each document and returns the
+new JSON text; the same rules apply as to UpdateBytesFunc. Documents are grouped by partition, so that each partition
+is locked once per batch. Documents that cannot be updated (they do not exist, the function fails, or the new JSON text
+is invalid) are left intact and their errors are returned keyed by document ID; the other documents are updated
+regardless.
+*/
+func (col *Col) UpdateBytesMany(ids []int, update func(id int, origDoc []byte) (newDoc []byte, err error)) (failed map[int]error, err error) {
+	if err = col.db.writes.wait(); err != nil {
+		return
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err = col.checkFlags(COL_WRITE); err != nil {
+		return
+	}
+	failed = make(map[int]error)
+	byPart := make([][]int, col.db.numParts)
+	for _, id := range ids {
+		if id < 0 {
+			failed[id] = dberr.New(dberr.ErrorNoDoc, id)
+		} else {
+			byPart[id%col.db.numParts] = append(byPart[id%col.db.numParts], id)
+		}
+	}
+	type change struct {
+		id            int
+		original, doc []byte
+	}
+	unlock := col.lockUnique()
+	defer unlock()
+	batch := make(map[uniqueValue]int)
+	for partNum, partIDs := range byPart {
+		if len(partIDs) == 0 {
+			continue
+		}
+		// Place lock once, read back original documents and update them
+		changes := make([]change, 0, len(partIDs))
+		err = col.writePart(partNum, func(part *data.Partition) error {
+			for _, id := range partIDs {
+				originalB, err := part.Read(id)
+				if err != nil {
+					failed[id] = err
+					continue
+				}
+				original := append([]byte(nil), originalB...) // Copy originalB before passing it to update
+				var doc map[string]interface{}
+				docB, err := update(id, originalB)
+				if err == nil {
+					err = json.Unmarshal(docB, &doc)
+				}
+				if err == nil {
+					err = col.validateDoc(doc)
+				}
+				if err == nil {
+					err = col.checkUnique(id, docB, part, batch)
+				}
+				if err == nil {
+					err = part.Update(id, docB)
+				}
+				if err != nil {
+					failed[id] = err
+					continue
+				}
+				changes = append(changes, change{id: id, original: original, doc: docB})
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		// Done with the collection data, next is to maintain indexed values
+		part := col.parts[partNum]
+		for _, c := range changes {
+			part.LockUpdate(c.id)
+			col.unindexDoc(c.id, c.original)
+			col.indexDoc(c.id, c.doc)
+			part.UnlockUpdate(c.id)
+			col.written(c.id, CHANGE_UPDATE, c.original, c.doc)
+		}
+	}
+	return
+}
+
 // UpdateFunc will update a document.
 // update func will get current document and should return updated document;
 // provided document should NOT be modified;
 // non-nil error will be propagated back and returned from UpdateFunc.
 func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (newDoc map[string]interface{}, err error)) error {
+	if err := col.db.writes.wait(); err != nil {
+		return err
+	}
 	col.db.schemaLock.RLock()
+	if err := col.checkFlags(COL_WRITE); err != nil {
+		col.db.schemaLock.RUnlock()
+		return err
+	}
 	part := col.parts[id%col.db.numParts]
+	unlock := col.lockUnique()
+	defer unlock()
 
 	// Place lock, read back original document and update
 	part.DataLock.Lock()
@@ -277,18 +744,24 @@ func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (
 		return err
 	}
 	doc, err := update(original)
+	if err == nil {
+		err = col.validateDoc(doc)
+	}
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
 		return err
 	}
 	docJS, err := json.Marshal(doc)
+	if err == nil {
+		err = col.checkUnique(id, docJS, part, nil)
+	}
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
 		return err
 	}
-	err = part.Update(id, []byte(docJS))
+	err = part.Update(id, docJS)
 	part.DataLock.Unlock()
 	if err != nil {
 		col.db.schemaLock.RUnlock()
@@ -297,46 +770,165 @@ func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (
 
 	// Done with the collection data, next is to maintain indexed values
 	part.LockUpdate(id)
-	col.unindexDoc(id, original)
-	col.indexDoc(id, doc)
+	col.unindexDoc(id, originalB)
+	col.indexDoc(id, docJS)
 	// Done with the document
 	part.UnlockUpdate(id)
+	col.written(id, CHANGE_UPDATE, originalB, docJS)
 
 	col.db.schemaLock.RUnlock()
 	return nil
 }
 
-// Delete a document.
+// Delete a document, enforcing relations (see AddRelation) that refer to the collection.
 func (col *Col) Delete(id int) error {
-	col.db.schemaLock.RLock()
-	part := col.parts[id%col.db.numParts]
+	rels, froms := col.referringRelations()
+	if err := col.denyReferenced(rels, froms, []int{id}); err != nil {
+		return err
+	} else if err := col.deleteDoc(id); err != nil {
+		return err
+	}
+	return col.cascadeDelete(rels, froms, []int{id})
+}
 
-	// Place lock, read back original document and delete document
-	part.DataLock.Lock()
-	originalB, err := part.Read(id)
-	if err != nil {
-		part.DataLock.Unlock()
+// Delete a document regardless of relations.
+func (col *Col) deleteDoc(id int) error {
+	if err := col.db.writes.wait(); err != nil {
+		return err
+	}
+	col.db.schemaLock.RLock()
+	if err := col.checkFlags(COL_WRITE); err != nil {
 		col.db.schemaLock.RUnlock()
 		return err
 	}
-	err = part.Delete(id)
-	part.DataLock.Unlock()
+	part := col.parts[id%col.db.numParts]
+
+	// Place lock, read back original document and delete document
+	var originalB []byte
+	err := col.writePart(id%col.db.numParts, func(part *data.Partition) (err error) {
+		if originalB, err = part.Read(id); err != nil {
+			return
+		} else if err = part.Delete(id); err == nil {
+			col.deleteAttachments(id%col.db.numParts, originalB)
+			col.logDelete(id % col.db.numParts)
+		}
+		return
+	})
 	if err != nil {
 		col.db.schemaLock.RUnlock()
 		return err
 	}
 
 	// Done with the collection data, next is to remove indexed values
-	var original map[string]interface{}
-	err = json.Unmarshal(originalB, &original)
-	if err == nil {
-		part.LockUpdate(id)
-		col.unindexDoc(id, original)
-		part.UnlockUpdate(id)
-	} else {
-		tdlog.Noticef("Will not attempt to unindex document %d during delete", id)
-	}
+	part.LockUpdate(id)
+	col.unindexDoc(id, originalB)
+	part.UnlockUpdate(id)
+	col.written(id, CHANGE_DELETE, originalB, nil)
 
 	col.db.schemaLock.RUnlock()
 	return nil
 }
+
+/*
+Delete documents by their IDs and return the number of documents deleted. IDs of documents that do not exist are
+skipped. Documents are grouped by partition, so that each partition and each index hash table is locked once per batch.
+Relations referring to the collection are enforced for the whole batch: nothing is deleted if any of the documents is
+referenced over a REF_DENY relation.
+*/
+func (col *Col) DeleteMany(ids []int) (deleted int, err error) {
+	rels, froms := col.referringRelations()
+	if err = col.denyReferenced(rels, froms, ids); err != nil {
+		return
+	}
+	deletedIDs, err := col.deleteMany(ids, nil)
+	if deleted = len(deletedIDs); err != nil {
+		return
+	}
+	err = col.cascadeDelete(rels, froms, ids)
+	return
+}
+
+// Delete documents by their IDs regardless of relations, leaving alone those the condition (if not nil) returns false
+// for. Return IDs of the deleted documents.
+func (col *Col) deleteMany(ids []int, cond func(docB []byte) bool) (deleted []int, err error) {
+	if err = col.db.writes.wait(); err != nil {
+		return
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err = col.checkFlags(COL_WRITE); err != nil {
+		return
+	}
+	byPart := make([][]int, col.db.numParts)
+	for _, id := range ids {
+		if id >= 0 {
+			byPart[id%col.db.numParts] = append(byPart[id%col.db.numParts], id)
+		}
+	}
+	for partNum, partIDs := range byPart {
+		if len(partIDs) == 0 {
+			continue
+		}
+		part := col.parts[partNum]
+		// Place lock once, read back original documents and delete them
+		originals := make(map[int][]byte, len(partIDs))
+		err = col.writePart(partNum, func(part *data.Partition) error {
+			for _, id := range partIDs {
+				originalB, readErr := part.Read(id)
+				if readErr != nil || cond != nil && !cond(originalB) {
+					continue
+				}
+				if err := part.Delete(id); err != nil {
+					return err
+				}
+				col.deleteAttachments(partNum, originalB)
+				col.logDelete(partNum)
+				originals[id] = originalB
+			}
+			return nil
+		})
+		for id, originalB := range originals {
+			deleted = append(deleted, id)
+			col.written(id, CHANGE_DELETE, originalB, nil)
+		}
+		if col.bulkLoad {
+			// Indexes are rebuilt at the end of bulk load
+			if err != nil {
+				return
+			}
+			continue
+		}
+		// Remove indexed values, grouped by index hash table
+		for id := range originals {
+			part.LockUpdate(id)
+		}
+		removals := make(map[*data.HashTable][][2]int)
+		for id, originalB := range originals {
+			for idxName := range col.indexPaths {
+				hashKeys, err := col.indexKeys(idxName, originalB)
+				if err != nil {
+					tdlog.Noticef("Will not attempt to unindex document %d: %v", id, err)
+					break
+				}
+				for _, hashKey := range hashKeys {
+					ht := col.indexHT(idxName, hashKey)
+					removals[ht] = append(removals[ht], [2]int{hashKey, id})
+				}
+			}
+		}
+		for ht, entries := range removals {
+			ht.Lock.Lock()
+			for _, entry := range entries {
+				ht.Remove(entry[0], entry[1])
+			}
+			ht.Lock.Unlock()
+		}
+		for id := range originals {
+			part.UnlockUpdate(id)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -784,17 +785,16 @@ func TestDeleteMarshalJsError(t *testing.T) {
 	log.SetOutput(&str)
 	db, _ := OpenDB(tempDir)
 	defer os.RemoveAll(tempDir)
-	errMessage := "Error json marshal"
 	col, _ := OpenCol(db, "test")
 
 	id, _ := col.Insert(map[string]interface{}{"test": "test"})
 	patchUpdate := monkey.PatchInstanceMethod(reflect.TypeOf(part), "Delete", func(_ *data.Partition, id int) (err error) {
 		return nil
 	})
-	patchMarshal := monkey.Patch(json.Unmarshal, func(data []byte, v interface{}) error {
-		return errors.New(errMessage)
+	patchRead := monkey.PatchInstanceMethod(reflect.TypeOf(part), "Read", func(_ *data.Partition, id int) ([]byte, error) {
+		return []byte("corrupted"), nil
 	})
-	defer patchMarshal.Unpatch()
+	defer patchRead.Unpatch()
 	defer patchUpdate.Unpatch()
 	col.Delete(id)
 
@@ -802,3 +802,368 @@ func TestDeleteMarshalJsError(t *testing.T) {
 		t.Error("Expected error: message log")
 	}
 }
+
+func TestIDGenerator(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	nextID := 100
+	col.SetIDGenerator(func() int {
+		nextID++
+		return nextID / 2
+	})
+	// 101 / 2 = 50
+	if id, err := col.Insert(map[string]interface{}{"a": 1}); err != nil || id != 50 {
+		t.Fatal(id, err)
+	}
+	// 102 / 2 = 51
+	if id, err := col.Insert(map[string]interface{}{"a": 2}); err != nil || id != 51 {
+		t.Fatal(id, err)
+	}
+	// 103 / 2 = 51 is taken
+	if _, err := col.Insert(map[string]interface{}{"a": 3}); err == nil {
+		t.Fatal("Did not error")
+	}
+	if doc, err := col.Read(51); err != nil || doc["a"].(float64) != 2 {
+		t.Fatal(doc, err)
+	}
+	// Generator survives schema change
+	if err := db.Rename("col", "col2"); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := col.Insert(map[string]interface{}{"a": 4}); err != nil || id != 52 {
+		t.Fatal(id, err)
+	}
+	col.SetIDGenerator(func() int {
+		return -1
+	})
+	if _, err := col.Insert(map[string]interface{}{"a": 5}); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Back to random IDs
+	col.SetIDGenerator(nil)
+	if id, err := col.Insert(map[string]interface{}{"a": 6}); err != nil || id == 53 {
+		t.Fatal(id, err)
+	}
+	count := 0
+	col.ForEachDoc(func(int, []byte) bool {
+		count++
+		return true
+	})
+	if count != 4 {
+		t.Fatal(count)
+	}
+}
+
+func TestRandomIDConcurrentDB(t *testing.T) {
+	// Databases opened at the same time do not generate the same IDs
+	const numDB = 4
+	dbs := make([]*DB, numDB)
+	wg := new(sync.WaitGroup)
+	for i := range dbs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if dbs[i], err = OpenDB(fmt.Sprintf("%s_%d", TEST_DATA_DIR, i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	ids := make(map[int]struct{})
+	for i, db := range dbs {
+		defer os.RemoveAll(fmt.Sprintf("%s_%d", TEST_DATA_DIR, i))
+		if db == nil {
+			t.FailNow()
+		}
+		defer db.Close()
+		ids[db.newID()] = struct{}{}
+	}
+	if len(ids) != numDB {
+		t.Fatal(ids)
+	}
+}
+
+func TestDocLimits(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	deep := map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{map[string]interface{}{"c": 1}}}}
+	wide := map[string]interface{}{"a": 1, "b": 2, "c": map[string]interface{}{"d": 3, "e": 4}}
+	long := map[string]interface{}{"a": []interface{}{1, 2, 3, 4}}
+	// Unlimited by default
+	id, err := col.Insert(deep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Config.DocMaxDepth = 3
+	db.Config.DocMaxKeys = 4
+	db.Config.DocMaxArrayLen = 3
+	for doc, errType := range map[*map[string]interface{}]interface{}{&deep: dberr.ErrorDocTooDeep, &wide: dberr.ErrorDocTooManyKeys, &long: dberr.ErrorDocArrayTooLong} {
+		if _, err := col.Insert(*doc); dberr.Type(err) != errType {
+			t.Fatal(*doc, err)
+		}
+		if err := col.Update(id, *doc); dberr.Type(err) != errType {
+			t.Fatal(*doc, err)
+		}
+		if err := col.UpdateFunc(id, func(map[string]interface{}) (map[string]interface{}, error) {
+			return *doc, nil
+		}); dberr.Type(err) != errType {
+			t.Fatal(*doc, err)
+		}
+		if err := col.UpdateBytesFunc(id, func([]byte) ([]byte, error) {
+			return json.Marshal(*doc)
+		}); dberr.Type(err) != errType {
+			t.Fatal(*doc, err)
+		}
+	}
+	// Rejected updates leave the document intact
+	if doc, err := col.Read(id); err != nil || len(doc) != 1 || doc["a"] == nil {
+		t.Fatal(doc, err)
+	}
+	if _, err := col.Insert(map[string]interface{}{"a": []interface{}{1, 2, 3}, "b": map[string]interface{}{"c": 1}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInsertFromReadTo(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	large := strings.Repeat("a", 200000)
+	// Without index the document is not decoded
+	plain, err := col.InsertFrom(strings.NewReader(`{"a": "` + large + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if n, err := col.ReadTo(plain, out); err != nil || n != out.Len() || out.String() != `{"a": "`+large+`"}` {
+		t.Fatal(n, err)
+	}
+	for _, invalid := range []string{"", "[1]", `{"a": 1`, `{} {}`} {
+		if _, err := col.InsertFrom(strings.NewReader(invalid)); err == nil {
+			t.Fatal("Did not error", invalid)
+		}
+	}
+	// With index the document is indexed
+	if err := col.Index([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	indexed, err := col.InsertFrom(strings.NewReader(`{"b": 1, "c": "` + large + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": 1, "in": []interface{}{"b"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	} else if _, found := result[indexed]; !found {
+		t.Fatal(result, indexed)
+	}
+	if _, err := col.InsertFrom(strings.NewReader(`{"b": `)); err == nil {
+		t.Fatal("Did not error")
+	}
+	if doc, err := col.Read(indexed); err != nil || doc["c"] != large {
+		t.Fatal(err)
+	}
+	if _, err := col.ReadTo(123456, out); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	count := 0
+	col.ForEachDoc(func(int, []byte) bool {
+		count++
+		return true
+	})
+	if count != 2 {
+		t.Fatal(count)
+	}
+	if _, err := col.InsertFrom(strings.NewReader(`{"a": "` + strings.Repeat("a", data.DefaultDocMaxRoom) + `"}`)); dberr.Type(err) != dberr.ErrorDocTooLarge {
+		t.Fatal(err)
+	}
+	// Reading the input does not hold up other writes
+	in, input := io.Pipe()
+	inserted := make(chan error, 1)
+	go func() {
+		_, err := col.InsertFrom(in)
+		inserted <- err
+	}()
+	if _, err := input.Write([]byte(`{"b": `)); err != nil {
+		t.Fatal(err)
+	} else if _, err := col.Insert(map[string]interface{}{"b": 2}); err != nil {
+		t.Fatal(err)
+	} else if _, err := input.Write([]byte(`3}`)); err != nil {
+		t.Fatal(err)
+	}
+	input.Close()
+	if err := <-inserted; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 20)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": i % 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Delete even-valued documents found by a query, plus IDs that do not exist and duplicates
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": 0, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 10 {
+		t.Fatal(result, err)
+	}
+	toDelete := []int{-1, 123456789, ids[0], ids[0]}
+	for id := range result {
+		toDelete = append(toDelete, id)
+	}
+	if deleted, err := col.DeleteMany(toDelete); err != nil || deleted != 10 {
+		t.Fatal(deleted, err)
+	}
+	for i, id := range ids {
+		if _, err := col.Read(id); i%2 == 0 && dberr.Type(err) != dberr.ErrorNoDoc || i%2 == 1 && err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	result = make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"has": []interface{}{"a"}}, col, &result); err != nil || len(result) != 10 {
+		t.Fatal(result, err)
+	}
+	if deleted, err := col.DeleteMany(nil); err != nil || deleted != 0 {
+		t.Fatal(deleted, err)
+	}
+}
+
+func TestUpdateBytesMany(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 20)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rename attribute "a" to "b" in all documents but the first, which fails the update, and the second, which
+	// becomes invalid JSON
+	updateErr := errors.New("update failed")
+	failed, err := col.UpdateBytesMany(append(ids, -1, 123456789), func(id int, origDoc []byte) ([]byte, error) {
+		if id == ids[0] {
+			return nil, updateErr
+		} else if id == ids[1] {
+			return []byte("{"), nil
+		}
+		return bytes.Replace(origDoc, []byte(`"a"`), []byte(`"b"`), 1), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(failed) != 4 || failed[ids[0]] != updateErr || failed[ids[1]] == nil ||
+		dberr.Type(failed[-1]) != dberr.ErrorNoDoc || dberr.Type(failed[123456789]) != dberr.ErrorNoDoc {
+		t.Fatal(failed)
+	}
+	for i, id := range ids {
+		doc, err := col.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		} else if i < 2 && doc["a"] != float64(i) || i >= 2 && doc["b"] != float64(i) {
+			t.Fatal(i, doc)
+		}
+	}
+	// The index follows the updates
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"has": []interface{}{"a"}}, col, &result); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	}
+}
+
+func TestInsertWithID(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := col.InsertWithID(12, map[string]interface{}{"a": 1}, false); err != nil || id != 12 {
+		t.Fatal(id, err)
+	} else if _, err := col.InsertWithID(12, map[string]interface{}{"a": 2}, false); dberr.Type(err) != dberr.ErrorDocExists {
+		t.Fatal(err)
+	} else if _, err := col.InsertWithID(-1, map[string]interface{}{"a": 2}, true); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Colliding IDs are remapped
+	idMap, err := col.ImportDocs(map[int]map[string]interface{}{12: {"a": 2}, 34: {"a": 3}}, true)
+	if err != nil || len(idMap) != 2 || idMap[34] != 34 || idMap[12] == 12 {
+		t.Fatal(idMap, err)
+	}
+	for id, a := range map[int]float64{12: 1, idMap[12]: 2, 34: 3} {
+		if doc, err := col.Read(id); err != nil || doc["a"] != a {
+			t.Fatal(id, doc, err)
+		}
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": 2, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	} else if _, found := result[idMap[12]]; !found {
+		t.Fatal(result)
+	}
+	// Without remapping, importing stops at the collision
+	if idMap, err := col.ImportDocs(map[int]map[string]interface{}{1: {}, 34: {}, 56: {}}, false); dberr.Type(err) != dberr.ErrorDocExists || len(idMap) != 1 {
+		t.Fatal(idMap, err)
+	}
+}
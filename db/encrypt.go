@@ -0,0 +1,223 @@
+// Passphrase encryption of archive dumps.
+
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	ENCRYPTION_MAGIC      = "TDENCBAK" // Leading bytes of an encrypted archive.
+	ENCRYPTION_VERSION    = 1          // Version of encrypted archive format.
+	ENCRYPTION_KDF_ROUNDS = 100000     // PBKDF2-HMAC-SHA256 iterations deriving the key from passphrase.
+	ENCRYPTION_CHUNK_SIZE = 64 * 1024  // Amount of archive data encrypted and authenticated as one chunk.
+	encryptionSaltLen     = 16
+	encryptionPrefixLen   = 7
+	encryptionHeaderLen   = len(ENCRYPTION_MAGIC) + 1 + 4 + encryptionSaltLen + encryptionPrefixLen
+)
+
+var errDecrypt = errors.New("Failed to decrypt archive - the passphrase is wrong or the archive is corrupted")
+
+// Derive a key from the passphrase using PBKDF2 with HMAC-SHA256.
+func deriveKey(passphrase, salt []byte, rounds, keyLen int) []byte {
+	prf := hmac.New(sha256.New, passphrase)
+	key := make([]byte, 0, keyLen)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		var blockNum [4]byte
+		binary.BigEndian.PutUint32(blockNum[:], block)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(blockNum[:])
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < rounds; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+/*
+Encrypted archive stream. The header carries format version, key derivation parameters and a random nonce prefix; it
+is followed by chunks of AES-256-GCM encrypted data. The nonce of a chunk is made of the prefix, the chunk counter, and
+a flag set only on the last chunk, hence chunks that are reordered, dropped, or truncated away fail authentication.
+*/
+type archiveCrypt struct {
+	aead   cipher.AEAD
+	header []byte // authenticated as additional data of every chunk
+	prefix []byte
+	count  uint32
+}
+
+// Set up encryption of the header parameters and passphrase.
+func newArchiveCrypt(header, passphrase []byte) (*archiveCrypt, error) {
+	saltStart := len(ENCRYPTION_MAGIC) + 1 + 4
+	rounds := binary.BigEndian.Uint32(header[len(ENCRYPTION_MAGIC)+1 : saltStart])
+	if rounds < 1 || rounds > 100*ENCRYPTION_KDF_ROUNDS {
+		return nil, fmt.Errorf("Encrypted archive has unreasonable key derivation rounds %d", rounds)
+	}
+	block, err := aes.NewCipher(deriveKey(passphrase, header[saltStart:saltStart+encryptionSaltLen], int(rounds), 32))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveCrypt{aead: aead, header: header, prefix: header[saltStart+encryptionSaltLen:]}, nil
+}
+
+// Return the nonce of the next chunk.
+func (crypt *archiveCrypt) nextNonce(last bool) []byte {
+	nonce := make([]byte, crypt.aead.NonceSize())
+	copy(nonce, crypt.prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixLen:], crypt.count)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	crypt.count++
+	return nonce
+}
+
+// Encrypt data written to it in chunks. Close writes the last chunk, and does not close the underlying writer.
+type encryptWriter struct {
+	crypt *archiveCrypt
+	out   io.Writer
+	buf   []byte
+}
+
+// Write the header of a new encrypted archive into the output, and return a writer that encrypts into the output.
+func newEncryptWriter(out io.Writer, passphrase []byte) (*encryptWriter, error) {
+	header := make([]byte, encryptionHeaderLen)
+	copy(header, ENCRYPTION_MAGIC)
+	header[len(ENCRYPTION_MAGIC)] = ENCRYPTION_VERSION
+	binary.BigEndian.PutUint32(header[len(ENCRYPTION_MAGIC)+1:], ENCRYPTION_KDF_ROUNDS)
+	if _, err := io.ReadFull(rand.Reader, header[len(ENCRYPTION_MAGIC)+1+4:]); err != nil {
+		return nil, err
+	}
+	crypt, err := newArchiveCrypt(header, passphrase)
+	if err != nil {
+		return nil, err
+	} else if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{crypt: crypt, out: out, buf: make([]byte, 0, ENCRYPTION_CHUNK_SIZE)}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		if len(w.buf) == ENCRYPTION_CHUNK_SIZE {
+			if err = w.writeChunk(false); err != nil {
+				return
+			}
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return
+}
+
+func (w *encryptWriter) writeChunk(last bool) error {
+	sealed := w.crypt.aead.Seal(nil, w.crypt.nextNonce(last), w.buf, w.crypt.header)
+	w.buf = w.buf[:0]
+	_, err := w.out.Write(sealed)
+	return err
+}
+
+func (w *encryptWriter) Close() error {
+	return w.writeChunk(true)
+}
+
+// Decrypt an encrypted archive, failing with an error upon reaching a chunk that does not authenticate.
+type decryptReader struct {
+	crypt *archiveCrypt
+	in    *bufio.Reader
+	buf   *bytes.Reader
+	done  bool
+}
+
+// Read the header of an encrypted archive, and return a reader of the decrypted archive.
+func newDecryptReader(in io.Reader, passphrase []byte) (*decryptReader, error) {
+	header := make([]byte, encryptionHeaderLen)
+	if _, err := io.ReadFull(in, header); err != nil || string(header[:len(ENCRYPTION_MAGIC)]) != ENCRYPTION_MAGIC {
+		return nil, errors.New("Input is not an encrypted archive")
+	} else if header[len(ENCRYPTION_MAGIC)] != ENCRYPTION_VERSION {
+		return nil, fmt.Errorf("Encrypted archive version %d is not supported", header[len(ENCRYPTION_MAGIC)])
+	}
+	crypt, err := newArchiveCrypt(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{crypt: crypt, in: bufio.NewReader(in), buf: bytes.NewReader(nil)}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		sealed := make([]byte, ENCRYPTION_CHUNK_SIZE+r.crypt.aead.Overhead())
+		n, err := io.ReadFull(r.in, sealed)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			r.done = true
+		} else if err != nil {
+			return 0, err
+		} else if _, err := r.in.Peek(1); err == io.EOF {
+			r.done = true
+		}
+		plain, err := r.crypt.aead.Open(nil, r.crypt.nextNonce(r.done), sealed[:n], r.crypt.header)
+		if err != nil {
+			return 0, errDecrypt
+		}
+		r.buf = bytes.NewReader(plain)
+	}
+	return r.buf.Read(p)
+}
+
+// Write the database as an archive (see DumpArchive) encrypted with a key derived from the passphrase.
+func (db *DB) DumpEncryptedArchive(out io.Writer, passphrase []byte) error {
+	encOut, err := newEncryptWriter(out, passphrase)
+	if err != nil {
+		return err
+	} else if err := db.DumpArchive(encOut); err != nil {
+		return err
+	}
+	return encOut.Close()
+}
+
+// Decrypt an archive made by DumpEncryptedArchive and restore it into the destination directory (see RestoreArchive).
+// Nothing is left behind in the destination if the passphrase is wrong or the archive is found corrupted.
+func RestoreEncryptedArchive(in io.Reader, passphrase []byte, dest string) error {
+	decIn, err := newDecryptReader(in, passphrase)
+	if err != nil {
+		return err
+	} else if err := RestoreArchive(decIn, dest); err != nil {
+		return err
+	}
+	// Authenticate the remainder, so that a truncated or tampered archive end is noticed
+	if _, err := io.Copy(ioutil.Discard, decIn); err != nil {
+		os.RemoveAll(dest)
+		return err
+	}
+	return nil
+}
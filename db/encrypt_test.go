@@ -0,0 +1,105 @@
+package db
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	// RFC 7914 test vector of PBKDF2-HMAC-SHA256
+	key := deriveKey([]byte("passwd"), []byte("salt"), 1, 64)
+	if hex.EncodeToString(key) != "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783" {
+		t.Fatal(hex.EncodeToString(key))
+	}
+}
+
+func TestEncryptStream(t *testing.T) {
+	for _, size := range []int{0, 1, ENCRYPTION_CHUNK_SIZE, 2*ENCRYPTION_CHUNK_SIZE + 5} {
+		plain := bytes.Repeat([]byte{'a'}, size)
+		encrypted := new(bytes.Buffer)
+		encOut, err := newEncryptWriter(encrypted, []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := encOut.Write(plain); err != nil {
+			t.Fatal(err)
+		} else if err := encOut.Close(); err != nil {
+			t.Fatal(err)
+		} else if bytes.Contains(encrypted.Bytes(), []byte("aaaa")) {
+			t.Fatal("Data is not encrypted")
+		}
+		sealed := encrypted.Bytes()
+		decIn, err := newDecryptReader(bytes.NewReader(sealed), []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decrypted, err := ioutil.ReadAll(decIn); err != nil || !bytes.Equal(decrypted, plain) {
+			t.Fatal(size, len(decrypted), err)
+		}
+		// Wrong passphrase, truncated data, and data cut at chunk boundary do not decrypt
+		type badCase struct {
+			passphrase string
+			sealed     []byte
+		}
+		badCases := []badCase{{"wrong", sealed}, {"secret", sealed[:len(sealed)-1]}}
+		if boundary := encryptionHeaderLen + ENCRYPTION_CHUNK_SIZE + 16; len(sealed) > boundary {
+			badCases = append(badCases, badCase{"secret", sealed[:boundary]})
+		}
+		for _, bad := range badCases {
+			decIn, err := newDecryptReader(bytes.NewReader(bad.sealed), []byte(bad.passphrase))
+			if err != nil {
+				t.Fatal(err)
+			} else if _, err := ioutil.ReadAll(decIn); err != errDecrypt {
+				t.Fatal(size, len(bad.sealed), err)
+			}
+		}
+	}
+	if _, err := newDecryptReader(bytes.NewReader([]byte("not encrypted at all, not encrypted at all")), []byte("secret")); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestEncryptedArchive(t *testing.T) {
+	restoreDir := TEST_DATA_DIR + "restore"
+	for _, dir := range []string{TEST_DATA_DIR, restoreDir} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.Use("col").Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := new(bytes.Buffer)
+	if err := db.DumpEncryptedArchive(archive, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreEncryptedArchive(bytes.NewReader(archive.Bytes()), []byte("wrong"), restoreDir); err == nil {
+		t.Fatal("Did not error")
+	} else if _, err := os.Stat(restoreDir); !os.IsNotExist(err) {
+		t.Fatal("Failed restore left files behind")
+	}
+	if err := RestoreArchive(bytes.NewReader(archive.Bytes()), restoreDir); err == nil {
+		t.Fatal("Encrypted archive restored without passphrase")
+	}
+	if err := RestoreEncryptedArchive(bytes.NewReader(archive.Bytes()), []byte("secret"), restoreDir); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenDB(restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if doc, err := restored.Use("col").Read(id); err != nil || doc["a"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+}
@@ -0,0 +1,151 @@
+// Typed index values and array length index.
+
+package db
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	INDEX_TYPE_STRING = ""       // Default index type - values are formatted into strings and hashed.
+	INDEX_TYPE_NUMBER = "number" // Index of numbers, other values are left out of the index.
+	INDEX_TYPE_BOOL   = "bool"   // Index of booleans, other values are left out of the index.
+)
+
+// Return an error if the index type is unknown.
+func checkIndexType(idxType string) error {
+	switch idxType {
+	case INDEX_TYPE_STRING, INDEX_TYPE_NUMBER, INDEX_TYPE_BOOL:
+		return nil
+	}
+	return fmt.Errorf("Unknown index type \"%s\"", idxType)
+}
+
+// Return the float64 value of a number given by JSON document or Go program.
+func toFloat(val interface{}) (float64, bool) {
+	switch num := val.(type) {
+	case float64:
+		return num, true
+	case float32:
+		return float64(num), true
+	case int:
+		return float64(num), true
+	case int32:
+		return float64(num), true
+	case int64:
+		return float64(num), true
+	case uint:
+		return float64(num), true
+	case uint32:
+		return float64(num), true
+	case uint64:
+		return float64(num), true
+	}
+	return 0, false
+}
+
+/*
+Return the hash key of a number. Keys are fixed-width and ordered - a greater number never has a smaller key. The key
+is made of the most significant bits of the IEEE 754 representation, with bits flipped so that the representation
+compares like an unsigned integer, hence adjacent numbers may share a key. Since the low bits of integers are all zero,
+number indexes mix the key (see data.MixKey) to choose its partition and bucket.
+*/
+func NumberKey(num float64) int {
+	bits := math.Float64bits(num)
+	if bits>>63 == 1 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return int(bits >> (64 - strconv.IntSize + 1))
+}
+
+// Return the hash key of a boolean.
+func BoolKey(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Return the canonical form of a value as seen by the index, and false if the index type does not accept the value.
+func (opts IndexOptions) canonical(val interface{}) (interface{}, bool) {
+	switch opts.Type {
+	case INDEX_TYPE_NUMBER:
+		num, isNum := toFloat(val)
+		if !isNum || math.IsNaN(num) {
+			return nil, false
+		} else if num == 0 {
+			return float64(0), true // negative zero
+		}
+		return num, true
+	case INDEX_TYPE_BOOL:
+		b, isBool := val.(bool)
+		return b, isBool
+	}
+	return fmt.Sprint(val), true
+}
+
+// Return the hash key of a canonical value.
+func (opts IndexOptions) key(canon interface{}) int {
+	switch opts.Type {
+	case INDEX_TYPE_NUMBER:
+		return NumberKey(canon.(float64))
+	case INDEX_TYPE_BOOL:
+		return BoolKey(canon.(bool))
+	}
+	return StrHash(canon.(string))
+}
+
+// Return lengths of the arrays found at the path.
+func GetLengthsIn(doc interface{}, path []string) (ret []int) {
+	docMap, ok := doc.(map[string]interface{})
+	if !ok {
+		return
+	}
+	var thing interface{} = docMap
+	for i, seg := range path {
+		if aMap, ok := thing.(map[string]interface{}); ok {
+			thing = aMap[seg]
+		} else if anArray, ok := thing.([]interface{}); ok {
+			for _, element := range anArray {
+				ret = append(ret, GetLengthsIn(element, path[i:])...)
+			}
+			return ret
+		} else {
+			return nil
+		}
+	}
+	if anArray, ok := thing.([]interface{}); ok {
+		return append(ret, len(anArray))
+	}
+	return
+}
+
+// Return the values at the path to be put on the index - array lengths on length index, or the values otherwise.
+func (opts IndexOptions) values(doc interface{}, path []string) []interface{} {
+	if !opts.Length {
+		return GetIn(doc, path)
+	}
+	lengths := GetLengthsIn(doc, path)
+	ret := make([]interface{}, len(lengths))
+	for i, length := range lengths {
+		ret[i] = float64(length)
+	}
+	return ret
+}
+
+// Like values, but extract the values from the raw JSON document without decoding the rest of it.
+func (opts IndexOptions) rawValues(docB []byte, path []string) ([]interface{}, error) {
+	if !opts.Length {
+		return GetInRaw(docB, path)
+	}
+	lengths, err := GetLengthsInRaw(docB, path)
+	ret := make([]interface{}, len(lengths))
+	for i, length := range lengths {
+		ret[i] = float64(length)
+	}
+	return ret, err
+}
@@ -0,0 +1,283 @@
+package db
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestNumberKey(t *testing.T) {
+	nums := []float64{math.Inf(-1), -1e300, -2.5, -1, -0.001, 0, 0.001, 1, 1.5, 2, 1e10, 1e300, math.Inf(1)}
+	for i, num := range nums {
+		if key := NumberKey(num); key < 0 {
+			t.Fatal(num, key)
+		} else if i > 0 && key <= NumberKey(nums[i-1]) {
+			t.Fatal(nums[i-1], num, NumberKey(nums[i-1]), key)
+		}
+	}
+	opts := IndexOptions{Type: INDEX_TYPE_NUMBER}
+	if canon, ok := opts.canonical(math.Copysign(0, -1)); !ok || opts.key(canon) != NumberKey(0) {
+		t.Fatal(canon, ok)
+	}
+	if canon, ok := opts.canonical(3); !ok || canon != float64(3) {
+		t.Fatal(canon, ok)
+	}
+	if _, ok := opts.canonical("3"); ok {
+		t.Fatal("String went on number index")
+	}
+	opts = IndexOptions{Type: INDEX_TYPE_BOOL}
+	if _, ok := opts.canonical(1); ok {
+		t.Fatal("Number went on bool index")
+	}
+	if canon, ok := opts.canonical(true); !ok || opts.key(canon) != 1 {
+		t.Fatal(canon, ok)
+	}
+}
+
+func TestTypedIndex(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.IndexWithOptions([]string{"a"}, IndexOptions{Type: "date"}); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err := col.IndexWithOptions([]string{"n"}, IndexOptions{Type: INDEX_TYPE_NUMBER}); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.IndexWithOptions([]string{"b"}, IndexOptions{Type: INDEX_TYPE_BOOL, IndexNull: true}); err != nil {
+		t.Fatal(err)
+	}
+	docs := []map[string]interface{}{{"n": 1, "b": true}, {"n": "1", "b": "true"}, {"n": 2.5, "b": false}, {"n": []interface{}{3, 1.0000001}}}
+	ids := make([]int, len(docs))
+	for i, doc := range docs {
+		if ids[i], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only numbers are on number index
+	if q, err := runQuery(`{"eq": 1, "in": ["n"]}`, col); err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[0]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"eq": "1", "in": ["n"]}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"int-from": 1, "int-to": 3, "in": ["n"]}`, col); err != nil || len(q) != 2 || !ensureMapHasKeys(q, ids[0], ids[3]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"has": ["n"]}`, col); err != nil || len(q) != 3 {
+		t.Fatal(q, err)
+	}
+	// Only booleans are on bool index
+	if q, err := runQuery(`{"eq": true, "in": ["b"]}`, col); err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[0]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"eq": false, "in": ["b"]}`, col); err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[2]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"null": ["b"]}`, col); err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[3]) {
+		t.Fatal(q, err)
+	}
+	// Index type survives reopening the database
+	db.Close()
+	db, err = OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if opts, err := db.Use("col").IndexOptionsOf([]string{"n"}); err != nil || opts.Type != INDEX_TYPE_NUMBER {
+		t.Fatal(opts, err)
+	}
+	if q, err := runQuery(`{"eq": 2.5, "in": ["n"]}`, db.Use("col")); err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[2]) {
+		t.Fatal(q, err)
+	}
+}
+
+func TestLengthIndex(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.IndexWithOptions([]string{"tags"}, IndexOptions{Length: true}); err == nil {
+		t.Fatal("Did not error")
+	}
+	if lengths := GetLengthsIn(map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": []interface{}{1, 2}}, map[string]interface{}{"b": 1}}}, []string{"a", "b"}); len(lengths) != 1 || lengths[0] != 2 {
+		t.Fatal(lengths)
+	}
+	docs := []map[string]interface{}{{"tags": []interface{}{}}, {"tags": []interface{}{"a", "b", "c"}}, {"tags": "a"}, {"tags": []interface{}{"a", "b", "c", "d", "e", "f"}}}
+	ids := make([]int, len(docs))
+	for i, doc := range docs {
+		if ids[i], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := col.IndexWithOptions([]string{"tags"}, IndexOptions{Length: true, Type: INDEX_TYPE_NUMBER}); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := runQuery(`{"eq": 3, "in": ["tags"]}`, col); err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[1]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"eq": 0, "in": ["tags"]}`, col); err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[0]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"int-from": 2, "int-to": 10, "in": ["tags"]}`, col); err != nil || len(q) != 2 || !ensureMapHasKeys(q, ids[1], ids[3]) {
+		t.Fatal(q, err)
+	}
+	// Length follows document updates
+	if err := col.Update(ids[3], map[string]interface{}{"tags": []interface{}{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := runQuery(`{"int-from": 2, "int-to": 10, "in": ["tags"]}`, col); err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[1]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"has": ["tags"]}`, col); err != nil || len(q) != 3 {
+		t.Fatal(q, err)
+	}
+}
+
+func TestIndexParts(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(path.Join(TEST_DATA_DIR, PART_NUM_FILE), []byte("4"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.IndexWithOptions([]string{"n"}, IndexOptions{Parts: db.numParts + 1}); err == nil {
+		t.Fatal("Did not error")
+	} else if err := col.IndexBackgroundWithOptions([]string{"n"}, IndexOptions{Parts: -1}, 0); err == nil {
+		t.Fatal("Did not error")
+	}
+	ids := make([]int, 100)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"n": i, "s": strconv.Itoa(i % 10)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := col.IndexWithOptions([]string{"n"}, IndexOptions{Type: INDEX_TYPE_NUMBER, Parts: 1}); err != nil {
+		t.Fatal(err)
+	} else if err := col.IndexWithOptions([]string{"s"}, IndexOptions{Parts: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// Small indexes keep a single hash table file
+	files, err := ioutil.ReadDir(path.Join(TEST_DATA_DIR, "col", "s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := 0
+	for _, file := range files {
+		if file.Name() != INDEX_OPTS_FILE {
+			tables++
+		}
+	}
+	if tables != 1 {
+		t.Fatal(files)
+	}
+	// Documents written afterwards go to the single partition too
+	if err := col.Update(ids[0], map[string]interface{}{"n": 1000, "s": "x"}); err != nil {
+		t.Fatal(err)
+	} else if err := col.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if opts, err := col.IndexOptionsOf([]string{"s"}); err != nil || opts.Parts != 1 {
+		t.Fatal(opts, err)
+	}
+	if q, err := runQuery(`{"eq": "5", "in": ["s"]}`, col); err != nil || len(q) != 10 {
+		t.Fatal(q, err)
+	} else if q, err := runQuery(`{"eq": "x", "in": ["s"]}`, col); err != nil || !ensureMapHasKeys(q, ids[0]) {
+		t.Fatal(q, err)
+	} else if q, err := runQuery(`{"int-from": 0, "int-to": 2, "in": ["n"]}`, col); err != nil || !ensureMapHasKeys(q, ids[2]) {
+		t.Fatal(q, err)
+	} else if q, err := runQuery(`{"has": ["s"]}`, col); err != nil || len(q) != 99 {
+		t.Fatal(q, err)
+	}
+	if sorted, err := EvalQueryOrdered(map[string]interface{}{"sort": []interface{}{"n", "desc"}, "limit": 2}, col); err != nil || len(sorted) != 2 || sorted[0] != ids[0] || sorted[1] != ids[99] {
+		t.Fatal(sorted, err)
+	}
+	for _, stats := range col.IndexStats() {
+		if stats.Entries != 99 {
+			t.Fatal(stats)
+		}
+	}
+	// Scrub keeps the partitions of indexes
+	if err := db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	} else if q, err := runQuery(`{"eq": "5", "in": ["s"]}`, col); err != nil || len(q) != 10 {
+		t.Fatal(q, err)
+	}
+	if err := col.Unindex([]string{"s"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNumberIndexSpread(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(path.Join(TEST_DATA_DIR, PART_NUM_FILE), []byte("4"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.IndexWithOptions([]string{"n"}, IndexOptions{Type: INDEX_TYPE_NUMBER}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := col.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Integers spread over all partitions without chaining buckets
+	for partNum := 0; partNum < db.numParts; partNum++ {
+		ht := col.hts[partNum]["n"]
+		if keys, _ := ht.GetPartition(0, 1); len(keys) == 0 {
+			t.Fatal("Partition is empty", partNum)
+		} else if ht.Used != db.Config.InitialBuckets*db.Config.BucketSize {
+			t.Fatal("Buckets are chained", partNum, ht.Used)
+		}
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{">=": 10, "<=": 19, "in": []interface{}{"n"}}, col, &result); err != nil || len(result) != 10 {
+		t.Fatal(result, err)
+	}
+}
@@ -0,0 +1,88 @@
+// Key-value store on top of a collection.
+
+package db
+
+const (
+	KV_KEY_ATTR   = "_key"   // Document attribute holding the key of a key-value pair, it is indexed.
+	KV_VALUE_ATTR = "_value" // Document attribute holding the value of a key-value pair.
+)
+
+// KV is a durable map of string keys to JSON values, every pair is stored as a document {"_key": key, "_value": value}.
+type KV struct {
+	col *Col
+}
+
+// Use the collection as key-value store, the collection and its key index are created if necessary.
+func (db *DB) KV(name string) (*KV, error) {
+	col, err := db.UseOrCreate(name)
+	if err != nil {
+		return nil, err
+	}
+	db.kvLock.Lock()
+	defer db.kvLock.Unlock()
+	for _, idxPath := range col.AllIndexes() {
+		if len(idxPath) == 1 && idxPath[0] == KV_KEY_ATTR {
+			return &KV{col: col}, nil
+		}
+	}
+	if err := col.Index([]string{KV_KEY_ATTR}); err != nil {
+		return nil, err
+	}
+	return &KV{col: col}, nil
+}
+
+// Return the collection storing the key-value pairs.
+func (kv *KV) Col() *Col {
+	return kv.col
+}
+
+// Return the document ID and document of the key, or -1 if the key does not exist.
+func (kv *KV) find(key string) (id int, doc map[string]interface{}, err error) {
+	result := make(map[int]struct{})
+	if err = kv.col.query(map[string]interface{}{"eq": key, "in": []interface{}{KV_KEY_ATTR}}, &result); err != nil {
+		return
+	}
+	for id = range result {
+		// Lookup compares values as strings, ignore documents of keys that merely look alike (e.g. number 1 VS "1")
+		if doc, err = kv.col.Read(id); err == nil && doc[KV_KEY_ATTR] == key {
+			return
+		}
+	}
+	return -1, nil, nil
+}
+
+// Return the value of the key, and false if the key does not exist.
+func (kv *KV) Get(key string) (val interface{}, found bool, err error) {
+	_, doc, err := kv.find(key)
+	if err != nil || doc == nil {
+		return nil, false, err
+	}
+	return doc[KV_VALUE_ATTR], true, nil
+}
+
+// Set the value of the key, the value must be serializable into JSON.
+func (kv *KV) Set(key string, val interface{}) error {
+	kv.col.db.kvLock.Lock()
+	defer kv.col.db.kvLock.Unlock()
+	id, doc, err := kv.find(key)
+	if err != nil {
+		return err
+	}
+	newDoc := map[string]interface{}{KV_KEY_ATTR: key, KV_VALUE_ATTR: val}
+	if doc != nil {
+		return kv.col.Update(id, newDoc)
+	}
+	_, err = kv.col.Insert(newDoc)
+	return err
+}
+
+// Delete the key, and return false if the key did not exist.
+func (kv *KV) Delete(key string) (bool, error) {
+	kv.col.db.kvLock.Lock()
+	defer kv.col.db.kvLock.Unlock()
+	id, doc, err := kv.find(key)
+	if err != nil || doc == nil {
+		return false, err
+	}
+	return true, kv.col.Delete(id)
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestKV(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	kv, err := db.KV("settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, found, err := kv.Get("a"); err != nil || found || val != nil {
+		t.Fatal(val, found, err)
+	}
+	if err := kv.Set("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Set("1", map[string]interface{}{"c": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if val, found, err := kv.Get("a"); err != nil || !found || val != "b" {
+		t.Fatal(val, found, err)
+	}
+	// Overwrite the value
+	if err := kv.Set("a", 2); err != nil {
+		t.Fatal(err)
+	}
+	if val, found, err := kv.Get("a"); err != nil || !found || val.(float64) != 2 {
+		t.Fatal(val, found, err)
+	}
+	// A key that looks like a number is not confused with a number
+	if _, err := kv.Col().Insert(map[string]interface{}{KV_KEY_ATTR: 1, KV_VALUE_ATTR: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if val, found, err := kv.Get("1"); err != nil || !found || val.(map[string]interface{})["c"].(float64) != 1 {
+		t.Fatal(val, found, err)
+	}
+	if deleted, err := kv.Delete("a"); err != nil || !deleted {
+		t.Fatal(deleted, err)
+	}
+	if deleted, err := kv.Delete("a"); err != nil || deleted {
+		t.Fatal(deleted, err)
+	}
+	if _, found, err := kv.Get("a"); err != nil || found {
+		t.Fatal(found, err)
+	}
+	// Concurrent writes of the same keys never produce duplicates
+	kv2, err := db.KV("settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := kv2.Set("k"+strconv.Itoa(j), i); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	count := 0
+	kv.Col().ForEachDoc(func(int, []byte) bool {
+		count++
+		return true
+	})
+	if count != 12 {
+		t.Fatal(count)
+	}
+}
@@ -0,0 +1,114 @@
+// Merging of databases.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	MERGE_SKIP      = "skip"      // Keep the destination document when a document ID is in use in both databases
+	MERGE_OVERWRITE = "overwrite" // Replace the destination document when a document ID is in use in both databases
+	MERGE_REMAP     = "remap"     // Give the source document a new ID when a document ID is in use in both databases
+)
+
+// MergeResult tells what became of source documents of a collection merged into the destination database.
+type MergeResult struct {
+	Inserted    int         // Documents inserted under their source IDs
+	Skipped     int         // Documents skipped because their IDs are in use (MERGE_SKIP)
+	Overwritten int         // Destination documents replaced by source documents (MERGE_OVERWRITE)
+	Remapped    map[int]int // New IDs of documents inserted under new IDs, keyed by source IDs (MERGE_REMAP)
+}
+
+/*
+Merge all collections and documents of the database in the source directory into the destination database, e.g. to
+sync a disconnected instance into a central store. Collections and indexes missing from the destination are created.
+Source documents keep their IDs, the policy (MERGE_SKIP, MERGE_OVERWRITE or MERGE_REMAP) decides what happens when an
+ID is in use in the destination collection. Return the result of each collection, keyed by collection name. Merging
+stops at the first error; the documents merged so far remain in the destination database.
+*/
+func Merge(srcPath string, dst *DB, policy string) (results map[string]*MergeResult, err error) {
+	if policy != MERGE_SKIP && policy != MERGE_OVERWRITE && policy != MERGE_REMAP {
+		return nil, fmt.Errorf("Unknown merge policy %s, expecting %s, %s or %s", policy, MERGE_SKIP, MERGE_OVERWRITE, MERGE_REMAP)
+	} else if _, err = os.Stat(srcPath); err != nil {
+		return
+	}
+	absSrc, err := filepath.Abs(srcPath)
+	if err != nil {
+		return
+	}
+	absDst, err := filepath.Abs(dst.path)
+	if err != nil {
+		return
+	} else if absSrc == absDst {
+		return nil, fmt.Errorf("Will not merge database %s into itself", srcPath)
+	}
+	src, err := OpenDB(srcPath)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	names := src.AllCols()
+	sort.Strings(names)
+	results = make(map[string]*MergeResult)
+	for _, name := range names {
+		if name == CATALOG_COL || strings.HasPrefix(name, SYNC_COL_PREFIX) {
+			continue
+		}
+		result := &MergeResult{Remapped: make(map[int]int)}
+		results[name] = result
+		if err = mergeCol(src.Use(name), dst, policy, result); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Merge documents of the source collection into the collection of the same name in the destination database.
+func mergeCol(srcCol *Col, dst *DB, policy string, result *MergeResult) (err error) {
+	dstCol, err := dst.UseOrCreate(srcCol.Name())
+	if err != nil {
+		return
+	}
+	for _, idxPath := range srcCol.AllIndexes() {
+		opts, err := srcCol.IndexOptionsOf(idxPath)
+		if err != nil {
+			return err
+		} else if _, err := dstCol.IndexOptionsOf(idxPath); err == nil {
+			continue
+		} else if err := dstCol.IndexWithOptions(idxPath, opts); err != nil {
+			return err
+		}
+	}
+	srcCol.ForEachDoc(func(id int, docB []byte) bool {
+		var doc map[string]interface{}
+		if json.Unmarshal(docB, &doc) != nil {
+			// Skip corrupted document
+			return true
+		}
+		var newID int
+		newID, err = dstCol.InsertWithID(id, doc, policy == MERGE_REMAP)
+		switch {
+		case err == nil && newID == id:
+			result.Inserted++
+		case err == nil:
+			result.Remapped[id] = newID
+		case dberr.Type(err) == dberr.ErrorDocExists && policy == MERGE_SKIP:
+			result.Skipped++
+			err = nil
+		case dberr.Type(err) == dberr.ErrorDocExists && policy == MERGE_OVERWRITE:
+			if err = dstCol.Update(id, doc); err == nil {
+				result.Overwritten++
+			}
+		}
+		return err == nil
+	})
+	return
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	srcDir, dstDir := TEST_DATA_DIR+"/src", TEST_DATA_DIR+"/dst"
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	src, err := OpenDB(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Create("a"); err != nil {
+		t.Fatal(err)
+	} else if err := src.Create("b"); err != nil {
+		t.Fatal(err)
+	} else if err := src.Use("b").IndexWithOptions([]string{"n"}, IndexOptions{Type: INDEX_TYPE_NUMBER}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{1, 2, 3} {
+		if _, err := src.Use("a").InsertWithID(id, map[string]interface{}{"from": "src"}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := src.Use("b").InsertWithID(7, map[string]interface{}{"n": 7}, false); err != nil {
+		t.Fatal(err)
+	} else if err := src.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Collection "a" of the destination has documents 1 and 2, collection "b" is missing
+	mergeInto := func(policy string) (*DB, map[string]*MergeResult) {
+		os.RemoveAll(dstDir)
+		dst, err := OpenDB(dstDir)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := dst.Create("a"); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []int{1, 2} {
+			if _, err := dst.Use("a").InsertWithID(id, map[string]interface{}{"from": "dst"}, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		results, err := Merge(srcDir, dst, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dst, results
+	}
+	from := func(dst *DB, id int) interface{} {
+		doc, err := dst.Use("a").Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return doc["from"]
+	}
+
+	dst, results := mergeInto(MERGE_SKIP)
+	if r := results["a"]; r.Inserted != 1 || r.Skipped != 2 || r.Overwritten != 0 || len(r.Remapped) != 0 {
+		t.Fatal(r)
+	} else if r := results["b"]; r.Inserted != 1 {
+		t.Fatal(r)
+	} else if from(dst, 1) != "dst" || from(dst, 3) != "src" {
+		t.Fatal("Bad skip")
+	} else if opts, err := dst.Use("b").IndexOptionsOf([]string{"n"}); err != nil || opts.Type != INDEX_TYPE_NUMBER {
+		t.Fatal(opts, err)
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": 7, "in": []interface{}{"n"}}, dst.Use("b"), &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	dst.Close()
+
+	dst, results = mergeInto(MERGE_OVERWRITE)
+	if r := results["a"]; r.Inserted != 1 || r.Overwritten != 2 {
+		t.Fatal(r)
+	} else if from(dst, 1) != "src" || from(dst, 2) != "src" {
+		t.Fatal("Bad overwrite")
+	}
+	dst.Close()
+
+	dst, results = mergeInto(MERGE_REMAP)
+	if r := results["a"]; r.Inserted != 1 || len(r.Remapped) != 2 {
+		t.Fatal(r)
+	} else if from(dst, 1) != "dst" || from(dst, results["a"].Remapped[1]) != "src" || from(dst, results["a"].Remapped[2]) != "src" {
+		t.Fatal("Bad remap")
+	}
+	if _, err := Merge(dstDir, dst, MERGE_SKIP); err == nil {
+		t.Fatal("Merged into itself")
+	} else if _, err := Merge(srcDir, dst, "x"); err == nil {
+		t.Fatal("Did not check policy")
+	} else if _, err := Merge(TEST_DATA_DIR+"/nope", dst, MERGE_SKIP); err == nil {
+		t.Fatal("Did not check source")
+	}
+	dst.Close()
+}
@@ -0,0 +1,192 @@
+/*
+MongoDB Extended JSON (v2) import and export.
+
+Import accepts the output of mongoexport - either one document per line or a JSON array of documents, in canonical or
+relaxed mode. Extended JSON values are mapped to plain tiedot values:
+- {"$oid": "5d505646cf6d4fe581014ab2"} becomes string "5d505646cf6d4fe581014ab2"
+- {"$date": ...} becomes an RFC3339 string in UTC, e.g. "2019-08-11T17:54:14.692Z"
+- {"$numberInt"/"$numberLong"/"$numberDouble"/"$numberDecimal": "1"} becomes number 1
+- {"$binary": {"base64": "...", "subType": "00"}} becomes the base64 string
+Other values are imported as they are. MongoDB document ID "_id" is kept as an ordinary attribute.
+
+Export writes one document per line in relaxed mode, suitable for mongoimport:
+- Attribute "_id" holding a 24 hexadecimal digit string becomes {"$oid": ...}
+- A document without "_id" attribute is given "_id" of {"$numberLong": "TIEDOT_DOCUMENT_ID"}
+- Strings in RFC3339 format become {"$date": ...}
+*/
+
+package db
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	MONGO_ID_ATTR     = "_id"                      // MongoDB document ID attribute.
+	MONGO_DATE_FORMAT = "2006-01-02T15:04:05.999Z" // Format of dates converted from Extended JSON.
+)
+
+// Convert a value from MongoDB Extended JSON into plain tiedot value.
+func fromMongoJSON(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = fromMongoJSON(elem)
+		}
+		return v
+	case map[string]interface{}:
+		if len(v) == 1 {
+			for key, inner := range v {
+				if converted, ok := fromMongoJSONType(key, inner); ok {
+					return converted
+				}
+			}
+		}
+		for key, elem := range v {
+			v[key] = fromMongoJSON(elem)
+		}
+		return v
+	}
+	return val
+}
+
+// Convert an Extended JSON type wrapper (e.g. {"$oid": ...}) into plain value. Return false if it is not recognised.
+func fromMongoJSONType(key string, val interface{}) (interface{}, bool) {
+	switch key {
+	case "$oid":
+		if str, ok := val.(string); ok {
+			return str, true
+		}
+	case "$numberInt", "$numberLong", "$numberDouble", "$numberDecimal":
+		if str, ok := val.(string); ok {
+			if num, err := strconv.ParseFloat(str, 64); err == nil && !math.IsInf(num, 0) && !math.IsNaN(num) {
+				return num, true
+			}
+		}
+	case "$date":
+		switch date := val.(type) {
+		case string: // relaxed mode
+			if t, err := time.Parse(time.RFC3339Nano, date); err == nil {
+				return t.UTC().Format(MONGO_DATE_FORMAT), true
+			}
+		case float64: // legacy relaxed mode - milliseconds since epoch
+			return time.Unix(0, int64(date)*int64(time.Millisecond)).UTC().Format(MONGO_DATE_FORMAT), true
+		case map[string]interface{}: // canonical mode - {"$numberLong": "milliseconds since epoch"}
+			if millis, ok := date["$numberLong"].(string); ok {
+				if ms, err := strconv.ParseInt(millis, 10, 64); err == nil {
+					return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(MONGO_DATE_FORMAT), true
+				}
+			}
+		}
+	case "$binary":
+		if binary, ok := val.(map[string]interface{}); ok {
+			if b64, ok := binary["base64"].(string); ok {
+				return b64, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Convert a plain tiedot value into MongoDB Extended JSON.
+func toMongoJSON(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, elem := range v {
+			ret[i] = toMongoJSON(elem)
+		}
+		return ret
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			ret[key] = toMongoJSON(elem)
+		}
+		return ret
+	case string:
+		if _, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return map[string]interface{}{"$date": v}
+		}
+	}
+	return val
+}
+
+// Return true if the string looks like a MongoDB ObjectId.
+func isObjectID(str string) bool {
+	if len(str) != 24 {
+		return false
+	}
+	_, err := hex.DecodeString(str)
+	return err == nil
+}
+
+// Insert documents read from MongoDB Extended JSON (v2) input, return number of documents inserted.
+func (col *Col) ImportMongoJSON(in io.Reader) (count int, err error) {
+	bufIn := bufio.NewReader(in)
+	decoder := json.NewDecoder(bufIn)
+	// Input may be a JSON array of documents, or a sequence of documents
+	inArray := false
+	for {
+		b, err := bufIn.Peek(1)
+		if err == io.EOF {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		} else if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+			bufIn.ReadByte()
+			continue
+		}
+		inArray = b[0] == '['
+		break
+	}
+	if inArray {
+		if _, err = decoder.Token(); err != nil {
+			return
+		}
+	}
+	for decoder.More() {
+		var doc map[string]interface{}
+		if err = decoder.Decode(&doc); err != nil {
+			return
+		}
+		if _, err = col.Insert(fromMongoJSON(doc).(map[string]interface{})); err != nil {
+			return
+		}
+		count++
+	}
+	return
+}
+
+// Write all documents as MongoDB Extended JSON (v2), one document per line, with redacted paths (see Redact) masked.
+func (col *Col) ExportMongoJSON(out io.Writer) (err error) {
+	redact, err := col.redactor()
+	if err != nil {
+		return
+	}
+	encoder := json.NewEncoder(out)
+	col.ForEachDoc(func(id int, docB []byte) bool {
+		var doc map[string]interface{}
+		if json.Unmarshal(docB, &doc) != nil {
+			// Skip corrupted document
+			return true
+		}
+		if redact != nil {
+			redact(doc)
+		}
+		mongoDoc := toMongoJSON(doc).(map[string]interface{})
+		if mongoID, exists := doc[MONGO_ID_ATTR]; !exists {
+			mongoDoc[MONGO_ID_ATTR] = map[string]interface{}{"$numberLong": strconv.Itoa(id)}
+		} else if strID, isStr := mongoID.(string); isStr && isObjectID(strID) {
+			mongoDoc[MONGO_ID_ATTR] = map[string]interface{}{"$oid": strID}
+		}
+		err = encoder.Encode(mongoDoc)
+		return err == nil
+	})
+	return
+}
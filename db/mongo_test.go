@@ -0,0 +1,108 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestImportMongoJSON(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// One document per line, canonical and relaxed mode mixed
+	lines := `{"_id": {"$oid": "5d505646cf6d4fe581014ab2"}, "n": {"$numberLong": "42"}, "d": {"$date": {"$numberLong": "1565546054692"}}}
+{"_id": {"$oid": "5d505646cf6d4fe581014ab3"}, "n": 1.5, "d": {"$date": "2019-08-11T17:54:14.692Z"}, "b": {"$binary": {"base64": "AQI=", "subType": "00"}}, "l": [{"$numberInt": "7"}]}
+`
+	if count, err := col.ImportMongoJSON(strings.NewReader(lines)); err != nil || count != 2 {
+		t.Fatal(count, err)
+	}
+	// JSON array
+	if count, err := col.ImportMongoJSON(strings.NewReader(` [{"_id": 1}, {"_id": 2}]`)); err != nil || count != 2 {
+		t.Fatal(count, err)
+	}
+	if count, err := col.ImportMongoJSON(strings.NewReader("")); err != nil || count != 0 {
+		t.Fatal(count, err)
+	}
+	if _, err := col.ImportMongoJSON(strings.NewReader(`{"a": `)); err == nil {
+		t.Fatal("Did not error")
+	}
+	docs := make(map[string]map[string]interface{})
+	col.ForEachDoc(func(id int, docB []byte) bool {
+		var doc map[string]interface{}
+		json.Unmarshal(docB, &doc)
+		if strID, ok := doc["_id"].(string); ok {
+			docs[strID] = doc
+		}
+		return true
+	})
+	first, second := docs["5d505646cf6d4fe581014ab2"], docs["5d505646cf6d4fe581014ab3"]
+	if first["n"].(float64) != 42 || first["d"] != "2019-08-11T17:54:14.692Z" {
+		t.Fatal(first)
+	}
+	if second["n"].(float64) != 1.5 || second["d"] != "2019-08-11T17:54:14.692Z" || second["b"] != "AQI=" || second["l"].([]interface{})[0].(float64) != 7 {
+		t.Fatal(second)
+	}
+}
+
+func TestExportMongoJSON(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	withOID, err := col.Insert(map[string]interface{}{"_id": "5d505646cf6d4fe581014ab2", "d": "2019-08-11T17:54:14.692Z", "s": "text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutID, err := col.Insert(map[string]interface{}{"a": []interface{}{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if err := col.ExportMongoJSON(out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal(lines)
+	}
+	for _, line := range lines {
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &doc); err != nil {
+			t.Fatal(err)
+		}
+		mongoID := doc["_id"].(map[string]interface{})
+		if oid, isOID := mongoID["$oid"]; isOID {
+			if oid != "5d505646cf6d4fe581014ab2" || doc["d"].(map[string]interface{})["$date"] != "2019-08-11T17:54:14.692Z" || doc["s"] != "text" {
+				t.Fatal(doc, withOID)
+			}
+		} else if mongoID["$numberLong"] != strconv.Itoa(withoutID) {
+			t.Fatal(doc, withoutID)
+		}
+	}
+	// Exported documents import back into the same values
+	if err := db.Create("col2"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := db.Use("col2").ImportMongoJSON(out); err != nil || count != 2 {
+		t.Fatal(count, err)
+	}
+}
@@ -0,0 +1,160 @@
+// Named queries - parameterized queries registered under names and persisted in the database directory.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+const (
+	NAMED_QUERIES_FILE = "named_queries" // Definitions of named queries, keyed by name.
+)
+
+// NamedQuery is a vetted query definition, invoked by name with parameters bound to its placeholders "$1", "$2", etc.
+type NamedQuery struct {
+	Col   string      `json:"collection"` // Name of the collection to query
+	Query interface{} `json:"query"`      // Query structure, may contain placeholders
+}
+
+// Named queries of a database.
+type namedQueries struct {
+	lock   *sync.Mutex
+	byName map[string]NamedQuery // Loaded upon first use
+}
+
+// Load named queries from the database directory unless they are loaded already. The caller must place query lock.
+func (db *DB) loadNamedQueries() error {
+	if db.queries.byName != nil {
+		return nil
+	}
+	queries := make(map[string]NamedQuery)
+	if queriesJS, err := ioutil.ReadFile(path.Join(db.path, NAMED_QUERIES_FILE)); err == nil {
+		if err := json.Unmarshal(queriesJS, &queries); err != nil {
+			return fmt.Errorf("Named queries file is corrupted: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	db.queries.byName = queries
+	return nil
+}
+
+// Write named queries into the database directory. The caller must place query lock.
+func (db *DB) saveNamedQueries(queries map[string]NamedQuery) error {
+	queriesJS, err := json.Marshal(queries)
+	if err != nil {
+		return err
+	} else if err = data.WriteFileAtomic(path.Join(db.path, NAMED_QUERIES_FILE), queriesJS, 0600); err != nil {
+		return err
+	}
+	db.queries.byName = queries
+	return nil
+}
+
+/*
+Register (or replace) a named query on the collection and persist it. The query is checked for validity upon
+registration; its placeholders ("$1", "$2", etc) are bound to parameters given to RunNamedQuery. Named queries are
+described in the system catalog as documents of kind "query".
+*/
+func (db *DB) RegisterQuery(name, colName string, q interface{}) error {
+	if name == "" {
+		return fmt.Errorf("Query name may not be empty")
+	} else if db.Use(colName) == nil {
+		return fmt.Errorf("Collection %s does not exist", colName)
+	}
+	// Keep a copy in the form it is persisted in, so that later changes made by the caller do not affect it
+	qJS, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	var stored interface{}
+	if err = json.Unmarshal(qJS, &stored); err != nil {
+		return err
+	} else if _, err = compileQuery(copyQuery(stored)); err != nil {
+		return err
+	}
+	db.queries.lock.Lock()
+	defer db.queries.lock.Unlock()
+	if err = db.loadNamedQueries(); err != nil {
+		return err
+	}
+	queries := make(map[string]NamedQuery, len(db.queries.byName)+1)
+	for existingName, existing := range db.queries.byName {
+		queries[existingName] = existing
+	}
+	queries[name] = NamedQuery{Col: colName, Query: stored}
+	return db.saveNamedQueries(queries)
+}
+
+// Remove a named query.
+func (db *DB) UnregisterQuery(name string) error {
+	db.queries.lock.Lock()
+	defer db.queries.lock.Unlock()
+	if err := db.loadNamedQueries(); err != nil {
+		return err
+	} else if _, exists := db.queries.byName[name]; !exists {
+		return fmt.Errorf("Query %s is not registered", name)
+	}
+	queries := make(map[string]NamedQuery, len(db.queries.byName))
+	for existingName, existing := range db.queries.byName {
+		if existingName != name {
+			queries[existingName] = existing
+		}
+	}
+	return db.saveNamedQueries(queries)
+}
+
+// Return the named query, or an error if it is not registered.
+func (db *DB) NamedQueryOf(name string) (NamedQuery, error) {
+	db.queries.lock.Lock()
+	defer db.queries.lock.Unlock()
+	if err := db.loadNamedQueries(); err != nil {
+		return NamedQuery{}, err
+	}
+	query, exists := db.queries.byName[name]
+	if !exists {
+		return NamedQuery{}, fmt.Errorf("Query %s is not registered", name)
+	}
+	// The stored query is shared, hand out a copy
+	query.Query = copyQuery(query.Query)
+	return query, nil
+}
+
+// Return all named queries keyed by name.
+func (db *DB) NamedQueries() (map[string]NamedQuery, error) {
+	db.queries.lock.Lock()
+	defer db.queries.lock.Unlock()
+	if err := db.loadNamedQueries(); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]NamedQuery, len(db.queries.byName))
+	for name, query := range db.queries.byName {
+		query.Query = copyQuery(query.Query)
+		ret[name] = query
+	}
+	return ret, nil
+}
+
+// Evaluate the named query with the parameters bound to its placeholders, put result into result map (as map keys),
+// and return the queried collection.
+func (db *DB) RunNamedQuery(name string, params []interface{}, result *map[int]struct{}) (*Col, error) {
+	query, err := db.NamedQueryOf(name)
+	if err != nil {
+		return nil, err
+	}
+	col := db.Use(query.Col)
+	if col == nil {
+		return nil, fmt.Errorf("Collection %s of query %s does not exist", query.Col, name)
+	} else if params == nil {
+		// Always evaluate the compiled plan, so that placeholders are never taken as values
+		params = []interface{}{}
+	}
+	return col, EvalQueryParams(query.Query, params, col, result)
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func TestNamedQuery(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err := db.Use("col").Index([]string{"name"}); err != nil {
+		t.Fatal(err)
+	}
+	joe, err := db.Use("col").Insert(map[string]interface{}{"name": "joe"})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Use("col").Insert(map[string]interface{}{"name": "ann"}); err != nil {
+		t.Fatal(err)
+	}
+	q := map[string]interface{}{"eq": "$1", "in": []interface{}{"name"}}
+	if err := db.RegisterQuery("byName", "col", q); err != nil {
+		t.Fatal(err)
+	} else if err := db.RegisterQuery("bad", "col", map[string]interface{}{"in": []interface{}{"name"}}); err == nil {
+		t.Fatal("Did not check query")
+	} else if err := db.RegisterQuery("nocol", "nope", q); err == nil {
+		t.Fatal("Did not check collection")
+	} else if err := db.RegisterQuery("", "col", q); err == nil {
+		t.Fatal("Did not check name")
+	}
+	// The registered query is not affected by changes made by the caller
+	q["eq"] = "ann"
+	run := func(db *DB, params ...interface{}) map[int]struct{} {
+		result := make(map[int]struct{})
+		if col, err := db.RunNamedQuery("byName", params, &result); err != nil || col != db.Use("col") {
+			t.Fatal(col, err)
+		}
+		return result
+	}
+	if result := run(db, "joe"); len(result) != 1 {
+		t.Fatal(result)
+	} else if _, found := result[joe]; !found {
+		t.Fatal(result)
+	}
+	result := make(map[int]struct{})
+	if _, err := db.RunNamedQuery("byName", nil, &result); err == nil {
+		t.Fatal("Did not check parameters")
+	} else if _, err := db.RunNamedQuery("nope", nil, &result); err == nil {
+		t.Fatal("Ran unknown query")
+	}
+	// Named queries are described in the catalog
+	catalog, err := db.Catalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	described := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": CATALOG_KIND_QUERY, "in": []interface{}{"kind"}}, catalog, &described); err != nil || len(described) != 1 {
+		t.Fatal(described, err)
+	}
+	for id := range described {
+		if doc, err := catalog.Read(id); err != nil || doc["name"] != "byName" || doc["collection"] != "col" {
+			t.Fatal(doc, err)
+		}
+	}
+	// Named queries survive reopening
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if result := run(db, "ann"); len(result) != 1 {
+		t.Fatal(result)
+	} else if queries, err := db.NamedQueries(); err != nil || len(queries) != 1 || queries["byName"].Col != "col" {
+		t.Fatal(queries, err)
+	} else if err := db.UnregisterQuery("byName"); err != nil {
+		t.Fatal(err)
+	} else if err := db.UnregisterQuery("byName"); err == nil {
+		t.Fatal("Unregistered twice")
+	} else if _, err := db.NamedQueryOf("byName"); err == nil {
+		t.Fatal("Did not unregister")
+	}
+}
@@ -0,0 +1,434 @@
+/*
+Apache Parquet export.
+
+The export writes a flat table, one row per document: column "_id" holds the document ID, and every column of the
+schema holds the first value found at its document path, converted into the column type. Values that are missing,
+null, or do not convert (e.g. a string in a number column, a fraction in an integer column) become null; string columns
+take any value that is not a string as its JSON text.
+
+Files are written uncompressed with PLAIN encoding in row groups of PARQUET_ROW_GROUP_SIZE rows, which every Parquet
+reader (DuckDB, Spark, pandas, etc.) understands. Metadata is encoded with Thrift compact protocol, as specified by
+https://github.com/apache/parquet-format.
+*/
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	PARQUET_INT64  = "int64"  // Column of 64-bit integers
+	PARQUET_DOUBLE = "double" // Column of double precision floating point numbers
+	PARQUET_BOOL   = "bool"   // Column of booleans
+	PARQUET_STRING = "string" // Column of UTF-8 strings
+
+	PARQUET_ID_COLUMN      = "_id"    // Name of the document ID column
+	PARQUET_ROW_GROUP_SIZE = 100000   // Maximum number of rows in a row group
+	parquetMagic           = "PAR1"   // Leading and trailing magic bytes of Parquet files
+	parquetCreatedBy       = "tiedot" // Application that wrote the file
+)
+
+// Parquet physical types, repetition types, and other enumerations of the format.
+const (
+	parquetTypeBoolean   = 0
+	parquetTypeInt64     = 2
+	parquetTypeDouble    = 5
+	parquetTypeByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetConvertedUTF8 = 0
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+	parquetCodecNone     = 0
+	parquetPageData      = 0
+)
+
+// ParquetColumn maps a document path to a column of the exported table.
+type ParquetColumn struct {
+	Name string   // Column name
+	Path []string // Document path of the column values
+	Type string   // One of PARQUET_* column types
+}
+
+// Return the physical type of the column type, or -1 if the type is unknown.
+func parquetPhysicalType(colType string) int {
+	switch colType {
+	case PARQUET_INT64:
+		return parquetTypeInt64
+	case PARQUET_DOUBLE:
+		return parquetTypeDouble
+	case PARQUET_BOOL:
+		return parquetTypeBoolean
+	case PARQUET_STRING:
+		return parquetTypeByteArray
+	}
+	return -1
+}
+
+// Convert a document value into the column type, return false if it does not convert.
+func parquetValue(colType string, val interface{}) (interface{}, bool) {
+	switch colType {
+	case PARQUET_INT64:
+		if num, isNum := val.(float64); isNum && num == math.Trunc(num) && math.Abs(num) < 1<<63 {
+			return int64(num), true
+		}
+	case PARQUET_DOUBLE:
+		num, isNum := val.(float64)
+		return num, isNum
+	case PARQUET_BOOL:
+		b, isBool := val.(bool)
+		return b, isBool
+	case PARQUET_STRING:
+		if str, isStr := val.(string); isStr {
+			return str, true
+		} else if val == nil {
+			return nil, false
+		} else if text, err := json.Marshal(val); err == nil {
+			return string(text), true
+		}
+	}
+	return nil, false
+}
+
+// Values of a column in the current row group, nil for null.
+type parquetColumnData struct {
+	name     string
+	physical int
+	required bool
+	values   []interface{}
+}
+
+// Encode values of the column as a data page: definition levels (unless required) followed by PLAIN encoded values.
+func (col *parquetColumnData) page() []byte {
+	var page bytes.Buffer
+	if !col.required {
+		// Definition levels of bit width 1, as RLE runs of the RLE/bit-packing hybrid
+		var levels bytes.Buffer
+		for i := 0; i < len(col.values); {
+			run := 1
+			for i+run < len(col.values) && (col.values[i+run] == nil) == (col.values[i] == nil) {
+				run++
+			}
+			writeUvarint(&levels, uint64(run)<<1)
+			if col.values[i] == nil {
+				levels.WriteByte(0)
+			} else {
+				levels.WriteByte(1)
+			}
+			i += run
+		}
+		binary.Write(&page, binary.LittleEndian, uint32(levels.Len()))
+		page.Write(levels.Bytes())
+	}
+	var bits, numBits uint8
+	for _, val := range col.values {
+		switch v := val.(type) {
+		case int64:
+			binary.Write(&page, binary.LittleEndian, v)
+		case float64:
+			binary.Write(&page, binary.LittleEndian, math.Float64bits(v))
+		case string:
+			binary.Write(&page, binary.LittleEndian, uint32(len(v)))
+			page.WriteString(v)
+		case bool:
+			if v {
+				bits |= 1 << numBits
+			}
+			if numBits++; numBits == 8 {
+				page.WriteByte(bits)
+				bits, numBits = 0, 0
+			}
+		}
+	}
+	if numBits > 0 {
+		page.WriteByte(bits)
+	}
+	return page.Bytes()
+}
+
+// Metadata of a column chunk written into the file.
+type parquetChunk struct {
+	offset    int64
+	size      int64
+	numValues int
+}
+
+// Writes a Parquet file.
+type parquetWriter struct {
+	out       io.Writer
+	offset    int64
+	columns   []*parquetColumnData
+	numRows   int
+	groups    [][]parquetChunk // Column chunks of every row group written so far
+	groupRows []int
+	err       error
+}
+
+func (pw *parquetWriter) write(b []byte) {
+	if pw.err != nil {
+		return
+	}
+	var n int
+	n, pw.err = pw.out.Write(b)
+	pw.offset += int64(n)
+}
+
+// Add a row of values, one for each column (nil for null).
+func (pw *parquetWriter) addRow(row []interface{}) {
+	for i, val := range row {
+		pw.columns[i].values = append(pw.columns[i].values, val)
+	}
+	if len(pw.columns[0].values) == PARQUET_ROW_GROUP_SIZE {
+		pw.flushGroup()
+	}
+}
+
+// Write the buffered rows as a row group, one data page per column chunk.
+func (pw *parquetWriter) flushGroup() {
+	rows := len(pw.columns[0].values)
+	if rows == 0 {
+		return
+	}
+	chunks := make([]parquetChunk, len(pw.columns))
+	for i, col := range pw.columns {
+		page := col.page()
+		var header thriftWriter
+		header.fieldI32(1, parquetPageData)
+		header.fieldI32(2, int32(len(page)))
+		header.fieldI32(3, int32(len(page)))
+		header.beginStruct(5)
+		header.fieldI32(1, int32(rows))
+		header.fieldI32(2, parquetEncodingPlain)
+		header.fieldI32(3, parquetEncodingRLE)
+		header.fieldI32(4, parquetEncodingRLE)
+		header.endStruct()
+		header.stop()
+		chunks[i] = parquetChunk{offset: pw.offset, size: int64(header.buf.Len() + len(page)), numValues: rows}
+		pw.write(header.buf.Bytes())
+		pw.write(page)
+		col.values = col.values[:0]
+	}
+	pw.groups = append(pw.groups, chunks)
+	pw.groupRows = append(pw.groupRows, rows)
+	pw.numRows += rows
+}
+
+// Write the remaining rows and the file footer.
+func (pw *parquetWriter) close() error {
+	pw.flushGroup()
+	var meta thriftWriter
+	meta.fieldI32(1, 1)
+	// Schema is a root element followed by the columns
+	meta.beginList(2, thriftStruct, len(pw.columns)+1)
+	meta.fieldString(4, "schema")
+	meta.fieldI32(5, int32(len(pw.columns)))
+	meta.stop()
+	for _, col := range pw.columns {
+		meta.fieldI32(1, int32(col.physical))
+		if col.required {
+			meta.fieldI32(3, parquetRequired)
+		} else {
+			meta.fieldI32(3, parquetOptional)
+		}
+		meta.fieldString(4, col.name)
+		if col.physical == parquetTypeByteArray {
+			meta.fieldI32(6, parquetConvertedUTF8)
+		}
+		meta.stop()
+	}
+	meta.endList()
+	meta.fieldI64(3, int64(pw.numRows))
+	meta.beginList(4, thriftStruct, len(pw.groups))
+	for g, chunks := range pw.groups {
+		var groupSize int64
+		meta.beginList(1, thriftStruct, len(chunks))
+		for i, chunk := range chunks {
+			col := pw.columns[i]
+			meta.fieldI64(2, chunk.offset)
+			meta.beginStruct(3)
+			meta.fieldI32(1, int32(col.physical))
+			meta.beginList(2, thriftI32, 2)
+			meta.elemI32(parquetEncodingPlain)
+			meta.elemI32(parquetEncodingRLE)
+			meta.endList()
+			meta.beginList(3, thriftBinary, 1)
+			meta.elemString(col.name)
+			meta.endList()
+			meta.fieldI32(4, parquetCodecNone)
+			meta.fieldI64(5, int64(chunk.numValues))
+			meta.fieldI64(6, chunk.size)
+			meta.fieldI64(7, chunk.size)
+			meta.fieldI64(9, chunk.offset)
+			meta.endStruct()
+			meta.stop()
+			groupSize += chunk.size
+		}
+		meta.endList()
+		meta.fieldI64(2, groupSize)
+		meta.fieldI64(3, int64(pw.groupRows[g]))
+		meta.stop()
+	}
+	meta.endList()
+	meta.fieldString(6, parquetCreatedBy)
+	meta.stop()
+	pw.write(meta.buf.Bytes())
+	footerLen := make([]byte, 4)
+	binary.LittleEndian.PutUint32(footerLen, uint32(meta.buf.Len()))
+	pw.write(footerLen)
+	pw.write([]byte(parquetMagic))
+	return pw.err
+}
+
+/*
+Write documents of the collection into a Parquet file, one row per document, with the document ID column followed by
+the columns of the schema (see the package documentation in parquet.go for how values are mapped). Document order is
+the storage order. Values at redacted paths (see Redact) are masked, and are null in columns of other than string type.
+*/
+func (col *Col) ExportParquet(out io.Writer, schema []ParquetColumn) error {
+	pw := &parquetWriter{out: out}
+	pw.columns = append(pw.columns, &parquetColumnData{name: PARQUET_ID_COLUMN, physical: parquetTypeInt64, required: true})
+	names := map[string]bool{PARQUET_ID_COLUMN: true}
+	for _, column := range schema {
+		physical := parquetPhysicalType(column.Type)
+		if physical < 0 {
+			return fmt.Errorf("Unknown type %s of Parquet column %s", column.Type, column.Name)
+		} else if column.Name == "" || names[column.Name] {
+			return fmt.Errorf("Parquet column name \"%s\" is empty or duplicated", column.Name)
+		}
+		names[column.Name] = true
+		pw.columns = append(pw.columns, &parquetColumnData{name: column.Name, physical: physical})
+	}
+	redact, err := col.redactor()
+	if err != nil {
+		return err
+	}
+	pw.write([]byte(parquetMagic))
+	row := make([]interface{}, len(pw.columns))
+	col.ForEachDoc(func(id int, docB []byte) bool {
+		var doc map[string]interface{}
+		if json.Unmarshal(docB, &doc) != nil {
+			// Skip corrupted document
+			return true
+		}
+		if redact != nil {
+			redact(doc)
+		}
+		row[0] = int64(id)
+		for i, column := range schema {
+			row[i+1] = nil
+			for _, val := range GetIn(doc, column.Path) {
+				if converted, ok := parquetValue(column.Type, val); ok {
+					row[i+1] = converted
+					break
+				}
+			}
+		}
+		pw.addRow(row)
+		return pw.err == nil
+	})
+	return pw.close()
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// Encodes Thrift structures with the compact protocol, enough of it for Parquet metadata.
+type thriftWriter struct {
+	buf       bytes.Buffer
+	lastField []int16 // ID of the last field written at each level of nesting, innermost last
+}
+
+func writeUvarint(buf *bytes.Buffer, n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func (tw *thriftWriter) fieldHeader(id int16, typ byte) {
+	if len(tw.lastField) == 0 {
+		tw.lastField = []int16{0}
+	}
+	last := &tw.lastField[len(tw.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		tw.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		tw.buf.WriteByte(typ)
+		writeUvarint(&tw.buf, uint64((id<<1)^(id>>15)))
+	}
+	*last = id
+}
+
+func (tw *thriftWriter) fieldI32(id int16, val int32) {
+	tw.fieldHeader(id, thriftI32)
+	tw.elemI32(val)
+}
+
+func (tw *thriftWriter) fieldI64(id int16, val int64) {
+	tw.fieldHeader(id, thriftI64)
+	writeUvarint(&tw.buf, uint64((val<<1)^(val>>63)))
+}
+
+func (tw *thriftWriter) fieldString(id int16, val string) {
+	tw.fieldHeader(id, thriftBinary)
+	tw.elemString(val)
+}
+
+func (tw *thriftWriter) elemI32(val int32) {
+	writeUvarint(&tw.buf, uint64(uint32((val<<1)^(val>>31))))
+}
+
+func (tw *thriftWriter) elemString(val string) {
+	writeUvarint(&tw.buf, uint64(len(val)))
+	tw.buf.WriteString(val)
+}
+
+// Begin a struct field, end it with endStruct.
+func (tw *thriftWriter) beginStruct(id int16) {
+	tw.fieldHeader(id, thriftStruct)
+	tw.lastField = append(tw.lastField, 0)
+}
+
+func (tw *thriftWriter) endStruct() {
+	tw.stop()
+	tw.lastField = tw.lastField[:len(tw.lastField)-1]
+}
+
+/*
+Begin a list field of the element type, end it with endList. Every struct element of the list is a sequence of fields
+terminated by stop.
+*/
+func (tw *thriftWriter) beginList(id int16, elemType byte, size int) {
+	tw.fieldHeader(id, thriftList)
+	if size < 15 {
+		tw.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		tw.buf.WriteByte(0xf0 | elemType)
+		writeUvarint(&tw.buf, uint64(size))
+	}
+	tw.lastField = append(tw.lastField, 0)
+}
+
+func (tw *thriftWriter) endList() {
+	tw.lastField = tw.lastField[:len(tw.lastField)-1]
+}
+
+// Terminate a struct. Inside a list, the next struct element begins afresh.
+func (tw *thriftWriter) stop() {
+	tw.buf.WriteByte(0)
+	if len(tw.lastField) > 0 {
+		tw.lastField[len(tw.lastField)-1] = 0
+	}
+}
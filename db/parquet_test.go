@@ -0,0 +1,67 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestExportParquet(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	docs := []map[string]interface{}{
+		{"name": "alpha", "n": 1, "price": 1.5, "ok": true},
+		{"name": "beta", "n": 2.5, "ok": "yes"},
+		{"name": map[string]interface{}{"first": "gamma"}, "n": 3},
+	}
+	for _, doc := range docs {
+		if _, err := col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	schema := []ParquetColumn{
+		{Name: "name", Path: []string{"name"}, Type: PARQUET_STRING},
+		{Name: "n", Path: []string{"n"}, Type: PARQUET_INT64},
+		{Name: "price", Path: []string{"price"}, Type: PARQUET_DOUBLE},
+		{Name: "ok", Path: []string{"ok"}, Type: PARQUET_BOOL},
+	}
+	var out bytes.Buffer
+	if err := col.ExportParquet(&out, schema); err != nil {
+		t.Fatal(err)
+	}
+	file := out.Bytes()
+	if len(file) < 12 || string(file[:4]) != "PAR1" || string(file[len(file)-4:]) != "PAR1" {
+		t.Fatal("Bad magic bytes")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	if footerLen <= 0 || footerLen > len(file)-12 {
+		t.Fatal(footerLen)
+	}
+	footer := file[len(file)-8-footerLen : len(file)-8]
+	for _, name := range []string{"schema", "_id", "name", "n", "price", "ok", "tiedot"} {
+		if !bytes.Contains(footer, []byte(name)) {
+			t.Fatal("Missing from footer", name)
+		}
+	}
+	for _, val := range []string{"alpha", "beta", `{"first":"gamma"}`} {
+		if !bytes.Contains(file, []byte(val)) {
+			t.Fatal("Missing value", val)
+		}
+	}
+	// Bad schemas
+	if err := col.ExportParquet(&out, []ParquetColumn{{Name: "x", Type: "decimal"}}); err == nil {
+		t.Fatal("Did not check type")
+	} else if err := col.ExportParquet(&out, []ParquetColumn{{Name: "_id", Type: PARQUET_INT64}}); err == nil {
+		t.Fatal("Did not check name")
+	}
+}
@@ -0,0 +1,320 @@
+// Compiled query plans and plan cache.
+
+package db
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	QUERY_PLAN_CACHE_SIZE = 1024 // Maximum number of compiled query plans cached by a database.
+)
+
+// A compiled query evaluates the query with parameters bound to placeholders. The caller must place schema lock.
+type queryPlan func(params []interface{}, src *Col, result *map[int]struct{}) error
+
+// Least recently used compiled query plans, keyed by normalized query structure.
+type planCache struct {
+	lock    *sync.Mutex
+	maxSize int
+	plans   map[string]*list.Element
+	lru     *list.List // of *planCacheEntry, most recently used first
+}
+
+type planCacheEntry struct {
+	shape string
+	plan  queryPlan
+}
+
+func newPlanCache(maxSize int) *planCache {
+	return &planCache{lock: new(sync.Mutex), maxSize: maxSize, plans: make(map[string]*list.Element), lru: list.New()}
+}
+
+// Return the compiled plan of the query, compile and cache the plan if necessary.
+func (cache *planCache) get(q interface{}) (queryPlan, error) {
+	// JSON encoding orders object keys, therefore equal query structures have equal shape.
+	shapeJS, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	shape := string(shapeJS)
+	cache.lock.Lock()
+	if elem, cached := cache.plans[shape]; cached {
+		cache.lru.MoveToFront(elem)
+		cache.lock.Unlock()
+		return elem.Value.(*planCacheEntry).plan, nil
+	}
+	cache.lock.Unlock()
+	// The plan must not be affected by later changes made by the caller to the query
+	plan, err := compileQuery(copyQuery(q))
+	if err != nil {
+		return nil, err
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if _, cached := cache.plans[shape]; !cached {
+		cache.plans[shape] = cache.lru.PushFront(&planCacheEntry{shape: shape, plan: plan})
+		for cache.lru.Len() > cache.maxSize {
+			delete(cache.plans, cache.lru.Remove(cache.lru.Back()).(*planCacheEntry).shape)
+		}
+	}
+	return plan, nil
+}
+
+// Change the maximum number of cached plans, evict the least recently used plans that no longer fit.
+func (cache *planCache) resize(maxSize int) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.maxSize = maxSize
+	for cache.lru.Len() > cache.maxSize {
+		delete(cache.plans, cache.lru.Remove(cache.lru.Back()).(*planCacheEntry).shape)
+	}
+}
+
+// Return the number of cached plans.
+func (cache *planCache) size() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.lru.Len()
+}
+
+// Return a deep copy of the query structure.
+func copyQuery(q interface{}) interface{} {
+	switch expr := q.(type) {
+	case []interface{}:
+		ret := make([]interface{}, len(expr))
+		for i, subExpr := range expr {
+			ret[i] = copyQuery(subExpr)
+		}
+		return ret
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(expr))
+		for key, val := range expr {
+			ret[key] = copyQuery(val)
+		}
+		return ret
+	}
+	return q
+}
+
+// Return the parameter number (starting from 1) if the value is a placeholder such as "$1".
+func placeholder(val interface{}) (paramNum int, isPlaceholder bool) {
+	str, isStr := val.(string)
+	if !isStr || !strings.HasPrefix(str, "$") {
+		return 0, false
+	}
+	paramNum, err := strconv.Atoi(str[1:])
+	return paramNum, err == nil
+}
+
+// Analyse the query structure once and return its plan. Index availability is checked upon evaluation, hence a plan
+// remains valid across schema changes.
+// Placeholders are only recognised as values of "eq", "int-from", "int-to", ">=", "<=", and "limit", never as paths.
+func compileQuery(q interface{}) (queryPlan, error) {
+	switch expr := q.(type) {
+	case []interface{}: // [sub query 1, sub query 2, etc]
+		subPlans, err := compileSubQueries(expr)
+		if err != nil {
+			return nil, err
+		}
+		return func(params []interface{}, src *Col, result *map[int]struct{}) error {
+			for _, subPlan := range subPlans {
+				if err := subPlan(params, src, result); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+	case string:
+		if expr == "all" {
+			return func(_ []interface{}, src *Col, result *map[int]struct{}) error {
+				return EvalAllIDs(src, result)
+			}, nil
+		}
+		// Might be single document number
+		docID, err := strconv.ParseInt(expr, 10, 64)
+		if err != nil {
+			return nil, dberr.New(dberr.ErrorExpectingInt, "Single Document ID", docID)
+		}
+		return func(_ []interface{}, _ *Col, result *map[int]struct{}) error {
+			(*result)[int(docID)] = struct{}{}
+			return nil
+		}, nil
+	case map[string]interface{}:
+		if subExprs, intersect := expr["n"]; intersect && !hasOperation(expr, "eq", "has", "null", "all", "any") { // n - intersection
+			return compileSetOperation(subExprs, intersect)
+		} else if subExprs, complement := expr["c"]; complement && !hasOperation(expr, "eq", "has", "null", "all", "any", "n") { // c - complement
+			return compileSetOperation(subExprs, false)
+		}
+		return compileLeaf(expr)
+	}
+	return func([]interface{}, *Col, *map[int]struct{}) error {
+		return nil
+	}, nil
+}
+
+// Return true if the expression has any of the operations.
+func hasOperation(expr map[string]interface{}, ops ...string) bool {
+	for _, op := range ops {
+		if _, exists := expr[op]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// Compile each of the sub-queries.
+func compileSubQueries(subExprs []interface{}) ([]queryPlan, error) {
+	subPlans := make([]queryPlan, len(subExprs))
+	for i, subExpr := range subExprs {
+		var err error
+		if subPlans[i], err = compileQuery(subExpr); err != nil {
+			return nil, err
+		}
+	}
+	return subPlans, nil
+}
+
+// Compile an intersection (isIntersect) or complement of sub-queries.
+func compileSetOperation(subExprs interface{}, isIntersect bool) (queryPlan, error) {
+	subExprVecs, ok := subExprs.([]interface{})
+	if !ok {
+		return nil, dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+	}
+	subPlans, err := compileSubQueries(subExprVecs)
+	if err != nil {
+		return nil, err
+	}
+	if !isIntersect {
+		return func(params []interface{}, src *Col, result *map[int]struct{}) error {
+			if err := complement(len(subPlans), func(i int, subResult *map[int]struct{}) error {
+				return subPlans[i](params, src, subResult)
+			}, result); err != nil {
+				return err
+			}
+			return src.checkQuerySize(*result)
+		}, nil
+	}
+	// Lookups are evaluated on their own, so that they are intersected by posting lists or only verify documents within
+	// the intersection so far
+	lookups := make([]func(params []interface{}) (map[string]interface{}, error), len(subExprVecs))
+	for i, subExpr := range subExprVecs {
+		if expr, ok := subExpr.(map[string]interface{}); ok && hasOperation(expr, "eq") {
+			if lookups[i], err = compileBinding(expr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return func(params []interface{}, src *Col, result *map[int]struct{}) error {
+		bound := make([]interface{}, len(subPlans))
+		for i, bind := range lookups {
+			if bind != nil {
+				var err error
+				if bound[i], err = bind(params); err != nil {
+					return err
+				}
+			}
+		}
+		if err := src.checkIndexes(subExprVecs); err != nil {
+			return err
+		} else if err := src.intersectPushdown(bound, func(i int, within map[int]struct{}, subResult *map[int]struct{}) error {
+			if bound[i] == nil {
+				return subPlans[i](params, src, subResult)
+			}
+			return evalIntersected(bound[i], src, within, subResult)
+		}, func(i int) int {
+			return src.estimateQuery(subExprVecs[i], params)
+		}, result); err != nil {
+			return err
+		}
+		return src.checkQuerySize(*result)
+	}, nil
+}
+
+// Compile a lookup, multi-value lookup, path existence test, null value test, or integer or number range query.
+func compileLeaf(expr map[string]interface{}) (queryPlan, error) {
+	bind, err := compileBinding(expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(params []interface{}, src *Col, result *map[int]struct{}) error {
+		bound, err := bind(params)
+		if err != nil {
+			return err
+		}
+		return evalQuery(bound, src, result, false)
+	}, nil
+}
+
+// Return the function binding parameters to placeholders of the leaf expression. Placeholder positions are located
+// once; upon binding the expression is copied with parameters in place of the placeholders.
+func compileBinding(expr map[string]interface{}) (func(params []interface{}) (map[string]interface{}, error), error) {
+	if !hasOperation(expr, "eq", "has", "null", "all", "any", "int-from", "int from", ">=", "<=", "sort") {
+		return nil, fmt.Errorf("Query %v does not contain any operation (lookup/union/etc)", expr)
+	}
+	slots := make([]string, 0, 1) // keys of placeholder values
+	for _, key := range []string{"eq", "all", "any", "int-from", "int from", "int-to", "int to", ">=", "<=", "limit"} {
+		if _, isPlaceholder := placeholder(expr[key]); isPlaceholder {
+			slots = append(slots, key)
+		}
+	}
+	return func(params []interface{}) (map[string]interface{}, error) {
+		bound := expr
+		if len(slots) > 0 {
+			bound = make(map[string]interface{}, len(expr))
+			for key, val := range expr {
+				bound[key] = val
+			}
+			for _, key := range slots {
+				paramNum, _ := placeholder(expr[key])
+				if paramNum < 1 || paramNum > len(params) {
+					return nil, fmt.Errorf("Query parameter %v is out of range, %d parameters given", expr[key], len(params))
+				}
+				bound[key] = params[paramNum-1]
+			}
+		}
+		return bound, nil
+	}, nil
+}
+
+// Evaluate a query with parameter placeholders ("$1", "$2", etc) bound to the parameters, and put result into result
+// map (as map keys). For example, query {"eq": "$1", "in": ["Name"]} with parameters ["Joe"] looks for Name == "Joe".
+// The parameters are substituted as values, therefore user input may be passed as parameters safely.
+// The query is compiled once per query structure, and the plan is cached for subsequent evaluations. A query without
+// parameters (nil) is evaluated by EvalQuery instead, so that one-off queries do not take up the cache.
+func EvalQueryParams(q interface{}, params []interface{}, src *Col, result *map[int]struct{}) (err error) {
+	return EvalQueryParamsContext(context.Background(), q, params, src, result)
+}
+
+// Evaluate a query with parameters like EvalQueryParams, on behalf of the caller and at the priority carried by the
+// context (see EvalQueryContext).
+func EvalQueryParamsContext(ctx context.Context, q interface{}, params []interface{}, src *Col, result *map[int]struct{}) (err error) {
+	if params == nil {
+		return EvalQueryContext(ctx, q, src, result)
+	}
+	plan, err := src.db.plans.get(q)
+	if err != nil {
+		return
+	}
+	done, err := src.db.heavy.admit(ctx, false)
+	if err != nil {
+		return
+	}
+	defer done()
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	defer src.db.logSlowQuery(q, time.Now())
+	if err = src.checkFlags(COL_READ); err != nil {
+		return
+	}
+	return plan(params, src, result)
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestPlanCache(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	joe, _ := col.Insert(map[string]interface{}{"Name": "Joe"})
+	ann, _ := col.Insert(map[string]interface{}{"Name": "Ann"})
+	q := map[string]interface{}{"eq": "$1", "in": []interface{}{"Name"}}
+	// Plan is cached even if the query fails for lack of index, and remains valid after schema change
+	result := make(map[int]struct{})
+	if err := EvalQueryParams(q, []interface{}{"Joe"}, col, &result); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	if db.plans.size() != 1 {
+		t.Fatal(db.plans.size())
+	}
+	if err := col.Index([]string{"Name"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, id := range map[string]int{"Joe": joe, "Ann": ann} {
+		result := make(map[int]struct{})
+		if err := EvalQueryParams(q, []interface{}{name}, col, &result); err != nil || !ensureMapHasKeys(result, id) {
+			t.Fatal(result, err)
+		}
+	}
+	// Same structure written separately shares the plan
+	result = make(map[int]struct{})
+	if err := EvalQueryParams(map[string]interface{}{"in": []interface{}{"Name"}, "eq": "$1"}, []interface{}{"Ann"}, col, &result); err != nil || !ensureMapHasKeys(result, ann) {
+		t.Fatal(result, err)
+	}
+	if db.plans.size() != 1 {
+		t.Fatal(db.plans.size())
+	}
+	// Changing the query afterwards does not affect the cached plan
+	plan, err := db.plans.get(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q["in"].([]interface{})[0] = "Other"
+	result = make(map[int]struct{})
+	if err := plan([]interface{}{"Joe"}, col, &result); err != nil || !ensureMapHasKeys(result, joe) {
+		t.Fatal(result, err)
+	}
+	// Invalid queries are not cached
+	if err := EvalQueryParams(map[string]interface{}{"in": []interface{}{"Name"}}, []interface{}{}, col, &result); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err := EvalQueryParams(map[string]interface{}{"n": "$1"}, []interface{}{}, col, &result); dberr.Type(err) != dberr.ErrorExpectingSubQuery {
+		t.Fatal(err)
+	}
+	// Queries without parameters are not cached
+	if err := EvalQueryParams("all", nil, col, &result); err != nil {
+		t.Fatal(err)
+	}
+	if db.plans.size() != 1 {
+		t.Fatal(db.plans.size())
+	}
+}
+
+func TestPlanCacheEviction(t *testing.T) {
+	cache := newPlanCache(2)
+	for _, q := range []interface{}{"1", "2", "1", "3"} {
+		if _, err := cache.get(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "2" is the least recently used
+	if cache.size() != 2 {
+		t.Fatal(cache.size())
+	}
+	if _, cached := cache.plans[`"2"`]; cached {
+		t.Fatal(cache.plans)
+	}
+	if _, cached := cache.plans[`"1"`]; !cached {
+		t.Fatal(cache.plans)
+	}
+}
+
+func TestCompileQuery(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 5)
+	for i := range ids {
+		ids[i], _ = col.Insert(map[string]interface{}{"a": i})
+	}
+	// Compiled plans give the same result as EvalQuery
+	for _, q := range []interface{}{
+		"all",
+		[]interface{}{map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, map[string]interface{}{"eq": 2, "in": []interface{}{"a"}}},
+		map[string]interface{}{"n": []interface{}{"all", map[string]interface{}{"int-from": 1, "int-to": 3, "in": []interface{}{"a"}}}},
+		map[string]interface{}{"c": []interface{}{"all", map[string]interface{}{"has": []interface{}{"a"}, "limit": 2}}},
+		map[string]interface{}{"eq": 4, "in": []interface{}{"a"}, "n": "ignored"},
+	} {
+		expected := make(map[int]struct{})
+		if err := EvalQuery(q, col, &expected); err != nil {
+			t.Fatal(q, err)
+		}
+		plan, err := compileQuery(q)
+		if err != nil {
+			t.Fatal(q, err)
+		}
+		result := make(map[int]struct{})
+		if err := plan(nil, col, &result); err != nil || len(result) != len(expected) {
+			t.Fatal(q, result, expected, err)
+		}
+		for id := range expected {
+			if _, found := result[id]; !found {
+				t.Fatal(q, result, expected)
+			}
+		}
+	}
+	if _, err := compileQuery("not a number"); dberr.Type(err) != dberr.ErrorExpectingInt {
+		t.Fatal(err)
+	}
+	if _, err := compileQuery(map[string]interface{}{"c": []interface{}{map[string]interface{}{}}}); err == nil {
+		t.Fatal("Did not error")
+	}
+}
@@ -0,0 +1,148 @@
+// Intersection of index posting lists.
+
+package db
+
+import (
+	"sort"
+	"strings"
+)
+
+// An equality lookup evaluated by intersecting its posting list - the document IDs of its index entries - with others.
+type postingLookup struct {
+	idxName string
+	canon   interface{} // Value to look for, in canonical form of the index
+	key     int         // Hash key of the value
+}
+
+// Return the lookup expression as a posting lookup, or false if it is not a lookup that may be pushed down into
+// intersection (it has a limit, or its index is not ready). The caller must place schema lock.
+func (col *Col) postingLookupOf(q interface{}) (lookup postingLookup, ok bool) {
+	expr, isMap := q.(map[string]interface{})
+	if !isMap {
+		return
+	}
+	lookupValue, isLookup := expr["eq"]
+	vecPath, isVec := expr["in"].([]interface{})
+	if _, hasLimit := expr["limit"]; !isLookup || !isVec || hasLimit {
+		return
+	}
+	strPath := make([]string, len(vecPath))
+	for i, segment := range vecPath {
+		strPath[i], ok = segment.(string)
+		if !ok {
+			return
+		}
+	}
+	lookup.idxName = strings.Join(strPath, INDEX_PATH_SEP)
+	if _, indexed := col.indexPaths[lookup.idxName]; !indexed {
+		return lookup, false
+	} else if _, building := col.building[lookup.idxName]; building {
+		return lookup, false
+	}
+	opts := col.indexOpts[lookup.idxName]
+	if lookup.canon, ok = opts.canonical(lookupValue); ok {
+		lookup.key = opts.key(lookup.canon)
+	}
+	return
+}
+
+// Return the position of the first element not less than val in the sorted list, searching from pos onwards in
+// exponentially growing steps (galloping search).
+func gallop(list []int, pos, val int) int {
+	step := 1
+	for pos+step < len(list) && list[pos+step] < val {
+		pos += step
+		step *= 2
+	}
+	end := pos + step + 1
+	if end > len(list) {
+		end = len(list)
+	}
+	return pos + sort.SearchInts(list[pos:end], val)
+}
+
+/*
+Put documents found by all of the lookups and within the set (nil for all) into result. The posting lists of the
+lookups are sorted and intersected by galloping through the longer lists, and only documents in the intersection are
+read to rule out hash collisions. The caller must place schema lock.
+*/
+func (col *Col) intersectPostings(lookups []postingLookup, within map[int]struct{}, result *map[int]struct{}) {
+	lists := make([][]int, len(lookups))
+	for i, lookup := range lookups {
+		lists[i] = col.hashScan(lookup.idxName, lookup.key, 0)
+		sort.Ints(lists[i])
+	}
+	order := make([]int, len(lookups))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return len(lists[order[a]]) < len(lists[order[b]])
+	})
+	shortest := lists[order[0]]
+	positions := make([]int, len(lookups))
+nextCandidate:
+	for i, id := range shortest {
+		if i > 0 && shortest[i-1] == id {
+			continue
+		} else if within != nil {
+			if _, in := within[id]; !in {
+				continue
+			}
+		}
+		for _, listNum := range order[1:] {
+			list := lists[listNum]
+			if positions[listNum] = gallop(list, positions[listNum], id); positions[listNum] == len(list) {
+				// Nothing further is in all of the lists
+				break nextCandidate
+			} else if list[positions[listNum]] != id {
+				continue nextCandidate
+			}
+		}
+		for _, lookup := range lookups {
+			if !col.hasIndexValue(lookup.idxName, id, lookup.canon) {
+				continue nextCandidate
+			}
+		}
+		(*result)[id] = struct{}{}
+	}
+}
+
+/*
+Calculate intersection of sub-queries like intersect does, where exprs[i] is the expression of sub-query i with
+parameters in place (nil if it is evaluated by evalSub only). Two or more lookups among them are evaluated together by
+intersecting their posting lists, instead of evaluating each of them into a result of its own.
+*/
+func (col *Col) intersectPushdown(exprs []interface{}, evalSub func(i int, within map[int]struct{}, subResult *map[int]struct{}) error, cost func(i int) int, result *map[int]struct{}) error {
+	lookups := make([]postingLookup, 0, len(exprs))
+	rest := make([]int, 0, len(exprs))
+	for i, expr := range exprs {
+		if lookup, ok := col.postingLookupOf(expr); ok {
+			lookups = append(lookups, lookup)
+		} else {
+			rest = append(rest, i)
+		}
+	}
+	if len(lookups) < 2 {
+		return intersect(len(exprs), evalSub, cost, result)
+	}
+	// The lookups make up one more sub-query, as large as the smallest of them
+	return intersect(len(rest)+1, func(i int, within map[int]struct{}, subResult *map[int]struct{}) error {
+		if i < len(rest) {
+			return evalSub(rest[i], within, subResult)
+		}
+		col.intersectPostings(lookups, within, subResult)
+		return col.checkQuerySize(*subResult)
+	}, func(i int) int {
+		if i < len(rest) {
+			return cost(rest[i])
+		}
+		min := -1
+		for _, lookup := range lookups {
+			if estimate := col.estimateLookup(lookup.idxName, lookup.canon); min < 0 || estimate < min {
+				min = estimate
+			}
+		}
+		return min
+	}, result)
+}
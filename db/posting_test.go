@@ -0,0 +1,134 @@
+package db
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestGallop(t *testing.T) {
+	list := []int{1, 3, 3, 5, 8, 13, 21, 34, 55, 89}
+	for pos := range list {
+		for val := 0; val < 100; val++ {
+			expected := pos
+			for expected < len(list) && list[expected] < val {
+				expected++
+			}
+			if actual := gallop(list, pos, val); actual != expected {
+				t.Fatal(pos, val, actual, expected)
+			}
+		}
+	}
+	if gallop(nil, 0, 1) != 0 {
+		t.Fatal("Bad empty list")
+	}
+}
+
+func TestIntersectPostings(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	for _, path := range []string{"a", "b", "tags"} {
+		if err := col.Index([]string{path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	docs := make(map[int]map[string]interface{})
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		doc := map[string]interface{}{
+			"a":    rng.Intn(3),
+			"b":    rng.Intn(5),
+			"tags": []interface{}{rng.Intn(4), rng.Intn(4)},
+		}
+		id, err := col.Insert(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs[id] = doc
+	}
+	matches := func(doc map[string]interface{}, a, b, tag int) bool {
+		tags := doc["tags"].([]interface{})
+		return doc["a"] == a && doc["b"] == b && (tags[0] == tag || tags[1] == tag)
+	}
+	for a := 0; a < 3; a++ {
+		for b := 0; b < 5; b++ {
+			for tag := 0; tag < 4; tag++ {
+				expected := make([]int, 0)
+				for id, doc := range docs {
+					if matches(doc, a, b, tag) {
+						expected = append(expected, id)
+					}
+				}
+				q := map[string]interface{}{"n": []interface{}{
+					map[string]interface{}{"eq": float64(a), "in": []interface{}{"a"}},
+					map[string]interface{}{"has": []interface{}{"b"}},
+					map[string]interface{}{"eq": float64(b), "in": []interface{}{"b"}},
+					map[string]interface{}{"all": []interface{}{float64(tag)}, "in": []interface{}{"tags"}},
+				}}
+				result := make(map[int]struct{})
+				if err := EvalQuery(q, col, &result); err != nil || !ensureMapHasKeys(result, expected...) {
+					t.Fatal(a, b, tag, len(result), len(expected), err)
+				}
+				paramQ := map[string]interface{}{"n": []interface{}{
+					map[string]interface{}{"eq": "$1", "in": []interface{}{"a"}},
+					map[string]interface{}{"eq": "$2", "in": []interface{}{"b"}},
+					map[string]interface{}{"eq": "$3", "in": []interface{}{"tags"}},
+				}}
+				result = make(map[int]struct{})
+				if err := EvalQueryParams(paramQ, []interface{}{a, b, tag}, col, &result); err != nil || !ensureMapHasKeys(result, expected...) {
+					t.Fatal(a, b, tag, len(result), len(expected), err)
+				}
+			}
+		}
+	}
+	// Documents having all of the tags
+	expected := make([]int, 0)
+	for id, doc := range docs {
+		if tags := doc["tags"].([]interface{}); tags[0] == 1 && tags[1] == 2 || tags[0] == 2 && tags[1] == 1 {
+			expected = append(expected, id)
+		}
+	}
+	if result, err := runQuery(`{"all": [1, 2], "in": ["tags"]}`, col); err != nil || !ensureMapHasKeys(result, expected...) {
+		t.Fatal(len(result), len(expected), err)
+	}
+	// Results are limited to the set given
+	db.schemaLock.RLock()
+	lookups := make([]postingLookup, 0)
+	for _, q := range []string{`{"eq": 1, "in": ["a"]}`, `{"eq": 1, "in": ["b"]}`} {
+		lookup, ok := col.postingLookupOf(parseQuery(t, q))
+		if !ok {
+			t.Fatal(q)
+		}
+		lookups = append(lookups, lookup)
+	}
+	for _, q := range []string{`{"eq": 1, "in": ["a"], "limit": 1}`, `{"eq": 1, "in": ["nope"]}`, `{"has": ["a"]}`} {
+		if _, ok := col.postingLookupOf(parseQuery(t, q)); ok {
+			t.Fatal(q)
+		}
+	}
+	within := make(map[int]struct{})
+	expected = make([]int, 0)
+	for id, doc := range docs {
+		if id%2 == 0 {
+			within[id] = struct{}{}
+			if doc["a"] == 1 && doc["b"] == 1 {
+				expected = append(expected, id)
+			}
+		}
+	}
+	result := make(map[int]struct{})
+	col.intersectPostings(lookups, within, &result)
+	db.schemaLock.RUnlock()
+	if !ensureMapHasKeys(result, expected...) {
+		t.Fatal(len(result), len(expected))
+	}
+}
@@ -0,0 +1,73 @@
+// Progress reporting and cancellation of maintenance operations.
+
+package db
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	PROGRESS_INTERVAL = 100 * time.Millisecond // Minimum interval between two progress reports of an operation.
+)
+
+// Progress of a maintenance operation (dump, restore, or scrub), given to the progress callback of the operation.
+type Progress struct {
+	File    string        // File being copied or verified, or collection being scrubbed
+	Done    int64         // Amount of work done - bytes copied and verified, or documents scrubbed
+	Total   int64         // Total amount of work, which is an estimate for scrub
+	Elapsed time.Duration // Time spent since the operation started
+	ETA     time.Duration // Estimated remaining time, 0 until any work is done
+}
+
+// Progress tracking and cancellation of a maintenance operation.
+type tracker struct {
+	ctx        context.Context
+	report     func(Progress)
+	start      time.Time
+	lastReport time.Time
+	progress   Progress
+}
+
+// Start tracking an operation of the total amount of work. The report function may be nil.
+func newTracker(ctx context.Context, total int64, report func(Progress)) *tracker {
+	now := time.Now()
+	return &tracker{ctx: ctx, report: report, start: now, lastReport: now, progress: Progress{Total: total}}
+}
+
+// Record work done on the file, report progress if it is time to, and return an error if the operation is cancelled.
+func (tr *tracker) advance(file string, done int64) error {
+	tr.progress.File = file
+	tr.progress.Done += done
+	if tr.report != nil && time.Since(tr.lastReport) >= PROGRESS_INTERVAL {
+		tr.reportNow()
+	}
+	return tr.ctx.Err()
+}
+
+// Report progress right away, e.g. upon completion of the operation.
+func (tr *tracker) reportNow() {
+	if tr.report == nil {
+		return
+	}
+	tr.lastReport = time.Now()
+	tr.progress.Elapsed = tr.lastReport.Sub(tr.start)
+	tr.progress.ETA = 0
+	if tr.progress.Done > 0 && tr.progress.Total > tr.progress.Done {
+		tr.progress.ETA = time.Duration(float64(tr.progress.Elapsed) * float64(tr.progress.Total-tr.progress.Done) / float64(tr.progress.Done))
+	}
+	tr.report(tr.progress)
+}
+
+// Count bytes written to it as work done on the file, and fail writes once the operation is cancelled.
+type progressWriter struct {
+	tr   *tracker
+	file string
+}
+
+func (w progressWriter) Write(p []byte) (int, error) {
+	if err := w.tr.advance(w.file, int64(len(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
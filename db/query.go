@@ -3,10 +3,13 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/HouzuoGuo/tiedot/tdlog"
@@ -26,13 +29,28 @@ func EvalUnion(exprs []interface{}, src *Col, result *map[int]struct{}) (err err
 func EvalAllIDs(src *Col, result *map[int]struct{}) (err error) {
 	src.forEachDoc(func(id int, _ []byte) bool {
 		(*result)[id] = struct{}{}
-		return true
+		err = src.checkQuerySize(*result)
+		return err == nil
 	}, false)
 	return
 }
 
+// Return an error if the query result or intermediate set holds more document IDs than the configured limit.
+func (col *Col) checkQuerySize(set map[int]struct{}) error {
+	if limit := col.db.Config.QueryMaxIDs; limit > 0 && len(set) > limit {
+		return dberr.New(dberr.ErrorQueryTooLarge, limit)
+	}
+	return nil
+}
+
 // Value equity check ("attribute == value") using hash lookup.
 func Lookup(lookupValue interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	return lookup(lookupValue, expr, src, nil, result)
+}
+
+// Value equity check, where only documents within the set (nil for all) are read to filter out hash collisions, the
+// others are left out of the result.
+func lookup(lookupValue interface{}, expr map[string]interface{}, src *Col, within map[int]struct{}, result *map[int]struct{}) (err error) {
 	// Figure out lookup path - JSON array "in"
 	path, hasPath := expr["in"]
 	if !hasPath {
@@ -57,24 +75,157 @@ func Lookup(lookupValue interface{}, expr map[string]interface{}, src *Col, resu
 			return dberr.New(dberr.ErrorExpectingInt, "limit", limit)
 		}
 	}
-	lookupStrValue := fmt.Sprint(lookupValue) // the value to look for
-	lookupValueHash := StrHash(lookupStrValue)
 	scanPath := strings.Join(vecPath, INDEX_PATH_SEP)
 	if _, indexed := src.indexPaths[scanPath]; !indexed {
 		return dberr.New(dberr.ErrorNeedIndex, scanPath, expr)
+	} else if _, building := src.building[scanPath]; building {
+		return dberr.New(dberr.ErrorIndexBuilding, vecPath, expr)
+	}
+	opts := src.indexOpts[scanPath]
+	lookupCanon, ok := opts.canonical(lookupValue) // the value to look for
+	if !ok {
+		// The value cannot be on the index
+		return
+	}
+	for _, match := range src.hashScan(scanPath, opts.key(lookupCanon), intLimit) {
+		if within != nil {
+			if _, in := within[match]; !in {
+				continue
+			}
+		}
+		// Filter result to avoid hash collision
+		if src.hasIndexValue(scanPath, match, lookupCanon) {
+			(*result)[match] = struct{}{}
+		}
+	}
+	return
+}
+
+/*
+Multi-value lookup on an indexed path, usually of array values (e.g. tags). With matchAll, documents having all of the
+values are found ("all" operation), otherwise documents having any of the values are found ("any" operation).
+*/
+func MultiLookup(lookupValues interface{}, matchAll bool, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	vecValues, ok := lookupValues.([]interface{})
+	if !ok || len(vecValues) == 0 {
+		return fmt.Errorf("Expecting a vector of lookup values, but %v given", lookupValues)
+	}
+	// Figure out result number limit
+	intLimit := 0
+	if limit, hasLimit := expr["limit"]; hasLimit {
+		if floatLimit, ok := limit.(float64); ok {
+			intLimit = int(floatLimit)
+		} else if _, ok := limit.(int); ok {
+			intLimit = limit.(int)
+		} else {
+			return dberr.New(dberr.ErrorExpectingInt, "limit", limit)
+		}
+	}
+	lookups := make([]interface{}, len(vecValues))
+	for i, val := range vecValues {
+		lookups[i] = map[string]interface{}{"eq": val, "in": expr["in"]}
+	}
+	lookupOne := func(i int, within map[int]struct{}, subResult *map[int]struct{}) error {
+		return lookup(vecValues[i], map[string]interface{}{"in": expr["in"]}, src, within, subResult)
+	}
+	myResult := make(map[int]struct{})
+	if matchAll {
+		err = src.intersectPushdown(lookups, lookupOne, func(i int) int {
+			return src.estimateLookupExpr(vecValues[i], map[string]interface{}{"in": expr["in"]}, nil)
+		}, &myResult)
+	} else {
+		for i := range vecValues {
+			if err = lookupOne(i, nil, &myResult); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return
+	}
+	counter := 0
+	for docID := range myResult {
+		if intLimit > 0 && counter == intLimit {
+			break
+		}
+		counter++
+		(*result)[docID] = struct{}{}
+	}
+	return
+}
+
+// Return true if the document has the value (in canonical form of the index) at the index path.
+func (col *Col) hasIndexValue(idxName string, id int, canon interface{}) bool {
+	doc, err := col.read(id, false)
+	if err != nil {
+		return false
+	}
+	opts := col.indexOpts[idxName]
+	for _, v := range opts.values(doc, col.indexPaths[idxName]) {
+		if vCanon, ok := opts.canonical(v); ok && vCanon == canon {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the document has a value (other than nil) of the hash key at the index path.
+func (col *Col) hasIndexKey(idxName string, id int, hashKey int) bool {
+	doc, err := col.read(id, false)
+	if err != nil {
+		return false
 	}
-	num := lookupValueHash % src.db.numParts
-	ht := src.hts[num][scanPath]
+	opts := col.indexOpts[idxName]
+	for _, v := range opts.values(doc, col.indexPaths[idxName]) {
+		if canon, ok := opts.canonical(v); ok && v != nil && opts.key(canon) == hashKey {
+			return true
+		}
+	}
+	return false
+}
+
+// Null or missing value check using the null value entries of an index created with IndexNull option.
+func NullValue(nullPath interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	// Figure out the path
+	vecPath := make([]string, 0)
+	if vecPathInterface, ok := nullPath.([]interface{}); ok {
+		for _, v := range vecPathInterface {
+			vecPath = append(vecPath, fmt.Sprint(v))
+		}
+	} else {
+		return fmt.Errorf("Expecting vector path, but %v given", nullPath)
+	}
+	// Figure out result number limit
+	intLimit := 0
+	if limit, hasLimit := expr["limit"]; hasLimit {
+		if floatLimit, ok := limit.(float64); ok {
+			intLimit = int(floatLimit)
+		} else if _, ok := limit.(int); ok {
+			intLimit = limit.(int)
+		} else {
+			return dberr.New(dberr.ErrorExpectingInt, "limit", limit)
+		}
+	}
+	jointPath := strings.Join(vecPath, INDEX_PATH_SEP)
+	if _, indexed := src.indexPaths[jointPath]; !indexed {
+		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
+	} else if _, building := src.building[jointPath]; building {
+		return dberr.New(dberr.ErrorIndexBuilding, vecPath, expr)
+	} else if !src.indexOpts[jointPath].IndexNull {
+		return fmt.Errorf("Index %v does not have null values, recreate it with IndexNull option", vecPath)
+	}
+	ht := src.indexHT(jointPath, indexNullKey)
 	ht.Lock.RLock()
-	vals := ht.Get(lookupValueHash, intLimit)
+	vals := ht.Get(indexNullKey, 0)
 	ht.Lock.RUnlock()
+	counter := 0
 	for _, match := range vals {
 		// Filter result to avoid hash collision
-		if doc, err := src.read(match, false); err == nil {
-			for _, v := range GetIn(doc, vecPath) {
-				if fmt.Sprint(v) == lookupStrValue {
-					(*result)[match] = struct{}{}
-				}
+		if doc, err := src.read(match, false); err == nil && isNullIn(doc, vecPath) {
+			(*result)[match] = struct{}{}
+			counter++
+			if counter == intLimit {
+				break
 			}
 		}
 	}
@@ -106,23 +257,33 @@ func PathExistence(hasPath interface{}, expr map[string]interface{}, src *Col, r
 	jointPath := strings.Join(vecPath, INDEX_PATH_SEP)
 	if _, indexed := src.indexPaths[jointPath]; !indexed {
 		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
+	} else if _, building := src.building[jointPath]; building {
+		return dberr.New(dberr.ErrorIndexBuilding, vecPath, expr)
 	}
+	withNull := src.indexOpts[jointPath].IndexNull
 	counter := 0
-	partDiv := src.approxDocCount(false) / src.db.numParts / 4000 // collect approx. 4k document IDs in each iteration
+	partDiv := src.approxDocCount(false) / src.indexParts(jointPath) / 4000 // collect approx. 4k document IDs in each iteration
 	if partDiv == 0 {
 		partDiv++
 	}
-	for iteratePart := 0; iteratePart < src.db.numParts; iteratePart++ {
+	for iteratePart := 0; iteratePart < src.indexParts(jointPath); iteratePart++ {
 		ht := src.hts[iteratePart][jointPath]
 		ht.Lock.RLock()
 		for i := 0; i < partDiv; i++ {
-			_, ids := ht.GetPartition(i, partDiv)
-			for _, id := range ids {
+			keys, ids := ht.GetPartition(i, partDiv)
+			for j, id := range ids {
+				if keys[j] == indexNullKey && withNull && !src.hasIndexKey(jointPath, id, indexNullKey) {
+					// The entry stands for null or missing value
+					continue
+				}
 				(*result)[id] = struct{}{}
 				counter++
 				if counter == intLimit {
 					ht.Lock.RUnlock()
 					return nil
+				} else if err := src.checkQuerySize(*result); err != nil {
+					ht.Lock.RUnlock()
+					return err
 				}
 			}
 		}
@@ -133,69 +294,196 @@ func PathExistence(hasPath interface{}, expr map[string]interface{}, src *Col, r
 
 // Calculate intersection of sub-query results.
 func Intersect(subExprs interface{}, src *Col, result *map[int]struct{}) (err error) {
-	myResult := make(map[int]struct{})
 	if subExprVecs, ok := subExprs.([]interface{}); ok {
-		first := true
-		for _, subExpr := range subExprVecs {
-			subResult := make(map[int]struct{})
-			intersection := make(map[int]struct{})
-			if err = evalQuery(subExpr, src, &subResult, false); err != nil {
-				return
+		if err = src.checkIndexes(subExprVecs); err != nil {
+			return
+		}
+		return src.intersectPushdown(subExprVecs, func(i int, within map[int]struct{}, subResult *map[int]struct{}) error {
+			return evalIntersected(subExprVecs[i], src, within, subResult)
+		}, func(i int) int {
+			return src.estimateQuery(subExprVecs[i], nil)
+		}, result)
+	}
+	return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+}
+
+/*
+Check that the indexes needed by the query and its sub-queries exist and are ready, without evaluating anything. An
+intersection stops evaluating its sub-queries once it is empty, hence it checks them all beforehand, so that a query
+missing an index fails regardless of the data. The caller must place schema lock.
+*/
+func (col *Col) checkIndexes(q interface{}) error {
+	switch expr := q.(type) {
+	case []interface{}:
+		for _, subExpr := range expr {
+			if err := col.checkIndexes(subExpr); err != nil {
+				return err
 			}
-			if first {
-				myResult = subResult
-				first = false
-			} else {
-				for k := range subResult {
-					if _, inBoth := myResult[k]; inBoth {
-						intersection[k] = struct{}{}
-					}
-				}
-				myResult = intersection
+		}
+	case map[string]interface{}:
+		// Same order of operations as evalOperation
+		var vecPath []string
+		var err error
+		var needNull, needNumber bool
+		if _, lookup := expr["eq"]; lookup {
+			vecPath, err = checkedPath(expr["in"])
+		} else if hasPath, exist := expr["has"]; exist {
+			vecPath, err = checkedPath(hasPath)
+		} else if nullPath, null := expr["null"]; null {
+			vecPath, err = checkedPath(nullPath)
+			needNull = true
+		} else if hasOperation(expr, "all", "any") {
+			vecPath, err = checkedPath(expr["in"])
+		} else if subExprs, intersect := expr["n"]; intersect {
+			return col.checkSubQueries(subExprs)
+		} else if subExprs, complement := expr["c"]; complement {
+			return col.checkSubQueries(subExprs)
+		} else if hasOperation(expr, "int-from", "int from") {
+			vecPath, err = checkedPath(expr["in"])
+		} else if hasOperation(expr, ">=", "<=") {
+			vecPath, err = checkedPath(expr["in"])
+			needNumber = true
+		} else if sortSpec, sorted := expr["sort"]; sorted {
+			var keys []SortKey
+			if keys, err = ParseSortKeys([]interface{}{sortSpec}); err == nil {
+				vecPath = keys[0].Path
 			}
+			needNumber = true
+		} else {
+			// Left to evaluation to report
+			return nil
 		}
-		for docID := range myResult {
-			(*result)[docID] = struct{}{}
+		if err != nil {
+			return err
 		}
-	} else {
+		idxName := strings.Join(vecPath, INDEX_PATH_SEP)
+		if _, indexed := col.indexPaths[idxName]; !indexed {
+			return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
+		} else if _, building := col.building[idxName]; building {
+			return dberr.New(dberr.ErrorIndexBuilding, vecPath, expr)
+		}
+		if opts := col.indexOpts[idxName]; needNull && !opts.IndexNull {
+			return fmt.Errorf("Index %v does not have null values, recreate it with IndexNull option", vecPath)
+		} else if needNumber && opts.Type != INDEX_TYPE_NUMBER {
+			return fmt.Errorf("Query %v needs an index of number type on %v", expr, vecPath)
+		}
+	}
+	return nil
+}
+
+// Check the indexes needed by the sub-queries of a set operation, see checkIndexes.
+func (col *Col) checkSubQueries(subExprs interface{}) error {
+	subExprVecs, ok := subExprs.([]interface{})
+	if !ok {
 		return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
 	}
+	return col.checkIndexes(subExprVecs)
+}
+
+// Return the path given as a vector of path segments.
+func checkedPath(path interface{}) ([]string, error) {
+	vecPathInterface, ok := path.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expecting vector path, but %v given", path)
+	}
+	vecPath := make([]string, 0, len(vecPathInterface))
+	for _, v := range vecPathInterface {
+		vecPath = append(vecPath, fmt.Sprint(v))
+	}
+	return vecPath, nil
+}
+
+/*
+Calculate intersection of the results of numSub sub-queries, which are evaluated by evalSub. Sub-queries are evaluated
+in ascending order of their estimated result size given by cost (negative if unknown, those go last), and each is given
+the intersection so far (nil for the first one) to limit its work. Once the intersection is empty, the remaining
+sub-queries are not evaluated.
+*/
+func intersect(numSub int, evalSub func(i int, within map[int]struct{}, subResult *map[int]struct{}) error, cost func(i int) int, result *map[int]struct{}) (err error) {
+	order := make([]int, numSub)
+	costs := make([]int, numSub)
+	for i := range order {
+		order[i] = i
+		if costs[i] = cost(i); costs[i] < 0 {
+			costs[i] = int(^uint(0) >> 1)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return costs[order[a]] < costs[order[b]]
+	})
+	var myResult map[int]struct{}
+	for _, i := range order {
+		subResult := make(map[int]struct{})
+		if err = evalSub(i, myResult, &subResult); err != nil {
+			return
+		}
+		if myResult == nil {
+			if myResult = subResult; len(myResult) == 0 {
+				break
+			}
+			continue
+		}
+		// Go through the smaller set
+		smaller, larger := subResult, myResult
+		if len(smaller) > len(larger) {
+			smaller, larger = larger, smaller
+		}
+		intersection := make(map[int]struct{}, len(smaller))
+		for k := range smaller {
+			if _, inBoth := larger[k]; inBoth {
+				intersection[k] = struct{}{}
+			}
+		}
+		if myResult = intersection; len(myResult) == 0 {
+			// Short-circuit, nothing is left to intersect
+			break
+		}
+	}
+	for docID := range myResult {
+		(*result)[docID] = struct{}{}
+	}
 	return
 }
 
 // Calculate complement of sub-query results.
 func Complement(subExprs interface{}, src *Col, result *map[int]struct{}) (err error) {
-	myResult := make(map[int]struct{})
 	if subExprVecs, ok := subExprs.([]interface{}); ok {
-		for _, subExpr := range subExprVecs {
-			subResult := make(map[int]struct{})
-			complement := make(map[int]struct{})
-			if err = evalQuery(subExpr, src, &subResult, false); err != nil {
-				return
-			}
-			for k := range subResult {
-				if _, inBoth := myResult[k]; !inBoth {
-					complement[k] = struct{}{}
-				}
-			}
-			for k := range myResult {
-				if _, inBoth := subResult[k]; !inBoth {
-					complement[k] = struct{}{}
-				}
+		return complement(len(subExprVecs), func(i int, subResult *map[int]struct{}) error {
+			return evalQuery(subExprVecs[i], src, subResult, false)
+		}, result)
+	}
+	return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+}
+
+// Calculate complement of the results of numSub sub-queries, which are evaluated by evalSub.
+func complement(numSub int, evalSub func(i int, subResult *map[int]struct{}) error, result *map[int]struct{}) (err error) {
+	myResult := make(map[int]struct{})
+	for i := 0; i < numSub; i++ {
+		subResult := make(map[int]struct{})
+		complement := make(map[int]struct{})
+		if err = evalSub(i, &subResult); err != nil {
+			return
+		}
+		for k := range subResult {
+			if _, inBoth := myResult[k]; !inBoth {
+				complement[k] = struct{}{}
 			}
-			myResult = complement
 		}
-		for docID := range myResult {
-			(*result)[docID] = struct{}{}
+		for k := range myResult {
+			if _, inBoth := subResult[k]; !inBoth {
+				complement[k] = struct{}{}
+			}
 		}
-	} else {
-		return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+		myResult = complement
+	}
+	for docID := range myResult {
+		(*result)[docID] = struct{}{}
 	}
 	return
 }
 
 func (col *Col) hashScan(idxName string, key, limit int) []int {
-	ht := col.hts[key%col.db.numParts][idxName]
+	ht := col.indexHT(idxName, key)
 	ht.Lock.RLock()
 	vals := ht.Get(key, limit)
 	ht.Lock.RUnlock()
@@ -256,51 +544,99 @@ func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result
 	} else {
 		return dberr.New(dberr.ErrorMissing, "int-to")
 	}
-	if to > from && to-from > 1000 || from > to && from-to > 1000 {
-		tdlog.CritNoRepeat("Query %v involves index lookup on more than 1000 values, which can be very inefficient", expr)
-	}
 	counter := int(0) // Number of results already collected
 	htPath := strings.Join(vecPath, ",")
 	if _, indexScan := src.indexPaths[htPath]; !indexScan {
 		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
+	} else if _, building := src.building[htPath]; building {
+		return dberr.New(dberr.ErrorIndexBuilding, vecPath, expr)
+	}
+	opts := src.indexOpts[htPath]
+	if opts.Type == INDEX_TYPE_NUMBER {
+		// Number index keys are ordered, look up the range of keys instead of every integer
+		if from > to {
+			return src.numberRange(htPath, float64(to), float64(from), true, true, intLimit, result)
+		}
+		return src.numberRange(htPath, float64(from), float64(to), false, true, intLimit, result)
+	}
+	if to > from && to-from > 1000 || from > to && from-to > 1000 {
+		tdlog.CritNoRepeat("Query %v involves index lookup on more than 1000 values, which can be very inefficient", expr)
 	}
 	if from < to {
 		// Forward scan - from low value to high value
 		for lookupValue := from; lookupValue <= to; lookupValue++ {
-			lookupStrValue := fmt.Sprint(float64(lookupValue))
-			hashValue := StrHash(lookupStrValue)
-			vals := src.hashScan(htPath, hashValue, int(intLimit))
+			canon, ok := opts.canonical(float64(lookupValue))
+			if !ok {
+				break
+			}
+			vals := src.hashScan(htPath, opts.key(canon), int(intLimit))
 			for _, docID := range vals {
 				if intLimit > 0 && counter == intLimit {
 					break
+				} else if opts.Type != INDEX_TYPE_STRING && !src.hasIndexValue(htPath, docID, canon) {
+					// Typed index keys are shared by adjacent numbers
+					continue
 				}
 				counter++
 				(*result)[docID] = struct{}{}
 			}
+			if err = src.checkQuerySize(*result); err != nil {
+				return
+			}
 		}
 	} else {
 		// Backward scan - from high value to low value
 		for lookupValue := from; lookupValue >= to; lookupValue-- {
-			lookupStrValue := fmt.Sprint(float64(lookupValue))
-			hashValue := StrHash(lookupStrValue)
-			vals := src.hashScan(htPath, hashValue, int(intLimit))
+			canon, ok := opts.canonical(float64(lookupValue))
+			if !ok {
+				break
+			}
+			vals := src.hashScan(htPath, opts.key(canon), int(intLimit))
 			for _, docID := range vals {
 				if intLimit > 0 && counter == intLimit {
 					break
+				} else if opts.Type != INDEX_TYPE_STRING && !src.hasIndexValue(htPath, docID, canon) {
+					// Typed index keys are shared by adjacent numbers
+					continue
 				}
 				counter++
 				(*result)[docID] = struct{}{}
 			}
+			if err = src.checkQuerySize(*result); err != nil {
+				return
+			}
 		}
 	}
 	return
 }
 
+// Evaluate a sub-query of intersection. A lookup only verifies documents within the intersection so far (nil for
+// all), since the others are left out of the intersection anyway.
+func evalIntersected(q interface{}, src *Col, within map[int]struct{}, result *map[int]struct{}) (err error) {
+	if expr, ok := q.(map[string]interface{}); ok && within != nil {
+		if lookupValue, isLookup := expr["eq"]; isLookup {
+			if err = lookup(lookupValue, expr, src, within, result); err != nil {
+				return
+			}
+			return src.checkQuerySize(*result)
+		}
+	}
+	return evalQuery(q, src, result, false)
+}
+
 func evalQuery(q interface{}, src *Col, result *map[int]struct{}, placeSchemaLock bool) (err error) {
 	if placeSchemaLock {
 		src.db.schemaLock.RLock()
 		defer src.db.schemaLock.RUnlock()
 	}
+	if err = evalOperation(q, src, result); err != nil {
+		return
+	}
+	return src.checkQuerySize(*result)
+}
+
+// Evaluate the query operation and put result into result map (as map keys).
+func evalOperation(q interface{}, src *Col, result *map[int]struct{}) (err error) {
 	switch expr := q.(type) {
 	case []interface{}: // [sub query 1, sub query 2, etc]
 		return EvalUnion(expr, src, result)
@@ -319,6 +655,12 @@ func evalQuery(q interface{}, src *Col, result *map[int]struct{}, placeSchemaLoc
 			return Lookup(lookupValue, expr, src, result)
 		} else if hasPath, exist := expr["has"]; exist { // has - path existence test
 			return PathExistence(hasPath, expr, src, result)
+		} else if nullPath, null := expr["null"]; null { // null - null or missing value test
+			return NullValue(nullPath, expr, src, result)
+		} else if lookupValues, multiLookup := expr["all"]; multiLookup { // all - lookup documents having all values
+			return MultiLookup(lookupValues, true, expr, src, result)
+		} else if lookupValues, multiLookup := expr["any"]; multiLookup { // any - lookup documents having any value
+			return MultiLookup(lookupValues, false, expr, src, result)
 		} else if subExprs, intersect := expr["n"]; intersect { // n - intersection
 			return Intersect(subExprs, src, result)
 		} else if subExprs, complement := expr["c"]; complement { // c - complement
@@ -327,6 +669,10 @@ func evalQuery(q interface{}, src *Col, result *map[int]struct{}, placeSchemaLoc
 			return IntRange(intFrom, expr, src, result)
 		} else if intFrom, htRange := expr["int from"]; htRange { // "int from, "int to" - integer range query - same as above, just without dash
 			return IntRange(intFrom, expr, src, result)
+		} else if hasOperation(expr, ">=", "<=") { // >=, <= - number range query
+			return NumberRange(expr, src, result)
+		} else if sortSpec, sorted := expr["sort"]; sorted { // sort - documents in order of indexed numbers
+			return SortedLookup(sortSpec, expr, src, result)
 		} else {
 			return errors.New(fmt.Sprintf("Query %v does not contain any operation (lookup/union/etc)", expr))
 		}
@@ -336,8 +682,115 @@ func evalQuery(q interface{}, src *Col, result *map[int]struct{}, placeSchemaLoc
 
 // Main entrance to query processor - evaluate a query and put result into result map (as map keys).
 func EvalQuery(q interface{}, src *Col, result *map[int]struct{}) (err error) {
-	return evalQuery(q, src, result, true)
+	return EvalQueryContext(context.Background(), q, src, result)
+}
+
+// Evaluate a query like EvalQuery, on behalf of the caller and at the priority carried by the context (see WithCaller
+// and WithPriority). The context may also cancel the wait for the turn of the query.
+func EvalQueryContext(ctx context.Context, q interface{}, src *Col, result *map[int]struct{}) (err error) {
+	done, err := src.db.heavy.admit(ctx, false)
+	if err != nil {
+		return
+	}
+	defer done()
+	return src.query(q, result)
+}
+
+// Evaluate a query and put result into result map, without admission control of heavy operations.
+func (col *Col) query(q interface{}, result *map[int]struct{}) (err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	defer col.db.logSlowQuery(q, time.Now())
+	if err = col.checkFlags(COL_READ); err != nil {
+		return
+	}
+	return evalQuery(q, col, result, false)
+}
+
+// QueryHit is a document in query result.
+type QueryHit struct {
+	ID  int                    // Document ID
+	Doc map[string]interface{} // Document content
+}
+
+/*
+Evaluate a query and return IDs of the resulting documents: in order of their numbers if the query is a sort operation
+(e.g. {"sort": ["Age", "desc"], "limit": 10}), or ordered by document ID otherwise.
+*/
+func EvalQueryOrdered(q interface{}, src *Col) (ids []int, err error) {
+	done, err := src.db.heavy.admit(context.Background(), false)
+	if err != nil {
+		return
+	}
+	defer done()
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	defer src.db.logSlowQuery(q, time.Now())
+	if err = src.checkFlags(COL_READ); err != nil {
+		return
+	}
+	return src.orderedQuery(q)
+}
+
+// Evaluate a query and return IDs of the resulting documents in order, see EvalQueryOrdered. The caller must place
+// schema lock.
+func (col *Col) orderedQuery(q interface{}) (ids []int, err error) {
+	if expr, ok := q.(map[string]interface{}); ok && !hasOperation(expr, "eq", "has", "null", "all", "any", "n", "c", "int-from", "int from", ">=", "<=") {
+		if sortSpec, sorted := expr["sort"]; sorted {
+			if ids, err = sortedQuery(sortSpec, expr, col); err != nil {
+				return
+			} else if limit := col.db.Config.QueryMaxIDs; limit > 0 && len(ids) > limit {
+				return nil, dberr.New(dberr.ErrorQueryTooLarge, limit)
+			}
+			return
+		}
+	}
+	result := make(map[int]struct{})
+	if err = evalQuery(q, col, &result, false); err != nil {
+		return
+	}
+	ids = make([]int, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return
+}
+
+// Evaluate a query and return the resulting documents ordered by document ID, or in order of their numbers if the
+// query is a sort operation (see EvalQueryOrdered). Documents deleted while the query runs are left out of the result.
+func EvalQueryDocs(q interface{}, src *Col) (hits []QueryHit, err error) {
+	done, err := src.db.heavy.admit(context.Background(), false)
+	if err != nil {
+		return
+	}
+	defer done()
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	defer src.db.logSlowQuery(q, time.Now())
+	if err = src.checkFlags(COL_READ); err != nil {
+		return
+	}
+	return src.queryDocs(q)
+}
+
+// Evaluate a query and return the resulting documents in order, see EvalQueryDocs. The caller must place schema lock.
+func (col *Col) queryDocs(q interface{}) (hits []QueryHit, err error) {
+	ids, err := col.orderedQuery(q)
+	if err != nil {
+		return
+	}
+	hits = make([]QueryHit, 0, len(ids))
+	for _, id := range ids {
+		doc, err := col.read(id, false)
+		if dberr.Type(err) == dberr.ErrorNoDoc {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		hits = append(hits, QueryHit{ID: id, Doc: doc})
+	}
+	return
 }
 
 // TODO: How to bring back regex matcher?
-// TODO: How to bring back JSON parameterized query?
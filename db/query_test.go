@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"testing"
 
 	"github.com/HouzuoGuo/tiedot/dberr"
@@ -277,6 +278,35 @@ func TestQuery(t *testing.T) {
 	if !ensureMapHasKeys(q, ids[2], ids[4], ids[5]) {
 		t.Fatal(q)
 	}
+	// intersection of nested complement and union
+	q, err = runQuery(`{"n": [{"c": [{"n": ["all", {"eq": 1, "in": ["d"]}]}, "all"]}, [{"eq": 2, "in": ["d"]}, {"eq": 4, "in": ["c"]}]]}`, col)
+	if err != nil || !ensureMapHasKeys(q, ids[1], ids[3]) {
+		t.Fatal(q, err)
+	}
+	// set operations without sub-queries
+	if q, err = runQuery(`{"n": []}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	} else if q, err = runQuery(`{"c": []}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	} else if q, err = runQuery(`[]`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+	// intersection stops evaluating sub-queries once it is empty, but checks their indexes beforehand
+	if q, err = runQuery(`{"n": [{"eq": 999, "in": ["d"]}, {"eq": 1, "in": ["c"]}]}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	} else if _, err = runQuery(`{"n": [{"eq": 999, "in": ["d"]}, {"eq": 1, "in": ["not indexed"]}]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	} else if _, err = runQuery(`{"n": [{"eq": 999, "in": ["d"]}, [{"c": [{"has": ["not indexed"]}, "all"]}]]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	} else if _, err = runQuery(`{"n": [{"eq": 999, "in": ["d"]}, {"null": ["d"]}]}`, col); err == nil {
+		t.Fatal("Did not error")
+	} else if _, err = runQuery(`{"n": [{"eq": 999, "in": ["d"]}, {"c": "all"}]}`, col); dberr.Type(err) != dberr.ErrorExpectingSubQuery {
+		t.Fatal(err)
+	}
+	// not: complement of a sub-query and all documents
+	if q, err = runQuery(`{"c": [{"eq": 2, "in": ["d"]}, "all"]}`, col); err != nil || !ensureMapHasKeys(q, ids[0], ids[2], ids[4], ids[5], ids[6], ids[7]) {
+		t.Fatal(q, err)
+	}
 }
 func TestEvalUnionQueryErr(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
@@ -398,3 +428,272 @@ func TestNameIntExpInNotFormat(t *testing.T) {
 		t.Error("Expected error")
 	}
 }
+
+func TestEvalQueryParams(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"Name"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.Index([]string{"Age"}); err != nil {
+		t.Fatal(err)
+	}
+	joe, _ := col.Insert(map[string]interface{}{"Name": "Joe", "Age": 30})
+	dollar, _ := col.Insert(map[string]interface{}{"Name": "$1", "Age": 40})
+	ann, _ := col.Insert(map[string]interface{}{"Name": "Ann", "Age": 50})
+	q := map[string]interface{}{"n": []interface{}{
+		map[string]interface{}{"eq": "$1", "in": []interface{}{"Name"}},
+		map[string]interface{}{"int-from": "$2", "int-to": "$3", "in": []interface{}{"Age"}},
+	}}
+	result := make(map[int]struct{})
+	if err := EvalQueryParams(q, []interface{}{"Joe", 20, 35}, col, &result); err != nil || !ensureMapHasKeys(result, joe) {
+		t.Fatal(result, err)
+	}
+	// Parameter value is never interpreted as a placeholder or query
+	result = make(map[int]struct{})
+	if err := EvalQueryParams(q, []interface{}{"$1", 0, 100}, col, &result); err != nil || !ensureMapHasKeys(result, dollar) {
+		t.Fatal(result, err)
+	}
+	result = make(map[int]struct{})
+	if err := EvalQueryParams([]interface{}{
+		map[string]interface{}{"eq": "$1", "in": []interface{}{"Name"}},
+		map[string]interface{}{"c": []interface{}{"all", map[string]interface{}{"eq": "$1", "in": []interface{}{"Name"}}}},
+	}, []interface{}{"Ann"}, col, &result); err != nil || !ensureMapHasKeys(result, joe, dollar, ann) {
+		t.Fatal(result, err)
+	}
+	// Query is not modified by binding
+	if q["n"].([]interface{})[0].(map[string]interface{})["eq"] != "$1" {
+		t.Fatal(q)
+	}
+	if err := EvalQueryParams(q, []interface{}{"Joe"}, col, &result); err == nil || !strings.Contains(err.Error(), "$2") {
+		t.Fatal(err)
+	}
+}
+
+func TestEvalQueryDocs(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := col.Insert(map[string]interface{}{"a": i % 2, "i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hits, err := EvalQueryDocs(map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, col)
+	if err != nil || len(hits) != 5 {
+		t.Fatal(hits, err)
+	}
+	for i, hit := range hits {
+		if i > 0 && hits[i-1].ID >= hit.ID {
+			t.Fatal("Hits are not ordered by ID", hits)
+		}
+		if doc, err := col.Read(hit.ID); err != nil || doc["i"] != hit.Doc["i"] || hit.Doc["a"].(float64) != 1 {
+			t.Fatal(hit, doc, err)
+		}
+	}
+	// Non-existing documents are left out
+	if hits, err := EvalQueryDocs([]interface{}{"1", strconv.Itoa(hits[0].ID)}, col); err != nil || len(hits) != 1 {
+		t.Fatal(hits, err)
+	}
+	if _, err := EvalQueryDocs(map[string]interface{}{"eq": 1, "in": []interface{}{"b"}}, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	if err := db.Reopen("col", COL_WRITE); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EvalQueryDocs("all", col); dberr.Type(err) != dberr.ErrorColWriteOnly {
+		t.Fatal(err)
+	}
+}
+
+func TestNullValueQuery(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	docs := []map[string]interface{}{{"a": 1, "b": 1}, {"a": nil, "b": 2}, {"b": 3}, {"a": []interface{}{1, nil}}, {"a": "x"}}
+	ids := make([]int, len(docs))
+	for i, doc := range docs {
+		if ids[i], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Null values are found on index created with the option, including the documents inserted earlier
+	if err := col.IndexWithOptions([]string{"a"}, IndexOptions{IndexNull: true}); err != nil {
+		t.Fatal(err)
+	}
+	if opts, err := col.IndexOptionsOf([]string{"a"}); err != nil || !opts.IndexNull {
+		t.Fatal(opts, err)
+	}
+	if q, err := runQuery(`{"null": ["a"]}`, col); err != nil || len(q) != 3 || !ensureMapHasKeys(q, ids[1], ids[2], ids[3]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"null": ["a"], "limit": 1}`, col); err != nil || len(q) != 1 {
+		t.Fatal(q, err)
+	}
+	// Null entries are not mistaken for existing values
+	if q, err := runQuery(`{"has": ["a"]}`, col); err != nil || len(q) != 3 || !ensureMapHasKeys(q, ids[0], ids[3], ids[4]) {
+		t.Fatal(q, err)
+	}
+	// Index without the option cannot answer null queries
+	if _, err := runQuery(`{"null": ["b"]}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+	if _, err := runQuery(`{"null": ["c"]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	// Null entries follow document updates and deletes
+	if err := col.Update(ids[0], map[string]interface{}{"b": 1}); err != nil {
+		t.Fatal(err)
+	} else if err := col.Update(ids[2], map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	} else if err := col.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := runQuery(`{"null": ["a"]}`, col); err != nil || len(q) != 2 || !ensureMapHasKeys(q, ids[0], ids[3]) {
+		t.Fatal(q, err)
+	}
+	// The option survives reopening and scrubbing the collection
+	if err := db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, err = OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if q, err := runQuery(`{"null": ["a"]}`, db.Use("col")); err != nil || len(q) != 2 || !ensureMapHasKeys(q, ids[0], ids[3]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"n": [{"null": ["a"]}, {"eq": 1, "in": ["b"]}]}`, db.Use("col")); err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[0]) {
+		t.Fatal(q, err)
+	}
+}
+
+func TestMultiLookup(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"tags"}); err != nil {
+		t.Fatal(err)
+	}
+	docs := []map[string]interface{}{{"tags": []interface{}{"go", "db"}}, {"tags": []interface{}{"go"}}, {"tags": []interface{}{"db", "sql"}}, {"tags": "go"}}
+	ids := make([]int, len(docs))
+	for i, doc := range docs {
+		if ids[i], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q, err := runQuery(`{"all": ["go", "db"], "in": ["tags"]}`, col); err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[0]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"all": ["go", "db", "sql"], "in": ["tags"]}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"any": ["go", "sql"], "in": ["tags"]}`, col); err != nil || len(q) != 4 {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"any": ["go", "sql"], "in": ["tags"], "limit": 2}`, col); err != nil || len(q) != 2 {
+		t.Fatal(q, err)
+	}
+	if _, err := runQuery(`{"any": [], "in": ["tags"]}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+	if _, err := runQuery(`{"all": ["go"], "in": ["a"]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	// Values may be given as query parameter
+	result := make(map[int]struct{})
+	if err := EvalQueryParams(map[string]interface{}{"all": "$1", "in": []interface{}{"tags"}}, []interface{}{[]interface{}{"db", "sql"}}, col, &result); err != nil || len(result) != 1 || !ensureMapHasKeys(result, ids[2]) {
+		t.Fatal(result, err)
+	}
+}
+
+func TestQueryMaxIDs(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Config.QueryMaxIDs = 5
+	tooLarge := []interface{}{
+		"all",
+		map[string]interface{}{"has": []interface{}{"a"}},
+		map[string]interface{}{"int-from": 0, "int-to": 9, "in": []interface{}{"a"}},
+		// Union of small sets
+		[]interface{}{map[string]interface{}{"int-from": 0, "int-to": 3, "in": []interface{}{"a"}}, map[string]interface{}{"int-from": 4, "int-to": 7, "in": []interface{}{"a"}}},
+		// Intermediate set of an intersection
+		map[string]interface{}{"n": []interface{}{"all", map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}}},
+	}
+	for _, q := range tooLarge {
+		if err := EvalQuery(q, col, &map[int]struct{}{}); dberr.Type(err) != dberr.ErrorQueryTooLarge {
+			t.Fatal(q, err)
+		}
+	}
+	if err := EvalQueryParams(map[string]interface{}{"c": []interface{}{
+		map[string]interface{}{"int-from": "$1", "int-to": 3, "in": []interface{}{"a"}},
+		map[string]interface{}{"int-from": 4, "int-to": 7, "in": []interface{}{"a"}}}}, []interface{}{0}, col, &map[int]struct{}{}); dberr.Type(err) != dberr.ErrorQueryTooLarge {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"int-from": 0, "int-to": 4, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 5 {
+		t.Fatal(result, err)
+	}
+	db.Config.QueryMaxIDs = 0
+	if err := EvalQuery("all", col, &map[int]struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,429 @@
+// Query cursors reading results lazily.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	QUERY_CURSOR_BATCH = 1000 // Approximate number of document IDs a cursor over all documents (or index entries) fetches at a time.
+)
+
+// Query is a query of a collection along with the window of its result to be read, see Col.Query.
+type Query struct {
+	col   *Col
+	q     interface{}
+	skip  int
+	limit int
+}
+
+// Cursor reads the documents of a query result one at a time, see Query.Cursor.
+type Cursor struct {
+	col    *Col
+	fetch  func() ([]int, error)                 // Return the next batch of document IDs, or nil when there are no more
+	ids    []int                                 // Document IDs fetched and not read yet
+	match  func(doc map[string]interface{}) bool // Return false for documents fetched but not in the result, nil if all are
+	skip   int                                   // Number of documents yet to be skipped
+	left   int                                   // Number of documents yet to be read, -1 for unlimited
+	hit    QueryHit
+	err    error
+	closed bool
+}
+
+// Prepare a query of the collection, to be read through a cursor (see Query.Cursor).
+func (col *Col) Query(q interface{}) *Query {
+	return &Query{col: col, q: q}
+}
+
+// Skip the first n documents of the result.
+func (query *Query) Skip(n int) *Query {
+	query.skip = n
+	return query
+}
+
+// Read no more than n documents of the result after skipping, 0 for unlimited.
+func (query *Query) Limit(n int) *Query {
+	query.limit = n
+	return query
+}
+
+/*
+Return a cursor over the query result, reading documents one at a time by Cursor.Next. Only queries whose result can be
+read without collecting it in full are accepted:
+- "all" yields documents in storage order, fetching document IDs in batches of about QUERY_CURSOR_BATCH while the cursor
+advances (or all at once, ordered by ID, if data.Config.OrderedIteration is set).
+- A sort operation (e.g. {"sort": ["Age", "desc"]}) yields documents in order of their numbers, and only looks up as many
+documents as the window (skip and limit, or the limit of the operation) needs.
+- Lookups ("eq", "has", and "any") yield documents in index order, scanning the index one value ("eq" and "any") or one
+hash table partition ("has") at a time while the cursor advances.
+Other queries are rejected, evaluate them by EvalQuery or EvalQueryOrdered instead. Documents are read only as the
+cursor reaches them, and documents deleted meanwhile are left out.
+*/
+func (query *Query) Cursor() (cur *Cursor, err error) {
+	col := query.col
+	if query.skip < 0 || query.limit < 0 {
+		return nil, fmt.Errorf("Skip %d and limit %d must not be negative", query.skip, query.limit)
+	}
+	cur = &Cursor{col: col, skip: query.skip, left: -1}
+	if query.limit > 0 {
+		cur.left = query.limit
+	}
+	if all, ok := query.q.(string); ok && all == "all" {
+		col.db.schemaLock.RLock()
+		defer col.db.schemaLock.RUnlock()
+		if err = col.checkFlags(COL_READ); err != nil {
+			return nil, err
+		} else if col.db.Config.OrderedIteration {
+			cur.fetch = fetchOnce(col.sortedAllIDs())
+		} else {
+			cur.fetch = col.allIDsBatches()
+		}
+		return
+	}
+	expr, _ := query.q.(map[string]interface{})
+	if op := lookupOperation(expr); op != "" {
+		return query.lookupCursor(cur, op, expr)
+	}
+	// Operations taking precedence over sort (see evalOperation) make it another query
+	if _, sorted := expr["sort"]; !sorted || hasOperation(expr, "null", "all", "n", "c", "int-from", "int from", ">=", "<=") {
+		return nil, fmt.Errorf("Cursor reads \"all\", lookup, and sort queries only, but %v given", query.q)
+	}
+	if query.limit > 0 {
+		// The sort operation finds no more than the documents of the window
+		expr = sortWithin(expr, query.skip+query.limit)
+	}
+	done, err := col.db.heavy.admit(context.Background(), false)
+	if err != nil {
+		return
+	}
+	defer done()
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	defer col.db.logSlowQuery(query.q, time.Now())
+	if err = col.checkFlags(COL_READ); err != nil {
+		return nil, err
+	}
+	ids, err := sortedQuery(expr["sort"], expr, col)
+	if err != nil {
+		return nil, err
+	}
+	cur.fetch = fetchOnce(ids)
+	return
+}
+
+// Return the lookup operation ("eq", "has", or "any") the expression is evaluated by (see evalOperation), or "" if none.
+func lookupOperation(expr map[string]interface{}) string {
+	if hasOperation(expr, "eq") {
+		return "eq"
+	} else if hasOperation(expr, "has") {
+		return "has"
+	} else if hasOperation(expr, "any") && !hasOperation(expr, "null", "all") {
+		return "any"
+	}
+	return ""
+}
+
+// Set the cursor up to read the result of the lookup operation from the index as the cursor advances.
+func (query *Query) lookupCursor(cur *Cursor, op string, expr map[string]interface{}) (*Cursor, error) {
+	col := query.col
+	pathSpec, hasPath := expr["in"]
+	if op == "has" {
+		pathSpec, hasPath = expr["has"], true
+	}
+	if !hasPath {
+		return nil, errors.New("Missing lookup path `in`")
+	}
+	vecPathInterface, ok := pathSpec.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expecting vector path, but %v given", pathSpec)
+	}
+	vecPath := make([]string, len(vecPathInterface))
+	for i, v := range vecPathInterface {
+		vecPath[i] = fmt.Sprint(v)
+	}
+	// The limit of the operation ends the result, regardless of the window
+	if limit, hasLimit := expr["limit"]; hasLimit {
+		intLimit := 0
+		if floatLimit, ok := limit.(float64); ok {
+			intLimit = int(floatLimit)
+		} else if intLimit, ok = limit.(int); !ok {
+			return nil, dberr.New(dberr.ErrorExpectingInt, "limit", limit)
+		}
+		if left := intLimit - cur.skip; intLimit > 0 && (cur.left < 0 || left < cur.left) {
+			if cur.left = left; left < 0 {
+				cur.left = 0
+			}
+		}
+	}
+	idxName := strings.Join(vecPath, INDEX_PATH_SEP)
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err := col.checkFlags(COL_READ); err != nil {
+		return nil, err
+	} else if _, indexed := col.indexPaths[idxName]; !indexed {
+		return nil, dberr.New(dberr.ErrorNeedIndex, idxName, expr)
+	} else if _, building := col.building[idxName]; building {
+		return nil, dberr.New(dberr.ErrorIndexBuilding, vecPath, expr)
+	}
+	opts := col.indexOpts[idxName]
+	if op == "has" {
+		cur.fetch = col.indexBatches(idxName)
+		cur.match = func(doc map[string]interface{}) bool {
+			// Null entries stand for null or missing values
+			for _, v := range opts.values(doc, vecPath) {
+				if _, ok := opts.canonical(v); ok && v != nil {
+					return true
+				}
+			}
+			return false
+		}
+		return cur, nil
+	}
+	values := []interface{}{expr["eq"]}
+	if op == "any" {
+		if values, ok = expr["any"].([]interface{}); !ok || len(values) == 0 {
+			return nil, fmt.Errorf("Expecting a vector of lookup values, but %v given", expr["any"])
+		}
+	}
+	canons := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		// Values that cannot be on the index match nothing
+		if canon, ok := opts.canonical(v); ok {
+			canons = append(canons, canon)
+		}
+	}
+	cur.fetch = col.valueBatches(idxName, opts, canons)
+	cur.match = func(doc map[string]interface{}) bool {
+		// Filter out hash collisions
+		for _, v := range opts.values(doc, vecPath) {
+			if vCanon, ok := opts.canonical(v); ok {
+				for _, canon := range canons {
+					if vCanon == canon {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	return cur, nil
+}
+
+// Return a function fetching the IDs as one batch.
+func fetchOnce(ids []int) func() ([]int, error) {
+	return func() ([]int, error) {
+		batch := ids
+		ids = nil
+		return batch, nil
+	}
+}
+
+// Return a copy of the sort expression limited to n documents, or the expression itself if its limit is lower.
+func sortWithin(expr map[string]interface{}, n int) map[string]interface{} {
+	switch limit := expr["limit"].(type) {
+	case float64:
+		if int(limit) <= n {
+			return expr
+		}
+	case int:
+		if limit <= n {
+			return expr
+		}
+	}
+	limited := make(map[string]interface{}, len(expr)+1)
+	for key, val := range expr {
+		limited[key] = val
+	}
+	limited["limit"] = n
+	return limited
+}
+
+// Return a function fetching IDs of all documents of the collection, one batch at a time.
+func (col *Col) allIDsBatches() func() ([]int, error) {
+	partNum, rangeNum, numRanges := 0, 0, 0
+	return func() ([]int, error) {
+		col.db.schemaLock.RLock()
+		defer col.db.schemaLock.RUnlock()
+		if err := col.checkCursor(); err != nil {
+			return nil, err
+		}
+		for partNum < col.db.numParts {
+			part := col.parts[partNum]
+			part.DataLock.RLock()
+			if numRanges == 0 {
+				if numRanges = part.ApproxDocCount() / QUERY_CURSOR_BATCH; numRanges < 1 {
+					numRanges = 1
+				}
+			}
+			ids := part.IDsInRange(rangeNum, numRanges)
+			part.DataLock.RUnlock()
+			if rangeNum++; rangeNum == numRanges {
+				partNum, rangeNum, numRanges = partNum+1, 0, 0
+			}
+			if len(ids) > 0 {
+				return ids, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+// Return a function fetching IDs of the documents indexed under the values (in canonical form of the index), one value
+// at a time. A document having several of the values is fetched once.
+func (col *Col) valueBatches(idxName string, opts IndexOptions, canons []interface{}) func() ([]int, error) {
+	seen := make(map[int]struct{})
+	return func() ([]int, error) {
+		col.db.schemaLock.RLock()
+		defer col.db.schemaLock.RUnlock()
+		if err := col.checkCursorIndex(idxName); err != nil {
+			return nil, err
+		}
+		for len(canons) > 0 {
+			ids := unseenIDs(seen, col.hashScan(idxName, opts.key(canons[0]), 0))
+			if canons = canons[1:]; len(ids) > 0 {
+				return ids, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+// Return a function fetching IDs of the documents on the index, one batch of about QUERY_CURSOR_BATCH entries of a hash
+// table partition at a time. A document having several values is fetched once.
+func (col *Col) indexBatches(idxName string) func() ([]int, error) {
+	seen := make(map[int]struct{})
+	partNum, rangeNum, numRanges := 0, 0, 0
+	return func() ([]int, error) {
+		col.db.schemaLock.RLock()
+		defer col.db.schemaLock.RUnlock()
+		if err := col.checkCursorIndex(idxName); err != nil {
+			return nil, err
+		}
+		for partNum < col.indexParts(idxName) {
+			if numRanges == 0 {
+				if numRanges = col.approxDocCount(false) / col.indexParts(idxName) / QUERY_CURSOR_BATCH; numRanges < 1 {
+					numRanges = 1
+				}
+			}
+			ht := col.hts[partNum][idxName]
+			ht.Lock.RLock()
+			_, ids := ht.GetPartition(rangeNum, numRanges)
+			ht.Lock.RUnlock()
+			if rangeNum++; rangeNum == numRanges {
+				partNum, rangeNum, numRanges = partNum+1, 0, 0
+			}
+			if ids = unseenIDs(seen, ids); len(ids) > 0 {
+				return ids, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+// Return the IDs not seen before, and remember them as seen.
+func unseenIDs(seen map[int]struct{}, ids []int) []int {
+	unseen := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if _, exists := seen[id]; !exists {
+			seen[id] = struct{}{}
+			unseen = append(unseen, id)
+		}
+	}
+	return unseen
+}
+
+// Return an error if the collection has been dropped or reopened since the cursor was made, or is no longer readable.
+// The caller must place schema lock.
+func (col *Col) checkCursor() error {
+	if col.db.cols[col.name] != col {
+		return fmt.Errorf("Collection %s has been dropped or reopened", col.name)
+	}
+	return col.checkFlags(COL_READ)
+}
+
+// Return an error like checkCursor does, or if the index is no longer ready. The caller must place schema lock.
+func (col *Col) checkCursorIndex(idxName string) error {
+	if err := col.checkCursor(); err != nil {
+		return err
+	} else if _, indexed := col.indexPaths[idxName]; !indexed {
+		return fmt.Errorf("Path %v is no longer indexed", strings.Split(idxName, INDEX_PATH_SEP))
+	} else if _, building := col.building[idxName]; building {
+		return dberr.New(dberr.ErrorIndexBuilding, strings.Split(idxName, INDEX_PATH_SEP), "cursor")
+	}
+	return nil
+}
+
+// Advance to the next document of the result, return false if there is none or upon error (see Err).
+func (cur *Cursor) Next() bool {
+	for !cur.closed && cur.err == nil && cur.left != 0 {
+		if len(cur.ids) == 0 {
+			if cur.ids, cur.err = cur.fetch(); cur.err != nil || len(cur.ids) == 0 {
+				break
+			}
+		}
+		var id int
+		if cur.match != nil {
+			// Only the documents in the result count towards skip
+			id, cur.ids = cur.ids[0], cur.ids[1:]
+		} else if cur.skip >= len(cur.ids) {
+			cur.skip -= len(cur.ids)
+			cur.ids = nil
+			continue
+		} else {
+			id = cur.ids[cur.skip]
+			cur.ids, cur.skip = cur.ids[cur.skip+1:], 0
+		}
+		doc, err := cur.read(id)
+		if dberr.Type(err) == dberr.ErrorNoDoc {
+			continue
+		} else if err != nil {
+			cur.err = err
+			break
+		} else if cur.match != nil && !cur.match(doc) {
+			continue
+		} else if cur.skip > 0 {
+			cur.skip--
+			continue
+		}
+		cur.hit = QueryHit{ID: id, Doc: doc}
+		if cur.left > 0 {
+			cur.left--
+		}
+		return true
+	}
+	cur.Close()
+	return false
+}
+
+// Read a document of the result, return an error if the collection is gone or is no longer readable.
+func (cur *Cursor) read(id int) (map[string]interface{}, error) {
+	col := cur.col
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err := col.checkCursor(); err != nil {
+		return nil, err
+	}
+	return col.read(id, false)
+}
+
+// Return the document the cursor is at.
+func (cur *Cursor) Hit() QueryHit {
+	return cur.hit
+}
+
+// Return the error that stopped the cursor, nil if the result has been read through or the cursor was closed.
+func (cur *Cursor) Err() error {
+	return cur.err
+}
+
+// Release the document IDs held by the cursor; Next returns false afterwards. Closing a cursor again does nothing.
+func (cur *Cursor) Close() {
+	cur.closed, cur.ids, cur.fetch, cur.match = true, nil, nil, nil
+}
@@ -0,0 +1,210 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Read the cursor through, return the IDs of its documents in order.
+func readCursor(t *testing.T, query *Query) []int {
+	cur, err := query.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cur.Close()
+	ids := make([]int, 0)
+	for cur.Next() {
+		if cur.Hit().Doc == nil {
+			t.Fatal("Missing document", cur.Hit())
+		}
+		ids = append(ids, cur.Hit().ID)
+	}
+	if err := cur.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestQueryCursor(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.IndexWithOptions([]string{"Age"}, IndexOptions{Type: INDEX_TYPE_NUMBER}); err != nil {
+		t.Fatal(err)
+	}
+	byAge := make([]int, 50)
+	for age := 0; age < 50; age++ {
+		if byAge[age], err = col.Insert(map[string]interface{}{"Age": age}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// All documents, in batches
+	if ids := readCursor(t, col.Query("all")); len(ids) != 50 {
+		t.Fatal(ids)
+	}
+	all := readCursor(t, col.Query("all"))
+	if ids := readCursor(t, col.Query("all").Skip(45)); len(ids) != 5 || ids[0] != all[45] {
+		t.Fatal(ids)
+	} else if ids := readCursor(t, col.Query("all").Skip(10).Limit(3)); len(ids) != 3 || ids[0] != all[10] || ids[2] != all[12] {
+		t.Fatal(ids)
+	}
+	// Sort query window
+	sortDesc := map[string]interface{}{"sort": []interface{}{"Age", "desc"}}
+	if ids := readCursor(t, col.Query(sortDesc).Skip(2).Limit(3)); len(ids) != 3 || ids[0] != byAge[47] || ids[1] != byAge[46] || ids[2] != byAge[45] {
+		t.Fatal(ids)
+	} else if sortDesc["limit"] != nil {
+		t.Fatal("Query was modified", sortDesc)
+	}
+	sortAsc := map[string]interface{}{"sort": []interface{}{"Age"}, "limit": 2.0}
+	if ids := readCursor(t, col.Query(sortAsc).Limit(10)); len(ids) != 2 || ids[0] != byAge[0] || ids[1] != byAge[1] {
+		t.Fatal(ids)
+	}
+	// Other queries are not read lazily, hence rejected
+	for _, q := range []interface{}{
+		map[string]interface{}{">=": 10, "<=": 19, "in": []interface{}{"Age"}},
+		map[string]interface{}{"sort": []interface{}{"Age"}, "int-from": 1, "int-to": 2, "in": []interface{}{"Age"}},
+		map[string]interface{}{"all": []interface{}{1, 2}, "any": []interface{}{1, 2}, "in": []interface{}{"Age"}},
+		map[string]interface{}{"n": []interface{}{sortDesc, "all"}},
+		[]interface{}{"all"},
+		"1",
+	} {
+		if _, err := col.Query(q).Cursor(); err == nil {
+			t.Fatal("Did not reject", q)
+		}
+	}
+	if _, err := col.Query(map[string]interface{}{"sort": []interface{}{"Nothing"}}).Cursor(); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	// Deleted documents are left out
+	cur, err := col.Query(sortDesc).Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := col.Delete(byAge[49]); err != nil {
+		t.Fatal(err)
+	} else if !cur.Next() || cur.Hit().ID != byAge[48] {
+		t.Fatal(cur.Hit(), cur.Err())
+	}
+	cur.Close()
+	if cur.Next() || cur.Err() != nil {
+		t.Fatal("Closed cursor moved on")
+	}
+	// Dropped collection stops the cursor
+	if cur, err = col.Query("all").Cursor(); err != nil {
+		t.Fatal(err)
+	} else if err := db.Drop("col"); err != nil {
+		t.Fatal(err)
+	} else if cur.Next() || cur.Err() == nil {
+		t.Fatal("Did not fail on dropped collection")
+	}
+	if _, err := col.Query("all").Skip(-1).Cursor(); err == nil {
+		t.Fatal("Did not fail on negative skip")
+	}
+}
+
+// Return the IDs of the query result in ascending order.
+func sortedResult(t *testing.T, q interface{}, col *Col) []int {
+	result := make(map[int]struct{})
+	if err := EvalQuery(q, col, &result); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func TestQueryCursorLookup(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(path.Join(TEST_DATA_DIR, PART_NUM_FILE), []byte("4"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"Tags"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40; i++ {
+		doc := map[string]interface{}{"Tags": []interface{}{fmt.Sprint("t", i%4), "common"}}
+		if i%5 == 0 {
+			doc = map[string]interface{}{"Other": i}
+		}
+		if _, err := col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The cursor reads the same documents as the evaluated query, each once
+	for _, q := range []interface{}{
+		map[string]interface{}{"eq": "common", "in": []interface{}{"Tags"}},
+		map[string]interface{}{"eq": "t1", "in": []interface{}{"Tags"}, "sort": []interface{}{"Tags"}},
+		map[string]interface{}{"any": []interface{}{"t0", "t1", "common"}, "in": []interface{}{"Tags"}},
+		map[string]interface{}{"has": []interface{}{"Tags"}},
+	} {
+		ids := readCursor(t, col.Query(q))
+		sort.Ints(ids)
+		if expected := sortedResult(t, q, col); len(ids) != len(expected) || len(ids) == 0 {
+			t.Fatal(q, ids, expected)
+		} else {
+			for i := range ids {
+				if ids[i] != expected[i] {
+					t.Fatal(q, ids, expected)
+				}
+			}
+		}
+	}
+	// Window and the limit of the operation
+	common := map[string]interface{}{"eq": "common", "in": []interface{}{"Tags"}}
+	all := readCursor(t, col.Query(common))
+	if ids := readCursor(t, col.Query(common).Skip(30)); len(ids) != 2 || ids[0] != all[30] {
+		t.Fatal(ids)
+	} else if ids := readCursor(t, col.Query(common).Skip(3).Limit(4)); len(ids) != 4 || ids[0] != all[3] || ids[3] != all[6] {
+		t.Fatal(ids)
+	}
+	limited := map[string]interface{}{"has": []interface{}{"Tags"}, "limit": 3}
+	if ids := readCursor(t, col.Query(limited).Skip(1).Limit(10)); len(ids) != 2 {
+		t.Fatal(ids)
+	} else if ids := readCursor(t, col.Query(limited).Skip(5)); len(ids) != 0 {
+		t.Fatal(ids)
+	}
+	if ids := readCursor(t, col.Query(map[string]interface{}{"eq": "none", "in": []interface{}{"Tags"}})); len(ids) != 0 {
+		t.Fatal(ids)
+	}
+	if _, err := col.Query(map[string]interface{}{"eq": 1, "in": []interface{}{"Other"}}).Cursor(); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	// Removed index stops the cursor
+	cur, err := col.Query(common).Cursor()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := col.Unindex([]string{"Tags"}); err != nil {
+		t.Fatal(err)
+	} else if cur.Next() || cur.Err() == nil {
+		t.Fatal("Did not fail on removed index")
+	}
+}
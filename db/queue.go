@@ -0,0 +1,185 @@
+// Persistent job queue on top of a collection.
+
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	QUEUE_STATUS_ATTR  = "_status"  // Document attribute holding message status, it is indexed for counting messages.
+	QUEUE_PAYLOAD_ATTR = "_payload" // Document attribute holding message payload.
+	QUEUE_SEQ_ATTR     = "_seq"     // Document attribute holding message sequence number, it decides the order of messages and has a number index.
+	QUEUE_UNTIL_ATTR   = "_until"   // Document attribute holding the time (Unix milliseconds) a popped message becomes visible again.
+	QUEUE_RECEIPT_ATTR = "_receipt" // Document attribute holding the receipt of the latest pop of a message.
+
+	QUEUE_READY   = "ready"   // Status of a message waiting to be popped.
+	QUEUE_PENDING = "pending" // Status of a popped message waiting to be acknowledged.
+
+	QUEUE_SEQ_COUNTER = "_queue_" // Prefix of the counter name that gives out message sequence numbers of a queue.
+	QUEUE_POP_BATCH   = 16        // Number of messages Pop looks at first, doubled until a visible message is found.
+)
+
+// Queue is a persistent first-in-first-out queue of messages, every message is stored as a document
+// {"_status": "ready", "_seq": 1, "_payload": payload}.
+// A popped message remains in the queue until it is acknowledged; if it is not acknowledged within the visibility
+// timeout, it becomes visible to Pop again. Every pop gives the message a new receipt, and only the latest receipt
+// acknowledges the message, so that a consumer whose timeout has passed cannot remove a message redelivered to another.
+// Queues are unbounded: Push does not limit the number of messages, which stay in the collection until acknowledged.
+type Queue struct {
+	col  *Col
+	name string
+}
+
+// QueueMessage is a message popped from a queue.
+type QueueMessage struct {
+	ID      int         // Document ID of the message
+	Receipt string      // Receipt of this pop, used for acknowledging the message
+	Payload interface{} // Message payload
+}
+
+// Use the collection as a queue, the collection and its status and sequence number indexes are created if necessary.
+func (db *DB) Queue(name string) (*Queue, error) {
+	col, err := db.UseOrCreate(name)
+	if err != nil {
+		return nil, err
+	}
+	db.queueLock.Lock()
+	defer db.queueLock.Unlock()
+	indexed := make(map[string]bool)
+	for _, idxPath := range col.AllIndexes() {
+		if len(idxPath) == 1 {
+			indexed[idxPath[0]] = true
+		}
+	}
+	if !indexed[QUEUE_STATUS_ATTR] {
+		if err := col.Index([]string{QUEUE_STATUS_ATTR}); err != nil {
+			return nil, err
+		}
+	}
+	if !indexed[QUEUE_SEQ_ATTR] {
+		if err := col.IndexWithOptions([]string{QUEUE_SEQ_ATTR}, IndexOptions{Type: INDEX_TYPE_NUMBER}); err != nil {
+			return nil, err
+		}
+	}
+	return &Queue{col: col, name: name}, nil
+}
+
+// Return the collection storing the messages.
+func (queue *Queue) Col() *Col {
+	return queue.col
+}
+
+// Push a message to the end of the queue, return its document ID. The payload must be serializable into JSON.
+func (queue *Queue) Push(payload interface{}) (int, error) {
+	seq, err := queue.col.db.Counter(QUEUE_SEQ_COUNTER + queue.name).Incr(1)
+	if err != nil {
+		return 0, err
+	}
+	return queue.col.Insert(map[string]interface{}{QUEUE_STATUS_ATTR: QUEUE_READY, QUEUE_SEQ_ATTR: seq, QUEUE_PAYLOAD_ATTR: payload})
+}
+
+/*
+Pop the first visible message and hide it from Pop for the duration of visibility timeout. Return nil if there is
+no visible message. Messages are visited in order of their sequence numbers on the sorted index, hence only the popped
+message and the hidden messages in front of it are read.
+*/
+func (queue *Queue) Pop(visibility time.Duration) (*QueueMessage, error) {
+	queue.col.db.queueLock.Lock()
+	defer queue.col.db.queueLock.Unlock()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	visited := 0
+	for limit := QUEUE_POP_BATCH; ; limit *= 2 {
+		queue.col.db.schemaLock.RLock()
+		if err := queue.col.checkFlags(COL_RDWR); err != nil {
+			queue.col.db.schemaLock.RUnlock()
+			return nil, err
+		}
+		ids := queue.col.sortedIDs(QUEUE_SEQ_ATTR, false, limit)
+		queue.col.db.schemaLock.RUnlock()
+		for _, id := range ids[visited:] {
+			doc, err := queue.col.Read(id)
+			if err != nil {
+				continue
+			} else if doc[QUEUE_STATUS_ATTR] == QUEUE_PENDING {
+				if until, _ := doc[QUEUE_UNTIL_ATTR].(float64); int64(until) > now {
+					continue
+				}
+			}
+			receipt := make([]byte, 16)
+			if _, err := rand.Read(receipt); err != nil {
+				return nil, err
+			}
+			doc[QUEUE_STATUS_ATTR] = QUEUE_PENDING
+			doc[QUEUE_UNTIL_ATTR] = now + int64(visibility/time.Millisecond)
+			doc[QUEUE_RECEIPT_ATTR] = hex.EncodeToString(receipt)
+			if err := queue.col.Update(id, doc); err != nil {
+				return nil, err
+			}
+			return &QueueMessage{ID: id, Receipt: doc[QUEUE_RECEIPT_ATTR].(string), Payload: doc[QUEUE_PAYLOAD_ATTR]}, nil
+		}
+		if len(ids) < limit {
+			return nil, nil
+		}
+		visited = len(ids)
+	}
+}
+
+// Read a popped message and return ErrorStaleReceipt unless the receipt is of its latest pop. The caller must hold
+// queue lock.
+func (queue *Queue) popped(id int, receipt string) (map[string]interface{}, error) {
+	doc, err := queue.col.Read(id)
+	if err != nil {
+		return nil, err
+	} else if doc[QUEUE_STATUS_ATTR] != QUEUE_PENDING || doc[QUEUE_RECEIPT_ATTR] != receipt {
+		return nil, dberr.New(dberr.ErrorStaleReceipt, id)
+	}
+	return doc, nil
+}
+
+// Acknowledge a popped message by the receipt of its latest pop, and remove it from the queue.
+func (queue *Queue) Ack(id int, receipt string) error {
+	queue.col.db.queueLock.Lock()
+	defer queue.col.db.queueLock.Unlock()
+	if _, err := queue.popped(id, receipt); err != nil {
+		return err
+	}
+	return queue.col.Delete(id)
+}
+
+// Give up a popped message by the receipt of its latest pop, making it visible to Pop again right away.
+func (queue *Queue) Nack(id int, receipt string) error {
+	queue.col.db.queueLock.Lock()
+	defer queue.col.db.queueLock.Unlock()
+	doc, err := queue.popped(id, receipt)
+	if err != nil {
+		return err
+	}
+	doc[QUEUE_STATUS_ATTR] = QUEUE_READY
+	delete(doc, QUEUE_UNTIL_ATTR)
+	delete(doc, QUEUE_RECEIPT_ATTR)
+	return queue.col.Update(id, doc)
+}
+
+// Return number of messages in the queue, including popped messages that are not yet acknowledged. Every message has
+// one entry on the status index, hence messages are counted there without being read.
+func (queue *Queue) Len() (count int) {
+	col := queue.col
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if _, indexed := col.indexPaths[QUEUE_STATUS_ATTR]; !indexed || col.checkFlags(COL_READ) != nil {
+		return 0
+	}
+	for i := 0; i < col.indexParts(QUEUE_STATUS_ATTR); i++ {
+		ht := col.hts[i][QUEUE_STATUS_ATTR]
+		ht.Lock.RLock()
+		keys, _ := ht.GetPartition(0, 1)
+		count += len(keys)
+		ht.Lock.RUnlock()
+	}
+	return
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Let the visibility timeout of a popped message pass.
+func expireMessage(t *testing.T, queue *Queue, id int) {
+	doc, err := queue.Col().Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc[QUEUE_UNTIL_ATTR] = 0
+	if err := queue.Col().Update(id, doc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	queue, err := db.Queue("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := queue.Pop(time.Minute); err != nil || msg != nil {
+		t.Fatal(msg, err)
+	}
+	for _, payload := range []string{"a", "b", "c"} {
+		if _, err := queue.Push(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Messages come out in the order they were pushed
+	first, err := queue.Pop(time.Minute)
+	if err != nil || first.Payload != "a" {
+		t.Fatal(first, err)
+	}
+	second, err := queue.Pop(time.Minute)
+	if err != nil || second.Payload != "b" {
+		t.Fatal(second, err)
+	}
+	if err := queue.Ack(first.ID, first.Receipt); err != nil {
+		t.Fatal(err)
+	}
+	if queue.Len() != 2 {
+		t.Fatal(queue.Len())
+	}
+	if msg, err := queue.Pop(time.Minute); err != nil || msg.Payload != "c" {
+		t.Fatal(msg, err)
+	}
+	if msg, err := queue.Pop(time.Minute); err != nil || msg != nil {
+		t.Fatal(msg, err)
+	}
+	// Unacknowledged message becomes visible after timeout
+	expireMessage(t, queue, second.ID)
+	again, err := queue.Pop(time.Minute)
+	if err != nil || again == nil || again.Payload != "b" || again.ID != second.ID || again.Receipt == second.Receipt {
+		t.Fatal(again, err)
+	}
+	// Only the latest receipt acknowledges the message
+	if err := queue.Ack(second.ID, second.Receipt); dberr.Type(err) != dberr.ErrorStaleReceipt {
+		t.Fatal(err)
+	} else if err := queue.Nack(second.ID, second.Receipt); dberr.Type(err) != dberr.ErrorStaleReceipt {
+		t.Fatal(err)
+	} else if err := queue.Nack(again.ID, again.Receipt); err != nil {
+		t.Fatal(err)
+	} else if err := queue.Ack(again.ID, again.Receipt); dberr.Type(err) != dberr.ErrorStaleReceipt {
+		t.Fatal(err)
+	}
+	// A message given up is visible right away
+	if msg, err := queue.Pop(time.Minute); err != nil || msg == nil || msg.ID != second.ID {
+		t.Fatal(msg, err)
+	} else if err := queue.Ack(msg.ID, msg.Receipt); err != nil {
+		t.Fatal(err)
+	} else if queue.Len() != 1 {
+		t.Fatal(queue.Len())
+	}
+	// Concurrent consumers never receive the same message
+	queue2, err := db.Queue("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if _, err := queue2.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := make(map[int]struct{})
+	lock := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				msg, err := queue2.Pop(time.Minute)
+				if err != nil {
+					t.Error(err)
+					return
+				} else if msg == nil {
+					return
+				}
+				lock.Lock()
+				if _, dup := received[msg.ID]; dup {
+					t.Error("Duplicated", msg)
+				}
+				received[msg.ID] = struct{}{}
+				lock.Unlock()
+				if err := queue2.Ack(msg.ID, msg.Receipt); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(received) != 50 || queue.Len() != 1 {
+		t.Fatal(len(received), queue.Len())
+	}
+}
+
+func TestQueuePopSkipsHidden(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	queue, err := db.Queue("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// More hidden messages than a batch are in front of the visible ones
+	for i := 0; i < 3*QUEUE_POP_BATCH; i++ {
+		if _, err := queue.Push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3*QUEUE_POP_BATCH; i++ {
+		if msg, err := queue.Pop(time.Minute); err != nil || msg == nil || msg.Payload != float64(i) {
+			t.Fatal(i, msg, err)
+		}
+	}
+	if msg, err := queue.Pop(time.Minute); err != nil || msg != nil {
+		t.Fatal(msg, err)
+	}
+	if _, err := queue.Push("last"); err != nil {
+		t.Fatal(err)
+	} else if msg, err := queue.Pop(time.Minute); err != nil || msg == nil || msg.Payload != "last" {
+		t.Fatal(msg, err)
+	}
+}
@@ -0,0 +1,225 @@
+// Number range queries assisted by sorted index keys.
+
+package db
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+/*
+Look for indexed numbers no less than ">=" and no greater than "<=", either bound may be left out, e.g.
+{">=": 18, "<=": 65, "in": ["Age"]}. The path must have an index of number type. Optional "limit" caps the number of
+documents found, visiting the numbers in ascending order.
+*/
+func NumberRange(expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	path, hasPath := expr["in"]
+	if !hasPath {
+		return dberr.New(dberr.ErrorMissing, "in")
+	}
+	vecPath := make([]string, 0)
+	if vecPathInterface, ok := path.([]interface{}); ok {
+		for _, v := range vecPathInterface {
+			vecPath = append(vecPath, fmt.Sprint(v))
+		}
+	} else {
+		return fmt.Errorf("Expecting vector path `in`, but %v given", path)
+	}
+	intLimit := 0
+	if limit, hasLimit := expr["limit"]; hasLimit {
+		if floatLimit, ok := limit.(float64); ok {
+			intLimit = int(floatLimit)
+		} else if _, ok := limit.(int); ok {
+			intLimit = limit.(int)
+		} else {
+			return dberr.New(dberr.ErrorExpectingInt, "limit", limit)
+		}
+	}
+	from, to := math.Inf(-1), math.Inf(1)
+	for _, bound := range []struct {
+		op  string
+		num *float64
+	}{{">=", &from}, {"<=", &to}} {
+		if val, exists := expr[bound.op]; exists {
+			num, isNum := toFloat(val)
+			if !isNum || math.IsNaN(num) {
+				return fmt.Errorf("Expecting `%s` as a number, but %v given", bound.op, val)
+			}
+			*bound.num = num
+		}
+	}
+	idxName := strings.Join(vecPath, INDEX_PATH_SEP)
+	if _, indexed := src.indexPaths[idxName]; !indexed {
+		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
+	} else if _, building := src.building[idxName]; building {
+		return dberr.New(dberr.ErrorIndexBuilding, vecPath, expr)
+	} else if src.indexOpts[idxName].Type != INDEX_TYPE_NUMBER {
+		return fmt.Errorf("Range query %v needs an index of number type on %v", expr, vecPath)
+	}
+	return src.numberRange(idxName, from, to, false, false, intLimit, result)
+}
+
+/*
+Put documents having numbers (integers only if integral is set) within [from, to] on the number index into result, up
+to limit documents (0 for unlimited) visiting the numbers in ascending order, or descending order if desc is set.
+Number keys are ordered, hence the range of keys is looked up from the sorted index of each partition. Unless integral
+is set, only documents of the boundary keys are verified, as the boundary keys are shared by numbers outside of the
+range.
+*/
+func (col *Col) numberRange(idxName string, from, to float64, desc, integral bool, limit int, result *map[int]struct{}) error {
+	if from > to {
+		return nil
+	}
+	fromKey, toKey := NumberKey(from), NumberKey(to)
+	var keys, ids []int
+	for partNum := 0; partNum < col.indexParts(idxName); partNum++ {
+		ht := col.hts[partNum][idxName]
+		ht.Lock.RLock()
+		partKeys, partIDs := ht.Range(fromKey, toKey)
+		ht.Lock.RUnlock()
+		keys = append(keys, partKeys...)
+		ids = append(ids, partIDs...)
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		ka, kb := keys[order[a]], keys[order[b]]
+		if ka == kb {
+			return ids[order[a]] < ids[order[b]]
+		}
+		return ka < kb != desc
+	})
+	opts := col.indexOpts[idxName]
+	found := 0
+	for _, i := range order {
+		key, id := keys[i], ids[i]
+		if _, dup := (*result)[id]; dup {
+			continue
+		} else if limit > 0 && found == limit {
+			break
+		} else if integral || key == fromKey || key == toKey || opts.IndexNull && key == indexNullKey {
+			if !col.hasNumberIn(idxName, id, from, to, integral) {
+				continue
+			}
+		}
+		(*result)[id] = struct{}{}
+		found++
+	}
+	return col.checkQuerySize(*result)
+}
+
+// Return true if the document has a number (an integer if integral is set) within [from, to] at the index path.
+func (col *Col) hasNumberIn(idxName string, id int, from, to float64, integral bool) bool {
+	doc, err := col.read(id, false)
+	if err != nil {
+		return false
+	}
+	opts := col.indexOpts[idxName]
+	for _, v := range opts.values(doc, col.indexPaths[idxName]) {
+		canon, ok := opts.canonical(v)
+		if !ok {
+			continue
+		} else if num := canon.(float64); num >= from && num <= to && (!integral || num == math.Trunc(num)) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Look for documents having the lowest numbers at the path, or the highest if the direction is "desc", e.g.
+{"sort": ["Age", "desc"], "limit": 10} finds the 10 oldest. The path must have an index of number type, and documents
+without a number at the path are not found. Without "limit", all documents on the index are found. The result set does
+not carry the order, use EvalQueryOrdered or EvalQueryDocs to receive the documents in order.
+*/
+func SortedLookup(sortSpec interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	ids, err := sortedQuery(sortSpec, expr, src)
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		(*result)[id] = struct{}{}
+	}
+	return src.checkQuerySize(*result)
+}
+
+// Return IDs of documents found by the sort operation, in order of their numbers.
+func sortedQuery(sortSpec interface{}, expr map[string]interface{}, src *Col) ([]int, error) {
+	keys, err := ParseSortKeys([]interface{}{sortSpec})
+	if err != nil {
+		return nil, err
+	}
+	intLimit := 0
+	if limit, hasLimit := expr["limit"]; hasLimit {
+		if floatLimit, ok := limit.(float64); ok {
+			intLimit = int(floatLimit)
+		} else if _, ok := limit.(int); ok {
+			intLimit = limit.(int)
+		} else {
+			return nil, dberr.New(dberr.ErrorExpectingInt, "limit", limit)
+		}
+	}
+	idxName := strings.Join(keys[0].Path, INDEX_PATH_SEP)
+	if _, indexed := src.indexPaths[idxName]; !indexed {
+		return nil, dberr.New(dberr.ErrorNeedIndex, keys[0].Path, expr)
+	} else if _, building := src.building[idxName]; building {
+		return nil, dberr.New(dberr.ErrorIndexBuilding, keys[0].Path, expr)
+	} else if src.indexOpts[idxName].Type != INDEX_TYPE_NUMBER {
+		return nil, fmt.Errorf("Sort %v needs an index of number type on %v", expr, keys[0].Path)
+	}
+	return src.sortedIDs(idxName, keys[0].Descending, intLimit), nil
+}
+
+/*
+Return IDs of documents on the number index in ascending order of their numbers (descending if desc is set), up to
+limit documents (0 for unlimited). A document having several numbers is placed by the first one in order. Only the
+first limit documents of each partition's sorted index (and the other documents of the last key) are visited; as
+adjacent numbers may share a key, documents of such numbers are ordered by ID.
+*/
+func (col *Col) sortedIDs(idxName string, desc bool, limit int) []int {
+	type entry struct {
+		key, id int
+	}
+	opts := col.indexOpts[idxName]
+	entries := make([]entry, 0, limit)
+	for partNum := 0; partNum < col.indexParts(idxName); partNum++ {
+		ht := col.hts[partNum][idxName]
+		partIDs := make(map[int]struct{})
+		ht.Lock.RLock()
+		ht.RangeFunc(NumberKey(math.Inf(-1)), NumberKey(math.Inf(1)), desc, func(key, id int) bool {
+			if limit > 0 && len(partIDs) >= limit && key != entries[len(entries)-1].key {
+				// Documents of the last key are all visited, as they are ordered by ID later on
+				return false
+			} else if opts.IndexNull && key == indexNullKey && !col.hasNumberIn(idxName, id, math.Inf(-1), math.Inf(1), false) {
+				return true
+			}
+			entries = append(entries, entry{key, id})
+			partIDs[id] = struct{}{}
+			return true
+		})
+		ht.Lock.RUnlock()
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		if entries[a].key == entries[b].key {
+			return entries[a].id < entries[b].id
+		}
+		return entries[a].key < entries[b].key != desc
+	})
+	ids := make([]int, 0, len(entries))
+	found := make(map[int]struct{}, len(entries))
+	for _, e := range entries {
+		if limit > 0 && len(ids) == limit {
+			break
+		} else if _, dup := found[e.id]; !dup {
+			found[e.id] = struct{}{}
+			ids = append(ids, e.id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestNumberRange(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.IndexWithOptions([]string{"n"}, IndexOptions{Type: INDEX_TYPE_NUMBER, IndexNull: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.Index([]string{"s"}); err != nil {
+		t.Fatal(err)
+	}
+	docs := []map[string]interface{}{{"n": -3}, {"n": 1}, {"n": 2.5}, {"n": []interface{}{7, 1.0000001}}, {"n": 100}, {"n": nil}, {"n": "5"}}
+	ids := make([]int, len(docs))
+	for i, doc := range docs {
+		if ids[i], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q, err := runQuery(`{">=": 1, "<=": 7, "in": ["n"]}`, col); err != nil || len(q) != 3 || !ensureMapHasKeys(q, ids[1], ids[2], ids[3]) {
+		t.Fatal(q, err)
+	}
+	// Bounds are inclusive, and close to the numbers outside of the range
+	if q, err := runQuery(`{">=": 1.00000001, "<=": 2.5, "in": ["n"]}`, col); err != nil || len(q) != 2 || !ensureMapHasKeys(q, ids[2], ids[3]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{">=": 2.6, "in": ["n"]}`, col); err != nil || len(q) != 2 || !ensureMapHasKeys(q, ids[3], ids[4]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"<=": 0, "in": ["n"]}`, col); err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[0]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"<=": 0, ">=": 1, "in": ["n"]}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+	// Limit visits the numbers in ascending order
+	if q, err := runQuery(`{">=": -10, "in": ["n"], "limit": 2}`, col); err != nil || len(q) != 2 || !ensureMapHasKeys(q, ids[0], ids[1]) {
+		t.Fatal(q, err)
+	}
+	// Integer range only matches integers, in either direction
+	if q, err := runQuery(`{"int-from": 1, "int-to": 100, "in": ["n"]}`, col); err != nil || len(q) != 3 || !ensureMapHasKeys(q, ids[1], ids[3], ids[4]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"int-from": 100, "int-to": -100, "in": ["n"], "limit": 2}`, col); err != nil || len(q) != 2 || !ensureMapHasKeys(q, ids[3], ids[4]) {
+		t.Fatal(q, err)
+	}
+	// The sorted index follows document changes
+	if err := col.Update(ids[4], map[string]interface{}{"n": 6}); err != nil {
+		t.Fatal(err)
+	}
+	if err := col.Delete(ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := runQuery(`{">=": 2, "<=": 6, "in": ["n"]}`, col); err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[4]) {
+		t.Fatal(q, err)
+	}
+	// Placeholders bind the bounds
+	result := make(map[int]struct{})
+	if err := EvalQueryParams(map[string]interface{}{">=": "$1", "<=": "$2", "in": []interface{}{"n"}}, []interface{}{-5, 1}, col, &result); err != nil || len(result) != 2 || !ensureMapHasKeys(result, ids[0], ids[1]) {
+		t.Fatal(result, err)
+	}
+	// Range queries need an index of number type
+	if _, err := runQuery(`{">=": 1, "in": ["x"]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	if _, err := runQuery(`{">=": 1, "in": ["s"]}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+	if _, err := runQuery(`{">=": "a", "in": ["n"]}`, col); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+
+func TestSortedLookup(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.IndexWithOptions([]string{"Age"}, IndexOptions{Type: INDEX_TYPE_NUMBER, IndexNull: true}); err != nil {
+		t.Fatal(err)
+	} else if err := col.Index([]string{"Name"}); err != nil {
+		t.Fatal(err)
+	}
+	docs := []map[string]interface{}{{"Age": 30}, {"Age": -2.5}, {"Age": []interface{}{90, 1}}, {"Age": 45}, {"Age": nil}, {"Age": "old"}, {"Age": 45}}
+	ids := make([]int, len(docs))
+	for i, doc := range docs {
+		if ids[i], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sameOrder := func(got []int, expected ...int) bool {
+		if len(got) != len(expected) {
+			return false
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				return false
+			}
+		}
+		return true
+	}
+	// Documents having the same number are ordered by ID
+	tied := []int{ids[3], ids[6]}
+	if tied[0] > tied[1] {
+		tied[0], tied[1] = tied[1], tied[0]
+	}
+	if got, err := EvalQueryOrdered(map[string]interface{}{"sort": []interface{}{"Age", "desc"}, "limit": 3}, col); err != nil || !sameOrder(got, ids[2], tied[0], tied[1]) {
+		t.Fatal(got, err)
+	} else if got, err := EvalQueryOrdered(map[string]interface{}{"sort": []interface{}{"Age"}}, col); err != nil || !sameOrder(got, ids[1], ids[2], ids[0], tied[0], tied[1]) {
+		t.Fatal(got, err)
+	} else if got, err := EvalQueryOrdered(map[string]interface{}{"sort": []interface{}{"Age", "asc"}, "limit": 2}, col); err != nil || !sameOrder(got, ids[1], ids[2]) {
+		t.Fatal(got, err)
+	}
+	if hits, err := EvalQueryDocs(map[string]interface{}{"sort": []interface{}{"Age", "desc"}, "limit": 1}, col); err != nil || len(hits) != 1 || hits[0].ID != ids[2] {
+		t.Fatal(hits, err)
+	}
+	// The result set of a sort operation takes part in set operations
+	if q, err := runQuery(`{"n": [{"sort": ["Age", "desc"], "limit": 2}, "all"]}`, col); err != nil || len(q) != 2 || !ensureMapHasKeys(q, ids[2], tied[0]) {
+		t.Fatal(q, err)
+	}
+	result := make(map[int]struct{})
+	if err := EvalQueryParams(map[string]interface{}{"sort": []interface{}{"Age"}, "limit": "$1"}, []interface{}{1}, col, &result); err != nil || len(result) != 1 || !ensureMapHasKeys(result, ids[1]) {
+		t.Fatal(result, err)
+	}
+	// Sorting needs a number index
+	if _, err := EvalQueryOrdered(map[string]interface{}{"sort": []interface{}{"Name"}}, col); err == nil {
+		t.Fatal("did not error")
+	} else if _, err := EvalQueryOrdered(map[string]interface{}{"sort": []interface{}{"Height"}}, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	} else if _, err := EvalQueryOrdered(map[string]interface{}{"sort": []interface{}{"Age", "up"}}, col); err == nil {
+		t.Fatal("did not error")
+	}
+	// Other queries are ordered by ID
+	if got, err := EvalQueryOrdered(`all`, col); err != nil || len(got) != len(ids) {
+		t.Fatal(got, err)
+	} else {
+		for i := 1; i < len(got); i++ {
+			if got[i-1] >= got[i] {
+				t.Fatal(got)
+			}
+		}
+	}
+}
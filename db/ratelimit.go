@@ -0,0 +1,72 @@
+// Document write rate limiting.
+
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// writeLimiter paces document writes, and sheds writes when too many are already waiting for their turn.
+type writeLimiter struct {
+	lock     *sync.Mutex
+	interval time.Duration // Minimum time between writes, 0 for unlimited
+	maxQueue int           // Maximum number of waiting writes, 0 for unlimited
+	next     time.Time     // When the next write may proceed
+	queued   int64         // Number of waiting writes (atomic)
+}
+
+func newWriteLimiter() *writeLimiter {
+	return &writeLimiter{lock: new(sync.Mutex)}
+}
+
+// Limit document writes (insert, update and delete) of all collections to the rate per second, 0 for unlimited. When
+// maxQueue writes are already waiting for their turn, another write fails immediately with ErrorWriteQueueFull instead
+// of waiting; 0 for unlimited waiting writes.
+func (db *DB) SetWriteLimit(perSec, maxQueue int) {
+	lim := db.writes
+	lim.lock.Lock()
+	defer lim.lock.Unlock()
+	lim.interval = 0
+	if perSec > 0 {
+		lim.interval = time.Second / time.Duration(perSec)
+	}
+	lim.maxQueue = maxQueue
+	lim.next = time.Time{}
+}
+
+// Return number of document writes waiting for their turn under the write rate limit.
+func (db *DB) WriteQueueDepth() int {
+	return int(atomic.LoadInt64(&db.writes.queued))
+}
+
+// Wait for the turn of a document write, or return ErrorWriteQueueFull if too many writes are waiting already.
+func (lim *writeLimiter) wait() error {
+	lim.lock.Lock()
+	if lim.interval == 0 {
+		lim.lock.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if lim.next.Before(now) {
+		lim.next = now
+	}
+	delay := lim.next.Sub(now)
+	if delay > 0 && lim.maxQueue > 0 && atomic.LoadInt64(&lim.queued) >= int64(lim.maxQueue) {
+		lim.lock.Unlock()
+		return dberr.New(dberr.ErrorWriteQueueFull, lim.maxQueue)
+	}
+	lim.next = lim.next.Add(lim.interval)
+	if delay > 0 {
+		atomic.AddInt64(&lim.queued, 1)
+	}
+	lim.lock.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+		atomic.AddInt64(&lim.queued, -1)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestWriteLimit(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	db.SetWriteLimit(10, 1)
+	start := time.Now()
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second write waits for its turn, the third is shed
+	waiting := make(chan error)
+	go func() {
+		waiting <- col.Update(id, map[string]interface{}{"a": 2})
+	}()
+	for db.WriteQueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := col.Delete(id); dberr.Type(err) != dberr.ErrorWriteQueueFull {
+		t.Fatal(err)
+	}
+	if err := <-waiting; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || db.WriteQueueDepth() != 0 {
+		t.Fatal(elapsed, db.WriteQueueDepth())
+	}
+	// Reads are never limited
+	if doc, err := col.Read(id); err != nil || doc["a"].(float64) != 2 {
+		t.Fatal(doc, err)
+	}
+	// Remove the limit
+	db.SetWriteLimit(0, 0)
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		if _, err := col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal(elapsed)
+	}
+}
@@ -0,0 +1,176 @@
+// Field-level redaction of documents leaving the database through exports and change streams.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+const (
+	REDACTIONS_FILE = "redactions" // Redacted paths of collections, keyed by collection name.
+	REDACTED_VALUE  = "***"        // Redacted values are replaced by this string.
+)
+
+// Redacted paths of all collections.
+type redactions struct {
+	lock  *sync.Mutex
+	byCol map[string][][]string // Loaded upon first use
+}
+
+// Load redacted paths from the database directory unless they are loaded already. The caller must place redaction lock.
+func (db *DB) loadRedactions() error {
+	if db.redactions.byCol != nil {
+		return nil
+	}
+	byCol := make(map[string][][]string)
+	if redactionsJS, err := ioutil.ReadFile(path.Join(db.path, REDACTIONS_FILE)); err == nil {
+		if err := json.Unmarshal(redactionsJS, &byCol); err != nil {
+			return fmt.Errorf("Redactions file is corrupted: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	db.redactions.byCol = byCol
+	return nil
+}
+
+// Write redacted paths into the database directory. The caller must place redaction lock.
+func (db *DB) saveRedactions(byCol map[string][][]string) error {
+	redactionsJS, err := json.Marshal(byCol)
+	if err != nil {
+		return err
+	} else if err = data.WriteFileAtomic(path.Join(db.path, REDACTIONS_FILE), redactionsJS, 0600); err != nil {
+		return err
+	}
+	db.redactions.byCol = byCol
+	return nil
+}
+
+// Change the redacted paths of the collection with the function and persist them. The caller must place redaction lock.
+func (db *DB) changeRedactions(colName string, change func(paths [][]string) ([][]string, error)) error {
+	if err := db.loadRedactions(); err != nil {
+		return err
+	}
+	byCol := make(map[string][][]string, len(db.redactions.byCol)+1)
+	for name, paths := range db.redactions.byCol {
+		byCol[name] = paths
+	}
+	paths, err := change(append([][]string{}, byCol[colName]...))
+	if err != nil {
+		return err
+	} else if len(paths) == 0 {
+		delete(byCol, colName)
+	} else {
+		byCol[colName] = paths
+	}
+	return db.saveRedactions(byCol)
+}
+
+/*
+Redact values at the path in documents of the collection as they leave the database through exports (ExportMongoJSON,
+ExportParquet) and change streams (Changes): the values are replaced by REDACTED_VALUE, following arrays on the way as
+queries do. Redacted paths are persisted, and follow the collection when it is renamed. File-level backups (Dump,
+DumpArchive) are exact copies for restoration, they are not redacted.
+*/
+func (db *DB) Redact(colName string, redactPath []string) error {
+	if len(redactPath) == 0 {
+		return fmt.Errorf("Redacted path may not be empty")
+	} else if db.Use(colName) == nil {
+		return fmt.Errorf("Collection %s does not exist", colName)
+	}
+	db.redactions.lock.Lock()
+	defer db.redactions.lock.Unlock()
+	return db.changeRedactions(colName, func(paths [][]string) ([][]string, error) {
+		joined := strings.Join(redactPath, INDEX_PATH_SEP)
+		for _, existing := range paths {
+			if strings.Join(existing, INDEX_PATH_SEP) == joined {
+				return nil, fmt.Errorf("Path %v of %s is already redacted", redactPath, colName)
+			}
+		}
+		return append(paths, append([]string{}, redactPath...)), nil
+	})
+}
+
+// Stop redacting values at the path in documents of the collection.
+func (db *DB) Unredact(colName string, redactPath []string) error {
+	db.redactions.lock.Lock()
+	defer db.redactions.lock.Unlock()
+	return db.changeRedactions(colName, func(paths [][]string) ([][]string, error) {
+		joined := strings.Join(redactPath, INDEX_PATH_SEP)
+		for i, existing := range paths {
+			if strings.Join(existing, INDEX_PATH_SEP) == joined {
+				return append(paths[:i], paths[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("Path %v of %s is not redacted", redactPath, colName)
+	})
+}
+
+// Return the redacted paths of the collection.
+func (db *DB) Redactions(colName string) ([][]string, error) {
+	db.redactions.lock.Lock()
+	defer db.redactions.lock.Unlock()
+	if err := db.loadRedactions(); err != nil {
+		return nil, err
+	}
+	ret := make([][]string, 0, len(db.redactions.byCol[colName]))
+	for _, redactPath := range db.redactions.byCol[colName] {
+		ret = append(ret, append([]string{}, redactPath...))
+	}
+	return ret, nil
+}
+
+// Move redacted paths of a renamed collection to its new name.
+func (db *DB) renameRedactions(oldName, newName string) error {
+	db.redactions.lock.Lock()
+	defer db.redactions.lock.Unlock()
+	if err := db.loadRedactions(); err != nil {
+		return err
+	} else if _, exists := db.redactions.byCol[oldName]; !exists {
+		return nil
+	}
+	paths := db.redactions.byCol[oldName]
+	if err := db.changeRedactions(oldName, func([][]string) ([][]string, error) { return nil, nil }); err != nil {
+		return err
+	}
+	return db.changeRedactions(newName, func([][]string) ([][]string, error) { return paths, nil })
+}
+
+// Replace values at the path inside the document by REDACTED_VALUE.
+func redactIn(doc interface{}, redactPath []string) {
+	switch val := doc.(type) {
+	case map[string]interface{}:
+		if inner, exists := val[redactPath[0]]; !exists {
+			return
+		} else if len(redactPath) == 1 {
+			val[redactPath[0]] = REDACTED_VALUE
+		} else {
+			redactIn(inner, redactPath[1:])
+		}
+	case []interface{}:
+		for _, elem := range val {
+			redactIn(elem, redactPath)
+		}
+	}
+}
+
+// Return the function redacting documents of the collection in place, or nil if nothing is redacted.
+func (col *Col) redactor() (func(doc map[string]interface{}), error) {
+	paths, err := col.db.Redactions(col.name)
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+	return func(doc map[string]interface{}) {
+		for _, redactPath := range paths {
+			redactIn(doc, redactPath)
+		}
+	}, nil
+}
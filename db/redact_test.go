@@ -0,0 +1,120 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedactIn(t *testing.T) {
+	doc := map[string]interface{}{
+		"name":  "joe",
+		"cards": []interface{}{map[string]interface{}{"no": "1234"}, map[string]interface{}{"no": "5678", "kind": "visa"}, "x"},
+		"addr":  map[string]interface{}{"street": "a", "city": "b"},
+	}
+	for _, redactPath := range [][]string{{"name"}, {"cards", "no"}, {"addr", "street"}, {"nope", "x"}, {"addr", "city", "x"}} {
+		redactIn(doc, redactPath)
+	}
+	expected := map[string]interface{}{
+		"name":  REDACTED_VALUE,
+		"cards": []interface{}{map[string]interface{}{"no": REDACTED_VALUE}, map[string]interface{}{"no": REDACTED_VALUE, "kind": "visa"}, "x"},
+		"addr":  map[string]interface{}{"street": REDACTED_VALUE, "city": "b"},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatal(doc)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Redact("col", []string{"ssn"}); err != nil {
+		t.Fatal(err)
+	} else if err := db.Redact("col", []string{"ssn"}); err == nil {
+		t.Fatal("Redacted twice")
+	} else if err := db.Redact("nope", []string{"ssn"}); err == nil {
+		t.Fatal("Redacted in missing collection")
+	} else if err := db.Redact("col", nil); err == nil {
+		t.Fatal("Redacted empty path")
+	} else if err := db.Redact("col", []string{"contact", "email"}); err != nil {
+		t.Fatal(err)
+	}
+	// Redactions are persisted and follow renamed collections
+	db.Close()
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Rename("col", "people"); err != nil {
+		t.Fatal(err)
+	}
+	if paths, err := db.Redactions("people"); err != nil || !reflect.DeepEqual(paths, [][]string{{"ssn"}, {"contact", "email"}}) {
+		t.Fatal(paths, err)
+	} else if paths, err := db.Redactions("col"); err != nil || len(paths) != 0 {
+		t.Fatal(paths, err)
+	}
+	col := db.Use("people")
+
+	// Change streams
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, _ := startChanges(t, col, ctx, ChangeOptions{Before: true, After: true}, 10)
+	id, err := col.Insert(map[string]interface{}{"name": "joe", "ssn": "123", "contact": map[string]interface{}{"email": "j@x", "tel": "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted := map[string]interface{}{"name": "joe", "ssn": REDACTED_VALUE, "contact": map[string]interface{}{"email": REDACTED_VALUE, "tel": "1"}}
+	select {
+	case ev := <-events:
+		if !reflect.DeepEqual(ev.After, redacted) {
+			t.Fatal(ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No event")
+	}
+	// The document itself is intact
+	if doc, err := col.Read(id); err != nil || doc["ssn"] != "123" {
+		t.Fatal(doc, err)
+	}
+
+	// Exports
+	var out bytes.Buffer
+	if err := col.ExportMongoJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	var exported map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &exported); err != nil {
+		t.Fatal(err)
+	} else if exported["ssn"] != REDACTED_VALUE || exported["contact"].(map[string]interface{})["email"] != REDACTED_VALUE || exported["name"] != "joe" {
+		t.Fatal(exported)
+	}
+	out.Reset()
+	if err := col.ExportParquet(&out, []ParquetColumn{{Name: "ssn", Path: []string{"ssn"}, Type: PARQUET_STRING}}); err != nil {
+		t.Fatal(err)
+	} else if bytes.Contains(out.Bytes(), []byte("123")) || !bytes.Contains(out.Bytes(), []byte(REDACTED_VALUE)) {
+		t.Fatal("Not redacted")
+	}
+
+	if err := db.Unredact("people", []string{"ssn"}); err != nil {
+		t.Fatal(err)
+	} else if err := db.Unredact("people", []string{"ssn"}); err == nil {
+		t.Fatal("Unredacted twice")
+	}
+	out.Reset()
+	if err := col.ExportMongoJSON(&out); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(out.Bytes(), []byte(`"123"`)) {
+		t.Fatal(out.String())
+	}
+}
@@ -0,0 +1,18 @@
+// +build linux
+
+package db
+
+import (
+	"os"
+	"syscall"
+)
+
+const ficlone = 0x40049409 // FICLONE ioctl request of linux/fs.h
+
+// Make the destination file share data extents with the source file (reflink, supported by btrfs and XFS).
+func reflink(dest, src *os.File) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dest.Fd(), ficlone, src.Fd()); errno != 0 {
+		return errno
+	}
+	return nil
+}
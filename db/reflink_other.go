@@ -0,0 +1,13 @@
+// +build !linux
+
+package db
+
+import (
+	"errors"
+	"os"
+)
+
+// Reflink is not implemented on this platform, files are always copied.
+func reflink(dest, src *os.File) error {
+	return errors.New("reflink is not supported on this platform")
+}
@@ -0,0 +1,203 @@
+// Reference integrity between collections.
+
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	REF_DENY    = "deny"    // Refuse to delete a document that is still referenced
+	REF_CASCADE = "cascade" // Delete the referencing documents together with the referenced document
+)
+
+// Relation declares that the values at a path of documents in one collection are IDs of documents in another
+// collection, and what happens to the referencing documents when a referenced document is deleted.
+type Relation struct {
+	From     string   // Referencing collection
+	Path     []string // Path of the referenced IDs in referencing documents, must be indexed
+	To       string   // Referenced collection
+	OnDelete string   // REF_DENY or REF_CASCADE
+}
+
+// Return true if the relation links the same collections over the same path as the other one.
+func (rel Relation) sameLink(other Relation) bool {
+	return rel.From == other.From && rel.To == other.To && strings.Join(rel.Path, INDEX_PATH_SEP) == strings.Join(other.Path, INDEX_PATH_SEP)
+}
+
+/*
+Declare a relation to be enforced upon deleting documents from the referenced collection, replacing the relation
+declared earlier between the same collections over the same path. The path must be indexed in the referencing
+collection; references are found by index lookup of the referenced ID, stored either as a number or as a string.
+Relations are not persisted, declare them again after opening the database; relations naming a collection that does
+not exist (e.g. after renaming) are ignored.
+*/
+func (db *DB) AddRelation(rel Relation) error {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	from, exists := db.cols[rel.From]
+	if !exists {
+		return fmt.Errorf("Collection %s does not exist", rel.From)
+	} else if _, exists := db.cols[rel.To]; !exists {
+		return fmt.Errorf("Collection %s does not exist", rel.To)
+	} else if _, indexed := from.indexPaths[strings.Join(rel.Path, INDEX_PATH_SEP)]; !indexed {
+		return fmt.Errorf("Path %v is not indexed in collection %s", rel.Path, rel.From)
+	} else if rel.OnDelete != REF_DENY && rel.OnDelete != REF_CASCADE {
+		return fmt.Errorf("Unknown delete action %s of relation, expecting %s or %s", rel.OnDelete, REF_DENY, REF_CASCADE)
+	}
+	rel.Path = append([]string{}, rel.Path...)
+	for i, existing := range db.relations {
+		if existing.sameLink(rel) {
+			db.relations[i] = rel
+			return nil
+		}
+	}
+	db.relations = append(db.relations, rel)
+	return nil
+}
+
+// Remove the relation between the collections over the path, return true if it was declared.
+func (db *DB) RemoveRelation(from string, path []string, to string) bool {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	for i, existing := range db.relations {
+		if existing.sameLink(Relation{From: from, Path: path, To: to}) {
+			db.relations = append(db.relations[:i], db.relations[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Return a copy of all declared relations.
+func (db *DB) Relations() []Relation {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	return append([]Relation{}, db.relations...)
+}
+
+// Return the relations referring to the collection, along with the referencing collections.
+func (col *Col) referringRelations() (rels []Relation, froms []*Col) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.dropped {
+		// The collection of the same name, if any, is not the one being deleted from
+		return
+	}
+	for _, rel := range col.db.relations {
+		if rel.To != col.name {
+			continue
+		} else if from, exists := col.db.cols[rel.From]; exists {
+			rels = append(rels, rel)
+			froms = append(froms, from)
+		}
+	}
+	return
+}
+
+/*
+Return IDs of documents in the referencing collection that refer to the document ID over the relation path. The ID may
+be stored as a number or as a string; the index is scanned for all forms of the ID and the documents are checked
+afterwards, because a large ID read back from a document is a float64 that does not format like the integer it was
+indexed as.
+*/
+func referrers(rel Relation, from *Col, id int) (ids map[int]struct{}, err error) {
+	from.db.schemaLock.RLock()
+	defer from.db.schemaLock.RUnlock()
+	if err = from.checkFlags(COL_READ); err != nil {
+		return
+	}
+	idxName := strings.Join(rel.Path, INDEX_PATH_SEP)
+	if _, indexed := from.indexPaths[idxName]; !indexed {
+		return nil, dberr.New(dberr.ErrorNeedIndex, idxName, rel)
+	} else if _, building := from.building[idxName]; building {
+		return nil, dberr.New(dberr.ErrorIndexBuilding, rel.Path, rel)
+	}
+	opts := from.indexOpts[idxName]
+	ids = make(map[int]struct{})
+	for _, val := range []interface{}{id, float64(id), strconv.Itoa(id)} {
+		canon, ok := opts.canonical(val)
+		if !ok {
+			continue
+		}
+		for _, match := range from.hashScan(idxName, opts.key(canon), 0) {
+			if doc, err := from.read(match, false); err == nil && refersTo(GetIn(doc, rel.Path), id) {
+				ids[match] = struct{}{}
+			}
+		}
+	}
+	return
+}
+
+// Return true if any of the values is the document ID as a number or as a string.
+func refersTo(vals []interface{}, id int) bool {
+	for _, val := range vals {
+		switch v := val.(type) {
+		case float64:
+			if v == float64(id) {
+				return true
+			}
+		case string:
+			if v == strconv.Itoa(id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Refuse to delete the documents if any of them is referenced over a REF_DENY relation by a document other than
+// those being deleted.
+func (col *Col) denyReferenced(rels []Relation, froms []*Col, ids []int) error {
+	deleting := make(map[int]struct{}, len(ids))
+	for _, id := range ids {
+		deleting[id] = struct{}{}
+	}
+	for i, rel := range rels {
+		if rel.OnDelete != REF_DENY {
+			continue
+		}
+		for _, id := range ids {
+			refs, err := referrers(rel, froms[i], id)
+			if err != nil {
+				return err
+			}
+			for ref := range refs {
+				if _, alsoDeleted := deleting[ref]; froms[i] == col && alsoDeleted {
+					continue
+				}
+				return dberr.New(dberr.ErrorReferenced, id, ref, rel.From)
+			}
+		}
+	}
+	return nil
+}
+
+// Delete documents referring to the deleted documents over REF_CASCADE relations.
+func (col *Col) cascadeDelete(rels []Relation, froms []*Col, ids []int) error {
+	for i, rel := range rels {
+		if rel.OnDelete != REF_CASCADE {
+			continue
+		}
+		refIDs := make([]int, 0)
+		for _, id := range ids {
+			refs, err := referrers(rel, froms[i], id)
+			if err != nil {
+				return err
+			}
+			for ref := range refs {
+				refIDs = append(refIDs, ref)
+			}
+		}
+		if len(refIDs) == 0 {
+			continue
+		} else if _, err := froms[i].DeleteMany(refIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
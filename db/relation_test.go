@@ -0,0 +1,87 @@
+package db
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestRelation(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, name := range []string{"users", "posts", "comments"} {
+		if err := db.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, posts, comments := db.Use("users"), db.Use("posts"), db.Use("comments")
+	if err := posts.Index([]string{"author"}); err != nil {
+		t.Fatal(err)
+	} else if err := comments.Index([]string{"post"}); err != nil {
+		t.Fatal(err)
+	}
+	// Declaration errors
+	if err := db.AddRelation(Relation{From: "posts", Path: []string{"title"}, To: "users", OnDelete: REF_DENY}); err == nil {
+		t.Fatal("Did not require index")
+	} else if err := db.AddRelation(Relation{From: "posts", Path: []string{"author"}, To: "users", OnDelete: "x"}); err == nil {
+		t.Fatal("Did not check action")
+	} else if err := db.AddRelation(Relation{From: "nope", Path: []string{"author"}, To: "users", OnDelete: REF_DENY}); err == nil {
+		t.Fatal("Did not check collection")
+	}
+	if err := db.AddRelation(Relation{From: "posts", Path: []string{"author"}, To: "users", OnDelete: REF_CASCADE}); err != nil {
+		t.Fatal(err)
+	} else if err := db.AddRelation(Relation{From: "posts", Path: []string{"author"}, To: "users", OnDelete: REF_DENY}); err != nil {
+		t.Fatal(err)
+	} else if err := db.AddRelation(Relation{From: "comments", Path: []string{"post"}, To: "posts", OnDelete: REF_CASCADE}); err != nil {
+		t.Fatal(err)
+	} else if rels := db.Relations(); len(rels) != 2 || rels[0].OnDelete != REF_DENY {
+		t.Fatal(rels)
+	}
+	alice, _ := users.Insert(map[string]interface{}{"name": "alice"})
+	bob, _ := users.Insert(map[string]interface{}{"name": "bob"})
+	post, _ := posts.Insert(map[string]interface{}{"author": alice})
+	// References stored as strings are found too
+	comment1, _ := comments.Insert(map[string]interface{}{"post": post})
+	comment2, _ := comments.InsertFrom(strings.NewReader(`{"post": "` + strconv.Itoa(post) + `"}`))
+	other, _ := comments.Insert(map[string]interface{}{"post": 1})
+
+	// Deny
+	if err := users.Delete(alice); dberr.Type(err) != dberr.ErrorReferenced {
+		t.Fatal(err)
+	} else if _, err := users.DeleteMany([]int{bob, alice}); dberr.Type(err) != dberr.ErrorReferenced {
+		t.Fatal(err)
+	} else if _, err := users.Read(bob); err != nil {
+		t.Fatal("Deleted part of the batch", err)
+	} else if err := users.Delete(bob); err != nil {
+		t.Fatal(err)
+	}
+	// Cascade
+	if err := posts.Delete(post); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{comment1, comment2} {
+		if _, err := comments.Read(id); dberr.Type(err) != dberr.ErrorNoDoc {
+			t.Fatal("Did not cascade", id, err)
+		}
+	}
+	if _, err := comments.Read(other); err != nil {
+		t.Fatal(err)
+	}
+	// The reference is gone, so the user may be deleted
+	if err := users.Delete(alice); err != nil {
+		t.Fatal(err)
+	}
+	if !db.RemoveRelation("comments", []string{"post"}, "posts") || db.RemoveRelation("comments", []string{"post"}, "posts") {
+		t.Fatal("Remove")
+	} else if len(db.Relations()) != 1 {
+		t.Fatal(db.Relations())
+	}
+}
@@ -0,0 +1,60 @@
+// Reloading of configuration tunables while the database is open.
+
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// Return the maximum number of compiled query plans to cache according to the configuration.
+func planCacheSize(conf *data.Config) int {
+	if conf.PlanCacheSize > 0 {
+		return conf.PlanCacheSize
+	}
+	return QUERY_PLAN_CACHE_SIZE
+}
+
+// Log the query if it has run for longer than the slow query threshold. The caller must place schema lock.
+func (db *DB) logSlowQuery(q interface{}, start time.Time) {
+	if db.Config.SlowQueryMs <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed >= time.Duration(db.Config.SlowQueryMs)*time.Millisecond {
+		tdlog.Noticef("Slow query took %v: %v", elapsed, q)
+	}
+}
+
+/*
+Read the configuration file (data-config.json) again and apply it to the open database. Changes to these tunables take
+effect right away: VerboseLog, PlanCacheSize, SlowQueryMs, DocMaxDepth, DocMaxKeys, DocMaxArrayLen, and
+OrderedIteration. Changes to file
+growth take effect on files opened afterwards (e.g. new collections, or upon opening the database again).
+DocMaxRoom, PerBucket, and HashBits decide the layout of existing files, and ColdPath the location of cold tier
+partitions, hence changing any of them fails the reload and nothing is applied.
+*/
+func (db *DB) ReloadConfig() error {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	conf, err := data.CreateOrReadConfigFrom(db.path, initialConfig(db.openOpts))
+	if err != nil {
+		return err
+	}
+	if conf.DocMaxRoom != db.Config.DocMaxRoom || conf.PerBucket != db.Config.PerBucket || conf.HashBits != db.Config.HashBits {
+		return fmt.Errorf("DocMaxRoom, PerBucket, and HashBits cannot change after the database is created (configured %d, %d, %d; in use %d, %d, %d)",
+			conf.DocMaxRoom, conf.PerBucket, conf.HashBits, db.Config.DocMaxRoom, db.Config.PerBucket, db.Config.HashBits)
+	} else if conf.ColdPath != db.Config.ColdPath {
+		return fmt.Errorf("ColdPath cannot change while the database is open (configured %s, in use %s)", conf.ColdPath, db.Config.ColdPath)
+	}
+	// Collections and hash tables share the configuration, hence they see the new values too.
+	*db.Config = *conf
+	if conf.VerboseLog != nil {
+		tdlog.VerboseLog = *conf.VerboseLog
+	}
+	db.plans.resize(planCacheSize(conf))
+	tdlog.Infof("Reloaded configuration of database %s", db.path)
+	return nil
+}
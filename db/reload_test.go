@@ -0,0 +1,67 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+func TestReloadConfig(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	defer func() { tdlog.VerboseLog = false }()
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		q := map[string]interface{}{"in": []interface{}{"a"}, "eq": "$1", "limit": i + 1}
+		if err := EvalQueryParams(q, []interface{}{i}, col, &map[int]struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configFile := path.Join(TEST_DATA_DIR, "data-config.json")
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Tunables take effect
+	writeConfig(`{"VerboseLog": true, "PlanCacheSize": 1, "SlowQueryMs": 1, "DocMaxDepth": 2}`)
+	if err := db.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !tdlog.VerboseLog || db.plans.size() != 1 || db.Config.SlowQueryMs != 1 {
+		t.Fatal(tdlog.VerboseLog, db.plans.size(), db.Config.SlowQueryMs)
+	}
+	if _, err := col.Insert(map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": 1}}}); err == nil {
+		t.Fatal("did not apply DocMaxDepth")
+	}
+	if err := EvalQuery("all", col, &map[int]struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	// Layout may not change
+	writeConfig(`{"HashBits": 3, "DocMaxDepth": 5}`)
+	if err := db.ReloadConfig(); err == nil || !strings.Contains(err.Error(), "cannot change") {
+		t.Fatal(err)
+	} else if db.Config.DocMaxDepth != 2 {
+		t.Fatal("applied part of a refused configuration")
+	}
+	// Corrupted configuration is refused
+	writeConfig(`{"DocMaxDepth": -1}`)
+	if err := db.ReloadConfig(); err == nil || db.Config.DocMaxDepth != 2 {
+		t.Fatal(err, db.Config.DocMaxDepth)
+	}
+}
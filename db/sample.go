@@ -0,0 +1,84 @@
+// Random sampling of documents.
+
+package db
+
+import (
+	"encoding/json"
+	"math/rand"
+)
+
+const (
+	SAMPLE_RANGE_DOCS   = 16 // Approximate number of documents in each lookup table range drawn for a sample.
+	SAMPLE_OVERSAMPLING = 4  // Documents are sampled out of this many times as many candidates as needed.
+)
+
+/*
+Return a uniform random sample of up to n documents, keyed by document ID, without scanning the collection. Each
+partition contributes in proportion to its approximate document count: random ranges of its ID lookup table are drawn
+until there are enough candidate IDs, and the sample is picked out of the candidates at random. Only the sampled
+documents are read. Nothing is returned if the collection is write-only.
+*/
+func (col *Col) Sample(n int) (docs map[int]map[string]interface{}, err error) {
+	docs = make(map[int]map[string]interface{})
+	if n <= 0 {
+		return
+	}
+	rng := rand.New(rand.NewSource(int64(col.db.newID())))
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err = col.checkFlags(COL_READ); err != nil {
+		return
+	}
+	counts := make([]int, col.db.numParts)
+	total := 0
+	for i, part := range col.parts {
+		part.DataLock.RLock()
+		counts[i] = part.ApproxDocCount()
+		part.DataLock.RUnlock()
+		total += counts[i]
+	}
+	if total == 0 {
+		return
+	}
+	for i, part := range col.parts {
+		// Share of the sample rounded at random, so that small shares are not always lost
+		share := float64(n) * float64(counts[i]) / float64(total)
+		quota := int(share)
+		if rng.Float64() < share-float64(quota) {
+			quota++
+		}
+		if quota == 0 {
+			continue
+		}
+		numRanges := counts[i] / SAMPLE_RANGE_DOCS
+		if numRanges < 1 {
+			numRanges = 1
+		} else if numRanges > col.db.Config.InitialBuckets {
+			numRanges = col.db.Config.InitialBuckets
+		}
+		part.DataLock.RLock()
+		candidates := make([]int, 0, quota*SAMPLE_OVERSAMPLING)
+		for _, rangeNum := range rng.Perm(numRanges) {
+			if candidates = append(candidates, part.IDsInRange(rangeNum, numRanges)...); len(candidates) >= quota*SAMPLE_OVERSAMPLING {
+				break
+			}
+		}
+		for _, pick := range rng.Perm(len(candidates)) {
+			if quota == 0 {
+				break
+			}
+			id := candidates[pick]
+			docB, readErr := part.Read(id)
+			if readErr != nil {
+				continue
+			}
+			var doc map[string]interface{}
+			if json.Unmarshal(docB, &doc) == nil {
+				docs[id] = doc
+				quota--
+			}
+		}
+		part.DataLock.RUnlock()
+	}
+	return
+}
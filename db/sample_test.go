@@ -0,0 +1,62 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSample(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if docs, err := col.Sample(10); err != nil || len(docs) != 0 {
+		t.Fatal(docs, err)
+	}
+	const total = 1000
+	for i := 0; i < total; i++ {
+		if _, err := col.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if docs, err := col.Sample(0); err != nil || len(docs) != 0 {
+		t.Fatal(docs, err)
+	}
+	// Samples hold real documents, and every document is sampled from time to time
+	seen := make(map[int]struct{})
+	sum, count := 0, 0
+	for round := 0; round < 200; round++ {
+		docs, err := col.Sample(50)
+		if err != nil || len(docs) < 40 || len(docs) > 60 {
+			t.Fatal(len(docs), err)
+		}
+		for id, doc := range docs {
+			var read map[string]interface{}
+			if read, err = col.Read(id); err != nil || read["n"] != doc["n"] {
+				t.Fatal(id, doc, read, err)
+			}
+			n := int(doc["n"].(float64))
+			seen[n] = struct{}{}
+			sum += n
+			count++
+		}
+	}
+	if len(seen) < total*9/10 {
+		t.Fatal("Not uniform", len(seen))
+	}
+	// Sampled values average out close to the average of all values
+	if avg := float64(sum) / float64(count); avg < total*0.4 || avg > total*0.6 {
+		t.Fatal("Not uniform", avg)
+	}
+	// A sample larger than the collection holds at most every document
+	if docs, err := col.Sample(2 * total); err != nil || len(docs) != total {
+		t.Fatal(len(docs), err)
+	}
+}
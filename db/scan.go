@@ -0,0 +1,244 @@
+// Extraction of document paths from raw JSON without decoding whole documents.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Return the position of the first non-whitespace character at or after pos.
+func skipSpace(data []byte, pos int) int {
+	for pos < len(data) {
+		switch data[pos] {
+		case ' ', '\t', '\n', '\r':
+			pos++
+		default:
+			return pos
+		}
+	}
+	return pos
+}
+
+// Return the position right after the JSON string starting at pos.
+func skipString(data []byte, pos int) (int, error) {
+	for i := pos + 1; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("Unterminated string at offset %d", pos)
+}
+
+// Return the position right after the JSON value starting at pos, without decoding it.
+func skipValue(data []byte, pos int) (end int, err error) {
+	if pos >= len(data) {
+		return 0, fmt.Errorf("Missing value at offset %d", pos)
+	}
+	switch data[pos] {
+	case '"':
+		return skipString(data, pos)
+	case '{', '[':
+		depth := 0
+		for i := pos; i < len(data); i++ {
+			switch data[i] {
+			case '"':
+				if i, err = skipString(data, i); err != nil {
+					return
+				}
+				i--
+			case '{', '[':
+				depth++
+			case '}', ']':
+				if depth--; depth == 0 {
+					return i + 1, nil
+				}
+			}
+		}
+		return 0, fmt.Errorf("Unterminated object or array at offset %d", pos)
+	default:
+		// Number or literal
+		for end = pos; end < len(data); end++ {
+			switch data[end] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+				return end, nil
+			}
+		}
+		return end, nil
+	}
+}
+
+// Call fun with the key and raw value of each member of the raw JSON object, in document order.
+func forEachMember(obj []byte, fun func(key string, val []byte)) error {
+	pos := skipSpace(obj, 1)
+	for pos < len(obj) && obj[pos] != '}' {
+		if obj[pos] != '"' {
+			return fmt.Errorf("Expecting a member name at offset %d", pos)
+		}
+		keyEnd, err := skipString(obj, pos)
+		if err != nil {
+			return err
+		}
+		key := string(obj[pos+1 : keyEnd-1])
+		if bytes.IndexByte(obj[pos:keyEnd], '\\') != -1 {
+			if err := json.Unmarshal(obj[pos:keyEnd], &key); err != nil {
+				return err
+			}
+		}
+		if pos = skipSpace(obj, keyEnd); pos >= len(obj) || obj[pos] != ':' {
+			return fmt.Errorf("Expecting a colon at offset %d", pos)
+		}
+		valStart := skipSpace(obj, pos+1)
+		valEnd, err := skipValue(obj, valStart)
+		if err != nil {
+			return err
+		}
+		fun(key, obj[valStart:valEnd])
+		if pos = skipSpace(obj, valEnd); pos < len(obj) && obj[pos] == ',' {
+			pos = skipSpace(obj, pos+1)
+		} else if pos < len(obj) && obj[pos] != '}' {
+			return fmt.Errorf("Expecting a comma at offset %d", pos)
+		}
+	}
+	if pos >= len(obj) {
+		return fmt.Errorf("Unterminated object")
+	}
+	return nil
+}
+
+// Call fun with each raw element of the raw JSON array.
+func forEachElement(arr []byte, fun func(elem []byte)) error {
+	pos := skipSpace(arr, 1)
+	for pos < len(arr) && arr[pos] != ']' {
+		end, err := skipValue(arr, pos)
+		if err != nil {
+			return err
+		}
+		fun(arr[pos:end])
+		if pos = skipSpace(arr, end); pos < len(arr) && arr[pos] == ',' {
+			pos = skipSpace(arr, pos+1)
+		} else if pos < len(arr) && arr[pos] != ']' {
+			return fmt.Errorf("Expecting a comma at offset %d", pos)
+		}
+	}
+	if pos >= len(arr) {
+		return fmt.Errorf("Unterminated array")
+	}
+	return nil
+}
+
+/*
+Call fun with the raw JSON value at the end of the path inside the raw JSON value, following arrays on the way as GetIn
+does. Like in GetIn, a missing last path segment leads to a null value, given to fun as nil.
+*/
+func walkRaw(raw []byte, path []string, fun func(leaf []byte) error) (err error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return fmt.Errorf("Missing value")
+	} else if len(path) == 0 {
+		return fun(raw)
+	}
+	switch raw[0] {
+	case '{':
+		var member []byte
+		if err = forEachMember(raw, func(key string, val []byte) {
+			if key == path[0] {
+				// The last one wins, as in json.Unmarshal
+				member = val
+			}
+		}); err != nil {
+			return
+		} else if member == nil {
+			if len(path) == 1 {
+				return fun(nil)
+			}
+			return nil
+		}
+		return walkRaw(member, path[1:], fun)
+	case '[':
+		var elemErr error
+		err = forEachElement(raw, func(elem []byte) {
+			if elem[0] == '{' && elemErr == nil {
+				elemErr = walkRaw(elem, path, fun)
+			}
+		})
+		if err == nil {
+			err = elemErr
+		}
+	}
+	return
+}
+
+// Return the values GetIn finds at the path of the raw JSON document, decoding nothing but the values.
+func GetInRaw(docB []byte, path []string) (ret []interface{}, err error) {
+	docB = bytes.TrimSpace(docB)
+	if len(docB) == 0 || docB[0] != '{' {
+		return nil, nil
+	}
+	err = walkRaw(docB, path, func(leaf []byte) error {
+		var val interface{}
+		if leaf != nil {
+			if err := json.Unmarshal(leaf, &val); err != nil {
+				return err
+			}
+		}
+		if anArray, ok := val.([]interface{}); ok {
+			ret = append(ret, anArray...)
+		} else {
+			ret = append(ret, val)
+		}
+		return nil
+	})
+	return
+}
+
+// Return the array lengths GetLengthsIn finds at the path of the raw JSON document, decoding nothing.
+func GetLengthsInRaw(docB []byte, path []string) (ret []int, err error) {
+	docB = bytes.TrimSpace(docB)
+	if len(docB) == 0 || docB[0] != '{' {
+		return nil, nil
+	}
+	err = walkRaw(docB, path, func(leaf []byte) error {
+		if len(leaf) == 0 || leaf[0] != '[' {
+			return nil
+		}
+		length := 0
+		err := forEachElement(leaf, func([]byte) {
+			length++
+		})
+		ret = append(ret, length)
+		return err
+	})
+	return
+}
+
+/*
+Do fun for all documents in the collection with the values of the paths, decoding only those values instead of whole
+documents. values[i] is the value at paths[i], nil if the path does not exist. Like in queries and indexes, arrays on the
+way are searched for the path: if more than one value is found, values[i] holds all of them. Documents are visited as
+in ForEachDoc, and the same restrictions apply to fun.
+*/
+func (col *Col) ScanPaths(paths [][]string, fun func(id int, values []interface{}) (moveOn bool)) {
+	col.ForEachDoc(func(id int, docB []byte) bool {
+		values := make([]interface{}, len(paths))
+		for i, path := range paths {
+			found, err := GetInRaw(docB, path)
+			if err != nil {
+				// Skip corrupted document
+				return true
+			}
+			switch len(found) {
+			case 0:
+			case 1:
+				values[i] = found[0]
+			default:
+				values[i] = found
+			}
+		}
+		return fun(id, values)
+	})
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetInRaw(t *testing.T) {
+	docs := []string{
+		`{"a": {"b": {"c": 1}}}`,
+		`{"a": {"b": {"c": [1, 2, 3]}}, "d": "x"}`,
+		`{"a": [{"b": {"c": 1}}, 2, [3], {"b": [{"c": "y"}, {"c": null}]}, {"x": 1}]}`,
+		`{"a": null, "a": {"b": {"c": true}}}`,
+		`{"a\"\\b": "esc", "a": {"b": {}}, "s": "}]\"{["}`,
+		` { "a" : [ ] , "b":-1.5e3 } `,
+		`{}`,
+	}
+	paths := [][]string{
+		{}, {"a"}, {"a", "b"}, {"a", "b", "c"}, {"a", "x"}, {"a", "b", "c", "d"}, {"x"}, {"x", "y"},
+		{"a\"\\b"}, {"s"}, {"b"}, {"d"},
+	}
+	for _, docStr := range docs {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(docStr), &doc); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range paths {
+			raw, err := GetInRaw([]byte(docStr), path)
+			if err != nil {
+				t.Fatal(docStr, path, err)
+			} else if expected := GetIn(doc, path); !reflect.DeepEqual(raw, expected) {
+				t.Fatal(docStr, path, raw, expected)
+			}
+			lengths, err := GetLengthsInRaw([]byte(docStr), path)
+			if err != nil {
+				t.Fatal(docStr, path, err)
+			} else if expected := GetLengthsIn(doc, path); !reflect.DeepEqual(lengths, expected) {
+				t.Fatal(docStr, path, lengths, expected)
+			}
+		}
+	}
+	if vals, err := GetInRaw([]byte(`[{"a": 1}]`), []string{"a"}); err != nil || vals != nil {
+		t.Fatal(vals, err)
+	}
+	for _, bad := range []string{`{"a": "b`, `{"a" 1}`, `{"a": {"b": 1}`, `{1: 2}`} {
+		if _, err := GetInRaw([]byte(bad), []string{"a", "b"}); err == nil {
+			t.Fatal("Did not fail", bad)
+		}
+	}
+}
+
+func TestScanPaths(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	wide := strings.Repeat("x", 10000)
+	ids := make(map[int]map[string]interface{})
+	for _, doc := range []map[string]interface{}{
+		{"name": "a", "tags": []interface{}{"t1", "t2"}, "blob": wide},
+		{"name": "b", "tags": []interface{}{"t3"}, "nested": map[string]interface{}{"n": 2}},
+		{"blob": wide},
+	} {
+		id, err := col.Insert(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[id] = doc
+	}
+	visited := 0
+	col.ScanPaths([][]string{{"name"}, {"tags"}, {"nested", "n"}}, func(id int, values []interface{}) bool {
+		visited++
+		doc := ids[id]
+		if len(values) != 3 || values[0] != doc["name"] {
+			t.Fatal(id, values)
+		}
+		tags, _ := doc["tags"].([]interface{})
+		switch len(tags) {
+		case 0:
+			if values[1] != nil {
+				t.Fatal(values)
+			}
+		case 1:
+			if values[1] != tags[0] {
+				t.Fatal(values)
+			}
+		default:
+			if !reflect.DeepEqual(values[1], tags) {
+				t.Fatal(values)
+			}
+		}
+		if nested, ok := doc["nested"]; ok && values[2] != float64(nested.(map[string]interface{})["n"].(int)) || !ok && values[2] != nil {
+			t.Fatal(values)
+		}
+		return true
+	})
+	if visited != 3 {
+		t.Fatal(visited)
+	}
+	visited = 0
+	col.ScanPaths(nil, func(id int, values []interface{}) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Fatal(visited)
+	}
+}
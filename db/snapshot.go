@@ -0,0 +1,49 @@
+// Consistent queries across collections.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ColQuery is a query of a collection evaluated by DB.QuerySnapshot.
+type ColQuery struct {
+	Col   string      // Collection name
+	Query interface{} // Query, as accepted by EvalQuery
+}
+
+/*
+Evaluate queries of one or more collections against the same state of the database, and return the resulting
+documents of each query (ordered like EvalQueryDocs) in the order of the queries. No document is written while the
+queries run, hence e.g. a report joining two collections does not observe writes made between the two queries.
+tiedot does not keep document versions, instead the database is locked exclusively meanwhile - writes, and other
+reads, wait until all queries finish; keep the queries small.
+*/
+func (db *DB) QuerySnapshot(queries []ColQuery) (results [][]QueryHit, err error) {
+	done, err := db.heavy.admit(context.Background(), false)
+	if err != nil {
+		return
+	}
+	defer done()
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	results = make([][]QueryHit, 0, len(queries))
+	for _, query := range queries {
+		col, exists := db.cols[query.Col]
+		if !exists {
+			return nil, fmt.Errorf("Collection %s does not exist", query.Col)
+		} else if err = col.checkFlags(COL_READ); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		hits, err := col.queryDocs(query.Query)
+		db.logSlowQuery(query.Query, start)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, hits)
+	}
+	return
+}
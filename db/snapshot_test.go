@@ -0,0 +1,88 @@
+package db
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestQuerySnapshot(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("Feeds"); err != nil {
+		t.Fatal(err)
+	} else if err := db.Create("Votes"); err != nil {
+		t.Fatal(err)
+	}
+	feeds, votes := db.Use("Feeds"), db.Use("Votes")
+	// Every feed is followed by its vote, hence votes never outnumber feeds
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	stopWriter := func() {
+		select {
+		case <-stop:
+		default:
+			close(stop)
+		}
+		<-stopped
+	}
+	defer stopWriter()
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			feedID, err := feeds.Insert(map[string]interface{}{"n": i})
+			if err != nil {
+				t.Error(err)
+				return
+			} else if _, err := votes.Insert(map[string]interface{}{"feed": strconv.Itoa(feedID)}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 30; i++ {
+		results, err := db.QuerySnapshot([]ColQuery{{"Votes", "all"}, {"Feeds", "all"}})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(results) != 2 {
+			t.Fatal(results)
+		} else if len(results[0]) > len(results[1]) {
+			t.Fatal("Torn state", len(results[0]), len(results[1]))
+		}
+		feedIDs := make(map[string]struct{})
+		for _, hit := range results[1] {
+			feedIDs[strconv.Itoa(hit.ID)] = struct{}{}
+		}
+		for _, hit := range results[0] {
+			if _, exists := feedIDs[hit.Doc["feed"].(string)]; !exists {
+				t.Fatal("Vote of a missing feed", hit)
+			}
+		}
+	}
+	stopWriter()
+	// Documents are ordered like EvalQueryDocs
+	results, err := db.QuerySnapshot([]ColQuery{{"Feeds", map[string]interface{}{"eq": 0, "in": []interface{}{"n"}}}})
+	if err == nil {
+		t.Fatal("Did not fail on unindexed path")
+	}
+	if err := feeds.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	if results, err = db.QuerySnapshot([]ColQuery{{"Feeds", map[string]interface{}{"eq": 0, "in": []interface{}{"n"}}}}); err != nil {
+		t.Fatal(err)
+	} else if len(results[0]) != 1 || results[0][0].Doc["n"].(float64) != 0 {
+		t.Fatal(results)
+	}
+	if _, err := db.QuerySnapshot([]ColQuery{{"Feeds", "all"}, {"Nope", "all"}}); err == nil {
+		t.Fatal("Did not fail on missing collection")
+	}
+}
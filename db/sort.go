@@ -0,0 +1,126 @@
+// Ordering of query results.
+
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SortKey is a document path to order documents by, in ascending or descending order.
+type SortKey struct {
+	Path       []string
+	Descending bool
+}
+
+/*
+Parse sort keys given as a JSON structure, e.g. [["Age", "desc"], ["Name", "asc"]], where each key is a path
+(comma-separated string, or array of path segments) followed by an optional direction ("asc" by default).
+*/
+func ParseSortKeys(spec interface{}) (keys []SortKey, err error) {
+	specKeys, ok := spec.([]interface{})
+	if !ok || len(specKeys) == 0 {
+		return nil, fmt.Errorf("Expecting a vector of sort keys, but %v given", spec)
+	}
+	keys = make([]SortKey, len(specKeys))
+	for i, specKey := range specKeys {
+		pair, ok := specKey.([]interface{})
+		if !ok || len(pair) < 1 || len(pair) > 2 {
+			return nil, fmt.Errorf("Expecting sort key [path, direction], but %v given", specKey)
+		}
+		switch path := pair[0].(type) {
+		case string:
+			keys[i].Path = strings.Split(path, ",")
+		case []interface{}:
+			for _, seg := range path {
+				keys[i].Path = append(keys[i].Path, fmt.Sprint(seg))
+			}
+		default:
+			return nil, fmt.Errorf("Expecting sort path as string or vector, but %v given", pair[0])
+		}
+		if len(pair) == 2 {
+			switch pair[1] {
+			case "asc":
+			case "desc":
+				keys[i].Descending = true
+			default:
+				return nil, fmt.Errorf("Expecting sort direction \"asc\" or \"desc\", but %v given", pair[1])
+			}
+		}
+	}
+	return
+}
+
+// Return an ordering of two document attribute values: missing values come first, followed by booleans, numbers, strings, and others.
+func CompareValues(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case bool:
+			return 1
+		case float64:
+			return 2
+		case string:
+			return 3
+		}
+		return 4
+	}
+	if rankA, rankB := rank(a), rank(b); rankA != rankB {
+		return rankA - rankB
+	}
+	switch aVal := a.(type) {
+	case nil:
+		return 0
+	case bool:
+		if aVal == b.(bool) {
+			return 0
+		} else if aVal {
+			return 1
+		}
+		return -1
+	case float64:
+		if bVal := b.(float64); aVal < bVal {
+			return -1
+		} else if aVal > bVal {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(aVal, b.(string))
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+/*
+Order document IDs by the sort keys - the first key decides the order, the following keys break ties. Documents that
+tie on all keys keep their original order. Only the sort key values are kept in memory, documents are not.
+Indexes are hash tables that do not maintain order, hence the result is always sorted in memory.
+*/
+func SortIDs(col *Col, ids []int, keys []SortKey) {
+	if len(keys) == 0 {
+		return
+	}
+	values := make(map[int][]interface{}, len(ids))
+	for _, id := range ids {
+		vals := make([]interface{}, len(keys))
+		if doc, err := col.Read(id); err == nil {
+			for i, key := range keys {
+				if found := GetIn(doc, key.Path); len(found) > 0 {
+					vals[i] = found[0]
+				}
+			}
+		}
+		values[id] = vals
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		valsI, valsJ := values[ids[i]], values[ids[j]]
+		for k, key := range keys {
+			if cmp := CompareValues(valsI[k], valsJ[k]); cmp != 0 {
+				return cmp < 0 != key.Descending
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCompareValues(t *testing.T) {
+	ordered := []interface{}{nil, false, true, -1.0, 2.0, "a", "b", []interface{}{1}}
+	for i := range ordered {
+		for j := range ordered {
+			cmp := CompareValues(ordered[i], ordered[j])
+			if i < j && cmp >= 0 || i > j && cmp <= 0 || i == j && cmp != 0 {
+				t.Fatal(ordered[i], ordered[j], cmp)
+			}
+		}
+	}
+}
+
+func TestParseSortKeys(t *testing.T) {
+	keys, err := ParseSortKeys([]interface{}{
+		[]interface{}{"Age", "desc"},
+		[]interface{}{"Name,First"},
+		[]interface{}{[]interface{}{"Name", "Last"}, "asc"},
+	})
+	if err != nil || len(keys) != 3 ||
+		len(keys[0].Path) != 1 || keys[0].Path[0] != "Age" || !keys[0].Descending ||
+		len(keys[1].Path) != 2 || keys[1].Path[1] != "First" || keys[1].Descending ||
+		len(keys[2].Path) != 2 || keys[2].Path[1] != "Last" || keys[2].Descending {
+		t.Fatal(keys, err)
+	}
+	for _, invalid := range []interface{}{
+		nil, "Age", []interface{}{}, []interface{}{"Age"}, []interface{}{[]interface{}{}},
+		[]interface{}{[]interface{}{1.0}}, []interface{}{[]interface{}{"Age", "up"}}, []interface{}{[]interface{}{"Age", "asc", "x"}},
+	} {
+		if _, err := ParseSortKeys(invalid); err == nil {
+			t.Fatal("Did not error", invalid)
+		}
+	}
+}
+
+func TestSortIDs(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	docs := []map[string]interface{}{
+		{"Age": 30, "Name": "b"},
+		{"Age": 20, "Name": "z"},
+		{"Age": 30, "Name": "a"},
+		{"Name": "c"},
+		{"Age": "30", "Name": "d"},
+		{"Age": 30, "Name": "a"},
+	}
+	ids := make([]int, len(docs))
+	for i, doc := range docs {
+		if ids[i], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sorted := append([]int{}, ids...)
+	SortIDs(col, sorted, []SortKey{{Path: []string{"Age"}, Descending: true}, {Path: []string{"Name"}}})
+	// Strings come after numbers, missing values come first; ties keep original order
+	expected := []int{ids[4], ids[2], ids[5], ids[0], ids[1], ids[3]}
+	for i := range expected {
+		if sorted[i] != expected[i] {
+			t.Fatal(sorted, expected)
+		}
+	}
+	// No sort key leaves the order intact
+	SortIDs(col, sorted, nil)
+	for i := range expected {
+		if sorted[i] != expected[i] {
+			t.Fatal(sorted, expected)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Collection statistics and the background statistics collector.
+
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// ColStats describes a collection, see Col.Stats.
+type ColStats struct {
+	Docs      int          // Approximate number of documents
+	DataBytes int          // Size of data files in use
+	FreeBytes int          // Space taken by deleted documents in data files, reclaimed by Scrub
+	Indexes   []IndexStats // Statistics of all indexes
+	Collected time.Time    // When the statistics were collected
+}
+
+// Return the fraction of data file space taken by deleted documents.
+func (stats ColStats) Fragmentation() float64 {
+	if stats.DataBytes == 0 {
+		return 0
+	}
+	return float64(stats.FreeBytes) / float64(stats.DataBytes)
+}
+
+// statsCollector refreshes the cached statistics of all collections periodically.
+type statsCollector struct {
+	lock   *sync.Mutex
+	cancel context.CancelFunc // Stops the collector, nil if the collector is not running
+	done   chan struct{}      // Closed when the collector has stopped
+}
+
+/*
+Return statistics of the collection: approximate number of documents, data file space and fragmentation, and index
+statistics (see IndexStats). Collecting them goes through all document headers and index entries, which takes a while
+on large collections; while the statistics collector is running (see StartStatsCollector), the statistics it collected
+most recently are returned instead. Statistics of a dropped collection are zero.
+*/
+func (col *Col) Stats() ColStats {
+	if stats := col.cachedStats(); stats != nil {
+		return *stats
+	}
+	done, _ := col.db.heavy.admit(context.Background(), true)
+	defer done()
+	return *col.collectStats()
+}
+
+// Return the statistics cached by the statistics collector, or nil if there are none.
+func (col *Col) cachedStats() *ColStats {
+	stats, _ := col.stats.Load().(*ColStats)
+	return stats
+}
+
+// Collect statistics of the collection, without admission control of heavy operations.
+func (col *Col) collectStats() *ColStats {
+	stats := &ColStats{Indexes: col.IndexStats(), Collected: time.Now()}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.checkFlags(0) != nil {
+		return stats
+	}
+	for _, part := range col.parts {
+		part.DataLock.RLock()
+		stats.Docs += part.ApproxDocCount()
+		used, deleted := part.DataUsage()
+		stats.DataBytes += used
+		stats.FreeBytes += deleted
+		part.DataLock.RUnlock()
+	}
+	return stats
+}
+
+/*
+Start collecting statistics of all collections in background, once every interval, replacing the collector already
+running. Until the collector stops, Col.Stats, ApproxDocCount and the query planner read the statistics it collected
+most recently, which may be up to an interval old. Statistics are collected as low priority heavy operations (see
+WithPriority), one collection at a time; collecting them also prepares the index sketches used by EstimateLookup.
+*/
+func (db *DB) StartStatsCollector(interval time.Duration) {
+	db.StopStatsCollector()
+	ctx, cancel := context.WithCancel(WithPriority(context.Background(), PRIORITY_LOW))
+	collector := db.collector
+	collector.lock.Lock()
+	collector.cancel, collector.done = cancel, make(chan struct{})
+	done := collector.done
+	collector.lock.Unlock()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, name := range db.AllCols() {
+				if err := db.refreshStats(ctx, name); err != nil {
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Collect and cache statistics of the collection, return an error only if the collector is stopping.
+func (db *DB) refreshStats(ctx context.Context, name string) error {
+	done, err := db.heavy.admit(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer done()
+	col := db.Use(name)
+	if col == nil {
+		// Dropped meanwhile
+		return nil
+	}
+	col.stats.Store(col.collectStats())
+	tdlog.Infof("Collected statistics of collection %s", name)
+	return nil
+}
+
+// Stop the statistics collector and forget the statistics it collected, do nothing if it is not running.
+func (db *DB) StopStatsCollector() {
+	collector := db.collector
+	collector.lock.Lock()
+	cancel, done := collector.cancel, collector.done
+	collector.cancel, collector.done = nil, nil
+	collector.lock.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	for _, col := range db.cols {
+		col.stats.Store((*ColStats)(nil))
+	}
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0, 100)
+	for i := 0; i < 100; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids[:50] {
+		if err := col.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := col.Stats()
+	if stats.FreeBytes == 0 || stats.DataBytes <= stats.FreeBytes || stats.Fragmentation() <= 0 || stats.Fragmentation() >= 1 {
+		t.Fatal(stats)
+	} else if len(stats.Indexes) != 1 || stats.Indexes[0].Entries != 50 {
+		t.Fatal(stats.Indexes)
+	}
+	if err := db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if stats = col.Stats(); stats.FreeBytes != 0 || stats.Fragmentation() != 0 {
+		t.Fatal(stats)
+	}
+	// The collector caches statistics of all collections
+	db.StartStatsCollector(time.Hour)
+	for col.cachedStats() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	cached := col.Stats()
+	for i := 0; i < 100; i++ {
+		if _, err := col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats = col.Stats(); !stats.Collected.Equal(cached.Collected) || stats.Docs != cached.Docs {
+		t.Fatal(stats, cached)
+	} else if col.ApproxDocCount() != cached.Docs {
+		t.Fatal(col.ApproxDocCount(), cached.Docs)
+	}
+	db.schemaLock.RLock()
+	estimate := col.estimateQuery("all", nil)
+	db.schemaLock.RUnlock()
+	if estimate != cached.Docs {
+		t.Fatal(estimate, cached.Docs)
+	}
+	// Restarting the collector collects afresh, stopping it forgets the statistics
+	db.StartStatsCollector(time.Hour)
+	for col.cachedStats() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if stats = col.Stats(); len(stats.Indexes) != 1 || stats.Indexes[0].Entries != 150 {
+		t.Fatal(stats)
+	}
+	db.StopStatsCollector()
+	if col.cachedStats() != nil {
+		t.Fatal("Statistics remain cached")
+	}
+	db.StopStatsCollector()
+}
@@ -0,0 +1,287 @@
+/*
+Offline sync of collections between database instances.
+
+A collection enabled for sync keeps a version of every document it has written - a hybrid logical clock reading, the
+ID of the database instance (node) that made the write, and whether the document was deleted. Versions live in a
+companion collection named SYNC_COL_PREFIX followed by the collection name, under the same IDs as the documents.
+
+Instances exchange changes (document content along with version) and each document converges to the change with the
+latest version, ordered by clock and then by node ID: last writer wins. Deletions are kept as versions (tombstones),
+so that a deleted document is not brought back by an instance that has not seen the deletion yet.
+*/
+
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	SYNC_COL_PREFIX = "_sync_"    // Name prefix of collections holding document versions of synced collections.
+	SYNC_NODE_FILE  = "sync_node" // File holding ID of the database instance, created when sync is first enabled.
+)
+
+// Version of a document in a synced collection.
+type syncVersion struct {
+	Clock   int64  `json:"clock"`   // Hybrid logical clock reading of the write
+	Node    string `json:"node"`    // ID of the database instance that made the write
+	Deleted bool   `json:"deleted"` // Whether the write deleted the document
+	Seq     int64  `json:"seq"`     // Local clock reading when the version was recorded, for incremental exchange
+}
+
+// Return true if the version wins over the other one.
+func (ver syncVersion) newer(other syncVersion) bool {
+	return ver.Clock > other.Clock || ver.Clock == other.Clock && ver.Node > other.Node
+}
+
+// SyncChange is a document write exchanged between database instances.
+type SyncChange struct {
+	ID      int                    // Document ID
+	Clock   int64                  // Hybrid logical clock reading of the write
+	Node    string                 // ID of the database instance that made the write
+	Deleted bool                   // Whether the write deleted the document
+	Doc     map[string]interface{} // Document content, nil if the document was deleted
+}
+
+// Return the ID of this database instance, create it if necessary.
+func (db *DB) syncNodeID() (string, error) {
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+	if db.syncNode != "" {
+		return db.syncNode, nil
+	}
+	nodeFile := path.Join(db.path, SYNC_NODE_FILE)
+	if content, err := ioutil.ReadFile(nodeFile); err == nil {
+		db.syncNode = strings.TrimSpace(string(content))
+		return db.syncNode, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	node := hex.EncodeToString(random)
+	if err := ioutil.WriteFile(nodeFile, []byte(node), 0600); err != nil {
+		return "", err
+	}
+	db.syncNode = node
+	return node, nil
+}
+
+// Move the local clock past a clock reading received from another instance.
+func (db *DB) observeClock(clock int64) {
+	db.seqLock.Lock()
+	defer db.seqLock.Unlock()
+	if clock > db.lastClock {
+		db.lastClock = clock
+	}
+}
+
+// Start keeping document versions of the collection, so that it can be synced with other database instances.
+// Existing documents are given versions right away.
+func (db *DB) EnableSync(name string) error {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	col, exists := db.cols[name]
+	if !exists {
+		return fmt.Errorf("Collection %s does not exist", name)
+	} else if strings.HasPrefix(name, SYNC_COL_PREFIX) {
+		return fmt.Errorf("Collection %s holds document versions and cannot be synced", name)
+	} else if _, synced := db.cols[SYNC_COL_PREFIX+name]; synced {
+		return nil
+	} else if _, err := db.syncNodeID(); err != nil {
+		return err
+	} else if err := db.create(SYNC_COL_PREFIX + name); err != nil {
+		return err
+	}
+	col.forEachDoc(func(id int, _ []byte) bool {
+		col.recordVersion(id, false)
+		return true
+	}, false)
+	return nil
+}
+
+// Stop keeping document versions of the collection and remove them.
+func (db *DB) DisableSync(name string) error {
+	if db.Use(SYNC_COL_PREFIX+name) == nil {
+		return fmt.Errorf("Collection %s is not synced", name)
+	}
+	return db.Drop(SYNC_COL_PREFIX + name)
+}
+
+// Return the collection holding document versions of the collection, or nil if it is not synced. The caller must place
+// schema lock.
+func (col *Col) versions() *Col {
+	return col.db.cols[SYNC_COL_PREFIX+col.name]
+}
+
+// Record a new local version of the document if the collection is synced. The caller must place schema lock.
+func (col *Col) recordVersion(id int, deleted bool) {
+	versions := col.versions()
+	if versions == nil {
+		return
+	}
+	node, err := col.db.syncNodeID()
+	if err != nil {
+		tdlog.Noticef("Failed to record sync version of document %d in %s: %v", id, col.name, err)
+		return
+	}
+	clock := col.db.clock()
+	versions.putVersion(id, syncVersion{Clock: clock, Node: node, Deleted: deleted, Seq: clock})
+}
+
+// Store the version of the document. The caller must place schema lock.
+func (versions *Col) putVersion(id int, ver syncVersion) {
+	verJS, err := json.Marshal(ver)
+	if err == nil {
+		part := versions.parts[id%versions.db.numParts]
+		part.DataLock.Lock()
+		if _, err = part.Read(id); err == nil {
+			err = part.Update(id, verJS)
+		} else {
+			_, err = part.Insert(id, verJS)
+		}
+		part.DataLock.Unlock()
+	}
+	if err != nil {
+		tdlog.Noticef("Failed to record sync version of document %d in %s: %v", id, versions.name, err)
+	}
+}
+
+// Return the version of the document, and false if the document has none. The caller must place schema lock.
+func (versions *Col) getVersion(id int) (ver syncVersion, exists bool) {
+	part := versions.parts[id%versions.db.numParts]
+	part.DataLock.RLock()
+	verJS, err := part.Read(id)
+	if err == nil {
+		err = json.Unmarshal(verJS, &ver)
+	}
+	part.DataLock.RUnlock()
+	return ver, err == nil
+}
+
+/*
+Return the changes recorded (made locally or received from other instances) after the local clock reading "since", in
+the order they were recorded, along with the clock reading to pass as "since" next time. Pass 0 to get the latest change
+of every document.
+*/
+func (col *Col) SyncChanges(since int64) (changes []SyncChange, next int64, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	versions := col.versions()
+	if versions == nil {
+		return nil, since, fmt.Errorf("Collection %s is not synced", col.name)
+	} else if err = col.checkFlags(COL_READ); err != nil {
+		return nil, since, err
+	}
+	type recorded struct {
+		id  int
+		ver syncVersion
+	}
+	vers := make([]recorded, 0)
+	versions.forEachDoc(func(id int, verJS []byte) bool {
+		var ver syncVersion
+		if json.Unmarshal(verJS, &ver) == nil && ver.Seq > since {
+			vers = append(vers, recorded{id: id, ver: ver})
+		}
+		return true
+	}, false)
+	sort.Slice(vers, func(a, b int) bool {
+		return vers[a].ver.Seq < vers[b].ver.Seq
+	})
+	next = since
+	changes = make([]SyncChange, 0, len(vers))
+	for _, rec := range vers {
+		change := SyncChange{ID: rec.id, Clock: rec.ver.Clock, Node: rec.ver.Node, Deleted: rec.ver.Deleted}
+		if !change.Deleted {
+			if change.Doc, err = col.read(rec.id, false); dberr.Type(err) == dberr.ErrorNoDoc {
+				// Deleted meanwhile, the deletion is a later change
+				continue
+			} else if err != nil {
+				return nil, since, err
+			}
+		}
+		changes = append(changes, change)
+		next = rec.ver.Seq
+	}
+	return changes, next, nil
+}
+
+/*
+Apply changes received from another instance, return the number of changes that won over the local versions of their
+documents. Changes that lose are ignored, as the other instance will receive the winning versions in turn. Changes
+should not be applied while the same documents are being written locally.
+*/
+func (col *Col) ApplySync(changes []SyncChange) (applied int, err error) {
+	for _, change := range changes {
+		col.db.schemaLock.RLock()
+		if err = col.checkFlags(0); err != nil {
+			col.db.schemaLock.RUnlock()
+			return
+		}
+		versions := col.versions()
+		var local syncVersion
+		var exists bool
+		if versions != nil {
+			local, exists = versions.getVersion(change.ID)
+		}
+		col.db.schemaLock.RUnlock()
+		if versions == nil {
+			return applied, fmt.Errorf("Collection %s is not synced", col.Name())
+		}
+		col.db.observeClock(change.Clock)
+		remote := syncVersion{Clock: change.Clock, Node: change.Node, Deleted: change.Deleted}
+		if exists && !remote.newer(local) {
+			continue
+		}
+		if change.Deleted {
+			if err = col.Delete(change.ID); err != nil && dberr.Type(err) != dberr.ErrorNoDoc {
+				return
+			}
+		} else if _, err = col.Read(change.ID); err == nil {
+			if err = col.Update(change.ID, change.Doc); err != nil {
+				return
+			}
+		} else if _, err = col.InsertWithID(change.ID, change.Doc, false); err != nil {
+			return
+		}
+		// Replace the version recorded by the write with the received one
+		remote.Seq = col.db.clock()
+		col.db.schemaLock.RLock()
+		if versions = col.versions(); versions != nil {
+			versions.putVersion(change.ID, remote)
+		}
+		col.db.schemaLock.RUnlock()
+		applied++
+	}
+	return applied, nil
+}
+
+// Exchange all changes between the two synced collections (usually of different database instances) in both
+// directions, so that their documents converge.
+func Sync(a, b *Col) error {
+	aChanges, _, err := a.SyncChanges(0)
+	if err != nil {
+		return err
+	}
+	bChanges, _, err := b.SyncChanges(0)
+	if err != nil {
+		return err
+	} else if _, err := b.ApplySync(aChanges); err != nil {
+		return err
+	}
+	_, err = a.ApplySync(bChanges)
+	return err
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestSync(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	open := func(dir string) (*DB, *Col) {
+		db, err := OpenDB(TEST_DATA_DIR + "/" + dir)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := db.Create("col"); err != nil {
+			t.Fatal(err)
+		}
+		return db, db.Use("col")
+	}
+	dbA, a := open("a")
+	defer dbA.Close()
+	dbB, b := open("b")
+	defer dbB.Close()
+	// Documents written before enabling sync are synced too
+	early, err := a.Insert(map[string]interface{}{"n": "early"})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, _, err := a.SyncChanges(0); err == nil {
+		t.Fatal("Did not check sync")
+	} else if err := dbA.EnableSync("col"); err != nil {
+		t.Fatal(err)
+	} else if err := dbB.EnableSync("col"); err != nil {
+		t.Fatal(err)
+	} else if err := dbB.EnableSync(SYNC_COL_PREFIX + "col"); err == nil {
+		t.Fatal("Synced versions")
+	}
+	shared, err := a.Insert(map[string]interface{}{"n": "shared"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, err := b.Insert(map[string]interface{}{"n": "gone"})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := Sync(a, b); err != nil {
+		t.Fatal(err)
+	}
+	same := func(ids ...int) {
+		for _, id := range ids {
+			docA, errA := a.Read(id)
+			docB, errB := b.Read(id)
+			if dberr.Type(errA) != dberr.Type(errB) || errA == nil && docA["n"] != docB["n"] {
+				t.Fatal(id, docA, errA, docB, errB)
+			}
+		}
+	}
+	same(early, shared, gone)
+
+	// Concurrent updates - the later one wins on both sides; a deletion reaches the other side
+	_, cursor, err := a.SyncChanges(0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := a.Update(shared, map[string]interface{}{"n": "by a"}); err != nil {
+		t.Fatal(err)
+	} else if err := b.Update(shared, map[string]interface{}{"n": "by b"}); err != nil {
+		t.Fatal(err)
+	} else if err := a.Delete(gone); err != nil {
+		t.Fatal(err)
+	}
+	changes, next, err := a.SyncChanges(cursor)
+	if err != nil || len(changes) != 2 || changes[0].ID != shared || changes[1].ID != gone || !changes[1].Deleted || next <= cursor {
+		t.Fatal(changes, next, err)
+	} else if changes, _, err := a.SyncChanges(next); err != nil || len(changes) != 0 {
+		t.Fatal(changes, err)
+	}
+	if err := Sync(a, b); err != nil {
+		t.Fatal(err)
+	}
+	same(early, shared, gone)
+	if doc, err := b.Read(shared); err != nil || doc["n"] != "by b" {
+		t.Fatal(doc, err)
+	} else if _, err := b.Read(gone); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	// Syncing again changes nothing, and an old change does not win over a newer one
+	if applied, err := b.ApplySync(changes); err != nil || applied != 0 {
+		t.Fatal(applied, err)
+	} else if err := Sync(a, b); err != nil {
+		t.Fatal(err)
+	}
+	same(early, shared, gone)
+	// A local write after receiving changes wins over them
+	if err := a.Update(shared, map[string]interface{}{"n": "by a again"}); err != nil {
+		t.Fatal(err)
+	} else if err := Sync(a, b); err != nil {
+		t.Fatal(err)
+	} else if doc, err := b.Read(shared); err != nil || doc["n"] != "by a again" {
+		t.Fatal(doc, err)
+	}
+	if err := dbA.DisableSync("col"); err != nil {
+		t.Fatal(err)
+	} else if err := dbA.DisableSync("col"); err == nil {
+		t.Fatal("Did not check sync")
+	}
+}
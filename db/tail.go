@@ -0,0 +1,164 @@
+// Live tail of documents matching a query.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// A subscriber to document changes of a collection.
+type colWatcher struct {
+	ids    map[int]struct{} // IDs of inserted and updated documents not yet picked up
+	signal chan struct{}    // Receives a value when there are new IDs
+	closed chan struct{}    // Closed when the collection is dropped or the database is closed
+}
+
+// Subscribe to document changes of the collection.
+func (col *Col) watch() *colWatcher {
+	w := &colWatcher{ids: make(map[int]struct{}), signal: make(chan struct{}, 1), closed: make(chan struct{})}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.dropped {
+		close(w.closed)
+		return w
+	}
+	col.watchLock.Lock()
+	if col.watchers == nil {
+		col.watchers = make(map[*colWatcher]struct{})
+	}
+	col.watchers[w] = struct{}{}
+	col.watchLock.Unlock()
+	return w
+}
+
+// Cancel the subscription.
+func (col *Col) unwatch(w *colWatcher) {
+	col.watchLock.Lock()
+	delete(col.watchers, w)
+	col.watchLock.Unlock()
+}
+
+// Tell subscribers that the document has been inserted or updated.
+func (col *Col) notifyChange(id int) {
+	col.watchLock.Lock()
+	defer col.watchLock.Unlock()
+	for w := range col.watchers {
+		w.ids[id] = struct{}{}
+		select {
+		case w.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Return and forget the changed document IDs collected by the subscriber, in ascending order.
+func (col *Col) takeChanges(w *colWatcher) []int {
+	col.watchLock.Lock()
+	defer col.watchLock.Unlock()
+	ids := make([]int, 0, len(w.ids))
+	for id := range w.ids {
+		ids = append(ids, id)
+	}
+	w.ids = make(map[int]struct{})
+	sort.Ints(ids)
+	return ids
+}
+
+// End all subscriptions and change streams, the collection is going away.
+func (col *Col) stopWatchers() {
+	col.watchLock.Lock()
+	defer col.watchLock.Unlock()
+	for w := range col.watchers {
+		close(w.closed)
+	}
+	col.watchers = nil
+	for s := range col.streams {
+		close(s.closed)
+	}
+	col.streams = nil
+}
+
+// Evaluate the query and return those of the documents (IDs in ascending order) that are in the result.
+func (col *Col) matchChanges(q interface{}, ids []int) (hits []QueryHit, err error) {
+	done, err := col.db.heavy.admit(context.Background(), false)
+	if err != nil {
+		return
+	}
+	defer done()
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	defer col.db.logSlowQuery(q, time.Now())
+	if err = col.checkFlags(COL_READ); err != nil {
+		return
+	}
+	result := make(map[int]struct{})
+	if err = evalQuery(q, col, &result, false); err != nil {
+		return
+	}
+	hits = make([]QueryHit, 0, len(ids))
+	for _, id := range ids {
+		if _, match := result[id]; !match {
+			continue
+		}
+		doc, err := col.read(id, false)
+		if dberr.Type(err) == dberr.ErrorNoDoc {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		hits = append(hits, QueryHit{ID: id, Doc: doc})
+	}
+	return
+}
+
+/*
+Call the function on all documents matching the query (in ascending ID order), then keep calling it on documents
+matching the query as they are inserted or updated, until the context is cancelled or the function returns false.
+Deleted documents are not reported. A document changed while the current matches are being read may be delivered
+twice; consecutive changes to a document may be delivered once, carrying the latest content.
+
+The query is evaluated once for every batch of changes, index assisted queries keep the tail cheap on busy
+collections. Return nil if the function stopped the tail, the context error if it was cancelled, or an error if the
+collection is dropped or the database is closed.
+*/
+func (col *Col) Tail(ctx context.Context, q interface{}, fun func(hit QueryHit) bool) error {
+	// Subscribe before the catch-up so that no change falls in between
+	w := col.watch()
+	defer col.unwatch(w)
+	hits, err := EvalQueryDocs(q, col)
+	if err != nil {
+		return err
+	}
+	for _, hit := range hits {
+		if !fun(hit) {
+			return nil
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.closed:
+			return fmt.Errorf("Collection %s is no longer available", col.name)
+		case <-w.signal:
+		}
+		ids := col.takeChanges(w)
+		if len(ids) == 0 {
+			continue
+		}
+		hits, err := col.matchChanges(q, ids)
+		if err != nil {
+			return err
+		}
+		for _, hit := range hits {
+			if !fun(hit) {
+				return nil
+			}
+		}
+	}
+}
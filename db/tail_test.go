@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTail(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	old, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := col.Insert(map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	hits := make(chan QueryHit, 10)
+	tailErr := make(chan error, 1)
+	go func() {
+		tailErr <- col.Tail(ctx, map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, func(hit QueryHit) bool {
+			hits <- hit
+			return true
+		})
+	}()
+	next := func() QueryHit {
+		select {
+		case hit := <-hits:
+			return hit
+		case <-time.After(2 * time.Second):
+			t.Fatal("No hit")
+		}
+		return QueryHit{}
+	}
+	// Current match comes first
+	if hit := next(); hit.ID != old {
+		t.Fatal(hit)
+	}
+	// Non-matching changes are not reported, matching inserts and updates are
+	if _, err := col.Insert(map[string]interface{}{"a": 3}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1, "b": "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hit := next(); hit.ID != id || hit.Doc["b"] != "new" {
+		t.Fatal(hit)
+	}
+	if err := col.Update(old, map[string]interface{}{"a": 1, "b": "updated"}); err != nil {
+		t.Fatal(err)
+	}
+	if hit := next(); hit.ID != old || hit.Doc["b"] != "updated" {
+		t.Fatal(hit)
+	}
+	if err := col.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-tailErr; err != context.Canceled {
+		t.Fatal(err)
+	}
+	if len(hits) != 0 {
+		t.Fatal(<-hits)
+	}
+	// The function may stop the tail
+	if err := col.Tail(context.Background(), "all", func(QueryHit) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	// Dropping the collection ends the tail
+	go func() {
+		tailErr <- col.Tail(context.Background(), "all", func(QueryHit) bool { return true })
+	}()
+	for {
+		col.watchLock.Lock()
+		subscribed := len(col.watchers) > 0
+		col.watchLock.Unlock()
+		if subscribed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := db.Drop("col"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-tailErr; err == nil {
+		t.Fatal("Did not end")
+	}
+}
@@ -0,0 +1,103 @@
+// Background task status tracking and asynchronous error reporting.
+
+package db
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// TaskError is the error passed to DB.OnError callbacks when a background task fails.
+type TaskError struct {
+	Task string // Name of the failed task
+	Err  error  // Error returned by the task
+}
+
+func (e TaskError) Error() string {
+	return fmt.Sprintf("Background task %s failed: %v", e.Task, e.Err)
+}
+
+// TaskStatus is a snapshot of the state of a background task.
+type TaskStatus struct {
+	Name      string    // Name of the task
+	Running   bool      // Whether the task is running right now
+	Runs      int       // Number of completed runs
+	Failures  int       // Number of runs that ended in error
+	LastStart time.Time // When the most recent run started
+	LastEnd   time.Time // When the most recent run finished
+	LastErr   string    // Error message of the most recent run, empty if it succeeded
+}
+
+// Background tasks and error callbacks registered on a database.
+type taskRegistry struct {
+	lock       *sync.Mutex
+	tasks      map[string]*TaskStatus
+	errHandler []func(err error)
+}
+
+func newTaskRegistry() *taskRegistry {
+	return &taskRegistry{lock: new(sync.Mutex), tasks: make(map[string]*TaskStatus)}
+}
+
+// Register a callback to be invoked whenever a background task fails. Callbacks are invoked in registration order.
+func (db *DB) OnError(fun func(err error)) {
+	db.bg.lock.Lock()
+	db.bg.errHandler = append(db.bg.errHandler, fun)
+	db.bg.lock.Unlock()
+}
+
+// Return status of all background tasks that have run at least once, ordered by task name.
+func (db *DB) TaskStatus() (ret []TaskStatus) {
+	db.bg.lock.Lock()
+	defer db.bg.lock.Unlock()
+	ret = make([]TaskStatus, 0, len(db.bg.tasks))
+	for _, status := range db.bg.tasks {
+		ret = append(ret, *status)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return
+}
+
+// Run fun as a named background task: record its status, and report a failure to the error callbacks.
+// The function blocks until fun returns; run it in a goroutine to make it asynchronous.
+func (db *DB) runTask(name string, fun func() error) error {
+	db.bg.lock.Lock()
+	status, exists := db.bg.tasks[name]
+	if !exists {
+		status = &TaskStatus{Name: name}
+		db.bg.tasks[name] = status
+	}
+	status.Running = true
+	status.LastStart = time.Now()
+	db.bg.lock.Unlock()
+
+	err := fun()
+
+	db.bg.lock.Lock()
+	status.Running = false
+	status.LastEnd = time.Now()
+	status.Runs++
+	status.LastErr = ""
+	if err != nil {
+		status.Failures++
+		status.LastErr = err.Error()
+	}
+	handlers := make([]func(error), len(db.bg.errHandler))
+	copy(handlers, db.bg.errHandler)
+	db.bg.lock.Unlock()
+
+	if err != nil {
+		taskErr := TaskError{Task: name, Err: err}
+		tdlog.CritNoRepeat("%v", taskErr)
+		for _, handler := range handlers {
+			handler(taskErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRunTask(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(db.TaskStatus()) != 0 {
+		t.Fatal(db.TaskStatus())
+	}
+	reported := make([]error, 0)
+	db.OnError(func(err error) {
+		reported = append(reported, err)
+	})
+	if err := db.runTask("b", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.runTask("a", func() error { return errors.New("boom") }); err == nil {
+		t.Fatal("Did not error")
+	}
+	if len(reported) != 1 {
+		t.Fatal(reported)
+	}
+	if taskErr, ok := reported[0].(TaskError); !ok || taskErr.Task != "a" || taskErr.Err.Error() != "boom" {
+		t.Fatal(reported[0])
+	}
+	status := db.TaskStatus()
+	if len(status) != 2 || status[0].Name != "a" || status[1].Name != "b" {
+		t.Fatal(status)
+	}
+	if status[0].Runs != 1 || status[0].Failures != 1 || status[0].LastErr != "boom" || status[0].Running {
+		t.Fatal(status[0])
+	}
+	if status[1].Runs != 1 || status[1].Failures != 0 || status[1].LastErr != "" || status[1].LastEnd.Before(status[1].LastStart) {
+		t.Fatal(status[1])
+	}
+	// A successful run clears the last error
+	db.runTask("a", func() error { return nil })
+	if status := db.TaskStatus(); status[0].Runs != 2 || status[0].Failures != 1 || status[0].LastErr != "" {
+		t.Fatal(status[0])
+	}
+}
@@ -0,0 +1,172 @@
+// Hot/cold data tiering.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// tierMigrator moves documents of all collections into the cold tier periodically.
+type tierMigrator struct {
+	lock   *sync.Mutex
+	cancel context.CancelFunc // Stops the migrator, nil if the migrator is not running
+	done   chan struct{}      // Closed when the migrator has stopped
+}
+
+// Return the cold tier directory of the collection, or an empty string if the database has no cold tier.
+func (db *DB) coldDir(name string) string {
+	if db.Config.ColdPath == "" {
+		return ""
+	}
+	return path.Join(db.Config.ColdPath, name)
+}
+
+// Open cold tier partitions of the collection, if the database has a cold tier.
+func (col *Col) loadCold() error {
+	dir := col.db.coldDir(col.name)
+	if dir == "" {
+		return nil
+	} else if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for i, part := range col.parts {
+		if err := part.OpenCold(
+			path.Join(dir, DOC_DATA_FILE+strconv.Itoa(i)),
+			path.Join(dir, DOC_LOOKUP_FILE+strconv.Itoa(i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move the cold tier directory of a collection along with the collection, if the database has a cold tier.
+func (db *DB) renameCold(oldName, newName string) error {
+	if db.Config.ColdPath == "" {
+		return nil
+	} else if err := os.RemoveAll(db.coldDir(newName)); err != nil {
+		return err
+	} else if err := os.Rename(db.coldDir(oldName), db.coldDir(newName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Remove the cold tier directory of a collection, if the database has a cold tier.
+func (db *DB) removeCold(name string) error {
+	if db.Config.ColdPath == "" {
+		return nil
+	}
+	return os.RemoveAll(db.coldDir(name))
+}
+
+// Return an error if the database has a cold tier, which dumps of the database directory would leave out.
+func (db *DB) checkDumpable() error {
+	if db.Config.ColdPath != "" {
+		return fmt.Errorf("Database %s has a cold tier in %s, back up both directories with file system tools instead", db.path, db.Config.ColdPath)
+	}
+	return nil
+}
+
+/*
+Move documents not accessed (inserted, read, or updated) within the idle duration into the cold tier, return the number
+of documents moved. Documents in the cold tier are read transparently, and moved back into the hot tier upon update;
+indexes are not affected. Access times are kept in memory, hence documents not accessed since the database was opened
+count as accessed upon opening. Return an error if the database has no cold tier (see data.Config.ColdPath).
+*/
+func (col *Col) MigrateCold(idle time.Duration) (int, error) {
+	return col.migrateCold(context.Background(), idle)
+}
+
+// Move documents into the cold tier as a heavy operation admitted under the context.
+func (col *Col) migrateCold(ctx context.Context, idle time.Duration) (moved int, err error) {
+	if col.db.Config.ColdPath == "" {
+		return 0, fmt.Errorf("Database %s has no cold tier", col.db.path)
+	}
+	done, err := col.db.heavy.admit(ctx, true)
+	if err != nil {
+		return
+	}
+	defer done()
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err = col.checkFlags(COL_WRITE); err != nil {
+		return
+	}
+	for _, part := range col.parts {
+		part.DataLock.Lock()
+		n, err := part.MigrateCold(idle)
+		part.DataLock.Unlock()
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+	return
+}
+
+/*
+Move documents not accessed within the idle duration into the cold tier (see Col.MigrateCold) in background, for all
+collections once every interval, replacing the migrator already running. Documents are moved as low priority heavy
+operations (see WithPriority), one collection at a time.
+*/
+func (db *DB) StartTiering(idle, interval time.Duration) error {
+	if db.Config.ColdPath == "" {
+		return fmt.Errorf("Database %s has no cold tier", db.path)
+	}
+	db.StopTiering()
+	ctx, cancel := context.WithCancel(WithPriority(context.Background(), PRIORITY_LOW))
+	migrator := db.tiering
+	migrator.lock.Lock()
+	migrator.cancel, migrator.done = cancel, make(chan struct{})
+	done := migrator.done
+	migrator.lock.Unlock()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, name := range db.AllCols() {
+				col := db.Use(name)
+				if col == nil || col.Flags()&COL_WRITE == 0 {
+					// Dropped meanwhile, or read-only
+					continue
+				}
+				moved, err := col.migrateCold(ctx, idle)
+				if ctx.Err() != nil {
+					return
+				} else if err != nil {
+					tdlog.Noticef("Failed to move documents of collection %s into cold tier: %v", name, err)
+				} else if moved > 0 {
+					tdlog.Infof("Moved %d documents of collection %s into cold tier", moved, name)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop the background migrator, do nothing if it is not running.
+func (db *DB) StopTiering() {
+	migrator := db.tiering
+	migrator.lock.Lock()
+	cancel, done := migrator.cancel, migrator.done
+	migrator.cancel, migrator.done = nil, nil
+	migrator.lock.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestColdTier(t *testing.T) {
+	coldDir := TEST_DATA_DIR + "-cold"
+	os.RemoveAll(TEST_DATA_DIR)
+	os.RemoveAll(coldDir)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(coldDir)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Use("col").MigrateCold(0); err == nil {
+		t.Fatal("did not error")
+	} else if err := db.StartTiering(0, time.Hour); err == nil {
+		t.Fatal("did not error")
+	}
+	db.Close()
+	// Configure the cold tier and reopen
+	db, err = OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Config.ColdPath = coldDir
+	if err := db.Reopen("col", COL_RDWR); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0, 20)
+	for i := 0; i < 20; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if moved, err := col.MigrateCold(time.Hour); err != nil || moved != 0 {
+		t.Fatal(moved, err)
+	} else if moved, err := col.MigrateCold(0); err != nil || moved != 20 {
+		t.Fatal(moved, err)
+	} else if err := db.Dump(TEST_DATA_DIR + "-dump"); err == nil {
+		t.Fatal("did not error")
+	}
+	// Cold documents are read, queried, updated and deleted as usual
+	if doc, err := col.Read(ids[3]); err != nil || doc["a"].(float64) != 3 {
+		t.Fatal(doc, err)
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": 5, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	} else if err := col.Update(ids[5], map[string]interface{}{"a": 50}); err != nil {
+		t.Fatal(err)
+	} else if err := col.Delete(ids[6]); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		count++
+		return true
+	})
+	if count != 19 {
+		t.Fatal(count)
+	}
+	// Renamed along with the collection
+	if err := db.Rename("col", "col2"); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(coldDir + "/col2"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col2")
+	if doc, err := col.Read(ids[3]); err != nil || doc["a"].(float64) != 3 {
+		t.Fatal(doc, err)
+	} else if doc, err := col.Read(ids[5]); err != nil || doc["a"].(float64) != 50 {
+		t.Fatal(doc, err)
+	}
+	// Background migration
+	if err := db.StartTiering(0, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	db.StopTiering()
+	if err := db.Drop("col2"); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(coldDir + "/col2"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	db.Close()
+}
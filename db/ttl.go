@@ -0,0 +1,161 @@
+// Document expiry by TTL indexes.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	TTL_SWEEP_INTERVAL = time.Minute // Default interval between sweeps of expired documents
+)
+
+// ttlReaper deletes expired documents of all collections periodically.
+type ttlReaper struct {
+	lock   *sync.Mutex
+	cancel context.CancelFunc // Stops the reaper, nil if the reaper is not running
+	done   chan struct{}      // Closed when the reaper has stopped
+}
+
+/*
+Create a TTL index on the path. Values at the path are times in seconds since the Unix epoch (e.g. time.Now().Unix()),
+and a document expires once the TTL has passed since any of its times. Expired documents are deleted by a background
+reaper once every sweep interval (see DB.SetTTLSweepInterval), hence they may remain readable for up to an interval
+after expiry. Documents without a number at the path never expire. The index is of number type, and is also useful for
+range queries like other number indexes.
+*/
+func (col *Col) IndexTTL(idxPath []string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("TTL %v of index on %v must be positive", ttl, idxPath)
+	}
+	return col.IndexWithOptions(idxPath, IndexOptions{Type: INDEX_TYPE_NUMBER, TTL: ttl})
+}
+
+/*
+Delete documents that have expired by the time according to TTL indexes of the collection, return the number of
+deleted documents. Deletions follow relations like DeleteMany. The reaper calls this periodically; call it directly to
+expire documents at a particular time.
+*/
+func (col *Col) Expire(now time.Time) (int, error) {
+	col.db.schemaLock.RLock()
+	if err := col.checkFlags(COL_WRITE); err != nil {
+		col.db.schemaLock.RUnlock()
+		return 0, err
+	}
+	// Look up documents of times up to the cutoff of each TTL index
+	cutoffs := make(map[string]float64)
+	found := make(map[int]struct{})
+	for idxName, opts := range col.indexOpts {
+		if _, building := col.building[idxName]; opts.TTL <= 0 || building {
+			continue
+		}
+		cutoffs[idxName] = float64(now.Add(-opts.TTL).UnixNano()) / 1e9
+		if err := col.numberRange(idxName, math.Inf(-1), cutoffs[idxName], false, false, 0, &found); err != nil {
+			col.db.schemaLock.RUnlock()
+			return 0, err
+		}
+	}
+	col.db.schemaLock.RUnlock()
+	if len(found) == 0 {
+		return 0, nil
+	}
+	ids := make([]int, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	rels, froms := col.referringRelations()
+	if err := col.denyReferenced(rels, froms, ids); err != nil {
+		return 0, err
+	}
+	// Documents updated meanwhile may no longer be expired
+	deleted, err := col.deleteMany(ids, func(docB []byte) bool {
+		return col.expired(docB, cutoffs)
+	})
+	if err != nil {
+		return len(deleted), err
+	}
+	return len(deleted), col.cascadeDelete(rels, froms, deleted)
+}
+
+// Return true if the document has a time not later than the cutoff of a TTL index. The caller must place schema lock.
+func (col *Col) expired(docB []byte, cutoffs map[string]float64) bool {
+	for idxName, cutoff := range cutoffs {
+		if _, exists := col.indexPaths[idxName]; !exists {
+			// Removed meanwhile
+			continue
+		}
+		for _, canon := range col.canonicalValues(idxName, docB) {
+			if canon.(float64) <= cutoff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Set the interval between sweeps of expired documents by TTL indexes, 0 to stop sweeping. The reaper starts with the
+interval of TTL_SWEEP_INTERVAL when the database is opened, and goes through collections opened for writing.
+*/
+func (db *DB) SetTTLSweepInterval(interval time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("Invalid TTL sweep interval %v", interval)
+	}
+	db.stopTTLReaper()
+	if interval == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	reaper := db.reaper
+	reaper.lock.Lock()
+	reaper.cancel, reaper.done = cancel, make(chan struct{})
+	done := reaper.done
+	reaper.lock.Unlock()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			for _, name := range db.AllCols() {
+				col := db.Use(name)
+				if col == nil || col.Flags()&COL_WRITE == 0 {
+					// Dropped meanwhile, or read-only
+					continue
+				}
+				expired, err := col.Expire(time.Now())
+				if ctx.Err() != nil {
+					return
+				} else if err != nil {
+					tdlog.Noticef("Failed to delete expired documents of collection %s: %v", name, err)
+				} else if expired > 0 {
+					tdlog.Infof("Deleted %d expired documents of collection %s", expired, name)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop the background reaper, do nothing if it is not running.
+func (db *DB) stopTTLReaper() {
+	reaper := db.reaper
+	reaper.lock.Lock()
+	cancel, done := reaper.cancel, reaper.done
+	reaper.cancel, reaper.done = nil, nil
+	reaper.lock.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
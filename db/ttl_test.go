@@ -0,0 +1,136 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestTTLIndex(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.IndexTTL([]string{"exp"}, 0); err == nil {
+		t.Fatal("Did not error")
+	} else if err := col.IndexWithOptions([]string{"exp"}, IndexOptions{TTL: time.Hour}); err == nil {
+		t.Fatal("Did not error")
+	} else if err := col.IndexTTL([]string{"exp"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	docs := []map[string]interface{}{
+		{"exp": now.Add(-2 * time.Hour).Unix()},
+		{"exp": float64(now.Add(-30*time.Minute).UnixNano()) / 1e9},
+		{"exp": []interface{}{now.Unix(), now.Add(-3 * time.Hour).Unix()}},
+		{"exp": "yesterday"},
+		{"other": 1},
+	}
+	ids := make([]int, len(docs))
+	for i, doc := range docs {
+		if ids[i], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Documents expire once the TTL has passed since any of their times
+	if expired, err := col.Expire(now); err != nil || expired != 2 {
+		t.Fatal(expired, err)
+	} else if _, err := col.Read(ids[0]); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if _, err := col.Read(ids[2]); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if _, err := col.Read(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	// Times in the future do not expire until then
+	if err := col.Update(ids[1], map[string]interface{}{"exp": now.Add(time.Hour).Unix()}); err != nil {
+		t.Fatal(err)
+	} else if expired, err := col.Expire(now.Add(time.Hour)); err != nil || expired != 0 {
+		t.Fatal(expired, err)
+	} else if expired, err := col.Expire(now.Add(2 * time.Hour)); err != nil || expired != 1 {
+		t.Fatal(expired, err)
+	} else if expired, err := col.Expire(now.Add(1000 * time.Hour)); err != nil || expired != 0 {
+		t.Fatal(expired, err)
+	}
+	remaining := make(map[int]struct{})
+	col.ForEachDoc(func(id int, _ []byte) bool {
+		remaining[id] = struct{}{}
+		return true
+	})
+	if !ensureMapHasKeys(remaining, ids[3], ids[4]) {
+		t.Fatal(remaining)
+	}
+	// The options survive reopening
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if opts, err := col.IndexOptionsOf([]string{"exp"}); err != nil || opts.TTL != time.Hour || opts.Type != INDEX_TYPE_NUMBER {
+		t.Fatal(opts, err)
+	}
+}
+
+func TestTTLReaper(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.SetTTLSweepInterval(-1); err == nil {
+		t.Fatal("Did not error")
+	} else if err := db.SetTTLSweepInterval(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.IndexTTL([]string{"exp"}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expiring, err := col.Insert(map[string]interface{}{"exp": time.Now().Add(-time.Second).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staying, err := col.Insert(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := col.Read(expiring); dberr.Type(err) == dberr.ErrorNoDoc {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Expired document was not deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := col.Read(staying); err != nil {
+		t.Fatal(err)
+	}
+	// Stopping the reaper leaves expired documents alone
+	if err := db.SetTTLSweepInterval(0); err != nil {
+		t.Fatal(err)
+	}
+	expiring, err = col.Insert(map[string]interface{}{"exp": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := col.Read(expiring); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,49 @@
+// Documents as Go values (e.g. structs) encoded by encoding/json.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Encode the value into the JSON text of a document, return an error if it does not encode into a JSON object.
+func valueDoc(v interface{}) ([]byte, error) {
+	docB, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	} else if len(docB) == 0 || docB[0] != '{' {
+		return nil, fmt.Errorf("Value of type %T does not encode into a JSON object", v)
+	}
+	return docB, nil
+}
+
+// Insert the value (e.g. a struct, encoded by encoding/json) as a new document, return its ID.
+func (col *Col) InsertValue(v interface{}) (id int, err error) {
+	docB, err := valueDoc(v)
+	if err != nil {
+		return
+	}
+	return col.InsertFrom(bytes.NewReader(docB))
+}
+
+// Decode the document into the value, which is a pointer (e.g. to a struct) accepted by json.Unmarshal.
+func (col *Col) ReadValue(id int, v interface{}) error {
+	var docB bytes.Buffer
+	if _, err := col.ReadTo(id, &docB); err != nil {
+		return err
+	}
+	return json.Unmarshal(docB.Bytes(), v)
+}
+
+// Replace the document by the value (e.g. a struct, encoded by encoding/json).
+func (col *Col) UpdateValue(id int, v interface{}) error {
+	docB, err := valueDoc(v)
+	if err != nil {
+		return err
+	}
+	return col.UpdateBytesFunc(id, func([]byte) ([]byte, error) {
+		return docB, nil
+	})
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+type typedUser struct {
+	Name string   `json:"name"`
+	Age  int      `json:"age"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+func TestTypedDocs(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"name"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.InsertValue(typedUser{Name: "a", Age: 1, Tags: []string{"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var user typedUser
+	if err := col.ReadValue(id, &user); err != nil || user.Name != "a" || user.Age != 1 || len(user.Tags) != 1 {
+		t.Fatal(user, err)
+	}
+	// Values are indexed like other documents
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": "a", "in": []interface{}{"name"}}, col, &result); err != nil || !ensureMapHasKeys(result, id) {
+		t.Fatal(result, err)
+	}
+	if err := col.UpdateValue(id, &typedUser{Name: "b", Age: 2}); err != nil {
+		t.Fatal(err)
+	}
+	user = typedUser{}
+	if err := col.ReadValue(id, &user); err != nil || user.Name != "b" || user.Age != 2 || user.Tags != nil {
+		t.Fatal(user, err)
+	}
+	result = make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": "a", "in": []interface{}{"name"}}, col, &result); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	// Values must encode into JSON objects
+	if _, err := col.InsertValue([]int{1}); err == nil {
+		t.Fatal("Did not fail on array")
+	} else if err := col.UpdateValue(id, (*typedUser)(nil)); err == nil {
+		t.Fatal("Did not fail on null")
+	}
+	if err := col.ReadValue(12345, &user); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if err := col.UpdateValue(12345, user); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,131 @@
+// Unique index constraint.
+
+package db
+
+import (
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// A value on a unique index.
+type uniqueValue struct {
+	idxName string
+	canon   interface{}
+}
+
+/*
+Create a unique index on the path: inserting or updating a document fails with ErrorDuplicateKey if a value of the
+document at the path is already on the index for another document. Null and missing values are not constrained. The
+index is not created if existing documents have duplicate values. Bulk load (see BeginBulkLoad) suspends the constraint
+along with index maintenance.
+*/
+func (col *Col) IndexUnique(idxPath []string) error {
+	return col.IndexWithOptions(idxPath, IndexOptions{Unique: true})
+}
+
+// Return the canonical values of the document on the index, leaving out null and missing values.
+func (col *Col) canonicalValues(idxName string, docB []byte) (canons []interface{}) {
+	opts := col.indexOpts[idxName]
+	vals, err := opts.rawValues(docB, col.indexPaths[idxName])
+	if err != nil {
+		return nil
+	}
+	for _, val := range vals {
+		if val == nil {
+			continue
+		} else if canon, ok := opts.canonical(val); ok {
+			canons = append(canons, canon)
+		}
+	}
+	return
+}
+
+// Put all documents on a new unique index, return ErrorDuplicateKey if two documents have the same value. The caller
+// must place schema lock.
+func (col *Col) indexUnique(idxName string) (err error) {
+	owners := make(map[interface{}]int)
+	col.forEachDoc(func(id int, doc []byte) (moveOn bool) {
+		for _, canon := range col.canonicalValues(idxName, doc) {
+			if owner, exists := owners[canon]; exists && owner != id {
+				err = dberr.New(dberr.ErrorDuplicateKey, canon, col.indexPaths[idxName], owner)
+				return false
+			}
+			owners[canon] = id
+			hashKey := col.indexOpts[idxName].key(canon)
+			col.indexHT(idxName, hashKey).Put(hashKey, id)
+		}
+		return true
+	}, false)
+	return
+}
+
+// Lock the collection against concurrent writes to unique indexes and return the unlock function; nothing is locked if
+// the collection has no unique index. The caller must place schema lock, and must not hold any partition lock yet.
+func (col *Col) lockUnique() func() {
+	for _, opts := range col.indexOpts {
+		if opts.Unique {
+			col.uniqueLock.Lock()
+			return col.uniqueLock.Unlock
+		}
+	}
+	return func() {}
+}
+
+/*
+Return ErrorDuplicateKey if a value of the document (JSON text) on a unique index belongs to another document. The
+partition already locked by the caller (or nil) is read without locking. Values claimed by documents earlier in a batch
+that are not indexed yet are found in the batch map (or nil), which receives the values of the document if none is taken. The caller
+must place schema lock and lockUnique.
+*/
+func (col *Col) checkUnique(id int, docB []byte, locked *data.Partition, batch map[uniqueValue]int) error {
+	if col.bulkLoad {
+		return nil
+	}
+	claimed := make([]uniqueValue, 0, 1)
+	for idxName, opts := range col.indexOpts {
+		if !opts.Unique {
+			continue
+		}
+		for _, canon := range col.canonicalValues(idxName, docB) {
+			if owner, exists := batch[uniqueValue{idxName, canon}]; exists && owner != id {
+				return dberr.New(dberr.ErrorDuplicateKey, canon, col.indexPaths[idxName], owner)
+			}
+			claimed = append(claimed, uniqueValue{idxName, canon})
+			hashKey := opts.key(canon)
+			ht := col.indexHT(idxName, hashKey)
+			ht.Lock.RLock()
+			owners := ht.Get(hashKey, 0)
+			ht.Lock.RUnlock()
+			for _, owner := range owners {
+				if owner != id && col.hasValue(owner, idxName, canon, locked) {
+					return dberr.New(dberr.ErrorDuplicateKey, canon, col.indexPaths[idxName], owner)
+				}
+			}
+		}
+	}
+	if batch != nil {
+		for _, val := range claimed {
+			batch[val] = id
+		}
+	}
+	return nil
+}
+
+// Return true if the document has the canonical value on the index, rather than a value of the same hash key.
+func (col *Col) hasValue(id int, idxName string, canon interface{}, locked *data.Partition) bool {
+	part := col.parts[id%col.db.numParts]
+	if part != locked {
+		part.DataLock.RLock()
+		defer part.DataLock.RUnlock()
+	}
+	docB, err := part.Read(id)
+	if err != nil {
+		return false
+	}
+	for _, val := range col.canonicalValues(idxName, docB) {
+		if val == canon {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestIndexUnique(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	id1, err := col.Insert(map[string]interface{}{"email": "a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := col.Insert(map[string]interface{}{"email": "a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Existing duplicates prevent the index
+	if err := col.IndexUnique([]string{"email"}); dberr.Type(err) != dberr.ErrorDuplicateKey {
+		t.Fatal(err)
+	} else if len(col.AllIndexes()) != 0 {
+		t.Fatal(col.AllIndexes())
+	} else if err := col.Update(id2, map[string]interface{}{"email": "b@example.com"}); err != nil {
+		t.Fatal(err)
+	} else if err := col.IndexUnique([]string{"email"}); err != nil {
+		t.Fatal(err)
+	} else if opts, err := col.IndexOptionsOf([]string{"email"}); err != nil || !opts.Unique {
+		t.Fatal(opts, err)
+	}
+	// Duplicates are rejected by inserts and updates
+	if _, err := col.Insert(map[string]interface{}{"email": "a@example.com"}); dberr.Type(err) != dberr.ErrorDuplicateKey {
+		t.Fatal(err)
+	} else if _, err := col.InsertWithID(12345, map[string]interface{}{"email": "b@example.com"}, false); dberr.Type(err) != dberr.ErrorDuplicateKey {
+		t.Fatal(err)
+	} else if _, err := col.InsertFrom(strings.NewReader(`{"email": "b@example.com"}`)); dberr.Type(err) != dberr.ErrorDuplicateKey {
+		t.Fatal(err)
+	} else if err := col.Update(id2, map[string]interface{}{"email": "a@example.com"}); dberr.Type(err) != dberr.ErrorDuplicateKey {
+		t.Fatal(err)
+	} else if err := col.UpdateFunc(id2, func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"email": "a@example.com"}, nil
+	}); dberr.Type(err) != dberr.ErrorDuplicateKey {
+		t.Fatal(err)
+	} else if err := col.UpdateBytesFunc(id2, func(doc []byte) ([]byte, error) {
+		return []byte(`{"email": "a@example.com"}`), nil
+	}); dberr.Type(err) != dberr.ErrorDuplicateKey {
+		t.Fatal(err)
+	}
+	// A document may keep its own value, and null values are not constrained
+	if err := col.Update(id1, map[string]interface{}{"email": "a@example.com", "n": 1}); err != nil {
+		t.Fatal(err)
+	} else if _, err := col.Insert(map[string]interface{}{"other": 1}); err != nil {
+		t.Fatal(err)
+	} else if _, err := col.Insert(map[string]interface{}{"other": 2}); err != nil {
+		t.Fatal(err)
+	} else if id3, err := col.Insert(map[string]interface{}{"email": "c@example.com"}); err != nil {
+		t.Fatal(err)
+	} else if err := col.Delete(id3); err != nil {
+		t.Fatal(err)
+	} else if _, err := col.Insert(map[string]interface{}{"email": "c@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	// Values claimed earlier in a batch count
+	failed, err := col.UpdateBytesMany([]int{id1, id2}, func(id int, doc []byte) ([]byte, error) {
+		return []byte(`{"email": "d@example.com"}`), nil
+	})
+	if err != nil || len(failed) != 1 {
+		t.Fatal(failed, err)
+	}
+	for id, err := range failed {
+		if dberr.Type(err) != dberr.ErrorDuplicateKey || (id != id1 && id != id2) {
+			t.Fatal(id, err)
+		}
+	}
+	// The constraint survives reopening
+	if err := db.Reopen("col", COL_RDWR); err != nil {
+		t.Fatal(err)
+	} else if _, err := col.Insert(map[string]interface{}{"email": "d@example.com"}); dberr.Type(err) != dberr.ErrorDuplicateKey {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,133 @@
+// Validation of database directory content upon opening.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// OpenOptions adjust how OpenDBWithOptions treats the content of a database directory.
+type OpenOptions struct {
+	CreateMissing bool // Create missing partition files of collections and indexes (empty) instead of failing to open
+	Compact       bool // Create a new database with compact configuration (see data.CompactConfig) and a single partition
+}
+
+// Open database and load all collections & indexes. Opening fails if a collection or index misses partition files,
+// unless the options ask for creating them.
+func OpenDBWithOptions(dbPath string, opts OpenOptions) (*DB, error) {
+	db, err := newDB(dbPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.load(); err != nil {
+		return db, err
+	}
+	return db, db.SetTTLSweepInterval(TTL_SWEEP_INTERVAL)
+}
+
+// Return the partition number of a file name made of the prefix and a number, or -1 if the name is not.
+func partNumOf(fileName, prefix string) int {
+	if !strings.HasPrefix(fileName, prefix) {
+		return -1
+	}
+	partNum, err := strconv.Atoi(strings.TrimPrefix(fileName, prefix))
+	if err != nil || partNum < 0 {
+		return -1
+	}
+	return partNum
+}
+
+/*
+Check that a collection directory has data and lookup files of all partitions, that each index directory has hash
+table files of all partitions, and that no partition file exceeds the number of partitions. Return an error describing
+all problems found. Missing files are not a problem if the open options ask for creating them.
+Insertion log and attachment files are left out, as they are created on demand.
+*/
+func (db *DB) validateCol(name string) error {
+	colDir := path.Join(db.path, name)
+	colDirContent, err := ioutil.ReadDir(colDir)
+	if err != nil {
+		return err
+	} else if len(colDirContent) == 0 {
+		// The collection was being created
+		return nil
+	}
+	var missing, stray []string
+	// Return partitions missing from the ones found
+	missingParts := func(found map[int]bool, numParts int) (ret []string) {
+		for i := 0; i < numParts; i++ {
+			if !found[i] {
+				ret = append(ret, strconv.Itoa(i))
+			}
+		}
+		return
+	}
+	dataFiles, lookupFiles := make(map[int]bool), make(map[int]bool)
+	for _, info := range colDirContent {
+		if info.IsDir() {
+			continue
+		}
+		for _, prefix := range []string{DOC_DATA_FILE, DOC_LOOKUP_FILE, INSERT_LOG_FILE, BLOB_FILE} {
+			if partNum := partNumOf(info.Name(), prefix); partNum >= db.numParts {
+				stray = append(stray, fmt.Sprintf("collection %s file %s belongs to partition %d, but the database has %d partitions", name, info.Name(), partNum, db.numParts))
+			} else if partNum >= 0 && prefix == DOC_DATA_FILE {
+				dataFiles[partNum] = true
+			} else if partNum >= 0 && prefix == DOC_LOOKUP_FILE {
+				lookupFiles[partNum] = true
+			}
+		}
+	}
+	for _, partNum := range missingParts(dataFiles, db.numParts) {
+		missing = append(missing, fmt.Sprintf("collection %s partition %s data file %s%s missing", name, partNum, DOC_DATA_FILE, partNum))
+	}
+	for _, partNum := range missingParts(lookupFiles, db.numParts) {
+		missing = append(missing, fmt.Sprintf("collection %s partition %s lookup file %s%s missing", name, partNum, DOC_LOOKUP_FILE, partNum))
+	}
+	for _, htDir := range colDirContent {
+		if !htDir.IsDir() {
+			continue
+		}
+		idxContent, err := ioutil.ReadDir(path.Join(colDir, htDir.Name()))
+		if err != nil {
+			return err
+		}
+		// The index may have fewer partitions than the database, see IndexOptions.Parts
+		idxParts := db.numParts
+		if optsContent, err := ioutil.ReadFile(path.Join(colDir, htDir.Name(), INDEX_OPTS_FILE)); err == nil {
+			var opts IndexOptions
+			if json.Unmarshal(optsContent, &opts) == nil && opts.Parts > 0 {
+				idxParts = opts.Parts
+			}
+		}
+		htFiles := make(map[int]bool)
+		for _, info := range idxContent {
+			if partNum := partNumOf(info.Name(), ""); partNum >= idxParts {
+				stray = append(stray, fmt.Sprintf("index %s of collection %s has file %s of partition %d, but the index has %d partitions", htDir.Name(), name, info.Name(), partNum, idxParts))
+			} else if partNum >= 0 {
+				htFiles[partNum] = true
+			}
+		}
+		if parts := missingParts(htFiles, idxParts); len(parts) > 0 {
+			missing = append(missing, fmt.Sprintf("index %s of collection %s has %d of %d partitions (missing %s)", htDir.Name(), name, idxParts-len(parts), idxParts, strings.Join(parts, ", ")))
+		}
+	}
+	problems := stray
+	if db.openOpts.CreateMissing {
+		for _, problem := range missing {
+			tdlog.Noticef("Creating missing files: %s", problem)
+		}
+	} else {
+		problems = append(missing, stray...)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Database %s is damaged: %s", db.path, strings.Join(problems, "; "))
+	}
+	return nil
+}
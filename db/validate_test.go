@@ -0,0 +1,112 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+func TestOpenValidation(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err := db.Use("col").Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// Missing partition files
+	if err := os.Remove(TEST_DATA_DIR + "/col/dat_1"); err != nil {
+		t.Fatal(err)
+	} else if err := os.Remove(TEST_DATA_DIR + "/col/a/0"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenDB(TEST_DATA_DIR)
+	if err == nil || !strings.Contains(err.Error(), "collection col partition 1 data file dat_1 missing") ||
+		!strings.Contains(err.Error(), "index a of collection col has 1 of 2 partitions (missing 0)") {
+		t.Fatal(err)
+	}
+	if db, err = OpenDBWithOptions(TEST_DATA_DIR, OpenOptions{CreateMissing: true}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// Stray partition files are not fixed by creating missing files
+	touchFile(TEST_DATA_DIR+"/col", "dat_2")
+	touchFile(TEST_DATA_DIR+"/col/a", "5")
+	for _, opts := range []OpenOptions{{}, {CreateMissing: true}} {
+		_, err := OpenDBWithOptions(TEST_DATA_DIR, opts)
+		if err == nil || !strings.Contains(err.Error(), "collection col file dat_2 belongs to partition 2, but the database has 2 partitions") ||
+			!strings.Contains(err.Error(), "index a of collection col has file 5 of partition 5") {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenCompact(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDBWithOptions(TEST_DATA_DIR, OpenOptions{Compact: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.numParts != 1 || db.Config.HashBits != data.CompactHashBits {
+		t.Fatal(db.numParts, db.Config)
+	}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("col%d", i)
+		if err := db.Create(name); err != nil {
+			t.Fatal(err)
+		} else if err := db.Use(name).Index([]string{"a"}); err != nil {
+			t.Fatal(err)
+		} else if _, err := db.Use(name).Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each small collection takes a few increments of file growth
+	size := int64(0)
+	filepath.Walk(TEST_DATA_DIR, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if size > 10*4*data.CompactFileGrowth {
+		t.Fatal("Collections take too much space", size)
+	}
+	// The database stays compact when opened again without the option
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.numParts != 1 || db.Config.HashBits != data.CompactHashBits {
+		t.Fatal(db.numParts, db.Config)
+	}
+	if q, err := runQuery(`{"eq": 5, "in": ["a"]}`, db.Use("col5")); err != nil || len(q) != 1 {
+		t.Fatal(q, err)
+	}
+}
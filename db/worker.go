@@ -0,0 +1,111 @@
+// Partition workers - optional execution mode of document writes.
+
+package db
+
+import (
+	"sync"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+const (
+	WORKER_BATCH_SIZE = 64 // Maximum number of queued writes a partition worker carries out under one lock acquisition.
+)
+
+// A write of partition data handed to a partition worker.
+type partitionOp struct {
+	fun  func(part *data.Partition) error
+	err  error
+	done chan struct{}
+}
+
+/*
+Carry out document inserts, updates and deletes of each collection partition on a dedicated goroutine, which consumes a
+queue of up to queueLen writes. Writers of a partition no longer contend for its lock; instead the worker takes the
+lock once for a batch of queued writes. Index maintenance remains with the writers. Pass 0 to turn off the workers.
+*/
+func (db *DB) SetPartitionWorkers(queueLen int) {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	if queueLen < 0 {
+		queueLen = 0
+	}
+	for _, col := range db.cols {
+		col.stopWorkers()
+	}
+	db.workerQueue = queueLen
+	if queueLen > 0 {
+		for _, col := range db.cols {
+			col.startWorkers()
+		}
+	}
+}
+
+// Start a worker for each partition. The caller must place schema lock.
+func (col *Col) startWorkers() {
+	col.workers = make([]chan *partitionOp, col.db.numParts)
+	col.workersDone = new(sync.WaitGroup)
+	for i := range col.workers {
+		col.workers[i] = make(chan *partitionOp, col.db.workerQueue)
+		col.workersDone.Add(1)
+		go col.runWorker(i, col.workers[i], col.workersDone)
+	}
+}
+
+// Stop partition workers and wait for them to exit. The caller must place schema lock.
+func (col *Col) stopWorkers() {
+	if col.workers == nil {
+		return
+	}
+	for _, queue := range col.workers {
+		close(queue)
+	}
+	col.workersDone.Wait()
+	col.workers, col.workersDone = nil, nil
+}
+
+// Carry out queued writes of a partition in batches until the queue is closed.
+func (col *Col) runWorker(partNum int, queue chan *partitionOp, done *sync.WaitGroup) {
+	defer done.Done()
+	batch := make([]*partitionOp, 0, WORKER_BATCH_SIZE)
+	for op := range queue {
+		batch = append(batch[:0], op)
+	collect:
+		for len(batch) < WORKER_BATCH_SIZE {
+			select {
+			case op, ok := <-queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, op)
+			default:
+				break collect
+			}
+		}
+		// Writers hold schema lock while waiting for their turn, hence the partition stays open meanwhile
+		part := col.parts[partNum]
+		part.DataLock.Lock()
+		for _, op := range batch {
+			op.err = op.fun(part)
+		}
+		part.DataLock.Unlock()
+		for _, op := range batch {
+			close(op.done)
+		}
+	}
+}
+
+// Run fun with the partition locked for writing, either right away or on the partition worker if the workers are
+// running. The caller must place schema lock.
+func (col *Col) writePart(partNum int, fun func(part *data.Partition) error) error {
+	if col.workers == nil {
+		part := col.parts[partNum]
+		part.DataLock.Lock()
+		defer part.DataLock.Unlock()
+		return fun(part)
+	}
+	op := &partitionOp{fun: fun, done: make(chan struct{})}
+	col.workers[partNum] <- op
+	<-op.done
+	return op.err
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestPartitionWorkers(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	db.SetPartitionWorkers(16)
+	if len(col.workers) != db.numParts {
+		t.Fatal(col.workers)
+	}
+	// Concurrent writes go through the workers
+	ids := make([]int, 200)
+	wg := new(sync.WaitGroup)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := col.Insert(map[string]interface{}{"a": i})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = id
+			if err := col.Update(id, map[string]interface{}{"a": i, "b": i}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, id := range ids {
+		if doc, err := col.Read(id); err != nil || doc["b"].(float64) != float64(i) {
+			t.Fatal(doc, err)
+		}
+	}
+	if err := col.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	} else if err := col.Delete(ids[0]); err == nil {
+		t.Fatal("Did not error")
+	}
+	if deleted, err := col.DeleteMany(ids[1:10]); err != nil || deleted != 9 {
+		t.Fatal(deleted, err)
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"has": []interface{}{"a"}}, col, &result); err != nil || len(result) != 190 {
+		t.Fatal(len(result), err)
+	}
+	// Collections created or reopened later have workers too
+	if err := db.Create("col2"); err != nil {
+		t.Fatal(err)
+	} else if len(db.Use("col2").workers) != db.numParts {
+		t.Fatal(db.Use("col2").workers)
+	}
+	if err := db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	} else if _, err := col.Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	db.SetPartitionWorkers(0)
+	if col.workers != nil || db.Use("col2").workers != nil {
+		t.Fatal("Workers are still running")
+	}
+	if _, err := col.Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+}
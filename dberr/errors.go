@@ -9,17 +9,46 @@ const (
 	ErrorUndefined errorType = "Unknown Error."
 
 	// IO error
-	ErrorIO    errorType = "IO error has occured, see log for more details."
-	ErrorNoDoc errorType = "Document `%d` does not exist"
+	ErrorIO     errorType = "IO error has occured, see log for more details."
+	ErrorNoDoc  errorType = "Document `%d` does not exist"
+	ErrorNoBlob errorType = "Blob `%d` does not exist"
 
 	// Document errors
-	ErrorDocTooLarge errorType = "Document is too large. Max: `%d`, Given: `%d`"
+	ErrorDocTooLarge     errorType = "Document is too large. Max: `%d`, Given: `%d`"
+	ErrorDocTooDeep      errorType = "Document is nested too deeply. Max depth: `%d`"
+	ErrorDocTooManyKeys  errorType = "Document has too many keys. Max: `%d`"
+	ErrorDocArrayTooLong errorType = "Document has an array that is too long. Max: `%d`, Given: `%d`"
+	ErrorDocExists       errorType = "Document `%d` already exists"
+	ErrorDuplicateKey    errorType = "Value `%v` of unique index %v already belongs to document `%d`"
+
+	// Write rate limit errors
+	ErrorWriteQueueFull errorType = "Too many writes are waiting for their turn. Max: `%d`"
+
+	// Admission control errors
+	ErrorTooBusy       errorType = "Too many heavy operations are running or waiting for their turn. Max running: `%d`"
+	ErrorQuotaExceeded errorType = "Caller `%s` has exceeded its quota of `%d` heavy operations per second"
+
+	// Reference integrity errors
+	ErrorReferenced errorType = "Document `%d` is referenced by document `%d` of collection `%s`"
+
+	// Attachment errors
+	ErrorNoAttachment errorType = "Document `%d` does not have attachment `%s`"
+
+	// Queue errors
+	ErrorStaleReceipt errorType = "Receipt of message `%d` is not of its latest pop, the message may have been handed out again"
+
+	// Collection access errors
+	ErrorColReadOnly  errorType = "Collection `%s` is opened read-only"
+	ErrorColWriteOnly errorType = "Collection `%s` is opened write-only"
+	ErrorColDropped   errorType = "Collection `%s` has been dropped"
 
 	// Query input errors
 	ErrorNeedIndex         errorType = "Please index %v and retry query %v."
+	ErrorIndexBuilding     errorType = "Index %v is being built in background, please retry query %v later."
 	ErrorExpectingSubQuery errorType = "Expecting a vector of sub-queries, but %v given."
 	ErrorExpectingInt      errorType = "Expecting `%s` as an integer, but %v given."
 	ErrorMissing           errorType = "Missing `%s`"
+	ErrorQueryTooLarge     errorType = "Query result or intermediate set exceeds the limit of `%d` document IDs"
 )
 
 func New(err errorType, details ...interface{}) Error {
@@ -45,3 +74,21 @@ func Type(e error) errorType {
 	}
 	return ErrorUndefined
 }
+
+/*
+Return true if the error is temporary and the operation may succeed when retried later, e.g. a write shed by write rate
+limit or a query shed by admission control; false if retrying cannot help, e.g. a document too large or a missing
+index. Errors of other packages are retryable if they have a Temporary method returning true (e.g. net.Error).
+*/
+func IsRetryable(e error) bool {
+	switch Type(e) {
+	case ErrorWriteQueueFull, ErrorTooBusy, ErrorQuotaExceeded, ErrorIndexBuilding:
+		return true
+	case ErrorUndefined:
+		temp, ok := e.(interface {
+			Temporary() bool
+		})
+		return ok && temp.Temporary()
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+/*
+Package dbtest helps applications to test their use of tiedot: it creates isolated databases in temporary directories,
+and loads test fixtures from NDJSON (one JSON document per line).
+
+	func TestSomething(t *testing.T) {
+		tdb := dbtest.NewTempDB(t)
+		defer tdb.Close()
+		ids := tdb.LoadNDJSON(t, "Users", strings.NewReader(`{"Name": "Joe"}
+	{"Name": "Ann"}`))
+		...
+	}
+*/
+
+package dbtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+// TempDB is a database in a temporary directory, the directory is removed when the database is closed.
+type TempDB struct {
+	*db.DB
+	Dir string // Temporary database directory
+}
+
+// Open a new empty database in a temporary directory. The test fails immediately if the database cannot be opened.
+// Close the database at the end of the test to remove the directory.
+func NewTempDB(t testing.TB) *TempDB {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tiedot_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.OpenDB(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return &TempDB{DB: database, Dir: dir}
+}
+
+// Close the database and remove its directory.
+func (tdb *TempDB) Close() error {
+	err := tdb.DB.Close()
+	if rmErr := os.RemoveAll(tdb.Dir); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// Insert documents read from NDJSON input (one JSON object per line, blank lines are ignored) into the collection,
+// creating the collection if necessary. Return IDs of the inserted documents in input order.
+func (tdb *TempDB) LoadNDJSON(t testing.TB, colName string, in io.Reader) (ids []int) {
+	t.Helper()
+	col, err := tdb.UseOrCreate(colName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), tdb.Config.DocMaxRoom)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &doc); err != nil {
+			t.Fatalf("Fixture line %d is not a JSON object: %v", lineNum, err)
+		}
+		id, err := col.Insert(doc)
+		if err != nil {
+			t.Fatalf("Failed to insert fixture line %d: %v", lineNum, err)
+		}
+		ids = append(ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Insert documents read from an NDJSON file into the collection, just like LoadNDJSON.
+func (tdb *TempDB) LoadNDJSONFile(t testing.TB, colName, fileName string) []int {
+	t.Helper()
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	return tdb.LoadNDJSON(t, colName, file)
+}
@@ -0,0 +1,46 @@
+package dbtest
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestTempDB(t *testing.T) {
+	tdb := NewTempDB(t)
+	other := NewTempDB(t)
+	if tdb.Dir == other.Dir {
+		t.Fatal(tdb.Dir)
+	}
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(other.Dir); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	ids := tdb.LoadNDJSON(t, "Users", strings.NewReader(`{"Name": "Joe"}
+
+{"Name": "Ann"}
+`))
+	if len(ids) != 2 {
+		t.Fatal(ids)
+	}
+	if doc, err := tdb.Use("Users").Read(ids[1]); err != nil || doc["Name"] != "Ann" {
+		t.Fatal(doc, err)
+	}
+	fixture := path.Join(tdb.Dir, "fixture.ndjson")
+	if err := ioutil.WriteFile(fixture, []byte(`{"Name": "Bob"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if ids := tdb.LoadNDJSONFile(t, "Users", fixture); len(ids) != 1 {
+		t.Fatal(ids)
+	}
+	if err := tdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tdb.Dir); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
@@ -40,6 +40,31 @@ func Map(f *os.File) (MMap, error) {
 	return mmap(length, fd)
 }
 
+/*
+Grow extends the mapping to cover the entire file after the file has grown. Where the platform allows, the grown part
+is mapped right after the existing mapping, so that data already mapped is left alone; otherwise the file is re-mapped
+in its entirety. Grow should only be called on the slice value returned from Map.
+*/
+func (m *MMap) Grow(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	length := int(fi.Size())
+	if int64(length) != fi.Size() {
+		return errors.New("memory map file length overflow")
+	} else if length <= len(*m) {
+		return nil
+	} else if growView(m, length, uintptr(f.Fd())) {
+		return nil
+	}
+	if err := m.Unmap(); err != nil {
+		return err
+	}
+	*m, err = Map(f)
+	return err
+}
+
 func (m *MMap) header() *reflect.SliceHeader {
 	return (*reflect.SliceHeader)(unsafe.Pointer(m))
 }
@@ -0,0 +1,42 @@
+package gommap
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGrow(t *testing.T) {
+	tmp := "/tmp/tiedot_gommap_test"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// A multiple of page size and Windows allocation granularity, so that the grown part may be mapped on its own
+	size := int64(65536)
+	if _, err := f.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Map(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m[0] = 1
+	if _, err := f.WriteAt(make([]byte, size), size); err != nil {
+		t.Fatal(err)
+	} else if err := m.Grow(f); err != nil {
+		t.Fatal(err)
+	} else if int64(len(m)) != 2*size || m[0] != 1 {
+		t.Fatal(len(m), m[0])
+	}
+	m[len(m)-1] = 2
+	if err := m.Unmap(); err != nil {
+		t.Fatal(err)
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, 2*size-1); err != nil || last[0] != 2 {
+		t.Fatal(last, err)
+	}
+}
@@ -14,6 +14,11 @@ func mmap(len int, fd uintptr) ([]byte, error) {
 	return syscall.Mmap(int(fd), 0, len, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
 }
 
+// Growing a mapping in place is not attempted, the file is re-mapped instead.
+func growView(m *MMap, length int, fd uintptr) bool {
+	return false
+}
+
 func unmap(addr, len uintptr) error {
 	_, _, errno := syscall.Syscall(syscall.SYS_MUNMAP, addr, len, 0)
 	if errno != 0 {
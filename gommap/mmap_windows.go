@@ -21,6 +21,20 @@ import (
 var handleLock sync.Mutex
 var handleMap = map[uintptr]syscall.Handle{}
 
+// A view mapped right after another view, to grow a mapping without re-mapping it.
+type growthView struct {
+	addr   uintptr
+	handle syscall.Handle
+}
+
+// Growth views of a mapping, keyed by the memory address of the mapping.
+var growthMap = map[uintptr][]growthView{}
+
+var procMapViewOfFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("MapViewOfFileEx")
+
+// A grown view must start at a multiple of the allocation granularity, which is 64KB on all Windows versions.
+var granularity = int64(65536)
+
 // Windows mmap always mapes the entire file regardless of the specified length.
 func mmap(length int, hfile uintptr) ([]byte, error) {
 	h, errno := syscall.CreateFileMapping(syscall.Handle(hfile), nil, syscall.PAGE_READWRITE, 0, 0, nil)
@@ -30,6 +44,7 @@ func mmap(length int, hfile uintptr) ([]byte, error) {
 
 	addr, errno := syscall.MapViewOfFile(h, syscall.FILE_MAP_WRITE, 0, 0, 0)
 	if addr == 0 {
+		syscall.CloseHandle(h)
 		return nil, os.NewSyscallError("MapViewOfFile", errno)
 	}
 	handleLock.Lock()
@@ -45,7 +60,51 @@ func mmap(length int, hfile uintptr) ([]byte, error) {
 	return m, nil
 }
 
+/*
+Growing a mapping and re-mapping the entire file is slow, and may fail to find a large enough address range under
+memory pressure. Instead, map the grown part of the file as another view placed at the address right after the
+mapping. This fails if the address range is taken or the mapping does not end at allocation granularity, in which
+case the caller re-maps the file.
+*/
+func growView(m *MMap, length int, hfile uintptr) bool {
+	dh := m.header()
+	if dh.Len == 0 || int64(dh.Len)%granularity != 0 {
+		return false
+	}
+	// The file mapping object must cover the grown file
+	h, _ := syscall.CreateFileMapping(syscall.Handle(hfile), nil, syscall.PAGE_READWRITE, 0, 0, nil)
+	if h == 0 {
+		return false
+	}
+	offset, want := uint64(dh.Len), dh.Data+uintptr(dh.Len)
+	addr, _, _ := procMapViewOfFileEx.Call(uintptr(h), syscall.FILE_MAP_WRITE, uintptr(uint32(offset>>32)), uintptr(uint32(offset)), uintptr(length-dh.Len), want)
+	if addr != want {
+		if addr != 0 {
+			syscall.UnmapViewOfFile(addr)
+		}
+		syscall.CloseHandle(h)
+		return false
+	}
+	handleLock.Lock()
+	growthMap[dh.Data] = append(growthMap[dh.Data], growthView{addr: addr, handle: h})
+	handleLock.Unlock()
+	dh.Len = length
+	dh.Cap = length
+	return true
+}
+
 func unmap(addr, len uintptr) error {
+	handleLock.Lock()
+	views := growthMap[addr]
+	delete(growthMap, addr)
+	handleLock.Unlock()
+	for _, view := range views {
+		if err := syscall.UnmapViewOfFile(view.addr); err != nil {
+			return err
+		} else if err := syscall.CloseHandle(view.handle); err != nil {
+			return os.NewSyscallError("CloseHandle", err)
+		}
+	}
 	if err := syscall.UnmapViewOfFile(addr); err != nil {
 		return err
 	}
@@ -0,0 +1,174 @@
+// Admin web UI.
+
+package httpapi
+
+import (
+	"net/http"
+)
+
+// Serve the admin web UI page, which browses collections and documents, runs queries, shows index statistics, and
+// triggers scrub and dump by calling the API endpoints.
+func Admin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(adminPage))
+}
+
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tiedot admin</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; height: 100vh; }
+nav { width: 220px; background: #f0f0f0; padding: 10px; overflow-y: auto; }
+nav a { display: block; padding: 3px 0; cursor: pointer; color: #036; }
+nav a.current { font-weight: bold; }
+main { flex: 1; padding: 10px; overflow-y: auto; }
+section { margin-bottom: 20px; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 3px 8px; text-align: left; vertical-align: top; }
+pre { margin: 0; white-space: pre-wrap; }
+textarea { width: 100%; height: 60px; font-family: monospace; }
+#status { color: #a00; }
+</style>
+</head>
+<body>
+<nav>
+  <p><input id="auth" placeholder="Authorization header" title="e.g. 'token PRE_SHARED_TOKEN' or 'Bearer JWT', empty if not required"></p>
+  <p><button onclick="loadCols()">Reload collections</button></p>
+  <div id="cols"></div>
+  <hr>
+  <p><input id="dest" placeholder="Dump destination directory"> <button onclick="dump()">Dump</button></p>
+</nav>
+<main>
+  <p id="status"></p>
+  <div id="col" hidden>
+    <h2 id="colName"></h2>
+    <p>Approximately <span id="docCount"></span> documents. <button onclick="scrub()">Scrub</button></p>
+    <section>
+      <h3>Indexes</h3>
+      <table id="indexes"></table>
+    </section>
+    <section>
+      <h3>Query</h3>
+      <textarea id="query">"all"</textarea>
+      <p>Limit <input id="limit" type="number" value="50" size="5"> <button onclick="query()">Run</button></p>
+    </section>
+    <section>
+      <h3>Documents</h3>
+      <p>Page <input id="page" type="number" value="0" size="5"> of <input id="pages" type="number" value="10" size="5"> <button onclick="browse()">Browse</button></p>
+      <table id="docs"></table>
+    </section>
+  </div>
+</main>
+<script>
+var current = null;
+
+function call(endpoint, params) {
+  var body = new URLSearchParams();
+  for (var key in params) {
+    body.append(key, params[key]);
+  }
+  var headers = {};
+  var auth = document.getElementById("auth").value;
+  if (auth) {
+    headers["Authorization"] = auth;
+  }
+  document.getElementById("status").textContent = "";
+  return fetch(endpoint, {method: "POST", headers: headers, body: body}).then(function (resp) {
+    return resp.text().then(function (text) {
+      if (!resp.ok) {
+        throw new Error(endpoint + ": HTTP " + resp.status + " " + text);
+      }
+      return text;
+    });
+  }).catch(function (err) {
+    document.getElementById("status").textContent = err.message;
+    throw err;
+  });
+}
+
+function fill(table, header, rows) {
+  table.innerHTML = "";
+  var tr = table.insertRow();
+  header.forEach(function (title) {
+    var th = document.createElement("th");
+    th.textContent = title;
+    tr.appendChild(th);
+  });
+  rows.forEach(function (row) {
+    var tr = table.insertRow();
+    row.forEach(function (val) {
+      var pre = document.createElement("pre");
+      pre.textContent = typeof val === "string" ? val : JSON.stringify(val, null, 2);
+      tr.insertCell().appendChild(pre);
+    });
+  });
+}
+
+function showDocs(text) {
+  var docs = JSON.parse(text);
+  fill(document.getElementById("docs"), ["ID", "Document"], Object.keys(docs).map(function (id) {
+    return [id, docs[id]];
+  }));
+}
+
+function loadCols() {
+  call("/all", {}).then(function (text) {
+    var cols = document.getElementById("cols");
+    cols.innerHTML = "";
+    JSON.parse(text).sort().forEach(function (name) {
+      var link = document.createElement("a");
+      link.textContent = name;
+      link.className = name === current ? "current" : "";
+      link.onclick = function () { openCol(name); };
+      cols.appendChild(link);
+    });
+  });
+}
+
+function openCol(name) {
+  current = name;
+  loadCols();
+  document.getElementById("col").hidden = false;
+  document.getElementById("colName").textContent = name;
+  document.getElementById("docs").innerHTML = "";
+  call("/approxdoccount", {col: name}).then(function (text) {
+    document.getElementById("docCount").textContent = text;
+  });
+  call("/indexstats", {col: name}).then(function (text) {
+    fill(document.getElementById("indexes"), ["Path", "Options", "Entries", "Bytes", "Building"], JSON.parse(text).map(function (idx) {
+      return [idx.Path.join(","), idx.Options, String(idx.Entries), String(idx.Bytes), String(idx.Building)];
+    }));
+  });
+}
+
+function query() {
+  call("/query", {col: current, q: document.getElementById("query").value, limit: document.getElementById("limit").value}).then(showDocs);
+}
+
+function browse() {
+  call("/getpage", {col: current, page: document.getElementById("page").value, total: document.getElementById("pages").value}).then(showDocs);
+}
+
+function scrub() {
+  if (confirm("Scrub collection " + current + "?")) {
+    call("/scrub", {col: current}).then(function () { openCol(current); });
+  }
+}
+
+function dump() {
+  var dest = document.getElementById("dest").value;
+  if (dest && confirm("Dump database into " + dest + "?")) {
+    call("/dump", {dest: dest}).then(function () {
+      document.getElementById("status").textContent = "Dumped into " + dest;
+    });
+  }
+}
+
+loadCols();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,20 @@
+package httpapi
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	w := httptest.NewRecorder()
+	Admin(w, httptest.NewRequest("GET", "http://localhost:8080/admin", nil))
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Error("Expected the admin page", w.Code, w.Header())
+	}
+	for _, endpoint := range []string{"/all", "/approxdoccount", "/indexstats", "/query", "/getpage", "/scrub", "/dump"} {
+		if !strings.Contains(w.Body.String(), `"`+endpoint+`"`) {
+			t.Error("Admin page does not call", endpoint)
+		}
+	}
+}
@@ -8,8 +8,22 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
 )
 
+// Return HTTP status 400 if the document was rejected by document limits, 503 if the write was shed by write rate limit,
+// or 500 for other errors.
+func docErrorStatus(err error) int {
+	switch dberr.Type(err) {
+	case dberr.ErrorDocTooDeep, dberr.ErrorDocTooManyKeys, dberr.ErrorDocArrayTooLong:
+		return 400
+	case dberr.ErrorWriteQueueFull:
+		return 503
+	}
+	return 500
+}
+
 // Insert a document into collection.
 func Insert(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
@@ -38,7 +52,7 @@ func Insert(w http.ResponseWriter, r *http.Request) {
 	}
 	id, err := dbcol.Insert(jsonDoc)
 	if err != nil {
-		http.Error(w, fmt.Sprint(err), 500)
+		http.Error(w, fmt.Sprint(err), docErrorStatus(err))
 		return
 	}
 	w.WriteHeader(201)
@@ -164,7 +178,7 @@ func Update(w http.ResponseWriter, r *http.Request) {
 	}
 	err = dbcol.Update(docID, newDoc)
 	if err != nil {
-		http.Error(w, fmt.Sprint(err), 500)
+		http.Error(w, fmt.Sprint(err), docErrorStatus(err))
 		return
 	}
 }
@@ -192,7 +206,11 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
 		return
 	}
-	dbcol.Delete(docID)
+	if err := dbcol.Delete(docID); dberr.Type(err) == dberr.ErrorWriteQueueFull {
+		http.Error(w, fmt.Sprint(err), 503)
+	} else if dberr.Type(err) == dberr.ErrorReferenced {
+		http.Error(w, fmt.Sprint(err), 409)
+	}
 }
 
 // Return approximate number of documents in the collection.
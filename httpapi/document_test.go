@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -51,6 +52,7 @@ func TestDocument(t *testing.T) {
 		TInsertEmptyDoc,
 		TInsertErrorUnmarshal,
 		TInsert,
+		TInsertWriteQueueFull,
 		TInsertCollectionNotExist,
 		TInsertError,
 		TGet,
@@ -174,6 +176,37 @@ func TInsert(t *testing.T) {
 		t.Error("Expected code 201 and get id new record")
 	}
 }
+func TInsertWriteQueueFull(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest("GET", requestCreate, nil))
+	HttpDB.SetWriteLimit(10, 1)
+	insert := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		Insert(w, httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, bytes.NewBufferString(`{"a": 1}`)))
+		return w
+	}
+	if w := insert(); w.Code != 201 {
+		t.Fatal(w.Code)
+	}
+	waiting := make(chan int)
+	go func() {
+		waiting <- insert().Code
+	}()
+	for HttpDB.WriteQueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if w := insert(); w.Code != 503 {
+		t.Error("Expected code 503 when write queue is full", w.Code)
+	}
+	if code := <-waiting; code != 201 {
+		t.Error("Expected code 201 after waiting", code)
+	}
+}
 func TInsertCollectionNotExist(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
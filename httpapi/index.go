@@ -27,11 +27,24 @@ func Index(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
 		return
 	}
-	if err := dbcol.Index(strings.Split(path, ",")); err != nil {
+	if r.FormValue("background") == "" {
+		if err := dbcol.Index(strings.Split(path, ",")); err != nil {
+			http.Error(w, fmt.Sprint(err), 400)
+			return
+		}
+		w.WriteHeader(201)
+		return
+	}
+	// Build the index in background, optionally at limited rate (documents per second)
+	var rate int
+	if !optionalInt(w, r, "rate", &rate) {
+		return
+	}
+	if err := dbcol.IndexBackground(strings.Split(path, ","), rate); err != nil {
 		http.Error(w, fmt.Sprint(err), 400)
 		return
 	}
-	w.WriteHeader(201)
+	w.WriteHeader(202)
 }
 
 // Return all indexed paths.
@@ -61,6 +74,29 @@ func Indexes(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
+// Return statistics of all indexes.
+func IndexStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	resp, err := json.Marshal(dbcol.IndexStats())
+	if err != nil {
+		http.Error(w, fmt.Sprint("Server error."), 500)
+		return
+	}
+	w.Write(resp)
+}
+
 // Remove an indexed path.
 func Unindex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
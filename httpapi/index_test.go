@@ -10,6 +10,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -23,6 +24,8 @@ var (
 func TestIndex(t *testing.T) {
 	testsIndex := []func(t *testing.T){
 		TIndex,
+		TIndexBackground,
+		TIndexBackgroundInvalidRate,
 		TIndexNotCol,
 		TIndexNotPath,
 		TIndexError,
@@ -30,6 +33,7 @@ func TestIndex(t *testing.T) {
 		TIndexCollNotExist,
 		TIndexesNotCol,
 		TIndexesCollNotExist,
+		TIndexStats,
 		TIndexErrMarshalJson,
 		TUnIndexes,
 		TUnIndexesColNotExist,
@@ -71,6 +75,85 @@ func TIndex(t *testing.T) {
 		t.Error("Expected code 201 and get list Indexes after insert")
 	}
 }
+func TIndexStats(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	wCreate, wIndex := httptest.NewRecorder(), httptest.NewRecorder()
+	Create(wCreate, httptest.NewRequest("GET", requestCreate, nil))
+	Index(wIndex, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndex, collection, path), nil))
+
+	wStats := httptest.NewRecorder()
+	IndexStats(wStats, httptest.NewRequest(RandMethodRequest(), "http://localhost:8080/indexstats?col="+collection, nil))
+	var stats []db.IndexStats
+	if err := json.Unmarshal(wStats.Body.Bytes(), &stats); err != nil || wStats.Code != 200 || len(stats) != 1 || stats[0].Path[0] != path {
+		t.Error("Expected statistics of the index", wStats.Body.String(), err)
+	}
+	wStats = httptest.NewRecorder()
+	IndexStats(wStats, httptest.NewRequest(RandMethodRequest(), "http://localhost:8080/indexstats?col=nope", nil))
+	if wStats.Code != 400 {
+		t.Error("Expected code 400 for a collection that does not exist", wStats.Code)
+	}
+}
+func TIndexBackground(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+
+	b := &bytes.Buffer{}
+	b.WriteString("{\"a\": 1, \"b\": 2}")
+
+	reqCreate := httptest.NewRequest("GET", requestCreate, nil)
+	reqInsert := httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, b)
+	reqIndex := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndex, collection, path)+"&background=1&rate=1000", nil)
+
+	wCreate := httptest.NewRecorder()
+	wInsert := httptest.NewRecorder()
+	wIndex := httptest.NewRecorder()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(wCreate, reqCreate)
+	Insert(wInsert, reqInsert)
+	Index(wIndex, reqIndex)
+
+	if wIndex.Code != 202 {
+		t.Error("Expected code 202 for background index build")
+	}
+	for HttpDB.Use(collection).IndexBuilding([]string{path}) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	result := make(map[int]struct{})
+	if err := db.EvalQuery(map[string]interface{}{"eq": 1, "in": []interface{}{path}}, HttpDB.Use(collection), &result); err != nil || len(result) != 1 {
+		t.Error("Expected background index build to index the document", result, err)
+	}
+}
+func TIndexBackgroundInvalidRate(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+
+	reqCreate := httptest.NewRequest("GET", requestCreate, nil)
+	reqIndex := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndex, collection, path)+"&background=1&rate=fast", nil)
+
+	wCreate := httptest.NewRecorder()
+	wIndex := httptest.NewRecorder()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(wCreate, reqCreate)
+	Index(wIndex, reqIndex)
+
+	if wIndex.Code != 400 || strings.TrimSpace(wIndex.Body.String()) != "Invalid 'rate' value 'fast'." {
+		t.Error("Expected code 400 and message of invalid rate")
+	}
+}
 func TIndexNotCol(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
@@ -221,6 +221,10 @@ func jwtWrap(originalHandler http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 		tokenClaims := token.Claims.(jwt.MapClaims)
+		// Identify the user as the caller of queries, for the purpose of caller quotas
+		if user, isStr := tokenClaims[JWT_USER_ATTR].(string); isStr {
+			r = r.WithContext(db.WithCaller(r.Context(), user))
+		}
 		var url = strings.TrimPrefix(r.URL.Path, "/")
 		var col = r.FormValue("col")
 		// Call the API endpoint handler if authorization allows
@@ -36,6 +36,18 @@ func Dump(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Apply changes made to the tunables in database configuration file without restarting the server.
+func ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	if err := HttpDB.ReloadConfig(); err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+}
+
 // Return server memory statistics.
 func MemStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
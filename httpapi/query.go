@@ -3,15 +3,122 @@
 package httpapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/HouzuoGuo/tiedot/dberr"
 )
 
-// Execute a query and return documents from the result.
+// Return HTTP status 503 if the query was shed by admission control of heavy operations or has to wait for an index
+// being built, 429 if the caller has exceeded its quota, or 400 for other errors.
+func queryErrorStatus(err error) int {
+	if dberr.Type(err) == dberr.ErrorTooBusy || dberr.Type(err) == dberr.ErrorIndexBuilding {
+		return 503
+	}
+	if dberr.Type(err) == dberr.ErrorQuotaExceeded {
+		return 429
+	}
+	return 400
+}
+
+// Store the request context into *ctx, at low priority if form parameter "priority" is "low" (see db.WithPriority).
+// If the priority is neither "low" nor "high", set HTTP status 400 and return false.
+func optionalPriority(w http.ResponseWriter, r *http.Request, ctx *context.Context) bool {
+	*ctx = r.Context()
+	switch priority := r.FormValue("priority"); priority {
+	case "", "high":
+	case "low":
+		*ctx = db.WithPriority(*ctx, db.PRIORITY_LOW)
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported priority '%s'.", priority), 400)
+		return false
+	}
+	return true
+}
+
+// Store integer form parameter value of specified key to *val and return true; if key does not exist, leave *val intact.
+// If the value is not a non-negative integer, set HTTP status 400 and return false.
+func optionalInt(w http.ResponseWriter, r *http.Request, key string, val *int) bool {
+	str := r.FormValue(key)
+	if str == "" {
+		return true
+	}
+	intVal, err := strconv.Atoi(str)
+	if err != nil || intVal < 0 {
+		http.Error(w, fmt.Sprintf("Invalid '%s' value '%v'.", key, str), 400)
+		return false
+	}
+	*val = intVal
+	return true
+}
+
+// Put the optional JSON array of query parameters into params. If the value is invalid, respond with HTTP 400 and return false.
+func optionalParams(w http.ResponseWriter, r *http.Request, params *[]interface{}) bool {
+	str := r.FormValue("params")
+	if str == "" {
+		return true
+	}
+	if err := json.Unmarshal([]byte(str), params); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not a valid JSON array.", str), 400)
+		return false
+	}
+	return true
+}
+
+// Parse the optional sort parameter into sort keys - either a document path (comma-separated, "-" prefix for descending
+// order), or a JSON array of [path, direction] pairs. If the value is invalid, respond with HTTP 400 and return false.
+func optionalSort(w http.ResponseWriter, r *http.Request, keys *[]db.SortKey) bool {
+	str := r.FormValue("sort")
+	if str == "" {
+		return true
+	}
+	if !strings.HasPrefix(str, "[") {
+		*keys = []db.SortKey{{Path: strings.Split(strings.TrimPrefix(str, "-"), ","), Descending: strings.HasPrefix(str, "-")}}
+		return true
+	}
+	var spec interface{}
+	if err := json.Unmarshal([]byte(str), &spec); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", str), 400)
+		return false
+	}
+	parsed, err := db.ParseSortKeys(spec)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return false
+	}
+	*keys = parsed
+	return true
+}
+
+// Order query result by document ID, and then by the sort keys.
+func orderResult(col *db.Col, queryResult map[int]struct{}, sortKeys []db.SortKey) []int {
+	ids := make([]int, 0, len(queryResult))
+	for id := range queryResult {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	db.SortIDs(col, ids, sortKeys)
+	return ids
+}
+
+/*
+Execute a query and return documents from the result.
+Optional parameters:
+- "params" is a JSON array of values bound to query placeholders "$1", "$2", etc.
+- "sort" orders the result by a document path (comma-separated), prefix the path with "-" to order descending; or by multiple paths as JSON array, e.g. [["Age", "desc"], ["Name", "asc"]].
+- "offset" and "limit" skip and cap the number of returned documents, result is ordered by document ID unless sorted.
+- "format=ndjson" streams {"id": "ID", "doc": {...}} objects one per line in result order.
+- "priority=low" runs the query at low priority, giving way to other queries under the heavy operation limit.
+When any of "sort", "offset" and "limit" is given, the response is a JSON array of {"id": "ID", "doc": {...}} objects in
+result order, instead of a JSON object of documents by ID.
+*/
 func Query(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
 	w.Header().Set("Content-Type", "application/json")
@@ -29,15 +136,46 @@ func Query(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
 		return
 	}
+	var params []interface{}
+	if !optionalParams(w, r, &params) {
+		return
+	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
 		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
 		return
 	}
+	respondQuery(w, r, dbcol, qJson, params)
+}
+
+// Evaluate the query and respond with documents from the result, according to optional parameters "sort", "offset",
+// "limit" and "format" (see Query).
+func respondQuery(w http.ResponseWriter, r *http.Request, dbcol *db.Col, qJson interface{}, params []interface{}) {
+	offset, limit := 0, 0
+	if !optionalInt(w, r, "offset", &offset) || !optionalInt(w, r, "limit", &limit) {
+		return
+	}
+	var sortKeys []db.SortKey
+	if !optionalSort(w, r, &sortKeys) {
+		return
+	}
+	format := r.FormValue("format")
+	if format != "" && format != "ndjson" {
+		http.Error(w, fmt.Sprintf("Unsupported format '%s'.", format), 400)
+		return
+	}
+	var ctx context.Context
+	if !optionalPriority(w, r, &ctx) {
+		return
+	}
 	// Evaluate the query
 	queryResult := make(map[int]struct{})
-	if err := db.EvalQuery(qJson, dbcol, &queryResult); err != nil {
-		http.Error(w, fmt.Sprint(err), 400)
+	if err := db.EvalQueryParamsContext(ctx, qJson, params, dbcol, &queryResult); err != nil {
+		http.Error(w, fmt.Sprint(err), queryErrorStatus(err))
+		return
+	}
+	if offset != 0 || limit != 0 || len(sortKeys) > 0 || format != "" {
+		queryPage(w, dbcol, queryResult, sortKeys, format, offset, limit)
 		return
 	}
 	// Construct array of result
@@ -59,6 +197,110 @@ func Query(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(string(resp)))
 }
 
+// Respond with the ordered and paginated query result, documents are read one at a time as they are written out.
+func queryPage(w http.ResponseWriter, dbcol *db.Col, queryResult map[int]struct{}, sortKeys []db.SortKey, format string, offset, limit int) {
+	ids := orderResult(dbcol, queryResult, sortKeys)
+	if offset > len(ids) {
+		offset = len(ids)
+	}
+	ids = ids[offset:]
+	if limit > 0 && limit < len(ids) {
+		ids = ids[:limit]
+	}
+	if format != "ndjson" {
+		// An array keeps the result order, unlike an object keyed by document ID
+		docs := make([]interface{}, 0, len(ids))
+		for _, docID := range ids {
+			if doc, _ := dbcol.Read(docID); doc != nil {
+				docs = append(docs, map[string]interface{}{"id": strconv.Itoa(docID), "doc": doc})
+			}
+		}
+		resp, err := json.Marshal(docs)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Server error: query returned invalid structure"), 500)
+			return
+		}
+		w.Write(resp)
+		return
+	}
+	// Stream the result; writing blocks while the client is not keeping up
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, canFlush := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for _, docID := range ids {
+		doc, _ := dbcol.Read(docID)
+		if doc == nil {
+			continue
+		}
+		if err := encoder.Encode(map[string]interface{}{"id": strconv.Itoa(docID), "doc": doc}); err != nil {
+			// Client has gone away
+			return
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+}
+
+/*
+Execute a query and stream the resulting documents for analytics consumers, one {"id": "ID", "doc": {...}} object per
+line (NDJSON), in chunks as they are read. The endpoint never modifies data, JWT users allowed to call "stream" alone
+get read-only access. Optional parameters "params", "sort", "offset" and "limit" work as they do for "query". Server
+caps the number of streamed documents at StreamMaxDocs (unless 0), and sets header "X-Result-Truncated: true" if the
+cap cuts the result short.
+*/
+func Stream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, q string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	var qJson interface{}
+	if err := json.Unmarshal([]byte(q), &qJson); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		return
+	}
+	var params []interface{}
+	if !optionalParams(w, r, &params) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	offset, limit := 0, 0
+	if !optionalInt(w, r, "offset", &offset) || !optionalInt(w, r, "limit", &limit) {
+		return
+	}
+	var sortKeys []db.SortKey
+	if !optionalSort(w, r, &sortKeys) {
+		return
+	}
+	var ctx context.Context
+	if !optionalPriority(w, r, &ctx) {
+		return
+	}
+	queryResult := make(map[int]struct{})
+	if err := db.EvalQueryParamsContext(ctx, qJson, params, dbcol, &queryResult); err != nil {
+		http.Error(w, fmt.Sprint(err), queryErrorStatus(err))
+		return
+	}
+	if StreamMaxDocs > 0 && (limit == 0 || limit > StreamMaxDocs) {
+		limit = StreamMaxDocs
+		if len(queryResult)-offset > limit {
+			w.Header().Set("X-Result-Truncated", "true")
+		}
+	}
+	queryPage(w, dbcol, queryResult, sortKeys, "ndjson", offset, limit)
+}
+
 // Execute a query and return number of documents from the result.
 func Count(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
@@ -77,15 +319,238 @@ func Count(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
 		return
 	}
+	var params []interface{}
+	if !optionalParams(w, r, &params) {
+		return
+	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
 		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
 		return
 	}
+	var ctx context.Context
+	if !optionalPriority(w, r, &ctx) {
+		return
+	}
 	queryResult := make(map[int]struct{})
-	if err := db.EvalQuery(qJson, dbcol, &queryResult); err != nil {
-		http.Error(w, fmt.Sprint(err), 400)
+	if err := db.EvalQueryParamsContext(ctx, qJson, params, dbcol, &queryResult); err != nil {
+		http.Error(w, fmt.Sprint(err), queryErrorStatus(err))
 		return
 	}
 	w.Write([]byte(strconv.Itoa(len(queryResult))))
 }
+
+// Register (or replace) a named query "name" of query string "q" on collection "col".
+func RegisterQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var name, col, q string
+	if !Require(w, r, "name", &name) {
+		return
+	}
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	var qJson interface{}
+	if err := json.Unmarshal([]byte(q), &qJson); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		return
+	}
+	if err := HttpDB.RegisterQuery(name, col, qJson); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	w.WriteHeader(201)
+}
+
+// Remove a named query.
+func UnregisterQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var name string
+	if !Require(w, r, "name", &name) {
+		return
+	}
+	if err := HttpDB.UnregisterQuery(name); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+	}
+}
+
+// Return all named queries as a JSON object of {"collection": "name", "query": {...}} keyed by query name.
+func NamedQueries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	queries, err := HttpDB.NamedQueries()
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	resp, err := json.Marshal(queries)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+/*
+Execute the named query "name" and return documents from the result, as "query" does. Parameter "col" must name the
+collection of the query, so that JWT collection access rights apply. Optional parameters "params", "sort", "offset",
+"limit" and "format" work as they do for "query".
+*/
+func RunQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var name, col string
+	if !Require(w, r, "name", &name) {
+		return
+	}
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	params := []interface{}{}
+	if !optionalParams(w, r, &params) {
+		return
+	}
+	query, err := HttpDB.NamedQueryOf(name)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	} else if query.Col != col {
+		http.Error(w, fmt.Sprintf("Query '%s' does not query collection '%s'.", name, col), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	respondQuery(w, r, dbcol, query.Query, params)
+}
+
+/*
+Execute a query and keep its result on the server as a cursor, respond with {"cursor": "ID", "total": N}. Pages of the
+result are fetched by "fetch" without executing the query again, hence documents inserted meanwhile do not shift the
+pages. Optional parameters "params" and "sort" work as they do for "query"; "ttl" is the number of seconds an idle
+cursor is kept.
+*/
+func OpenCursor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, q string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	var qJson interface{}
+	if err := json.Unmarshal([]byte(q), &qJson); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		return
+	}
+	var params []interface{}
+	if !optionalParams(w, r, &params) {
+		return
+	}
+	var sortKeys []db.SortKey
+	if !optionalSort(w, r, &sortKeys) {
+		return
+	}
+	ttl := 0
+	if !optionalInt(w, r, "ttl", &ttl) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	cursorID, total, err := HttpDB.OpenCursor(dbcol, qJson, params, sortKeys, time.Duration(ttl)*time.Second)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), queryErrorStatus(err))
+		return
+	}
+	resp, err := json.Marshal(map[string]interface{}{"cursor": cursorID, "total": total})
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+/*
+Fetch the next page of documents from cursor "cursor", respond with {"docs": [{"id": "ID", "doc": {...}}, ...],
+"more": true/false}. Parameter "col" must name the collection of the cursor, so that JWT collection access rights
+apply. Optional parameter "limit" is the page size, the rest of the result is fetched without it. Documents deleted
+since the cursor was opened are skipped. The cursor is closed once it has no more documents.
+*/
+func Fetch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var cursorID, col string
+	if !Require(w, r, "cursor", &cursorID) {
+		return
+	}
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	limit := 0
+	if !optionalInt(w, r, "limit", &limit) {
+		return
+	}
+	if cursorCol, err := HttpDB.CursorCol(cursorID); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	} else if cursorCol != col {
+		http.Error(w, fmt.Sprintf("Cursor '%s' does not belong to collection '%s'.", cursorID, col), 400)
+		return
+	}
+	dbcol, ids, more, err := HttpDB.CursorNext(cursorID, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	docs := make([]interface{}, 0, len(ids))
+	for _, docID := range ids {
+		if doc, _ := dbcol.Read(docID); doc != nil {
+			docs = append(docs, map[string]interface{}{"id": strconv.Itoa(docID), "doc": doc})
+		}
+	}
+	resp, err := json.Marshal(map[string]interface{}{"docs": docs, "more": more})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Server error: query returned invalid structure"), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Close cursor "cursor" before it is exhausted or expires.
+func CloseCursor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var cursorID string
+	if !Require(w, r, "cursor", &cursorID) {
+		return
+	}
+	if !HttpDB.CloseCursor(cursorID) {
+		http.Error(w, fmt.Sprintf("Cursor '%s' does not exist.", cursorID), 400)
+	}
+}
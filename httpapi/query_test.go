@@ -1,6 +1,7 @@
 package httpapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/HouzuoGuo/tiedot/db"
@@ -8,6 +9,7 @@ import (
 	"github.com/pkg/errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"strings"
 	"testing"
@@ -43,7 +45,7 @@ func TestQuery(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
 
-	path := monkey.Patch(db.EvalQuery, func(q interface{}, src *db.Col, result *map[int]struct{}) (err error) {
+	path := monkey.Patch(db.EvalQueryContext, func(ctx context.Context, q interface{}, src *db.Col, result *map[int]struct{}) (err error) {
 		*result = map[int]struct{}{2: struct{}{}}
 		return nil
 	})
@@ -106,7 +108,7 @@ func TestQueryJsonIsNotValid(t *testing.T) {
 }
 func TestQueryErrEvalQuery(t *testing.T) {
 	errMessage := "Error eval query"
-	path := monkey.Patch(db.EvalQuery, func(q interface{}, src *db.Col, result *map[int]struct{}) (err error) {
+	path := monkey.Patch(db.EvalQueryContext, func(ctx context.Context, q interface{}, src *db.Col, result *map[int]struct{}) (err error) {
 		return errors.New(errMessage)
 	})
 	defer path.Unpatch()
@@ -227,7 +229,7 @@ func TestCountErrEvalQuery(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
 	errMessage := "Error eval query"
-	path := monkey.Patch(db.EvalQuery, func(q interface{}, src *db.Col, result *map[int]struct{}) (err error) {
+	path := monkey.Patch(db.EvalQueryContext, func(ctx context.Context, q interface{}, src *db.Col, result *map[int]struct{}) (err error) {
 		return errors.New(errMessage)
 	})
 	defer path.Unpatch()
@@ -246,3 +248,281 @@ func TestCountErrEvalQuery(t *testing.T) {
 		t.Errorf("Expected status %d and error message eval query", http.StatusBadRequest)
 	}
 }
+func TestQueryPage(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	for _, n := range []int{3, 1, 2, 5, 4} {
+		if _, err := HttpDB.Use(collection).Insert(map[string]interface{}{"n": n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Sort descending, skip one, take two, stream as NDJSON
+	req := httptest.NewRequest("GET", fmt.Sprintf(requestQueryWithAll, collection, `"all"`)+"&sort=-n&offset=1&limit=2&format=ndjson", nil)
+	w := httptest.NewRecorder()
+	Query(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal(lines)
+	}
+	for i, expected := range []float64{4, 3} {
+		var line map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[i]), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line["id"] == "" || line["doc"].(map[string]interface{})["n"].(float64) != expected {
+			t.Fatal(line)
+		}
+	}
+	// Paginate into a JSON array
+	req = httptest.NewRequest("GET", fmt.Sprintf(requestQueryWithAll, collection, `"all"`)+"&offset=3", nil)
+	w = httptest.NewRecorder()
+	Query(w, req)
+	var docs []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &docs); err != nil || len(docs) != 2 {
+		t.Fatal(w.Body.String(), err)
+	}
+	// Sorted JSON array keeps the order
+	req = httptest.NewRequest("GET", fmt.Sprintf(requestQueryWithAll, collection, `"all"`)+"&sort=-n&limit=3", nil)
+	w = httptest.NewRecorder()
+	Query(w, req)
+	docs = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &docs); err != nil || len(docs) != 3 {
+		t.Fatal(w.Body.String(), err)
+	}
+	for i, expected := range []float64{5, 4, 3} {
+		if docs[i]["id"] == "" || docs[i]["doc"].(map[string]interface{})["n"].(float64) != expected {
+			t.Fatal(docs)
+		}
+	}
+	// Sort by multiple paths given as JSON
+	req = httptest.NewRequest("GET", fmt.Sprintf(requestQueryWithAll, collection, `"all"`)+"&format=ndjson&sort="+url.QueryEscape(`[["missing", "desc"], ["n", "asc"]]`), nil)
+	w = httptest.NewRecorder()
+	Query(w, req)
+	lines = strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatal(w.Code, lines)
+	}
+	for i, line := range lines {
+		if !strings.Contains(line, fmt.Sprintf(`"n":%d`, i+1)) {
+			t.Fatal(lines)
+		}
+	}
+	// Bad parameters
+	for _, params := range []string{"&limit=-1", "&offset=a", "&format=xml", "&sort=" + url.QueryEscape("[1]"), "&sort=" + url.QueryEscape(`[["n", "up"]]`), "&sort=" + url.QueryEscape("[")} {
+		req = httptest.NewRequest("GET", fmt.Sprintf(requestQueryWithAll, collection, `"all"`)+params, nil)
+		w = httptest.NewRecorder()
+		Query(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(params, w.Code)
+		}
+	}
+}
+func TestStream(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	defer func() {
+		StreamMaxDocs = 0
+	}()
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	for _, n := range []int{3, 1, 2, 5, 4} {
+		if _, err := HttpDB.Use(collection).Insert(map[string]interface{}{"n": n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := func(params string) (*httptest.ResponseRecorder, []string) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("http://localhost:8080/stream?col=%s&q=%s", collection, `"all"`)+params, nil)
+		w := httptest.NewRecorder()
+		Stream(w, req)
+		return w, strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	}
+	if w, lines := stream("&sort=n"); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" ||
+		len(lines) != 5 || !strings.Contains(lines[0], `"n":1`) || w.Header().Get("X-Result-Truncated") != "" {
+		t.Fatal(w.Code, lines)
+	}
+	// Server side limit caps the client limit
+	StreamMaxDocs = 2
+	if w, lines := stream("&sort=n&limit=3"); len(lines) != 2 || !strings.Contains(lines[1], `"n":2`) || w.Header().Get("X-Result-Truncated") != "true" {
+		t.Fatal(w.Code, lines)
+	} else if w, lines := stream("&offset=4"); len(lines) != 1 || w.Header().Get("X-Result-Truncated") != "" {
+		t.Fatal(w.Code, lines)
+	}
+	for _, params := range []string{"&limit=-1", "&sort=" + url.QueryEscape("["), "&params=x"} {
+		if w, _ := stream(params); w.Code != http.StatusBadRequest {
+			t.Fatal(params, w.Code)
+		}
+	}
+	req := httptest.NewRequest("GET", "http://localhost:8080/stream?col=nope&q=1", nil)
+	w := httptest.NewRecorder()
+	Stream(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	}
+}
+func TestNamedQueries(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	if err := HttpDB.Use(collection).Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{1, 2, 2} {
+		if _, err := HttpDB.Use(collection).Insert(map[string]interface{}{"n": n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	call := func(handler http.HandlerFunc, params string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "http://localhost:8080/?"+params, nil))
+		return w
+	}
+	q := url.QueryEscape(`{"eq": "$1", "in": ["n"]}`)
+	if w := call(RegisterQuery, "name=byN&col="+collection+"&q="+q); w.Code != http.StatusCreated {
+		t.Fatal(w.Code, w.Body.String())
+	} else if w := call(RegisterQuery, "name=bad&col="+collection+"&q=x"); w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	} else if w := call(NamedQueries, ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"byN":{"collection":"`+collection) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	var result map[string]interface{}
+	if w := call(RunQuery, "name=byN&col="+collection+"&params=[2]"); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || len(result) != 2 {
+		t.Fatal(result, err)
+	} else if w := call(RunQuery, "name=byN&col="+collection+"&params=[2]&limit=1&format=ndjson"); strings.Count(w.Body.String(), "\n") != 1 {
+		t.Fatal(w.Body.String())
+	}
+	// The collection must be the one of the query, missing parameters and unknown queries are rejected
+	for _, params := range []string{"name=byN&col=other&params=[2]", "name=byN&col=" + collection, "name=nope&col=" + collection} {
+		if w := call(RunQuery, params); w.Code != http.StatusBadRequest {
+			t.Fatal(params, w.Code)
+		}
+	}
+	if w := call(UnregisterQuery, "name=byN"); w.Code != http.StatusOK {
+		t.Fatal(w.Code)
+	} else if w := call(UnregisterQuery, "name=byN"); w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	}
+}
+func TestCursor(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	for _, n := range []int{3, 1, 2} {
+		if _, err := HttpDB.Use(collection).Insert(map[string]interface{}{"n": n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	call := func(handler http.HandlerFunc, params string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "http://localhost:8080/?"+params, nil))
+		return w
+	}
+	var opened struct {
+		Cursor string
+		Total  int
+	}
+	if w := call(OpenCursor, "col="+collection+`&q="all"&sort=n&ttl=60`); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &opened); err != nil || opened.Total != 3 {
+		t.Fatal(opened, err)
+	}
+	var page struct {
+		Docs []struct {
+			ID  string
+			Doc map[string]interface{}
+		}
+		More bool
+	}
+	if w := call(Fetch, "cursor="+opened.Cursor+"&col=other"); w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	} else if w := call(Fetch, "cursor="+opened.Cursor+"&col="+collection+"&limit=2"); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Docs) != 2 || !page.More || page.Docs[0].Doc["n"] != float64(1) {
+		t.Fatal(page, err)
+	} else if w := call(Fetch, "cursor="+opened.Cursor+"&col="+collection); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Docs) != 1 || page.More || page.Docs[0].Doc["n"] != float64(3) {
+		t.Fatal(page, err)
+	} else if w := call(Fetch, "cursor="+opened.Cursor+"&col="+collection); w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	}
+	if w := call(OpenCursor, "col="+collection+`&q="all"`); w.Code != http.StatusOK {
+		t.Fatal(w.Code)
+	} else if err := json.Unmarshal(w.Body.Bytes(), &opened); err != nil {
+		t.Fatal(err)
+	} else if w := call(CloseCursor, "cursor="+opened.Cursor); w.Code != http.StatusOK {
+		t.Fatal(w.Code)
+	} else if w := call(CloseCursor, "cursor="+opened.Cursor); w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	} else if w := call(OpenCursor, "col=nope&q=1"); w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	}
+}
+func TestQueryParams(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err := HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	col := HttpDB.Use(collection)
+	if err := col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, val := range []string{"x", "$1", "x"} {
+		if _, err := col.Insert(map[string]interface{}{"a": val}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := `{"eq": "$1", "in": ["a"]}`
+	for params, count := range map[string]string{`["x"]`: "2", `["$1"]`: "1", `["y"]`: "0"} {
+		req := httptest.NewRequest("GET", fmt.Sprintf(requestCountWithAll, collection, url.QueryEscape(q))+"&params="+url.QueryEscape(params), nil)
+		w := httptest.NewRecorder()
+		Count(w, req)
+		if w.Code != http.StatusOK || w.Body.String() != count {
+			t.Fatal(params, w.Code, w.Body.String())
+		}
+	}
+	req := httptest.NewRequest("GET", fmt.Sprintf(requestQueryWithAll, collection, url.QueryEscape(q))+"&params="+url.QueryEscape(`["x"]`), nil)
+	w := httptest.NewRecorder()
+	Query(w, req)
+	var docs map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &docs); err != nil || len(docs) != 2 {
+		t.Fatal(w.Body.String())
+	}
+	for _, params := range []string{`{"a": 1}`, `[]`} {
+		req := httptest.NewRequest("GET", fmt.Sprintf(requestQueryWithAll, collection, url.QueryEscape(q))+"&params="+url.QueryEscape(params), nil)
+		w := httptest.NewRecorder()
+		Query(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(params, w.Code)
+		}
+	}
+}
@@ -13,7 +13,9 @@ Client request example: curl -I -H "Authorization: token PRE_SHARED_TOKEN" http:
 The sophisticated mechanism offers finer-grained access control, separated by individual users.
 Access to specific endpoints are granted explicitly to each user.
 
-These API endpoints will never require authorization: / (root), /version, and /memstats
+These API endpoints will never require authorization: / (root), /version, /memstats, and /admin (the admin web UI
+page, which is served only if AdminUI is turned on; the page asks for the authorization header to send along API
+requests).
 */
 
 package httpapi
@@ -29,7 +31,9 @@ import (
 )
 
 var (
-	HttpDB *db.DB // HTTP API endpoints operate on this database
+	HttpDB        *db.DB // HTTP API endpoints operate on this database
+	AdminUI       bool   // Serve admin web UI at /admin
+	StreamMaxDocs int    // Maximum number of documents streamed by /stream, 0 for no limit
 )
 
 // Store form parameter value of specified key to *val and return true; if key does not exist, set HTTP status 400 and return false.
@@ -101,6 +105,14 @@ func Start(dir string, port int, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind,
 	// query
 	http.HandleFunc("/query", authWrap(Query))
 	http.HandleFunc("/count", authWrap(Count))
+	http.HandleFunc("/stream", authWrap(Stream))
+	http.HandleFunc("/registerquery", authWrap(RegisterQuery))
+	http.HandleFunc("/unregisterquery", authWrap(UnregisterQuery))
+	http.HandleFunc("/namedqueries", authWrap(NamedQueries))
+	http.HandleFunc("/runquery", authWrap(RunQuery))
+	http.HandleFunc("/opencursor", authWrap(OpenCursor))
+	http.HandleFunc("/fetch", authWrap(Fetch))
+	http.HandleFunc("/closecursor", authWrap(CloseCursor))
 	// document management
 	http.HandleFunc("/insert", authWrap(Insert))
 	http.HandleFunc("/get", authWrap(Get))
@@ -111,10 +123,17 @@ func Start(dir string, port int, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind,
 	// index management (stop-the-world)
 	http.HandleFunc("/index", authWrap(Index))
 	http.HandleFunc("/indexes", authWrap(Indexes))
+	http.HandleFunc("/indexstats", authWrap(IndexStats))
 	http.HandleFunc("/unindex", authWrap(Unindex))
 	// misc (stop-the-world)
 	http.HandleFunc("/shutdown", authWrap(Shutdown))
 	http.HandleFunc("/dump", authWrap(Dump))
+	http.HandleFunc("/reloadconfig", authWrap(ReloadConfig))
+	if AdminUI {
+		// The page carries no data, the API endpoints it calls require authorization as usual
+		tdlog.Noticef("Admin web UI is available at /admin.")
+		http.HandleFunc("/admin", Admin)
+	}
 
 	iface := "all interfaces"
 	if bind != "" {
@@ -3,9 +3,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/HouzuoGuo/tiedot/benchmark"
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/db"
 	"github.com/HouzuoGuo/tiedot/examples"
 	"github.com/HouzuoGuo/tiedot/httpapi"
+	"github.com/HouzuoGuo/tiedot/respapi"
 	"github.com/HouzuoGuo/tiedot/tdlog"
 	"io/ioutil"
 	"os"
@@ -40,6 +44,43 @@ func linuxPerfAdvice() {
 	}
 }
 
+// Import MongoDB Extended JSON file into a collection, or export a collection into MongoDB Extended JSON file.
+func mongoJSON(mode, dir, colName, file string) error {
+	database, err := db.OpenDB(dir)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	if mode == "mongoimport" {
+		in := os.Stdin
+		if file != "" {
+			if in, err = os.Open(file); err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+		col, err := database.UseOrCreate(colName)
+		if err != nil {
+			return err
+		}
+		count, err := col.ImportMongoJSON(in)
+		tdlog.Noticef("Imported %d documents into %s", count, colName)
+		return err
+	}
+	col := database.Use(colName)
+	if col == nil {
+		return fmt.Errorf("Collection %s does not exist", colName)
+	}
+	out := os.Stdout
+	if file != "" {
+		if out, err = os.Create(file); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	return col.ExportMongoJSON(out)
+}
+
 func main() {
 	var err error
 	var defaultMaxprocs int
@@ -52,7 +93,7 @@ func main() {
 	// General params
 	var mode string
 	var maxprocs int
-	flag.StringVar(&mode, "mode", "", "Mandatory - specify the execution mode [httpd|bench|bench2|example]")
+	flag.StringVar(&mode, "mode", "", "Mandatory - specify the execution mode [httpd|resp|bench|bench2|example|mongoimport|mongoexport|migrate]")
 	flag.IntVar(&maxprocs, "gomaxprocs", defaultMaxprocs, "GOMAXPROCS")
 	// Debug params
 	var profile, debug bool
@@ -65,18 +106,25 @@ func main() {
 	var port int
 	var authToken string
 	var tlsCrt, tlsKey string
-	flag.StringVar(&dir, "dir", "", "(HTTP server) database directory")
-	flag.StringVar(&bind, "bind", "", "(HTTP server) bind to IP address (all network interfaces by default)")
-	flag.IntVar(&port, "port", 8080, "(HTTP server) port number")
+	flag.StringVar(&dir, "dir", "", "(HTTP/Redis protocol server, import/export, migrate) database directory")
+	flag.StringVar(&bind, "bind", "", "(HTTP/Redis protocol server) bind to IP address (all network interfaces by default; loopback only for Redis protocol server without -authtoken)")
+	flag.IntVar(&port, "port", 8080, "(HTTP/Redis protocol server) port number")
 	flag.StringVar(&tlsCrt, "tlscrt", "", "(HTTP server) TLS certificate (empty to disable TLS).")
 	flag.StringVar(&tlsKey, "tlskey", "", "(HTTP server) TLS certificate key (empty to disable TLS).")
-	flag.StringVar(&authToken, "authtoken", "", "(HTTP server) Only authorize requests carrying this token in 'Authorization: token TOKEN' header. (empty to disable)")
+	flag.StringVar(&authToken, "authtoken", "", "(HTTP/Redis protocol server) Only authorize requests carrying this token in 'Authorization: token TOKEN' header, or Redis clients that AUTH with it. (empty to disable)")
+	flag.BoolVar(&httpapi.AdminUI, "admin", false, "(HTTP server) Serve admin web UI at /admin")
+	flag.IntVar(&httpapi.StreamMaxDocs, "streammax", 0, "(HTTP server) Maximum number of documents streamed by /stream (0 for no limit)")
 
 	// HTTP + JWT params
 	var jwtPubKey, jwtPrivateKey string
 	flag.StringVar(&jwtPubKey, "jwtpubkey", "", "(HTTP JWT server) Public key for signing tokens (empty to disable JWT)")
 	flag.StringVar(&jwtPrivateKey, "jwtprivatekey", "", "(HTTP JWT server) Private key for decoding tokens (empty to disable JWT)")
 
+	// MongoDB Extended JSON import/export mode params
+	var col, file string
+	flag.StringVar(&col, "col", "", "(MongoDB import/export) collection name, the collection is created upon import if necessary")
+	flag.StringVar(&file, "file", "", "(MongoDB import/export) Extended JSON file to read from or write into (empty for stdin/stdout)")
+
 	// Benchmark mode params
 	var (
 		// Size of benchmark sample
@@ -146,6 +194,37 @@ func main() {
 			os.Exit(1)
 		}
 		httpapi.Start(dir, port, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind, authToken)
+	case "resp":
+		// Run Redis protocol compatibility server
+		if dir == "" {
+			tdlog.Notice("Please specify database directory, for example -dir=/tmp/db")
+			os.Exit(1)
+		}
+		if port == 0 {
+			tdlog.Notice("Please specify port number, for example -port=6379")
+			os.Exit(1)
+		}
+		respapi.Start(dir, port, bind, authToken)
+	case "mongoimport", "mongoexport":
+		// Import/export MongoDB Extended JSON
+		if dir == "" || col == "" {
+			tdlog.Notice("Please specify database directory and collection name, for example -dir=/tmp/db -col=Feeds")
+			os.Exit(1)
+		}
+		if err := mongoJSON(mode, dir, col, file); err != nil {
+			tdlog.Noticef("%s failed: %v", mode, err)
+			os.Exit(1)
+		}
+	case "migrate":
+		// Upgrade database files to the current format version
+		if dir == "" {
+			tdlog.Notice("Please specify database directory, for example -dir=/tmp/db")
+			os.Exit(1)
+		}
+		if err := data.MigrateFormat(dir); err != nil {
+			tdlog.Noticef("migrate failed: %v", err)
+			os.Exit(1)
+		}
 	case "example":
 		// Run embedded usage examples
 		examples.EmbeddedExample()
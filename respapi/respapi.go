@@ -0,0 +1,387 @@
+/*
+Package respapi is a minimal Redis protocol (RESP) compatibility shim, allowing Redis clients to store and retrieve
+documents by string keys.
+
+A Redis key looks like "collection:key". The collection is created upon SET if necessary, and the key is stored in
+document attribute "_key", which is indexed automatically.
+
+Supported commands:
+- PING [message]
+- GET key - return the document as JSON (without "_key"), or the plain value given to SET if it was not a JSON object.
+- SET key value - store a JSON object as document, or any other value as document {"_value": value}.
+- DEL key [key ...] - delete documents and return the number of deleted documents.
+- HGETALL key - return top-level document attributes and values; values that are not strings are JSON encoded.
+- AUTH password - authenticate the connection, required before other commands if the server has an auth token.
+- QUIT
+
+Without an auth token, Start binds to the loopback interface unless told otherwise.
+*/
+
+package respapi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	KEY_ATTR   = "_key"   // Document attribute holding the Redis key.
+	VALUE_ATTR = "_value" // Document attribute holding a plain (non-JSON object) value.
+	KEY_SEP    = ":"      // Separator between collection name and key.
+
+	MAX_MULTIBULK_LEN = 1024 * 1024       // Maximum number of arguments of a command.
+	MAX_BULK_LEN      = 512 * 1024 * 1024 // Maximum size of an argument.
+	MAX_INLINE_LEN    = 64 * 1024         // Maximum size of an inline command or protocol line.
+)
+
+// Server answers Redis protocol requests using documents of a database.
+type Server struct {
+	db        *db.DB
+	writeLock *sync.Mutex         // serialise SET and DEL so that a key never refers to more than one document
+	indexLock *sync.Mutex         // guard keyedCol
+	keyedCol  map[string]struct{} // collections known to have the key attribute indexed
+	authToken string              // password clients must AUTH with, empty to disable authentication
+}
+
+// Create a Redis protocol server on top of the database. Clients must AUTH with the token unless it is empty.
+func NewServer(database *db.DB, authToken string) *Server {
+	return &Server{db: database, writeLock: new(sync.Mutex), indexLock: new(sync.Mutex), keyedCol: make(map[string]struct{}), authToken: authToken}
+}
+
+// Accept and serve client connections until the listener is closed.
+func (srv *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.serveConn(conn)
+	}
+}
+
+/*
+Start a Redis protocol server on the database directory and block until the server shuts down. Panic on error. Without
+an auth token, the server binds to 127.0.0.1 unless a bind address is given.
+*/
+func Start(dir string, port int, bind, authToken string) {
+	if bind == "" && authToken == "" {
+		bind = "127.0.0.1"
+		tdlog.Notice("Redis protocol service has no auth token, hence it only listens on the loopback interface.")
+	}
+	database, err := db.OpenDB(dir)
+	if err != nil {
+		panic(err)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", bind, port))
+	if err != nil {
+		tdlog.Panicf("Failed to start Redis protocol service - %s", err)
+	}
+	tdlog.Noticef("Will listen on %s (Redis protocol).", listener.Addr())
+	if err := NewServer(database, authToken).Serve(listener); err != nil {
+		tdlog.Panicf("Redis protocol service stopped - %s", err)
+	}
+}
+
+// Read and execute commands from a client connection.
+func (srv *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	out := bufio.NewWriter(conn)
+	authed := srv.authToken == ""
+	for {
+		args, err := readCommand(in)
+		if err != nil {
+			if err != io.EOF {
+				writeError(out, err.Error())
+				out.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "QUIT":
+			writeSimple(out, "OK")
+			out.Flush()
+			return
+		case cmd == "AUTH" && len(args) != 2:
+			writeError(out, "wrong number of arguments for 'auth' command")
+		case cmd == "AUTH" && srv.authToken == "":
+			writeError(out, "AUTH <password> called without any password configured for the default user.")
+		case cmd == "AUTH":
+			if authed = subtle.ConstantTimeCompare([]byte(args[1]), []byte(srv.authToken)) == 1; authed {
+				writeSimple(out, "OK")
+			} else {
+				out.WriteString("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+			}
+		case !authed:
+			out.WriteString("-NOAUTH Authentication required.\r\n")
+		default:
+			srv.execute(out, args)
+		}
+		if err := out.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Read a command - either an array of bulk strings, or an inline command separated by spaces.
+func readCommand(in *bufio.Reader) (args []string, err error) {
+	line, err := readLine(in)
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	num, err := strconv.Atoi(line[1:])
+	if err != nil || num < 0 || num > MAX_MULTIBULK_LEN {
+		return nil, errors.New("Protocol error: invalid multibulk length")
+	}
+	// Arguments are allocated as they arrive, instead of trusting the length
+	args = make([]string, 0, 16)
+	for i := 0; i < num; i++ {
+		if line, err = readLine(in); err != nil {
+			return
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("Protocol error: expected '$', got '%s'", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > MAX_BULK_LEN {
+			return nil, errors.New("Protocol error: invalid bulk length")
+		}
+		var buf bytes.Buffer
+		if _, err = io.CopyN(&buf, in, int64(size)+2); err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf.Bytes()[:size]))
+	}
+	return
+}
+
+// Read a line terminated by CRLF (or LF) of up to MAX_INLINE_LEN bytes, and return it without the terminator.
+func readLine(in *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := in.ReadSlice('\n')
+		if line = append(line, chunk...); len(line) > MAX_INLINE_LEN {
+			return "", errors.New("Protocol error: too big inline request")
+		} else if err == bufio.ErrBufferFull {
+			continue
+		} else if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		} else if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+func writeSimple(out *bufio.Writer, str string) {
+	fmt.Fprintf(out, "+%s\r\n", str)
+}
+
+func writeError(out *bufio.Writer, msg string) {
+	fmt.Fprintf(out, "-ERR %s\r\n", strings.Replace(msg, "\r\n", " ", -1))
+}
+
+func writeInt(out *bufio.Writer, num int) {
+	fmt.Fprintf(out, ":%d\r\n", num)
+}
+
+func writeBulk(out *bufio.Writer, str string) {
+	fmt.Fprintf(out, "$%d\r\n%s\r\n", len(str), str)
+}
+
+func writeNil(out *bufio.Writer) {
+	out.WriteString("$-1\r\n")
+}
+
+// Execute a command and write its response.
+func (srv *Server) execute(out *bufio.Writer, args []string) {
+	cmd := strings.ToUpper(args[0])
+	switch {
+	case cmd == "PING" && len(args) == 1:
+		writeSimple(out, "PONG")
+	case cmd == "PING" && len(args) == 2:
+		writeBulk(out, args[1])
+	case cmd == "GET" && len(args) == 2:
+		_, doc, err := srv.find(args[1])
+		if err != nil {
+			writeError(out, err.Error())
+		} else if doc == nil {
+			writeNil(out)
+		} else if plain, isPlain := doc[VALUE_ATTR].(string); isPlain && len(doc) == 2 {
+			writeBulk(out, plain)
+		} else {
+			delete(doc, KEY_ATTR)
+			docJS, _ := json.Marshal(doc)
+			writeBulk(out, string(docJS))
+		}
+	case cmd == "SET" && len(args) == 3:
+		if err := srv.set(args[1], args[2]); err != nil {
+			writeError(out, err.Error())
+		} else {
+			writeSimple(out, "OK")
+		}
+	case cmd == "DEL" && len(args) > 1:
+		deleted := 0
+		for _, key := range args[1:] {
+			found, err := srv.del(key)
+			if err != nil {
+				writeError(out, err.Error())
+				return
+			} else if found {
+				deleted++
+			}
+		}
+		writeInt(out, deleted)
+	case cmd == "HGETALL" && len(args) == 2:
+		_, doc, err := srv.find(args[1])
+		if err != nil {
+			writeError(out, err.Error())
+			return
+		}
+		delete(doc, KEY_ATTR)
+		attrs := make([]string, 0, len(doc))
+		for attr := range doc {
+			attrs = append(attrs, attr)
+		}
+		sort.Strings(attrs)
+		fmt.Fprintf(out, "*%d\r\n", len(attrs)*2)
+		for _, attr := range attrs {
+			writeBulk(out, attr)
+			if str, isStr := doc[attr].(string); isStr {
+				writeBulk(out, str)
+			} else {
+				valJS, _ := json.Marshal(doc[attr])
+				writeBulk(out, string(valJS))
+			}
+		}
+	case cmd == "PING" || cmd == "GET" || cmd == "SET" || cmd == "DEL" || cmd == "HGETALL":
+		writeError(out, fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+	default:
+		writeError(out, fmt.Sprintf("unknown command '%s'", args[0]))
+	}
+}
+
+// Split a Redis key into collection name and document key.
+func splitKey(key string) (colName, docKey string, err error) {
+	sep := strings.Index(key, KEY_SEP)
+	if sep < 1 || sep == len(key)-1 {
+		return "", "", fmt.Errorf("key '%s' should look like 'collection%skey'", key, KEY_SEP)
+	}
+	return key[:sep], key[sep+1:], nil
+}
+
+// Return the collection of the key, creating the collection and key index if necessary. Without create, return nil
+// collection if the collection does not exist or does not have the key index.
+func (srv *Server) keyedCollection(colName string, create bool) (col *db.Col, err error) {
+	if create {
+		if col, err = srv.db.UseOrCreate(colName); err != nil {
+			return
+		}
+	} else if col = srv.db.Use(colName); col == nil {
+		return
+	}
+	srv.indexLock.Lock()
+	defer srv.indexLock.Unlock()
+	if _, known := srv.keyedCol[colName]; known {
+		return
+	}
+	for _, idxPath := range col.AllIndexes() {
+		if len(idxPath) == 1 && idxPath[0] == KEY_ATTR {
+			srv.keyedCol[colName] = struct{}{}
+			return
+		}
+	}
+	if !create {
+		// Reading a key does not build the index, the collection has no keyed documents yet
+		return nil, nil
+	}
+	if err = col.Index([]string{KEY_ATTR}); err == nil {
+		srv.keyedCol[colName] = struct{}{}
+	}
+	return
+}
+
+// Find the document of the key. Return nil document if it does not exist.
+func (srv *Server) find(key string) (id int, doc map[string]interface{}, err error) {
+	colName, docKey, err := splitKey(key)
+	if err != nil {
+		return
+	}
+	col, err := srv.keyedCollection(colName, false)
+	if err != nil || col == nil {
+		return
+	}
+	result := make(map[int]struct{})
+	if err = db.EvalQuery(map[string]interface{}{"eq": docKey, "in": []interface{}{KEY_ATTR}, "limit": 1}, col, &result); err != nil {
+		return
+	}
+	for id = range result {
+		if doc, err = col.Read(id); err == nil {
+			return
+		}
+	}
+	return 0, nil, nil
+}
+
+// Store the value as the document of the key.
+func (srv *Server) set(key, value string) error {
+	colName, docKey, err := splitKey(key)
+	if err != nil {
+		return err
+	}
+	col, err := srv.keyedCollection(colName, true)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if json.Unmarshal([]byte(value), &doc) != nil || doc == nil {
+		doc = map[string]interface{}{VALUE_ATTR: value}
+	}
+	doc[KEY_ATTR] = docKey
+	srv.writeLock.Lock()
+	defer srv.writeLock.Unlock()
+	id, existing, err := srv.find(key)
+	if err != nil {
+		return err
+	} else if existing != nil {
+		return col.Update(id, doc)
+	}
+	_, err = col.Insert(doc)
+	return err
+}
+
+// Delete the document of the key, return true if it existed.
+func (srv *Server) del(key string) (bool, error) {
+	srv.writeLock.Lock()
+	defer srv.writeLock.Unlock()
+	id, existing, err := srv.find(key)
+	if err != nil || existing == nil {
+		return false, err
+	}
+	colName, _, _ := splitKey(key)
+	if col := srv.db.Use(colName); col != nil {
+		return true, col.Delete(id)
+	}
+	return false, nil
+}
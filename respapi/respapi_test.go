@@ -0,0 +1,182 @@
+package respapi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+const (
+	TEST_DATA_DIR = "/tmp/tiedot_resp_test"
+)
+
+// Send a command in RESP array format and return the raw response.
+func send(t *testing.T, conn net.Conn, in *bufio.Reader, args ...string) string {
+	req := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		req += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, in)
+}
+
+func bulk(str string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(str), str)
+}
+
+func readResponse(t *testing.T, in *bufio.Reader) string {
+	line, err := in.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch line[0] {
+	case '$':
+		if line == "$-1\r\n" {
+			return line
+		}
+		var size int
+		fmt.Sscanf(line, "$%d", &size)
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(in, buf); err != nil {
+			t.Fatal(err)
+		}
+		return line + string(buf)
+	case '*':
+		var num int
+		fmt.Sscanf(line, "*%d", &num)
+		for i := 0; i < num; i++ {
+			line += readResponse(t, in)
+		}
+	}
+	return line
+}
+
+func TestRESP(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	database, err := db.OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err := database.Create("plain"); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go NewServer(database, "").Serve(listener)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+
+	expectations := [][]string{
+		{"+PONG\r\n", "PING"},
+		{"$-1\r\n", "GET", "users:alice"},
+		{"+OK\r\n", "SET", "users:alice", `{"age": 30, "name": "Alice"}`},
+		{"+OK\r\n", "SET", "users:bob", "plain value"},
+		{bulk(`{"age":30,"name":"Alice"}`), "GET", "users:alice"},
+		{bulk("plain value"), "GET", "users:bob"},
+		{"*4\r\n" + bulk("age") + bulk("30") + bulk("name") + bulk("Alice"), "HGETALL", "users:alice"},
+		{"+OK\r\n", "SET", "users:alice", `{"age": 31}`},
+		{bulk(`{"age":31}`), "get", "users:alice"},
+		{":2\r\n", "DEL", "users:alice", "users:bob", "users:carol"},
+		{"$-1\r\n", "GET", "users:alice"},
+		{"*0\r\n", "HGETALL", "nosuchcol:alice"},
+		{"$-1\r\n", "GET", "plain:alice"},
+		{"-ERR key 'nocolon' should look like 'collection:key'\r\n", "GET", "nocolon"},
+		{"-ERR wrong number of arguments for 'set' command\r\n", "SET", "users:alice"},
+		{"-ERR unknown command 'INCR'\r\n", "INCR", "users:alice"},
+	}
+	for _, expect := range expectations {
+		if resp := send(t, conn, in, expect[1:]...); resp != expect[0] {
+			t.Fatalf("%v: expected %q, got %q", expect[1:], expect[0], resp)
+		}
+	}
+	// Reading keys does not index the collection
+	if indexes := database.Use("plain").AllIndexes(); len(indexes) != 0 {
+		t.Fatal(indexes)
+	}
+	// Keys are kept unique across updates
+	result := make(map[int]struct{})
+	if err := db.EvalQuery("all", database.Use("users"), &result); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	// Inline command
+	if _, err := conn.Write([]byte("PING hello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if resp := readResponse(t, in); resp != bulk("hello") {
+		t.Fatal(resp)
+	}
+	if resp := send(t, conn, in, "QUIT"); !strings.HasPrefix(resp, "+OK") {
+		t.Fatal(resp)
+	}
+}
+
+func TestRESPAuthAndLimits(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	database, err := db.OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go NewServer(database, "secret").Serve(listener)
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	conn, in := dial()
+	defer conn.Close()
+	expectations := [][]string{
+		{"-NOAUTH Authentication required.\r\n", "PING"},
+		{"-NOAUTH Authentication required.\r\n", "SET", "users:alice", "1"},
+		{"-WRONGPASS invalid username-password pair or user is disabled.\r\n", "AUTH", "wrong"},
+		{"-ERR wrong number of arguments for 'auth' command\r\n", "AUTH"},
+		{"+OK\r\n", "AUTH", "secret"},
+		{"+PONG\r\n", "PING"},
+		{"+OK\r\n", "SET", "users:alice", "1"},
+	}
+	for _, expect := range expectations {
+		if resp := send(t, conn, in, expect[1:]...); resp != expect[0] {
+			t.Fatalf("%v: expected %q, got %q", expect[1:], expect[0], resp)
+		}
+	}
+	// Lengths beyond the limits are rejected before anything is allocated
+	for _, req := range []string{
+		"*2000000000\r\n",
+		"*1\r\n$2000000000\r\n",
+		strings.Repeat("A", 2*MAX_INLINE_LEN),
+	} {
+		conn, in := dial()
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		if resp := readResponse(t, in); !strings.HasPrefix(resp, "-ERR Protocol error") {
+			t.Fatal(resp)
+		}
+		conn.Close()
+	}
+}
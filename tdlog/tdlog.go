@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
 // Controls whether INFO log messages are generated
@@ -34,21 +35,56 @@ func Notice(params ...interface{}) {
 	log.Print(params...)
 }
 
-var critHistory = make(map[string]struct{})
+var critHistory = make(map[string]time.Time)
 var critLock = new(sync.Mutex)
+var critHistorySize = limitCritHistory
+var critWindow time.Duration
+var critHandler func(msg string)
 
-// LVL 2 - will not repeat a message twice over the past 100 distinct crit messages
+/*
+SetCritDedupe configures how CritNoRepeat suppresses repeated messages: a message is not repeated within the window
+(0 for as long as it is remembered), and up to historySize distinct messages are remembered before the history is
+cleared. The default is to remember 100 messages without a window.
+*/
+func SetCritDedupe(historySize int, window time.Duration) {
+	critLock.Lock()
+	defer critLock.Unlock()
+	if historySize < 1 {
+		historySize = limitCritHistory
+	}
+	critHistorySize, critWindow = historySize, window
+	critHistory = make(map[string]time.Time)
+}
+
+/*
+SetCritHandler registers a function to be called with every message logged by CritNoRepeat, e.g. to page an operator
+upon "Bad hash table - repair ASAP". Suppressed repetitions do not call the handler. Pass nil to remove the handler.
+The handler is called on the goroutine that logs the message, and should return quickly.
+*/
+func SetCritHandler(handler func(msg string)) {
+	critLock.Lock()
+	defer critLock.Unlock()
+	critHandler = handler
+}
+
+// LVL 2 - will not repeat a message within the dedupe window, or over the past 100 (configurable) distinct crit messages
 func CritNoRepeat(template string, params ...interface{}) {
 	msg := fmt.Sprintf(template, params...)
+	now := time.Now()
+	var handler func(string)
 	critLock.Lock()
-	if _, exists := critHistory[msg]; !exists {
+	if last, exists := critHistory[msg]; !exists || (critWindow > 0 && now.Sub(last) >= critWindow) {
 		log.Print(msg)
-		critHistory[msg] = struct{}{}
+		critHistory[msg] = now
+		handler = critHandler
 	}
-	if len(critHistory) > limitCritHistory {
-		critHistory = make(map[string]struct{})
+	if len(critHistory) > critHistorySize {
+		critHistory = make(map[string]time.Time)
 	}
 	critLock.Unlock()
+	if handler != nil {
+		handler(msg)
+	}
 }
 
 // LVL 1
@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"strings"
 	"testing"
+	"time"
 )
 
 func RandStringBytes(n int) string {
@@ -40,7 +41,7 @@ func TestInfo(t *testing.T) {
 func TestCritNoRepeatMoreLimit(t *testing.T) {
 	VerboseLog = true
 	for len(critHistory) < 100 {
-		critHistory[RandStringBytes(5)] = struct{}{}
+		critHistory[RandStringBytes(5)] = time.Now()
 	}
 	fmt.Println(len(critHistory))
 	fmt.Println(critHistory)
@@ -48,6 +49,37 @@ func TestCritNoRepeatMoreLimit(t *testing.T) {
 	log.SetOutput(&str)
 	CritNoRepeat("test %s", "argument")
 }
+func TestCritDedupeAndHandler(t *testing.T) {
+	defer SetCritDedupe(limitCritHistory, 0)
+	defer SetCritHandler(nil)
+	log.SetOutput(new(bytes.Buffer))
+	var handled []string
+	SetCritHandler(func(msg string) { handled = append(handled, msg) })
+	// Without a window, a message is not repeated while remembered
+	SetCritDedupe(2, 0)
+	CritNoRepeat("Bad hash table - repair ASAP %s", "a")
+	CritNoRepeat("Bad hash table - repair ASAP %s", "a")
+	if len(handled) != 1 || handled[0] != "Bad hash table - repair ASAP a" {
+		t.Fatal(handled)
+	}
+	// Exceeding the history size forgets the messages
+	CritNoRepeat("b")
+	CritNoRepeat("c")
+	CritNoRepeat("Bad hash table - repair ASAP %s", "a")
+	if len(handled) != 4 {
+		t.Fatal(handled)
+	}
+	// A message repeats after the window
+	SetCritDedupe(100, 50*time.Millisecond)
+	handled = nil
+	CritNoRepeat("d")
+	CritNoRepeat("d")
+	time.Sleep(60 * time.Millisecond)
+	CritNoRepeat("d")
+	if len(handled) != 2 {
+		t.Fatal(handled)
+	}
+}
 func TestAllLogLevels(t *testing.T) {
 	defer func() {
 		if recover() == nil {